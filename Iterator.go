@@ -9,6 +9,7 @@ type Iterator struct {
 	indexIter index.Iterator //索引迭代器
 	db        *DB
 	options   IteratorOptions
+	internal  bool //内部使用的迭代器可以看到命名空间的key
 }
 
 func (db *DB) NewIterator(Options IteratorOptions) *Iterator {
@@ -51,10 +52,7 @@ func (it *Iterator) Key() []byte {
 // 遍历当前位置Value，这里指数据文件
 func (it *Iterator) Value() ([]byte, error) {
 	pos := it.indexIter.Value()
-
-	it.db.mu.RLock()
-	defer it.db.mu.RUnlock()
-	return it.db.getValueByPosition(pos)
+	return it.db.readValue(pos)
 
 }
 
@@ -66,12 +64,16 @@ func (it *Iterator) Close() {
 func (it *Iterator) skipToNext() {
 	preFixlen := len(it.options.Prefix)
 	//没设定就不用过滤
-	if preFixlen == 0 {
+	if preFixlen == 0 && it.internal {
 		return
 	}
 
 	for ; it.indexIter.Valid(); it.indexIter.Next() {
 		key := it.indexIter.Key()
+		//命名空间的key不对外暴露
+		if !it.internal && isReservedKey(key) {
+			continue
+		}
 		if preFixlen <= len(key) && bytes.Equal(it.options.Prefix, it.indexIter.Key()[:preFixlen]) {
 			break
 		}
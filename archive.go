@@ -0,0 +1,227 @@
+package bitcask_go
+
+import (
+	"bitcask-go/fio"
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// 备份归档的魔数，最后一个字节是格式版本
+var archiveMagic = []byte("BCARC\x01")
+
+// 归档中文件名的最大长度
+const archiveMaxNameLen = 255
+
+// 归档中的一个文件
+type archiveFile struct {
+	name string
+	size int64
+}
+
+// 把数据库某个时间点的一致性备份流式写入w，不需要在本地暂存备份数据
+// 格式 magic | 文件数 | (文件名 大小)... | 头部crc | (文件内容 文件crc)...
+// 一致性由检查点保证，检查点只是数据目录旁边的一组硬链接
+func (db *DB) BackupTo(w io.Writer) error {
+	sibling := db.getSiblingPath(checkpointDirName)
+	cpPath, err := fio.MkdirTemp(db.fs, filepath.Dir(sibling), filepath.Base(sibling)+"-")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = db.fs.RemoveAll(cpPath)
+	}()
+	if err := db.Checkpoint(cpPath); err != nil {
+		return err
+	}
+
+	entries, err := db.fs.ReadDir(cpPath)
+	if err != nil {
+		return err
+	}
+	files := make([]*archiveFile, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		files = append(files, &archiveFile{name: entry.Name(), size: info.Size()})
+	}
+
+	bw := bufio.NewWriter(w)
+	if _, err := bw.Write(encodeArchiveHeader(files)); err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := writeArchiveFile(db.fs, bw, filepath.Join(cpPath, file.name), file.size); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// 编码归档头部，最后4个字节是前面内容的crc
+func encodeArchiveHeader(files []*archiveFile) []byte {
+	var buf bytes.Buffer
+	buf.Write(archiveMagic)
+	varint := make([]byte, binary.MaxVarintLen64)
+	buf.Write(varint[:binary.PutUvarint(varint, uint64(len(files)))])
+	for _, file := range files {
+		buf.Write(varint[:binary.PutUvarint(varint, uint64(len(file.name)))])
+		buf.WriteString(file.name)
+		buf.Write(varint[:binary.PutUvarint(varint, uint64(file.size))])
+	}
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(buf.Bytes()))
+	buf.Write(crc)
+	return buf.Bytes()
+}
+
+// 写入一个文件的内容和crc
+func writeArchiveFile(fs fio.FS, w io.Writer, path string, size int64) error {
+	file, err := fs.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	crc := crc32.NewIEEE()
+	if _, err := io.CopyN(io.MultiWriter(w, crc), file, size); err != nil {
+		return err
+	}
+	_, err = w.Write(crc.Sum(nil))
+	return err
+}
+
+// 从BackupTo写出的归档中恢复数据库到dir，dir必须为空
+// 每个文件都会校验crc，校验失败时删除已经写入的文件
+func RestoreFrom(r io.Reader, dir string) error {
+	return RestoreFromWithFS(fio.OSFS{}, r, dir)
+}
+
+// 在fs中从归档恢复数据库到dir
+func RestoreFromWithFS(fs fio.FS, r io.Reader, dir string) (err error) {
+	if err := fio.MkdirAllSync(fs, dir, os.ModePerm); err != nil {
+		return err
+	}
+	entries, err := fs.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return ErrRestoreDirNotEmpty
+	}
+
+	br := bufio.NewReader(r)
+	files, err := readArchiveHeader(br)
+	if err != nil {
+		return err
+	}
+	var written []string
+	defer func() {
+		if err != nil {
+			for _, name := range written {
+				_ = fs.Remove(filepath.Join(dir, name))
+			}
+		}
+	}()
+	for _, file := range files {
+		written = append(written, file.name)
+		if err = readArchiveFile(fs, br, filepath.Join(dir, file.name), file.size); err != nil {
+			return err
+		}
+	}
+	return fs.SyncDir(dir)
+}
+
+// 读取并校验归档头部
+func readArchiveHeader(br *bufio.Reader) ([]*archiveFile, error) {
+	var header bytes.Buffer
+	tr := io.TeeReader(br, &header)
+
+	magic := make([]byte, len(archiveMagic))
+	if _, err := io.ReadFull(tr, magic); err != nil || !bytes.Equal(magic, archiveMagic) {
+		return nil, ErrInvalidBackupArchive
+	}
+	byteReader := &archiveByteReader{r: tr}
+	count, err := binary.ReadUvarint(byteReader)
+	if err != nil {
+		return nil, ErrInvalidBackupArchive
+	}
+	var files []*archiveFile
+	names := make(map[string]bool)
+	for i := uint64(0); i < count; i++ {
+		nameLen, err := binary.ReadUvarint(byteReader)
+		if err != nil || nameLen == 0 || nameLen > archiveMaxNameLen {
+			return nil, ErrInvalidBackupArchive
+		}
+		name := make([]byte, nameLen)
+		if _, err := io.ReadFull(tr, name); err != nil {
+			return nil, ErrInvalidBackupArchive
+		}
+		size, err := binary.ReadUvarint(byteReader)
+		if err != nil {
+			return nil, ErrInvalidBackupArchive
+		}
+		//只允许目录下的普通文件名
+		if !isValidArchiveName(string(name)) || names[string(name)] {
+			return nil, ErrInvalidBackupArchive
+		}
+		names[string(name)] = true
+		files = append(files, &archiveFile{name: string(name), size: int64(size)})
+	}
+
+	crc := make([]byte, 4)
+	if _, err := io.ReadFull(br, crc); err != nil {
+		return nil, ErrInvalidBackupArchive
+	}
+	if binary.BigEndian.Uint32(crc) != crc32.ChecksumIEEE(header.Bytes()) {
+		return nil, ErrInvalidBackupArchive
+	}
+	return files, nil
+}
+
+func isValidArchiveName(name string) bool {
+	return name != "." && name != ".." && !strings.ContainsAny(name, "/\\\x00")
+}
+
+// 读取一个文件写入path，并校验crc
+func readArchiveFile(fs fio.FS, r io.Reader, path string, size int64) error {
+	file, err := fs.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, fio.DatafilePerm)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	crc := crc32.NewIEEE()
+	if _, err := io.CopyN(io.MultiWriter(file, crc), r, size); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrInvalidBackupArchive
+		}
+		return err
+	}
+	sum := make([]byte, 4)
+	if _, err := io.ReadFull(r, sum); err != nil {
+		return ErrInvalidBackupArchive
+	}
+	if binary.BigEndian.Uint32(sum) != crc.Sum32() {
+		return ErrBackupCorrupted
+	}
+	return file.Sync()
+}
+
+// 给ReadUvarint用的按字节读取
+type archiveByteReader struct {
+	r io.Reader
+}
+
+func (br *archiveByteReader) ReadByte() (byte, error) {
+	var b [1]byte
+	_, err := io.ReadFull(br.r, b[:])
+	return b[0], err
+}
@@ -0,0 +1,93 @@
+package bitcask_go
+
+import (
+	"bitcask-go/utils"
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_BackupTo(t *testing.T) {
+	opts := DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-archive")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+	}
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, wb.Put([]byte("txn"), []byte("v")))
+	assert.Nil(t, wb.Commit())
+
+	var buf bytes.Buffer
+	assert.Nil(t, db.BackupTo(&buf))
+	//备份之后的写入不在归档中
+	assert.Nil(t, db.Put([]byte("after"), []byte("v")))
+
+	restoreDir, _ := os.MkdirTemp("", "bitcask-go-archive-restore")
+	assert.Nil(t, RestoreFrom(bytes.NewReader(buf.Bytes()), restoreDir))
+	assert.Equal(t, ErrRestoreDirNotEmpty, RestoreFrom(bytes.NewReader(buf.Bytes()), restoreDir))
+	restoreOpts := opts
+	restoreOpts.DirPath = restoreDir
+	restoreDB, err := Open(restoreOpts)
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		val, err := restoreDB.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, utils.GetTestKey(i), val)
+	}
+	val, err := restoreDB.Get([]byte("txn"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v"), val)
+	_, err = restoreDB.Get([]byte("after"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	destroyDB(restoreDB)
+
+	badDir, _ := os.MkdirTemp("", "bitcask-go-archive-bad")
+	defer func() {
+		_ = os.RemoveAll(badDir)
+	}()
+
+	//文件内容损坏，已经写入的文件被清理
+	corrupted := append([]byte{}, buf.Bytes()...)
+	corrupted[len(corrupted)-10] ^= 0xff
+	assert.Equal(t, ErrBackupCorrupted, RestoreFrom(bytes.NewReader(corrupted), badDir))
+	entries, _ := os.ReadDir(badDir)
+	assert.Equal(t, 0, len(entries))
+
+	//归档被截断
+	truncated := buf.Bytes()[:buf.Len()/2]
+	assert.Equal(t, ErrInvalidBackupArchive, RestoreFrom(bytes.NewReader(truncated), badDir))
+
+	//头部损坏
+	header := append([]byte{}, buf.Bytes()...)
+	header[len(archiveMagic)+2] ^= 0xff
+	assert.Equal(t, ErrInvalidBackupArchive, RestoreFrom(bytes.NewReader(header), badDir))
+	assert.Equal(t, ErrInvalidBackupArchive, RestoreFrom(bytes.NewReader([]byte("not an archive")), badDir))
+}
+
+func TestDB_BackupToEmpty(t *testing.T) {
+	opts := DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-archive-empty")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	var buf bytes.Buffer
+	assert.Nil(t, db.BackupTo(&buf))
+	restoreDir, _ := os.MkdirTemp("", "bitcask-go-archive-empty-restore")
+	assert.Nil(t, RestoreFrom(&buf, restoreDir))
+	restoreOpts := opts
+	restoreOpts.DirPath = restoreDir
+	restoreDB, err := Open(restoreOpts)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(restoreDB.ListKeys()))
+	destroyDB(restoreDB)
+}
@@ -0,0 +1,396 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/fio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// 在dir中创建数据库的一致性检查点，dir可以直接作为数据库打开
+// 分层存储时冷热目录中的文件都放进dir，检查点是不分层的数据目录
+// 只在封存活跃文件时短暂持有锁，旧数据文件和hint文件不会再修改，直接硬链接
+// B+树索引文件不复制，检查点打开时会从数据文件重建
+func (db *DB) Checkpoint(dir string) error {
+	if err := fio.MkdirAllSync(db.fs, dir, os.ModePerm); err != nil {
+		return err
+	}
+	entries, err := db.fs.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return ErrCheckpointDirNotEmpty
+	}
+
+	db.mu.Lock()
+	if db.activeFile == nil {
+		db.mu.Unlock()
+		return nil
+	}
+	//封存当前活跃文件，之后所有要用到的数据文件都不会再修改
+	if db.activeFile.Offset > db.activeFile.RecordStart() {
+		if err := db.activeFile.Sync(); err != nil {
+			db.mu.Unlock()
+			return err
+		}
+		if err := db.sealActiveFile(); err != nil {
+			db.mu.Unlock()
+			return err
+		}
+		if err := db.setActiveDataFile(); err != nil {
+			db.mu.Unlock()
+			return err
+		}
+		db.publishOldFiles()
+	}
+	//检查点的MANIFEST只包含这些封存的文件和新的活跃文件
+	manifest := newManifestState()
+	fileIds := make([]uint32, 0, len(db.oldFiles))
+	for fid := range db.oldFiles {
+		fileIds = append(fileIds, fid)
+		manifest.files[fid] = db.manifestState.files[fid]
+	}
+	activeFid := db.activeFile.FileId
+	manifest.files[activeFid] = manifestActiveSize
+	manifest.logStart = db.manifestState.logStart
+	manifest.commitSeqNo = db.commitSeqNo
+	seqNo := db.seqNo
+	db.mu.Unlock()
+
+	for _, fid := range fileIds {
+		src := data.GetDataFileName(db.dataFileDir(fid), fid)
+		if err := fio.LinkOrCopyFile(db.fs, src, data.GetDataFileName(dir, fid)); err != nil {
+			return err
+		}
+	}
+
+	//检查点打开后会往最大的文件里写，不能和原来的数据库共享，单独创建一个空的活跃文件
+	activeFile, err := db.fs.OpenFile(data.GetDataFileName(dir, activeFid), os.O_CREATE|os.O_WRONLY, fio.DatafilePerm)
+	if err != nil {
+		return err
+	}
+	if err := activeFile.Close(); err != nil {
+		return err
+	}
+
+	//hint文件安装后不会再修改，merge完成标识很小，直接复制
+	hintFile := filepath.Join(db.mergeFileDir(data.HintFileName), data.HintFileName)
+	if _, err := db.fs.Stat(hintFile); err == nil {
+		if err := fio.LinkOrCopyFile(db.fs, hintFile, filepath.Join(dir, data.HintFileName)); err != nil {
+			return err
+		}
+	}
+	mergeFinFile := filepath.Join(db.mergeFileDir(data.MergeFinishedName), data.MergeFinishedName)
+	if _, err := db.fs.Stat(mergeFinFile); err == nil {
+		if err := fio.CopyFile(db.fs, mergeFinFile, filepath.Join(dir, data.MergeFinishedName)); err != nil {
+			return err
+		}
+	}
+
+	//保存封存时的事务序列号
+	if err := writeSeqNoFile(db.fs, dir, seqNo); err != nil {
+		return err
+	}
+	if err := writeManifestFile(db.fs, dir, data.ManifestFileName, manifest); err != nil {
+		return err
+	}
+	return db.fs.SyncDir(dir)
+}
+
+// 在dir中写入事务序列号文件
+func writeSeqNoFile(fs fio.FS, dir string, seqNo uint64) error {
+	seqNoFile, err := data.OpenSeqNoFile(fs, dir)
+	if err != nil {
+		return err
+	}
+	record := &data.LogRecord{
+		Key:   []byte(seqNoKey),
+		Value: []byte(strconv.FormatUint(seqNo, 10)),
+	}
+	buf, _ := seqNoFile.EncodeLogRecord(record)
+	if err := seqNoFile.Write(buf); err != nil {
+		return err
+	}
+	if err := seqNoFile.Sync(); err != nil {
+		return err
+	}
+	return seqNoFile.Close()
+}
+
+// 增量备份时临时检查点的目录后缀，和数据目录在同一个文件系统上才能硬链接
+const checkpointDirName = "-checkpoint"
+
+// 备份清单中的一个文件
+type backupFile struct {
+	name       string
+	generation uint32 //文件内容保存在哪一次备份的目录中
+	size       int64
+	modTime    int64
+	crc        uint32
+}
+
+// 增量备份到dir，每次备份是dir下一个递增编号的目录
+// 目录中只保存新增或者变化了的文件，清单记录了这次备份完整的文件列表和每个文件所在的目录
+// 清单最后写入，没有清单的目录是没有完成的备份
+func (db *DB) BackupIncremental(dir string) error {
+	if err := fio.MkdirAllSync(db.fs, dir, os.ModePerm); err != nil {
+		return err
+	}
+	prevGen, prevFiles, err := loadLatestBackup(db.fs, dir)
+	if err != nil {
+		return err
+	}
+
+	//先在数据目录旁边创建检查点，得到一致的文件集合
+	cpPath := db.getSiblingPath(checkpointDirName)
+	if err := db.fs.RemoveAll(cpPath); err != nil {
+		return err
+	}
+	if err := db.Checkpoint(cpPath); err != nil {
+		return err
+	}
+	defer func() {
+		_ = db.fs.RemoveAll(cpPath)
+	}()
+
+	entries, err := db.fs.ReadDir(cpPath)
+	if err != nil {
+		return err
+	}
+	gen := prevGen + 1
+	genDir := filepath.Join(dir, fmt.Sprintf("%09d", gen))
+	//上一次没有完成的备份
+	if err := db.fs.RemoveAll(genDir); err != nil {
+		return err
+	}
+	if err := fio.MkdirAllSync(db.fs, genDir, os.ModePerm); err != nil {
+		return err
+	}
+
+	var files []*backupFile
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		//大小或者修改时间变了一定要重新复制
+		//都没变时也可能是merge重写的同名文件，修改时间的精度不够区分，再用crc确认内容相同
+		prev := prevFiles[entry.Name()]
+		if prev != nil && prev.size == info.Size() && prev.modTime == info.ModTime().UnixNano() {
+			crc, err := fileCrc(db.fs, filepath.Join(cpPath, entry.Name()))
+			if err != nil {
+				return err
+			}
+			if crc == prev.crc {
+				files = append(files, prev)
+				continue
+			}
+		}
+		crc, size, err := copyFileWithCrc(db.fs, filepath.Join(cpPath, entry.Name()), filepath.Join(genDir, entry.Name()))
+		if err != nil {
+			return err
+		}
+		files = append(files, &backupFile{
+			name:       entry.Name(),
+			generation: gen,
+			size:       size,
+			modTime:    info.ModTime().UnixNano(),
+			crc:        crc,
+		})
+	}
+
+	if err := writeBackupManifest(db.fs, genDir, files); err != nil {
+		return err
+	}
+	if err := db.fs.SyncDir(genDir); err != nil {
+		return err
+	}
+	return db.fs.SyncDir(dir)
+}
+
+// 从backupDir中最新的备份恢复出完整的数据目录
+func Restore(backupDir, targetDir string) error {
+	return RestoreWithFS(fio.OSFS{}, backupDir, targetDir)
+}
+
+// 在fs中从backupDir中最新的备份恢复出完整的数据目录
+func RestoreWithFS(fs fio.FS, backupDir, targetDir string) error {
+	gen, files, err := loadLatestBackup(fs, backupDir)
+	if err != nil {
+		return err
+	}
+	if gen == 0 {
+		return ErrBackupNotFound
+	}
+	if err := fio.MkdirAllSync(fs, targetDir, os.ModePerm); err != nil {
+		return err
+	}
+	entries, err := fs.ReadDir(targetDir)
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return ErrRestoreDirNotEmpty
+	}
+
+	for _, file := range files {
+		src := filepath.Join(backupDir, fmt.Sprintf("%09d", file.generation), file.name)
+		crc, size, err := copyFileWithCrc(fs, src, filepath.Join(targetDir, file.name))
+		if err != nil {
+			return err
+		}
+		if crc != file.crc || size != file.size {
+			return ErrBackupCorrupted
+		}
+	}
+	return fs.SyncDir(targetDir)
+}
+
+// 复制文件，同时计算crc
+func copyFileWithCrc(fs fio.FS, src, dest string) (uint32, int64, error) {
+	srcFile, err := fs.OpenFile(src, os.O_RDONLY, 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer srcFile.Close()
+	destFile, err := fs.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, fio.DatafilePerm)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer destFile.Close()
+
+	crc := crc32.NewIEEE()
+	size, err := io.Copy(io.MultiWriter(destFile, crc), srcFile)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := destFile.Sync(); err != nil {
+		return 0, 0, err
+	}
+	return crc.Sum32(), size, nil
+}
+
+// 计算文件内容的crc
+func fileCrc(fs fio.FS, name string) (uint32, error) {
+	file, err := fs.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	crc := crc32.NewIEEE()
+	if _, err := io.Copy(crc, file); err != nil {
+		return 0, err
+	}
+	return crc.Sum32(), nil
+}
+
+// 找到最新的完整备份，返回编号和文件清单，没有备份时编号为0
+func loadLatestBackup(fs fio.FS, dir string) (uint32, map[string]*backupFile, error) {
+	entries, err := fs.ReadDir(dir)
+	if err != nil {
+		return 0, nil, err
+	}
+	var gens []int
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		gen, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		gens = append(gens, gen)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(gens)))
+	for _, gen := range gens {
+		genDir := filepath.Join(dir, fmt.Sprintf("%09d", gen))
+		if _, err := fs.Stat(filepath.Join(genDir, data.BackupManifestName)); err != nil {
+			continue
+		}
+		files, err := readBackupManifest(fs, genDir)
+		if err != nil {
+			return 0, nil, err
+		}
+		return uint32(gen), files, nil
+	}
+	return 0, map[string]*backupFile{}, nil
+}
+
+// 清单中每个文件一条记录 key为文件名 value为 generation size modTime crc
+func writeBackupManifest(fs fio.FS, dir string, files []*backupFile) error {
+	manifestFile, err := data.OpenBackupManifestFile(fs, dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		buf := make([]byte, binary.MaxVarintLen32+binary.MaxVarintLen64*2+4)
+		var index = 0
+		index += binary.PutUvarint(buf[index:], uint64(file.generation))
+		index += binary.PutVarint(buf[index:], file.size)
+		index += binary.PutVarint(buf[index:], file.modTime)
+		binary.BigEndian.PutUint32(buf[index:], file.crc)
+		index += 4
+		record, _ := manifestFile.EncodeLogRecord(&data.LogRecord{Key: []byte(file.name), Value: buf[:index]})
+		if err := manifestFile.Write(record); err != nil {
+			return err
+		}
+	}
+	if err := manifestFile.Sync(); err != nil {
+		return err
+	}
+	return manifestFile.Close()
+}
+
+func readBackupManifest(fs fio.FS, dir string) (map[string]*backupFile, error) {
+	manifestFile, err := data.OpenBackupManifestFile(fs, dir)
+	if err != nil {
+		return nil, err
+	}
+	defer manifestFile.Close()
+
+	files := make(map[string]*backupFile)
+	offset := manifestFile.RecordStart()
+	for {
+		record, size, err := manifestFile.ReadLogRecord(offset)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		offset += size
+
+		buf := record.Value
+		var index = 0
+		gen, n := binary.Uvarint(buf[index:])
+		if n <= 0 {
+			return nil, ErrBackupCorrupted
+		}
+		index += n
+		fileSize, n := binary.Varint(buf[index:])
+		if n <= 0 {
+			return nil, ErrBackupCorrupted
+		}
+		index += n
+		modTime, n := binary.Varint(buf[index:])
+		if n <= 0 || len(buf)-index-n != 4 {
+			return nil, ErrBackupCorrupted
+		}
+		index += n
+		files[string(record.Key)] = &backupFile{
+			name:       string(record.Key),
+			generation: uint32(gen),
+			size:       fileSize,
+			modTime:    modTime,
+			crc:        binary.BigEndian.Uint32(buf[index:]),
+		}
+	}
+	return files, nil
+}
@@ -0,0 +1,233 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/fio"
+	"bitcask-go/utils"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_Checkpoint(t *testing.T) {
+	for _, indexType := range []IndexerType{Btree, BPTree} {
+		opts := DefaultDBOptions
+		dir, _ := os.MkdirTemp("", "bitcask-go-checkpoint")
+		opts.DirPath = dir
+		opts.DataFileSize = 32 * 1024
+		opts.IndexType = indexType
+		db, err := Open(opts)
+		assert.Nil(t, err)
+
+		for i := 0; i < 1000; i++ {
+			assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+		}
+		wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+		assert.Nil(t, wb.Put([]byte("txn"), []byte("v")))
+		assert.Nil(t, wb.Commit())
+
+		cpDir, _ := os.MkdirTemp("", "bitcask-go-checkpoint-dest")
+		activeFid := db.activeFile.FileId
+		assert.Nil(t, db.Checkpoint(cpDir))
+		//活跃文件被封存了
+		assert.Equal(t, activeFid+1, db.activeFile.FileId)
+
+		//检查点之后的写入不影响检查点
+		assert.Nil(t, db.Put([]byte("after"), []byte("v")))
+		assert.Nil(t, db.Delete(utils.GetTestKey(0)))
+
+		//旧数据文件是硬链接
+		src, _ := os.Stat(data.GetDataFileName(dir, 0))
+		dest, _ := os.Stat(data.GetDataFileName(cpDir, 0))
+		assert.True(t, os.SameFile(src, dest))
+		_, err = os.Stat(filepath.Join(cpDir, bptreeIndexName))
+		assert.True(t, os.IsNotExist(err))
+
+		//检查点有自己的MANIFEST，列出其中的数据文件，新的活跃文件还没有封存
+		manifestFile, err := data.OpenManifestFile(fio.OSFS{}, cpDir, data.ManifestFileName)
+		assert.Nil(t, err)
+		record, _, err := manifestFile.ReadLogRecord(manifestFile.RecordStart())
+		assert.Nil(t, err)
+		assert.Nil(t, manifestFile.Close())
+		manifest := newManifestState()
+		assert.Nil(t, manifest.apply(record.Value))
+		cpFileIds, err := listDataFileIds(fio.OSFS{}, cpDir)
+		assert.Nil(t, err)
+		assert.Equal(t, cpFileIds, manifest.fileIds())
+		assert.Equal(t, activeFid+1, cpFileIds[len(cpFileIds)-1])
+		assert.Equal(t, manifestActiveSize, manifest.files[activeFid+1])
+		assert.NotEqual(t, manifestActiveSize, manifest.files[activeFid])
+
+		cpOpts := opts
+		cpOpts.DirPath = cpDir
+		cpDB, err := Open(cpOpts)
+		assert.Nil(t, err)
+		for i := 0; i < 1000; i++ {
+			val, err := cpDB.Get(utils.GetTestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, utils.GetTestKey(i), val)
+		}
+		_, err = cpDB.Get([]byte("after"))
+		assert.Equal(t, ErrKeyNotFound, err)
+		val, err := cpDB.Get([]byte("txn"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("v"), val)
+
+		//检查点的写入不会影响原来的数据库
+		assert.Nil(t, cpDB.Put([]byte("checkpoint-only"), []byte("v")))
+		wb = cpDB.NewWriteBatch(DefaultWriteBatchOptions)
+		assert.Nil(t, wb.Put([]byte("checkpoint-txn"), []byte("v")))
+		assert.Nil(t, wb.Commit())
+		_, err = db.Get([]byte("checkpoint-only"))
+		assert.Equal(t, ErrKeyNotFound, err)
+		val, err = db.Get(utils.GetTestKey(999))
+		assert.Nil(t, err)
+		assert.Equal(t, utils.GetTestKey(999), val)
+		destroyDB(cpDB)
+
+		//目录非空时拒绝
+		nonEmpty, _ := os.MkdirTemp("", "bitcask-go-checkpoint-nonempty")
+		assert.Nil(t, os.WriteFile(filepath.Join(nonEmpty, "file"), nil, 0644))
+		assert.Equal(t, ErrCheckpointDirNotEmpty, db.Checkpoint(nonEmpty))
+		_ = os.RemoveAll(nonEmpty)
+		destroyDB(db)
+	}
+}
+
+// 备份目录中某一次备份实际复制的文件
+func backupGenFiles(t *testing.T, dir string, gen int) []string {
+	entries, err := os.ReadDir(filepath.Join(dir, fmt.Sprintf("%09d", gen)))
+	assert.Nil(t, err)
+	var names []string
+	for _, entry := range entries {
+		if entry.Name() != data.BackupManifestName {
+			names = append(names, entry.Name())
+		}
+	}
+	return names
+}
+
+func TestDB_BackupIncremental(t *testing.T) {
+	opts := DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-backup-incr")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	backupDir, _ := os.MkdirTemp("", "bitcask-go-backup-incr-dest")
+	defer func() {
+		_ = os.RemoveAll(backupDir)
+	}()
+
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	assert.Nil(t, db.BackupIncremental(backupDir))
+	full := backupGenFiles(t, backupDir, 1)
+	assert.Contains(t, full, filepath.Base(data.GetDataFileName(dir, 0)))
+
+	//第二次只复制新写入的文件
+	for i := 1000; i < 1100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+	}
+	assert.Nil(t, db.BackupIncremental(backupDir))
+	incr := backupGenFiles(t, backupDir, 2)
+	assert.NotContains(t, incr, filepath.Base(data.GetDataFileName(dir, 0)))
+	assert.Contains(t, incr, data.SeqNoFileName)
+	assert.Less(t, len(incr), len(full))
+
+	//merge 之后旧文件被删除，重写的文件需要重新复制
+	for i := 0; i < 900; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put([]byte("after-merge"), []byte("v")))
+	assert.Nil(t, db.BackupIncremental(backupDir))
+	merged := backupGenFiles(t, backupDir, 3)
+	assert.Contains(t, merged, filepath.Base(data.GetDataFileName(dir, 0)))
+
+	//没有写完清单的备份不算数
+	assert.Nil(t, os.MkdirAll(filepath.Join(backupDir, fmt.Sprintf("%09d", 4)), os.ModePerm))
+
+	restoreDir, _ := os.MkdirTemp("", "bitcask-go-backup-incr-restore")
+	assert.Nil(t, Restore(backupDir, restoreDir))
+	assert.Equal(t, ErrRestoreDirNotEmpty, Restore(backupDir, restoreDir))
+	restoreOpts := opts
+	restoreOpts.DirPath = restoreDir
+	restoreDB, err := Open(restoreOpts)
+	assert.Nil(t, err)
+	assert.Equal(t, len(db.ListKeys()), len(restoreDB.ListKeys()))
+	for i := 0; i < 1100; i++ {
+		val, err := restoreDB.Get(utils.GetTestKey(i))
+		if i < 900 {
+			assert.Equal(t, ErrKeyNotFound, err)
+			continue
+		}
+		assert.Nil(t, err)
+		expect, _ := db.Get(utils.GetTestKey(i))
+		assert.Equal(t, expect, val)
+	}
+	val, err := restoreDB.Get([]byte("after-merge"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v"), val)
+	destroyDB(restoreDB)
+
+	//备份文件损坏
+	corruptDir, _ := os.MkdirTemp("", "bitcask-go-backup-incr-corrupt")
+	name := filepath.Join(backupDir, fmt.Sprintf("%09d", 3), filepath.Base(data.GetDataFileName(dir, 0)))
+	assert.Nil(t, os.WriteFile(name, []byte("corrupted"), 0644))
+	assert.Equal(t, ErrBackupCorrupted, Restore(backupDir, corruptDir))
+	_ = os.RemoveAll(corruptDir)
+
+	emptyDir, _ := os.MkdirTemp("", "bitcask-go-backup-incr-empty")
+	assert.Equal(t, ErrBackupNotFound, Restore(emptyDir, filepath.Join(emptyDir, "target")))
+	_ = os.RemoveAll(emptyDir)
+	destroyDB(db)
+}
+
+func TestDB_BackupIncrementalSameModTime(t *testing.T) {
+	opts := DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-backup-mtime")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+	backupDir, _ := os.MkdirTemp("", "bitcask-go-backup-mtime-dest")
+	defer func() {
+		_ = os.RemoveAll(backupDir)
+	}()
+
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	assert.Nil(t, db.BackupIncremental(backupDir))
+
+	//同名文件内容变了，但是大小和修改时间都和上一次备份时一样
+	fileName := data.GetDataFileName(dir, 0)
+	info, err := os.Stat(fileName)
+	assert.Nil(t, err)
+	content, err := os.ReadFile(fileName)
+	assert.Nil(t, err)
+	content[len(content)-1] ^= 0xff
+	assert.Nil(t, os.WriteFile(fileName, content, 0644))
+	assert.Nil(t, os.Chtimes(fileName, info.ModTime(), info.ModTime()))
+
+	assert.Nil(t, db.BackupIncremental(backupDir))
+	assert.Contains(t, backupGenFiles(t, backupDir, 2), filepath.Base(fileName))
+	restoreDir, _ := os.MkdirTemp("", "bitcask-go-backup-mtime-restore")
+	defer func() {
+		_ = os.RemoveAll(restoreDir)
+	}()
+	assert.Nil(t, Restore(backupDir, restoreDir))
+	restored, err := os.ReadFile(filepath.Join(restoreDir, filepath.Base(fileName)))
+	assert.Nil(t, err)
+	assert.Equal(t, content, restored)
+}
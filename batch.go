@@ -2,6 +2,7 @@ package bitcask_go
 
 import (
 	"bitcask-go/data"
+	"bitcask-go/index"
 	"encoding/binary"
 	"sync"
 	"sync/atomic"
@@ -19,6 +20,7 @@ type WriteBatch struct {
 	db           *DB
 	pendingWrite map[string]*data.LogRecord //暂存的数据
 	options      WriteBatchOptions          //配置项
+	apply        bool                       //应用复制日志的批量写，允许保留前缀，从库也可以提交
 }
 
 func (db *DB) NewWriteBatch(options WriteBatchOptions) *WriteBatch {
@@ -39,6 +41,14 @@ func (wb *WriteBatch) Put(key, value []byte) error {
 	if len(key) == 0 {
 		return ErrKeyIsEmpty
 	}
+	if isReservedKey(key) && !wb.apply {
+		return ErrKeyIsReserved
+	}
+	return wb.put(key, value)
+}
+
+// 暂存数据，不检查保留前缀
+func (wb *WriteBatch) put(key, value []byte) error {
 	wb.mu.Lock()
 	defer wb.mu.Unlock()
 
@@ -53,11 +63,22 @@ func (wb *WriteBatch) Delete(key []byte) error {
 	if len(key) == 0 {
 		return ErrKeyIsEmpty
 	}
+	if isReservedKey(key) && !wb.apply {
+		return ErrKeyIsReserved
+	}
+	return wb.delete(key)
+}
+
+// 暂存删除，不检查保留前缀
+func (wb *WriteBatch) delete(key []byte) error {
 	wb.mu.Lock()
 	defer wb.mu.Unlock()
 
 	//如果数据已经删除了或者不存在没必要
-	index := wb.db.index.Get(key)
+	var index *data.LogRecordPos
+	if !wb.db.keyDefinitelyAbsent(key) {
+		index = wb.db.index.Get(key)
+	}
 	if index == nil {
 		if wb.pendingWrite[string(key)] != nil {
 			delete(wb.pendingWrite, string(key))
@@ -80,13 +101,130 @@ func (wb *WriteBatch) Commit() error {
 	if len(wb.pendingWrite) == 0 {
 		return nil
 	}
+	if wb.db.isFollower() && !wb.apply {
+		return ErrFollowerReadOnly
+	}
+	if err := wb.db.indexFlushErr(); err != nil {
+		return err
+	}
 	//超过了配置的最大提交数据量
 	if uint(len(wb.pendingWrite)) > wb.options.MaxBatchNum {
 		return ErrExceedMaxBatchNum
 	}
 
+	//持有命名空间读锁，提交过程中命名空间不会被删除
+	wb.db.nsLock.RLock()
+	defer wb.db.nsLock.RUnlock()
+	//暂存之后命名空间已经被删除，这些key不再写入
+	//复制日志里的命名空间版本以主库为准，提交后再更新
+	for key := range wb.pendingWrite {
+		if !wb.apply && wb.db.isStaleNamespaceKey([]byte(key)) {
+			delete(wb.pendingWrite, key)
+		}
+	}
+	if len(wb.pendingWrite) == 0 {
+		return nil
+	}
+
+	//锁住这一批key所在的分段，保证和并发的Put/Delete顺序一致
+	keys := make([][]byte, 0, len(wb.pendingWrite))
+	for _, record := range wb.pendingWrite {
+		keys = append(keys, record.Key)
+	}
+	unlock := wb.db.keyLocks.lockAll(keys)
+	defer unlock()
+
+	//追加写入数据文件，内存索引只有这一步需要持有db锁
+	//记录检查点的持久化索引需要按日志顺序更新，更新完索引才能释放db锁
 	wb.db.mu.Lock()
-	defer wb.db.mu.Unlock()
+	if err := wb.db.reserveCommitSeqNo(); err != nil {
+		wb.db.mu.Unlock()
+		return err
+	}
+	pos, finPos, err := wb.writeLogRecords()
+	if err != nil {
+		wb.db.mu.Unlock()
+		return err
+	}
+	commitSeqNo := wb.db.nextCommitSeqNo()
+	if wb.db.checkpointIndex == nil {
+		wb.db.mu.Unlock()
+		wb.updateIndex(pos)
+	} else {
+		wb.updateIndex(pos)
+		wb.db.setCheckpoint(finPos)
+		wb.db.mu.Unlock()
+	}
+
+	//同一批次的事件一起通知订阅者
+	if wb.db.watchHub.active() {
+		records := make([]*data.LogRecord, 0, len(wb.pendingWrite))
+		for _, record := range wb.pendingWrite {
+			records = append(records, record)
+		}
+		wb.db.watchHub.publish(commitSeqNo, records)
+	}
+	wb.pendingWrite = make(map[string]*data.LogRecord)
+	return nil
+}
+
+// 根据写入的位置更新索引
+func (wb *WriteBatch) updateIndex(pos map[string]*data.LogRecordPos) {
+	//先加入布隆过滤器再更新索引
+	if wb.db.bloom != nil {
+		for _, record := range wb.pendingWrite {
+			if record.Type == data.LogRecordNormal {
+				wb.db.bloom.Add(record.Key)
+			}
+		}
+	}
+
+	//更新内存索引
+	var oldPoses []*data.LogRecordPos
+	if batchIndex, ok := wb.db.index.(index.BatchIndexer); ok {
+		//支持批量更新的索引，put和delete各用一次批量操作
+		var putKeys, deleteKeys [][]byte
+		var putPoses []*data.LogRecordPos
+		for _, record := range wb.pendingWrite {
+			if record.Type == data.LogRecordDelete {
+				deleteKeys = append(deleteKeys, record.Key)
+			}
+			if record.Type == data.LogRecordNormal {
+				putKeys = append(putKeys, record.Key)
+				putPoses = append(putPoses, pos[string(record.Key)])
+			}
+		}
+		if len(putKeys) > 0 {
+			oldPoses = append(oldPoses, batchIndex.PutBatch(putKeys, putPoses)...)
+		}
+		if len(deleteKeys) > 0 {
+			oldPoses = append(oldPoses, batchIndex.DeleteBatch(deleteKeys)...)
+		}
+	} else {
+		for _, record := range wb.pendingWrite {
+			reocrdPos := pos[string(record.Key)]
+			var oldPos *data.LogRecordPos
+			if record.Type == data.LogRecordDelete {
+				oldPos, _ = wb.db.index.Delete(record.Key)
+
+			}
+			if record.Type == data.LogRecordNormal {
+				oldPos = wb.db.index.Put(record.Key, reocrdPos)
+			}
+			oldPoses = append(oldPoses, oldPos)
+		}
+	}
+
+	for _, oldPos := range oldPoses {
+		if oldPos != nil {
+			atomic.AddInt64(&wb.db.reclaimSize, int64(oldPos.Size))
+		}
+	}
+}
+
+// 将暂存的数据追加写入数据文件，返回每个key的位置以及事务完成标识的位置
+// 调用方必须持有db锁
+func (wb *WriteBatch) writeLogRecords() (map[string]*data.LogRecordPos, *data.LogRecordPos, error) {
 
 	//获取当前的事务序列号
 	//atomic.AddUint64 函数用于执行原子操作+1 eg:wb.db.seqNo=1 atomic.AddUint64(&wb.db.seqNo, 1)-> seqNO=2 wb.db.seqNo=2
@@ -103,7 +241,7 @@ func (wb *WriteBatch) Commit() error {
 			Type:  record.Type,
 		})
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
 		pos[string(record.Key)] = logRecordPos
 	}
@@ -114,36 +252,19 @@ func (wb *WriteBatch) Commit() error {
 		Type: data.LogRecordTxnFinished,
 	}
 	//当这条数据插入，才能代表事务完成
-	if _, err := wb.db.appendLogRecord(finishedRecord); err != nil {
-		return err
+	finPos, err := wb.db.appendLogRecord(finishedRecord)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	//根据配置持久化
 	if wb.options.SyncWrites {
 		//wb.db.Sync()不用这个是因为这个也带锁，会死锁，所以直接用wb.db.activeFile.Sync()
 		if err := wb.db.activeFile.Sync(); err != nil {
-			return err
+			return nil, nil, err
 		}
 	}
-
-	//更新内存索引
-	for _, record := range wb.pendingWrite {
-		reocrdPos := pos[string(record.Key)]
-		var oldPos *data.LogRecordPos
-		if record.Type == data.LogRecordDelete {
-			oldPos, _ = wb.db.index.Delete(record.Key)
-
-		}
-		if record.Type == data.LogRecordNormal {
-			oldPos = wb.db.index.Put(record.Key, reocrdPos)
-		}
-
-		if oldPos != nil {
-			wb.db.reclaimSize += int64(oldPos.Size)
-		}
-	}
-	wb.pendingWrite = make(map[string]*data.LogRecord)
-	return nil
+	return pos, finPos, nil
 }
 
 // key+Seq 编码 最后变成SeqKey
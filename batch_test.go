@@ -129,3 +129,50 @@ func TestDB_WriteBatch2(t *testing.T) {
 // 	// assert.Nil(t, err)
 // 	t.Fail()
 // }
+
+func TestDB_WriteBatchBPTree(t *testing.T) {
+	opts := DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-WriteBatch-bptree")
+	opts.DirPath = dir
+	opts.IndexType = BPTree
+	opts.BPTreeFlushBatchSize = 64
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 100; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(10))
+		assert.Nil(t, err)
+	}
+
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	for i := 100; i < 500; i++ {
+		err := wb.Put(utils.GetTestKey(i), utils.RandomValue(10))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 50; i++ {
+		err := wb.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	err = wb.Commit()
+	assert.Nil(t, err)
+
+	assert.Equal(t, 450, len(db.ListKeys()))
+	_, err = db.Get(utils.GetTestKey(10))
+	assert.Equal(t, ErrKeyNotFound, err)
+	val, err := db.Get(utils.GetTestKey(300))
+	assert.Nil(t, err)
+	assert.NotNil(t, val)
+
+	//重启后索引依然完整
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 450, len(db2.ListKeys()))
+	val, err = db2.Get(utils.GetTestKey(499))
+	assert.Nil(t, err)
+	assert.NotNil(t, val)
+	db2.Close()
+}
@@ -0,0 +1,69 @@
+package benchmark
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/fio"
+	"bitcask-go/utils"
+	"os"
+	"testing"
+)
+
+// 每条记录value的大小，校验的开销和记录长度成正比
+const checksumBenchValueSize = 4096
+
+// 编码写入时计算校验的开销
+func benchmarkEncodeChecksum(b *testing.B, checksum data.ChecksumType) {
+	record := &data.LogRecord{Key: utils.GetTestKey(1), Value: utils.RandomValue(checksumBenchValueSize)}
+	b.SetBytes(int64(len(record.Key) + len(record.Value)))
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		data.EncodeLogRecordWithChecksum(record, checksum)
+	}
+}
+
+func Benchmark_EncodeChecksum_IEEE(b *testing.B) {
+	benchmarkEncodeChecksum(b, data.ChecksumIEEE)
+}
+
+func Benchmark_EncodeChecksum_CRC32C(b *testing.B) {
+	benchmarkEncodeChecksum(b, data.ChecksumCRC32C)
+}
+
+// 从数据文件中读取并校验记录的开销
+func benchmarkReadChecksum(b *testing.B, checksum data.ChecksumType) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-checksum")
+	defer os.RemoveAll(dir)
+	dataFile, err := data.OpenDataFileWithChecksum(fio.OSFS{}, dir, 0, fio.StandardFIO, checksum)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer dataFile.Close()
+
+	const recordNum = 1000
+	var offsets []int64
+	for i := 0; i < recordNum; i++ {
+		offsets = append(offsets, dataFile.Offset)
+		buf, _ := dataFile.EncodeLogRecord(&data.LogRecord{Key: utils.GetTestKey(i), Value: utils.RandomValue(checksumBenchValueSize)})
+		if err := dataFile.Write(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.SetBytes(checksumBenchValueSize)
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := dataFile.ReadLogRecord(offsets[i%recordNum]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func Benchmark_ReadChecksum_IEEE(b *testing.B) {
+	benchmarkReadChecksum(b, data.ChecksumIEEE)
+}
+
+func Benchmark_ReadChecksum_CRC32C(b *testing.B) {
+	benchmarkReadChecksum(b, data.ChecksumCRC32C)
+}
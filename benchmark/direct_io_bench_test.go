@@ -0,0 +1,143 @@
+package benchmark
+
+import (
+	bitcask "bitcask-go"
+	"bitcask-go/utils"
+	"bufio"
+	"math/rand"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// 大数据集每条记录value的大小
+const largeDatasetValueSize = 4096
+
+// 数据集大小，单位MB，可以通过环境变量BITCASK_BENCH_DATASET_MB设置成超过内存的大小
+func largeDatasetSize() int64 {
+	size := int64(256)
+	if env := os.Getenv("BITCASK_BENCH_DATASET_MB"); env != "" {
+		if n, err := strconv.ParseInt(env, 10, 64); err == nil && n > 0 {
+			size = n
+		}
+	}
+	return size * 1024 * 1024
+}
+
+// 读取系统页缓存的大小，只有linux支持
+func pageCacheBytes() (int64, bool) {
+	file, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, false
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "Cached:" {
+			kb, err := strconv.ParseInt(fields[1], 10, 64)
+			return kb * 1024, err == nil
+		}
+	}
+	return 0, false
+}
+
+// 写好的大数据集，同一个配置多轮基准测试共用
+type largeDataset struct {
+	db         *bitcask.DB
+	dir        string
+	keyNum     int
+	cacheStart int64 //写入数据之前的页缓存大小
+}
+
+var largeDatasets = make(map[string]*largeDataset)
+
+// 所有基准测试结束之后关闭并删除大数据集
+func TestMain(m *testing.M) {
+	code := m.Run()
+	closeLargeDatasets()
+	os.Exit(code)
+}
+
+func closeLargeDatasets() {
+	for name, ds := range largeDatasets {
+		_ = ds.db.Close()
+		_ = os.RemoveAll(ds.dir)
+		delete(largeDatasets, name)
+	}
+}
+
+func openLargeDataset(b *testing.B, name string, ioType bitcask.IOType, sealedOnly bool) *largeDataset {
+	if ds, ok := largeDatasets[name]; ok {
+		return ds
+	}
+	opts := bitcask.DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-large-"+name)
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024 * 1024
+	opts.IOType = ioType
+	opts.DirectIOSealedOnly = sealedOnly
+	opts.IndexType = bitcask.Hash
+
+	cacheStart, _ := pageCacheBytes()
+	db, err := bitcask.Open(opts)
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		b.Fatal(err)
+	}
+	//写入失败时数据集不会被保存，这里直接清理
+	fail := func(err error) {
+		_ = db.Close()
+		_ = os.RemoveAll(dir)
+		b.Fatal(err)
+	}
+	keyNum := int(largeDatasetSize() / largeDatasetValueSize)
+	value := utils.RandomValue(largeDatasetValueSize)
+	for i := 0; i < keyNum; i++ {
+		if err := db.Put(utils.GetTestKey(i), value); err != nil {
+			fail(err)
+		}
+	}
+	if err := db.Sync(); err != nil {
+		fail(err)
+	}
+	ds := &largeDataset{db: db, dir: dir, keyNum: keyNum, cacheStart: cacheStart}
+	largeDatasets[name] = ds
+	return ds
+}
+
+// 在大数据集上随机读取，报告页缓存增长和堆内存
+// 标准IO的页缓存随数据集增长，直接IO基本不变
+func benchmarkLargeDatasetGet(b *testing.B, name string, ioType bitcask.IOType, sealedOnly bool) {
+	ds := openLargeDataset(b, name, ioType, sealedOnly)
+	b.SetBytes(largeDatasetValueSize)
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := ds.db.Get(utils.GetTestKey(rand.Intn(ds.keyNum))); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+
+	if cache, ok := pageCacheBytes(); ok {
+		b.ReportMetric(float64(cache-ds.cacheStart)/1024/1024, "cache-MB")
+	}
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	b.ReportMetric(float64(stats.HeapInuse)/1024/1024, "heap-MB")
+}
+
+func Benchmark_LargeDatasetGet_StandardIO(b *testing.B) {
+	benchmarkLargeDatasetGet(b, "standard", bitcask.StandardIO, false)
+}
+
+func Benchmark_LargeDatasetGet_DirectIO(b *testing.B) {
+	benchmarkLargeDatasetGet(b, "direct", bitcask.DirectIO, false)
+}
+
+func Benchmark_LargeDatasetGet_DirectIOSealedOnly(b *testing.B) {
+	benchmarkLargeDatasetGet(b, "direct-sealed", bitcask.DirectIO, true)
+}
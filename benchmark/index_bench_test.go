@@ -0,0 +1,79 @@
+package benchmark
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/index"
+	"bitcask-go/utils"
+	"runtime"
+	"testing"
+)
+
+// 每轮写入的key数量
+const indexBenchKeyNum = 100000
+
+// 统计索引中每个key平均占用的内存，方便对比不同索引类型
+func benchmarkIndexMemory(b *testing.B, typ index.IndexType) {
+	keys := make([][]byte, indexBenchKeyNum)
+	for i := range keys {
+		keys[i] = utils.GetTestKey(i)
+	}
+
+	b.ResetTimer()
+	b.ReportAllocs()
+	var bytesPerKey float64
+	for i := 0; i < b.N; i++ {
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+
+		indexer := index.NewIndexer(typ, "", false)
+		for j, key := range keys {
+			indexer.Put(key, &data.LogRecordPos{Fid: 1, Offset: int64(j), Size: 128})
+		}
+
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		bytesPerKey += float64(after.HeapAlloc-before.HeapAlloc) / indexBenchKeyNum
+		//保证统计期间索引不会被回收
+		runtime.KeepAlive(indexer)
+	}
+	b.ReportMetric(bytesPerKey/float64(b.N), "bytes/key")
+}
+
+func Benchmark_IndexMemory_Btree(b *testing.B) {
+	benchmarkIndexMemory(b, index.Btree)
+}
+
+func Benchmark_IndexMemory_ART(b *testing.B) {
+	benchmarkIndexMemory(b, index.ART)
+}
+
+func Benchmark_IndexMemory_Hash(b *testing.B) {
+	benchmarkIndexMemory(b, index.Hash)
+}
+
+// 点查性能对比
+func benchmarkIndexGet(b *testing.B, typ index.IndexType) {
+	indexer := index.NewIndexer(typ, "", false)
+	for i := 0; i < indexBenchKeyNum; i++ {
+		indexer.Put(utils.GetTestKey(i), &data.LogRecordPos{Fid: 1, Offset: int64(i), Size: 128})
+	}
+
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		indexer.Get(utils.GetTestKey(i % indexBenchKeyNum))
+	}
+}
+
+func Benchmark_IndexGet_Btree(b *testing.B) {
+	benchmarkIndexGet(b, index.Btree)
+}
+
+func Benchmark_IndexGet_ART(b *testing.B) {
+	benchmarkIndexGet(b, index.ART)
+}
+
+func Benchmark_IndexGet_Hash(b *testing.B) {
+	benchmarkIndexGet(b, index.Hash)
+}
@@ -0,0 +1,101 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/utils"
+	"path/filepath"
+)
+
+const (
+	bloomFilterKey = "bloomFilterKey"
+	//布隆过滤器的误判率
+	bloomFilterFPRate = 0.01
+	//布隆过滤器最少按这个数量的key分配，避免小库刚打开就写满
+	bloomFilterMinKeys = 1 << 16
+)
+
+// 加载布隆过滤器
+// 上次正常关闭时保存的过滤器可以直接使用，否则根据索引重新构建
+// 加载后立即删除文件，之后如果没有正常关闭，下次打开就不会用到过期的过滤器
+func (db *DB) loadBloomFilter() error {
+	filename := filepath.Join(db.options.DirPath, data.BloomFilterName)
+	var bloom *utils.BloomFilter
+	if _, err := db.fs.Stat(filename); err == nil {
+		if db.options.BloomFilter {
+			bloomFile, err := data.OpenBloomFilterFile(db.fs, db.options.DirPath)
+			if err != nil {
+				return err
+			}
+			record, _, err := bloomFile.ReadLogRecord(bloomFile.RecordStart())
+			bloomFile.Close()
+			//文件损坏就当作没有，重新构建
+			if err == nil {
+				bloom, _ = utils.DecodeBloomFilter(record.Value)
+			}
+		}
+		//没有开启布隆过滤器也要删掉，否则关闭期间写入的key不在旧的过滤器里
+		if err := db.fs.Remove(filename); err != nil {
+			return err
+		}
+	}
+
+	if !db.options.BloomFilter {
+		return nil
+	}
+	//key的数量已经超过了过滤器的容量，误判率太高，重新构建
+	if bloom == nil || bloom.Overloaded() {
+		var err error
+		if bloom, err = db.buildBloomFilter(); err != nil {
+			return err
+		}
+	}
+	db.bloom = bloom
+	return nil
+}
+
+// 遍历索引构建布隆过滤器，预留一倍的容量给之后的写入
+// 索引读取失败时过滤器会漏掉key，返回错误
+func (db *DB) buildBloomFilter() (*utils.BloomFilter, error) {
+	expect := uint64(db.index.Size()) * 2
+	if expect < bloomFilterMinKeys {
+		expect = bloomFilterMinKeys
+	}
+	bloom := utils.NewBloomFilter(expect, bloomFilterFPRate)
+	it := db.index.Iterator(false)
+	defer it.Close()
+	for it.Rewind(); it.Valid(); it.Next() {
+		bloom.Add(it.Key())
+	}
+	if err := db.indexFlushErr(); err != nil {
+		return nil, err
+	}
+	return bloom, nil
+}
+
+// 关闭时保存布隆过滤器，调用方必须持有db锁
+func (db *DB) saveBloomFilter() error {
+	if db.bloom == nil {
+		return nil
+	}
+	bloomFile, err := data.OpenBloomFilterFile(db.fs, db.options.DirPath)
+	if err != nil {
+		return err
+	}
+	record := &data.LogRecord{
+		Key:   []byte(bloomFilterKey),
+		Value: db.bloom.Encode(),
+	}
+	buf, _ := bloomFile.EncodeLogRecord(record)
+	if err := bloomFile.Write(buf); err != nil {
+		return err
+	}
+	if err := bloomFile.Sync(); err != nil {
+		return err
+	}
+	return bloomFile.Close()
+}
+
+// key是否一定不存在，没有开启布隆过滤器时总是返回false
+func (db *DB) keyDefinitelyAbsent(key []byte) bool {
+	return db.bloom != nil && !db.bloom.MayContain(key)
+}
@@ -0,0 +1,287 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/fio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 崩溃测试的数据库配置，所有文件都在注入故障的内存文件系统中
+func crashOptions(ffs *fio.FaultFS) Options {
+	opts := DefaultDBOptions
+	opts.DirPath = filepath.Join(os.TempDir(), "bitcask-go-crash")
+	opts.DataFileSize = 4 * 1024
+	opts.DataFileMergeRatio = 0
+	opts.SyncWrites = true
+	opts.FS = ffs
+	return opts
+}
+
+func crashKey(i int) []byte {
+	return []byte(fmt.Sprintf("crash-key-%05d", i))
+}
+
+func crashValue(i, version int) []byte {
+	return []byte(fmt.Sprintf("crash-value-%05d-%d-%064d", i, version, i))
+}
+
+// 崩溃测试的一个场景
+type crashCase struct {
+	name string
+	//准备已经提交的数据，返回期望的数据
+	setup func(t *testing.T, db *DB) map[string]string
+	//注入故障的操作
+	op func(db *DB) error
+	//检查重新打开之后的数据，expected是setup返回的数据
+	check func(t *testing.T, db *DB, expected map[string]string, opErr error)
+}
+
+// 在操作的每一个修改点注入失败和写一半两种故障，崩溃之后重新打开，只能看到已经提交的数据
+// 写一半的故障崩溃时保留一部分没有Sync的数据，打开时要截断或者跳过写了一半的记录
+func runCrashCase(t *testing.T, c crashCase) {
+	//先不注入故障，统计操作中修改的次数
+	ffs := fio.NewFaultFS(fio.NewMemFS())
+	db, err := Open(crashOptions(ffs))
+	assert.Nil(t, err)
+	c.setup(t, db)
+	ffs.FailAfter(0, false)
+	assert.Nil(t, c.op(db))
+	opNum := ffs.Ops()
+	assert.Greater(t, opNum, 0)
+	assert.Nil(t, ffs.Crash())
+
+	for i := 1; i <= opNum; i++ {
+		for _, short := range []bool{false, true} {
+			ffs := fio.NewFaultFS(fio.NewMemFS())
+			opts := crashOptions(ffs)
+			db, err := Open(opts)
+			assert.Nil(t, err)
+			expected := c.setup(t, db)
+			ffs.FailAfter(i, short)
+			opErr := c.op(db)
+			assert.True(t, ffs.Failed(), "%s: no fault at op %d", c.name, i)
+			if short {
+				assert.Nil(t, ffs.CrashWithTornWrites())
+			} else {
+				assert.Nil(t, ffs.Crash())
+			}
+
+			//崩溃后打开，再正常关闭打开一次，两次看到的数据都一样
+			for round := 0; round < 2; round++ {
+				db, err = Open(opts)
+				if !assert.Nil(t, err, "%s: open after fault at op %d short %v", c.name, i, short) {
+					return
+				}
+				c.check(t, db, expected, opErr)
+				assert.Nil(t, db.Close())
+			}
+
+			//写了一半的记录被截断或者跳过，之后追加的数据重新打开仍然能读到
+			db, err = Open(opts)
+			assert.Nil(t, err)
+			assert.Nil(t, db.Put([]byte("crash-marker"), []byte("marker")))
+			assert.Nil(t, db.Close())
+			db, err = Open(opts)
+			assert.Nil(t, err)
+			val, err := db.Get([]byte("crash-marker"))
+			assert.Nil(t, err, "%s: marker after fault at op %d short %v", c.name, i, short)
+			assert.Equal(t, []byte("marker"), val)
+			assert.Nil(t, db.Close())
+		}
+	}
+}
+
+// 数据库中的数据和期望的完全一致
+func assertCrashData(t *testing.T, db *DB, expected map[string]string) {
+	keys := db.ListKeys()
+	assert.Equal(t, len(expected), len(keys))
+	for key, value := range expected {
+		val, err := db.Get([]byte(key))
+		assert.Nil(t, err, key)
+		assert.Equal(t, value, string(val))
+	}
+}
+
+// 写入一些数据，有覆盖也有删除，产生可以merge的无效数据
+func setupCrashData(t *testing.T, db *DB) map[string]string {
+	expected := make(map[string]string)
+	for i := 0; i < 200; i++ {
+		assert.Nil(t, db.Put(crashKey(i), crashValue(i, 0)))
+		expected[string(crashKey(i))] = string(crashValue(i, 0))
+	}
+	for i := 0; i < 50; i++ {
+		assert.Nil(t, db.Delete(crashKey(i)))
+		delete(expected, string(crashKey(i)))
+	}
+	for i := 50; i < 100; i++ {
+		assert.Nil(t, db.Put(crashKey(i), crashValue(i, 1)))
+		expected[string(crashKey(i))] = string(crashValue(i, 1))
+	}
+	return expected
+}
+
+func TestCrash_Merge(t *testing.T) {
+	runCrashCase(t, crashCase{
+		name:  "merge",
+		setup: setupCrashData,
+		op: func(db *DB) error {
+			return db.Merge()
+		},
+		check: func(t *testing.T, db *DB, expected map[string]string, opErr error) {
+			assertCrashData(t, db, expected)
+		},
+	})
+}
+
+func TestCrash_WriteBatchCommit(t *testing.T) {
+	runCrashCase(t, crashCase{
+		name:  "batch",
+		setup: setupCrashData,
+		op: func(db *DB) error {
+			wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+			for i := 100; i < 150; i++ {
+				if err := wb.Put(crashKey(i), crashValue(i, 2)); err != nil {
+					return err
+				}
+			}
+			for i := 150; i < 160; i++ {
+				if err := wb.Delete(crashKey(i)); err != nil {
+					return err
+				}
+			}
+			return wb.Commit()
+		},
+		check: func(t *testing.T, db *DB, expected map[string]string, opErr error) {
+			//事务要么全部生效，要么全部不生效，提交成功的一定生效
+			committed := make(map[string]string)
+			for key, value := range expected {
+				committed[key] = value
+			}
+			for i := 100; i < 150; i++ {
+				committed[string(crashKey(i))] = string(crashValue(i, 2))
+			}
+			for i := 150; i < 160; i++ {
+				delete(committed, string(crashKey(i)))
+			}
+			val, err := db.Get(crashKey(100))
+			assert.Nil(t, err)
+			if opErr == nil || string(val) == string(crashValue(100, 2)) {
+				assertCrashData(t, db, committed)
+			} else {
+				assertCrashData(t, db, expected)
+			}
+		},
+	})
+}
+
+func TestCrash_Close(t *testing.T) {
+	runCrashCase(t, crashCase{
+		name:  "close",
+		setup: setupCrashData,
+		op: func(db *DB) error {
+			return db.Close()
+		},
+		check: func(t *testing.T, db *DB, expected map[string]string, opErr error) {
+			assertCrashData(t, db, expected)
+		},
+	})
+}
+
+// 读取fs中文件的全部内容
+func readCrashFile(t *testing.T, fs fio.FS, name string) []byte {
+	file, err := fs.OpenFile(name, os.O_RDONLY, 0)
+	assert.Nil(t, err)
+	defer file.Close()
+	content, err := io.ReadAll(file)
+	assert.Nil(t, err)
+	return content
+}
+
+func writeCrashFile(t *testing.T, fs fio.FS, name string, content []byte) {
+	file, err := fs.OpenFile(name, os.O_WRONLY|os.O_TRUNC, 0)
+	assert.Nil(t, err)
+	_, err = file.Write(content)
+	assert.Nil(t, err)
+	assert.Nil(t, file.Sync())
+	assert.Nil(t, file.Close())
+}
+
+// MANIFEST中每条记录的位置
+func manifestRecordOffsets(t *testing.T, fs fio.FS, dir string) []int64 {
+	manifestFile, err := data.OpenManifestFile(fs, dir, data.ManifestFileName)
+	assert.Nil(t, err)
+	defer manifestFile.Close()
+	var offsets []int64
+	offset := manifestFile.RecordStart()
+	for {
+		_, size, err := manifestFile.ReadLogRecord(offset)
+		if err == io.EOF {
+			return offsets
+		}
+		assert.Nil(t, err)
+		offsets = append(offsets, offset)
+		offset += size
+	}
+}
+
+// 崩溃之后MANIFEST中间的记录损坏，不能当作写了一半的末尾记录丢弃，也不能因此清理任何数据文件
+func TestCrash_ManifestCorrupted(t *testing.T) {
+	ffs := fio.NewFaultFS(fio.NewMemFS())
+	opts := crashOptions(ffs)
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	expected := setupCrashData(t, db)
+	assert.Nil(t, ffs.Crash())
+
+	manifestName := filepath.Join(opts.DirPath, data.ManifestFileName)
+	content := readCrashFile(t, ffs, manifestName)
+	dataFiles, err := ffs.ReadDir(opts.DirPath)
+	assert.Nil(t, err)
+
+	//数据文件切换了很多次，MANIFEST中有很多条记录，中间的字节在某一条完整的记录里
+	corrupted := append([]byte{}, content...)
+	corrupted[len(corrupted)/2] ^= 0xff
+	writeCrashFile(t, ffs, manifestName, corrupted)
+	for round := 0; round < 2; round++ {
+		_, err = Open(opts)
+		assert.Equal(t, ErrDataDirectoryCorrupdated, err)
+		assert.Nil(t, ffs.Crash())
+	}
+	entries, err := ffs.ReadDir(opts.DirPath)
+	assert.Nil(t, err)
+	assert.Equal(t, len(dataFiles), len(entries))
+	_, err = ffs.Stat(siblingPath(opts.DirPath, quarantineDirName))
+	assert.True(t, os.IsNotExist(err))
+
+	//中间记录的key、value长度损坏，看起来像是超过文件末尾或者正好到文件末尾，后面还有完整的记录，不能当作末尾丢弃
+	writeCrashFile(t, ffs, manifestName, content)
+	offsets := manifestRecordOffsets(t, ffs, opts.DirPath)
+	assert.Greater(t, len(offsets), 2)
+	for _, offset := range offsets[1 : len(offsets)-1] {
+		for _, pos := range []int64{offset + 5, offset + 6} {
+			for _, b := range []byte{0x7e, 0x7f, content[pos] ^ 0x01, content[pos] ^ 0x80} {
+				corrupted := append([]byte{}, content...)
+				corrupted[pos] = b
+				writeCrashFile(t, ffs, manifestName, corrupted)
+				_, err = Open(opts)
+				assert.Equal(t, ErrDataDirectoryCorrupdated, err, "offset %d pos %d byte %x", offset, pos, b)
+				assert.Nil(t, ffs.Crash())
+			}
+		}
+	}
+	_, err = ffs.Stat(siblingPath(opts.DirPath, quarantineDirName))
+	assert.True(t, os.IsNotExist(err))
+
+	//修复MANIFEST之后数据都还在
+	writeCrashFile(t, ffs, manifestName, content)
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assertCrashData(t, db, expected)
+	assert.Nil(t, db.Close())
+}
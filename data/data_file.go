@@ -7,48 +7,111 @@ import (
 	"hash/crc32"
 	"io"
 	"path/filepath"
+	"sync/atomic"
 )
 
 var (
-	ErrInvalidCRC = errors.New("invalid crc value,log record maybe corrupted")
+	ErrInvalidCRC             = errors.New("invalid crc value,log record maybe corrupted")
+	ErrUnsupportedFileVersion = errors.New("the file format version is newer than supported")
+	ErrUnknownChecksumType    = errors.New("unknown checksum type in the file header")
 )
 
 const (
-	DataFileNameSuffix = ".data"
-	HintFileName       = "hint-index"
-	MergeFinishedName  = "merge-finshed"
-	SeqNoFileName      = "seq-no"
+	DataFileNameSuffix  = ".data"
+	HintFileName        = "hint-index"
+	MergeFinishedName   = "merge-finshed"
+	SeqNoFileName       = "seq-no"
+	BloomFilterName     = "bloom-filter"
+	BackupManifestName  = "backup-manifest"
+	ArchiveFinishedName = "archive-finished"
+	ManifestFileName    = "MANIFEST"
 )
 
 // 数据文件
 type DataFile struct {
 	FileId   uint32        //文件id
 	Offset   int64         //文件偏移
+	Header   *FileHeader   //文件头，旧格式的文件为nil
 	IoManger fio.IOManager //io读写管理
+	fs       fio.FS        //文件所在的文件系统
+	refs     int32         //引用计数，创建时持有者占一个引用，归零时关闭文件
+	retired  int32         //是否已经下线，下线后不能再获取引用
 }
 
 // 打开新的数据文件
-func OpenDataFile(dirPath string, fileId uint32, ioType fio.FileIOType) (*DataFile, error) {
+func OpenDataFile(fs fio.FS, dirPath string, fileId uint32, ioType fio.FileIOType) (*DataFile, error) {
+	return OpenDataFileWithChecksum(fs, dirPath, fileId, ioType, DefaultChecksum)
+}
+
+// 打开数据文件，checksum只用于新建的文件，已有的文件按文件头中记录的算法校验
+func OpenDataFileWithChecksum(fs fio.FS, dirPath string, fileId uint32, ioType fio.FileIOType, checksum ChecksumType) (*DataFile, error) {
 	filename := GetDataFileName(dirPath, fileId)
-	return newDataFile(filename, fileId, ioType)
+	return newDataFile(fs, filename, fileId, ioType, FileTypeData, checksum)
 }
 
 // 打开Hint索引文件
-func OpenHintFile(dirPath string) (*DataFile, error) {
+func OpenHintFile(fs fio.FS, dirPath string) (*DataFile, error) {
 	filename := filepath.Join(dirPath, HintFileName)
-	return newDataFile(filename, 0, fio.StandardFIO)
+	return newDataFile(fs, filename, 0, fio.StandardFIO, FileTypeHint, DefaultChecksum)
 }
 
 // 打开Merge完成索引文件
-func OpenMergeFinishFile(dirPath string) (*DataFile, error) {
-	filename := filepath.Join(dirPath, MergeFinishedName)
-	return newDataFile(filename, 0, fio.StandardFIO)
+func OpenMergeFinishFile(fs fio.FS, dirPath string) (*DataFile, error) {
+	return OpenMergeFinishFileWithName(fs, dirPath, MergeFinishedName)
+}
+
+// 打开Merge完成标识文件，name可以是写入过程中的临时文件名
+func OpenMergeFinishFileWithName(fs fio.FS, dirPath, name string) (*DataFile, error) {
+	filename := filepath.Join(dirPath, name)
+	return newDataFile(fs, filename, 0, fio.StandardFIO, FileTypeMergeFinished, DefaultChecksum)
 }
 
 // 存储SeqNo文件
-func OpenSeqNoFile(dirPath string) (*DataFile, error) {
+func OpenSeqNoFile(fs fio.FS, dirPath string) (*DataFile, error) {
 	filename := filepath.Join(dirPath, SeqNoFileName)
-	return newDataFile(filename, 0, fio.StandardFIO)
+	return newDataFile(fs, filename, 0, fio.StandardFIO, FileTypeSeqNo, DefaultChecksum)
+}
+
+// 存储布隆过滤器文件
+func OpenBloomFilterFile(fs fio.FS, dirPath string) (*DataFile, error) {
+	filename := filepath.Join(dirPath, BloomFilterName)
+	return newDataFile(fs, filename, 0, fio.StandardFIO, FileTypeBloomFilter, DefaultChecksum)
+}
+
+// 打开增量备份的清单文件
+func OpenBackupManifestFile(fs fio.FS, dirPath string) (*DataFile, error) {
+	filename := filepath.Join(dirPath, BackupManifestName)
+	return newDataFile(fs, filename, 0, fio.StandardFIO, FileTypeBackupManifest, DefaultChecksum)
+}
+
+// 打开旧数据文件归档完成的标识文件
+func OpenArchiveFinishedFile(fs fio.FS, dirPath string) (*DataFile, error) {
+	filename := filepath.Join(dirPath, ArchiveFinishedName)
+	return newDataFile(fs, filename, 0, fio.StandardFIO, FileTypeArchiveFinished, DefaultChecksum)
+}
+
+// 打开MANIFEST文件，name可以是写入过程中的临时文件名
+func OpenManifestFile(fs fio.FS, dirPath, name string) (*DataFile, error) {
+	filename := filepath.Join(dirPath, name)
+	return newDataFile(fs, filename, 0, fio.StandardFIO, FileTypeManifest, DefaultChecksum)
+}
+
+// 只读打开数据文件，不写入文件头，用于离线恢复读取源目录和归档中的文件
+func OpenDataFileReadOnly(fs fio.FS, dirPath string, fileId uint32) (*DataFile, error) {
+	filename := GetDataFileName(dirPath, fileId)
+	return newReadOnlyFile(fs, filename, fileId, FileTypeData)
+}
+
+// 只读打开Merge完成标识文件
+func OpenMergeFinishFileReadOnly(fs fio.FS, dirPath string) (*DataFile, error) {
+	filename := filepath.Join(dirPath, MergeFinishedName)
+	return newReadOnlyFile(fs, filename, 0, FileTypeMergeFinished)
+}
+
+// 只读打开归档完成的标识文件
+func OpenArchiveFinishedFileReadOnly(fs fio.FS, dirPath string) (*DataFile, error) {
+	filename := filepath.Join(dirPath, ArchiveFinishedName)
+	return newReadOnlyFile(fs, filename, 0, FileTypeArchiveFinished)
 }
 
 // 获取数据文件名
@@ -57,17 +120,112 @@ func GetDataFileName(dirPath string, fileId uint32) string {
 }
 
 // 打开新文件
-func newDataFile(dirPath string, fileId uint32, ioType fio.FileIOType) (*DataFile, error) {
+func newDataFile(fs fio.FS, dirPath string, fileId uint32, ioType fio.FileIOType, fileType FileType, checksum ChecksumType) (*DataFile, error) {
+	//新文件先写入文件头，要在打开IOManager之前，mmap只能读取已有的内容
+	header, err := loadFileHeader(fs, dirPath, fileType, checksum)
+	if err != nil {
+		return nil, err
+	}
+	if header != nil && header.Version > FileFormatVersion {
+		return nil, ErrUnsupportedFileVersion
+	}
+	if header != nil && header.Checksum().table() == nil {
+		return nil, ErrUnknownChecksumType
+	}
 	//初始化IOManager管理器
-	ioManager, err := fio.NewIOManager(dirPath, ioType)
+	ioManager, err := fs.OpenIOManager(dirPath, ioType)
+	if err != nil {
+		return nil, err
+	}
+	df := &DataFile{
+		FileId:   fileId,
+		Header:   header,
+		IoManger: ioManager,
+		fs:       fs,
+		refs:     1,
+	}
+	df.Offset = df.RecordStart()
+	return df, nil
+}
+
+func newReadOnlyFile(fs fio.FS, fileName string, fileId uint32, fileType FileType) (*DataFile, error) {
+	header, err := peekFileHeader(fs, fileName, fileType)
 	if err != nil {
 		return nil, err
 	}
-	return &DataFile{
+	if header != nil && header.Version > FileFormatVersion {
+		return nil, ErrUnsupportedFileVersion
+	}
+	if header != nil && header.Checksum().table() == nil {
+		return nil, ErrUnknownChecksumType
+	}
+	ioManager, err := fio.NewReadOnlyIOManager(fs, fileName)
+	if err != nil {
+		return nil, err
+	}
+	df := &DataFile{
 		FileId:   fileId,
-		Offset:   0,
+		Header:   header,
 		IoManger: ioManager,
-	}, nil
+		fs:       fs,
+		refs:     1,
+	}
+	df.Offset = df.RecordStart()
+	return df, nil
+}
+
+// 文件中日志记录使用的校验算法，旧格式的文件使用IEEE
+func (df *DataFile) Checksum() ChecksumType {
+	if df.Header == nil {
+		return ChecksumIEEE
+	}
+	return df.Header.Checksum()
+}
+
+// 按文件的校验算法对LogRecord进行编码
+func (df *DataFile) EncodeLogRecord(log *LogRecord) ([]byte, int64) {
+	return EncodeLogRecordWithChecksum(log, df.Checksum())
+}
+
+// 第一条日志记录的位置，旧格式的文件没有文件头，从0开始
+func (df *DataFile) RecordStart() int64 {
+	if df.Header == nil {
+		return 0
+	}
+	return FileHeaderSize
+}
+
+// 获取一个读引用，文件已经下线关闭时返回false
+// 获取成功后必须调用Release释放
+func (df *DataFile) Acquire() bool {
+	if atomic.LoadInt32(&df.retired) == 1 {
+		return false
+	}
+	for {
+		refs := atomic.LoadInt32(&df.refs)
+		if refs <= 0 {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&df.refs, refs, refs+1) {
+			return true
+		}
+	}
+}
+
+// 释放一个引用，最后一个引用释放时关闭文件
+func (df *DataFile) Release() error {
+	if atomic.AddInt32(&df.refs, -1) == 0 {
+		return df.IoManger.Close()
+	}
+	return nil
+}
+
+// 下线数据文件，释放持有者的引用，正在读取的读者结束后文件才会真正关闭
+func (df *DataFile) Retire() error {
+	if !atomic.CompareAndSwapInt32(&df.retired, 0, 1) {
+		return nil
+	}
+	return df.Release()
 }
 
 // Sync持久化当前数据文件到磁盘
@@ -91,7 +249,7 @@ func (df *DataFile) WriteHintRecord(key []byte, pos *LogRecordPos) error {
 		Key:   key,
 		Value: EncodeLogRecordPos(pos),
 	}
-	encRecord, _ := EncodeLogRecord(record)
+	encRecord, _ := df.EncodeLogRecord(record)
 	return df.Write(encRecord)
 }
 
@@ -102,9 +260,14 @@ func (df *DataFile) ReadLogRecord(offset int64) (*LogRecord, int64, error) {
 		return nil, 0, err
 	}
 
+	//已经读到文件末尾
+	if offset >= filesize {
+		return nil, 0, io.EOF
+	}
+
 	//这种情况判断最大长度header+offset超过文件长度，读到末尾即可
-	var headerBytes int64 = maxLogRecordHeaderSize
-	if offset+maxLogRecordHeaderSize > filesize {
+	var headerBytes int64 = maxTimestampHeaderSize
+	if offset+maxTimestampHeaderSize > filesize {
 		headerBytes = filesize - offset
 	}
 
@@ -127,11 +290,16 @@ func (df *DataFile) ReadLogRecord(offset int64) (*LogRecord, int64, error) {
 	// 取出key value长度
 	keySize, valueSize := int64(header.keySize), int64(header.valueSize)
 	var recordSize = headerSize + keySize + valueSize
+	//记录超过了文件末尾，可能是写了一半或者长度损坏，不按损坏的长度分配内存
+	if offset+recordSize > filesize {
+		return nil, 0, io.EOF
+	}
 
 	log := &LogRecord{}
 
-	//取出type
+	//取出type和写入时间
 	log.Type = header.recordType
+	log.Timestamp = header.timestamp
 
 	//开始读取用户实际存储的key/value
 	if keySize > 0 || valueSize > 0 {
@@ -146,9 +314,10 @@ func (df *DataFile) ReadLogRecord(offset int64) (*LogRecord, int64, error) {
 
 	//校验crc
 	//这里只截取从crc之后到header总长度之前的数据
-	crc := getLogRecordCRC(log, headerBuf[crc32.Size:headerSize])
+	//校验失败时仍然返回记录的长度，调用方可以判断损坏的记录是否在文件末尾
+	crc := getLogRecordCRC(log, headerBuf[crc32.Size:headerSize], df.Checksum().table())
 	if crc != header.crc {
-		return nil, 0, ErrInvalidCRC
+		return nil, recordSize, ErrInvalidCRC
 	}
 
 	return log, recordSize, nil
@@ -167,7 +336,7 @@ func (df *DataFile) SetIOManager(dirpath string, ioType fio.FileIOType) error {
 		return err
 	}
 
-	ioManager, err := fio.NewIOManager(GetDataFileName(dirpath, df.FileId), ioType)
+	ioManager, err := df.fs.OpenIOManager(GetDataFileName(dirpath, df.FileId), ioType)
 	if err != nil {
 		return err
 	}
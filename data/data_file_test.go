@@ -12,15 +12,15 @@ import (
 func TestOpenDataFile(t *testing.T) {
 	mypath, _ := os.Getwd()
 	path := path.Join(mypath, "tmp")
-	DataFile, err := OpenDataFile(path, 0, fio.StandardFIO)
+	DataFile, err := OpenDataFile(fio.OSFS{}, path, 0, fio.StandardFIO)
 	assert.Nil(t, err)
 	assert.NotNil(t, DataFile)
 
-	DataFile2, err := OpenDataFile(path, 111, fio.StandardFIO)
+	DataFile2, err := OpenDataFile(fio.OSFS{}, path, 111, fio.StandardFIO)
 	assert.Nil(t, err)
 	assert.NotNil(t, DataFile2)
 
-	DataFile3, err := OpenDataFile(path, 111, fio.StandardFIO)
+	DataFile3, err := OpenDataFile(fio.OSFS{}, path, 111, fio.StandardFIO)
 	assert.Nil(t, err)
 	assert.NotNil(t, DataFile3)
 
@@ -31,7 +31,7 @@ func TestOpenDataFile(t *testing.T) {
 func TestDataFile_Write(t *testing.T) {
 	mypath, _ := os.Getwd()
 	path := path.Join(mypath, "tmp")
-	DataFile, err := OpenDataFile(path, 0, fio.StandardFIO)
+	DataFile, err := OpenDataFile(fio.OSFS{}, path, 0, fio.StandardFIO)
 	assert.Nil(t, err)
 	assert.NotNil(t, DataFile)
 
@@ -48,7 +48,7 @@ func TestDataFile_Write(t *testing.T) {
 func TestDataFile_Close(t *testing.T) {
 	mypath, _ := os.Getwd()
 	path := path.Join(mypath, "tmp")
-	DataFile, err := OpenDataFile(path, 0, fio.StandardFIO)
+	DataFile, err := OpenDataFile(fio.OSFS{}, path, 0, fio.StandardFIO)
 	assert.Nil(t, err)
 	assert.NotNil(t, DataFile)
 
@@ -60,7 +60,7 @@ func TestDataFile_Close(t *testing.T) {
 func TestDataFile_Sync(t *testing.T) {
 	mypath, _ := os.Getwd()
 	path := path.Join(mypath, "tmp")
-	DataFile, err := OpenDataFile(path, 744, fio.StandardFIO)
+	DataFile, err := OpenDataFile(fio.OSFS{}, path, 744, fio.StandardFIO)
 	assert.Nil(t, err)
 	assert.NotNil(t, DataFile)
 
@@ -81,7 +81,7 @@ func TestDataFile_Sync(t *testing.T) {
 func TestReadLogRecordDataFile(t *testing.T) {
 	mypath, _ := os.Getwd()
 	path := path.Join(mypath, "tmp")
-	DataFile, err := OpenDataFile(path, 31, fio.StandardFIO)
+	DataFile, err := OpenDataFile(fio.OSFS{}, path, 31, fio.StandardFIO)
 	assert.Nil(t, err)
 	assert.NotNil(t, DataFile)
 
@@ -133,3 +133,35 @@ func TestReadLogRecordDataFile(t *testing.T) {
 	assert.Equal(t, bufsize3, logsize3)
 	assert.Equal(t, readlog3, res)
 }
+
+func TestDataFile_Retire(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-retire")
+	defer os.RemoveAll(dir)
+	DataFile, err := OpenDataFile(fio.OSFS{}, dir, 0, fio.StandardFIO)
+	assert.Nil(t, err)
+
+	err = DataFile.Write([]byte("aaa"))
+	assert.Nil(t, err)
+
+	//读者持有引用时下线，文件不会被关闭
+	assert.True(t, DataFile.Acquire())
+	err = DataFile.Retire()
+	assert.Nil(t, err)
+	buf := make([]byte, 3)
+	_, err = DataFile.IoManger.Read(buf, DataFile.RecordStart())
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("aaa"), buf)
+
+	//下线后不能再获取引用
+	assert.False(t, DataFile.Acquire())
+
+	//最后一个读者释放后关闭
+	err = DataFile.Release()
+	assert.Nil(t, err)
+	_, err = DataFile.IoManger.Read(buf, DataFile.RecordStart())
+	assert.NotNil(t, err)
+
+	//重复下线没有影响
+	err = DataFile.Retire()
+	assert.Nil(t, err)
+}
@@ -0,0 +1,227 @@
+package data
+
+import (
+	"bitcask-go/fio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"time"
+)
+
+// 文件类型，写在文件头中
+type FileType byte
+
+const (
+	FileTypeData FileType = iota + 1
+	FileTypeHint
+	FileTypeMergeFinished
+	FileTypeSeqNo
+	FileTypeBloomFilter
+	FileTypeBackupManifest
+	FileTypeArchiveFinished
+	FileTypeManifest
+)
+
+// 当前的文件格式版本，旧版本没有文件头的文件看作版本0
+const FileFormatVersion byte = 1
+
+// flags中低4位是日志记录的校验算法
+const fileHeaderChecksumMask byte = 0x0f
+
+// magic version type flags reserved createdAt reserved crc
+// 4       1      1     1      1        8        4      4
+const FileHeaderSize = 24
+
+var fileHeaderMagic = []byte("BCSK")
+
+// 文件头，记录文件格式和创建信息，日志记录从文件头之后开始
+type FileHeader struct {
+	Version   byte
+	Type      FileType
+	Flags     byte
+	CreatedAt int64 //创建时间，UnixNano
+}
+
+// 对文件头进行编码
+func EncodeFileHeader(header *FileHeader) []byte {
+	buf := make([]byte, FileHeaderSize)
+	copy(buf[:4], fileHeaderMagic)
+	buf[4] = header.Version
+	buf[5] = byte(header.Type)
+	buf[6] = header.Flags
+	binary.BigEndian.PutUint64(buf[8:16], uint64(header.CreatedAt))
+	binary.BigEndian.PutUint32(buf[20:], crc32.ChecksumIEEE(buf[:20]))
+	return buf
+}
+
+// 对文件头进行解码，magic或者crc不对时返回false，说明是没有文件头的旧格式文件
+func DecodeFileHeader(buf []byte) (*FileHeader, bool) {
+	if len(buf) < FileHeaderSize || !bytes.Equal(buf[:4], fileHeaderMagic) {
+		return nil, false
+	}
+	if binary.BigEndian.Uint32(buf[20:24]) != crc32.ChecksumIEEE(buf[:20]) {
+		return nil, false
+	}
+	return &FileHeader{
+		Version:   buf[4],
+		Type:      FileType(buf[5]),
+		Flags:     buf[6],
+		CreatedAt: int64(binary.BigEndian.Uint64(buf[8:16])),
+	}, true
+}
+
+// 文件中日志记录使用的校验算法
+func (header *FileHeader) Checksum() ChecksumType {
+	return ChecksumType(header.Flags & fileHeaderChecksumMask)
+}
+
+// 新建的文件
+func newFileHeader(fileType FileType, checksum ChecksumType) *FileHeader {
+	return &FileHeader{
+		Version:   FileFormatVersion,
+		Type:      fileType,
+		Flags:     byte(checksum) & fileHeaderChecksumMask,
+		CreatedAt: time.Now().UnixNano(),
+	}
+}
+
+// 读取文件头，空文件先写入文件头，已经有内容但是没有文件头的是旧格式文件，返回nil
+// 文件头写了一半就崩溃的文件里不会有记录，清空重新写
+func loadFileHeader(fs fio.FS, fileName string, fileType FileType, checksum ChecksumType) (*FileHeader, error) {
+	info, err := fs.Stat(fileName)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var size int64
+	if err == nil {
+		size = info.Size()
+	}
+	if size > 0 {
+		header, ok, err := readFileHeader(fs, fileName)
+		if err != nil || ok {
+			return header, err
+		}
+		partial, err := isPartialHeader(fs, fileName, size)
+		if err != nil || !partial {
+			return nil, err
+		}
+	}
+
+	header := newFileHeader(fileType, checksum)
+	file, err := fs.OpenFile(fileName, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, fio.DatafilePerm)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Write(EncodeFileHeader(header)); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return header, file.Close()
+}
+
+// 和loadFileHeader相同，但是不写入文件
+// 空文件和文件头写了一半的文件里没有记录，用内存中的文件头代替，读取时直接返回EOF
+func peekFileHeader(fs fio.FS, fileName string, fileType FileType) (*FileHeader, error) {
+	info, err := fs.Stat(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if size := info.Size(); size > 0 {
+		header, ok, err := readFileHeader(fs, fileName)
+		if err != nil || ok {
+			return header, err
+		}
+		partial, err := isPartialHeader(fs, fileName, size)
+		if err != nil || !partial {
+			return nil, err
+		}
+	}
+	return newFileHeader(fileType, DefaultChecksum), nil
+}
+
+// 读取文件开头的文件头
+func readFileHeader(fs fio.FS, fileName string) (*FileHeader, bool, error) {
+	buf, err := readFilePrefix(fs, fileName, FileHeaderSize)
+	if err != nil {
+		return nil, false, err
+	}
+	header, ok := DecodeFileHeader(buf)
+	return header, ok, nil
+}
+
+// 文件比文件头短，并且开头和magic相同
+func isPartialHeader(fs fio.FS, fileName string, size int64) (bool, error) {
+	if size >= FileHeaderSize {
+		return false, nil
+	}
+	prefix, err := readFilePrefix(fs, fileName, size)
+	if err != nil {
+		return false, err
+	}
+	n := len(prefix)
+	if n > len(fileHeaderMagic) {
+		n = len(fileHeaderMagic)
+	}
+	return bytes.Equal(prefix[:n], fileHeaderMagic[:n]), nil
+}
+
+// 读取文件开头最多n个字节
+func readFilePrefix(fs fio.FS, fileName string, n int64) ([]byte, error) {
+	file, err := fs.OpenFile(fileName, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	buf := make([]byte, n)
+	read, err := io.ReadFull(file, buf)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	return buf[:read], nil
+}
+
+// 判断文件是否为没有文件头的旧格式
+func IsLegacyFile(fs fio.FS, fileName string) (bool, error) {
+	info, err := fs.Stat(fileName)
+	if err != nil {
+		return false, err
+	}
+	if info.Size() == 0 {
+		return false, nil
+	}
+	_, ok, err := readFileHeader(fs, fileName)
+	if err != nil || ok {
+		return false, err
+	}
+	partial, err := isPartialHeader(fs, fileName, info.Size())
+	return !partial, err
+}
+
+// 把旧格式的文件升级成dest，在原来的内容前面加上文件头，记录的位置整体后移FileHeaderSize
+// 记录原样复制，仍然使用旧格式的IEEE校验
+func UpgradeFile(fs fio.FS, src, dest string, fileType FileType) error {
+	srcFile, err := fs.OpenFile(src, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+	destFile, err := fs.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, fio.DatafilePerm)
+	if err != nil {
+		return err
+	}
+	defer destFile.Close()
+
+	if _, err := destFile.Write(EncodeFileHeader(newFileHeader(fileType, ChecksumIEEE))); err != nil {
+		return err
+	}
+	if _, err := io.Copy(destFile, srcFile); err != nil {
+		return err
+	}
+	return destFile.Sync()
+}
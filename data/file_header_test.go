@@ -0,0 +1,82 @@
+package data
+
+import (
+	"bitcask-go/fio"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncodeFileHeader(t *testing.T) {
+	header := &FileHeader{Version: FileFormatVersion, Type: FileTypeHint, Flags: 1, CreatedAt: 123456}
+	buf := EncodeFileHeader(header)
+	assert.Equal(t, FileHeaderSize, len(buf))
+
+	decoded, ok := DecodeFileHeader(buf)
+	assert.True(t, ok)
+	assert.Equal(t, header, decoded)
+
+	//crc不对
+	buf[10] ^= 0xff
+	_, ok = DecodeFileHeader(buf)
+	assert.False(t, ok)
+	//长度不够
+	_, ok = DecodeFileHeader(buf[:FileHeaderSize-1])
+	assert.False(t, ok)
+}
+
+func TestDataFile_Header(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-header")
+	defer os.RemoveAll(dir)
+
+	//新文件写入文件头，记录从文件头之后开始
+	dataFile, err := OpenDataFile(fio.OSFS{}, dir, 0, fio.StandardFIO)
+	assert.Nil(t, err)
+	assert.NotNil(t, dataFile.Header)
+	assert.Equal(t, FileTypeData, dataFile.Header.Type)
+	assert.Equal(t, int64(FileHeaderSize), dataFile.Offset)
+	assert.Equal(t, DefaultChecksum, dataFile.Checksum())
+	buf, size := dataFile.EncodeLogRecord(&LogRecord{Key: []byte("name"), Value: []byte("bitcask")})
+	assert.Nil(t, dataFile.Write(buf))
+	record, readSize, err := dataFile.ReadLogRecord(dataFile.RecordStart())
+	assert.Nil(t, err)
+	assert.Equal(t, size, readSize)
+	assert.Equal(t, []byte("bitcask"), record.Value)
+	assert.Nil(t, dataFile.Close())
+
+	dataFile, err = OpenDataFile(fio.OSFS{}, dir, 0, fio.StandardFIO)
+	assert.Nil(t, err)
+	assert.NotNil(t, dataFile.Header)
+	assert.Nil(t, dataFile.Close())
+
+	//没有文件头的旧格式文件从0开始读，使用IEEE校验
+	buf, _ = EncodeLogRecord(&LogRecord{Key: []byte("name"), Value: []byte("bitcask")})
+	assert.Nil(t, os.WriteFile(GetDataFileName(dir, 1), buf, fio.DatafilePerm))
+	legacy, err := IsLegacyFile(fio.OSFS{}, GetDataFileName(dir, 1))
+	assert.Nil(t, err)
+	assert.True(t, legacy)
+	dataFile, err = OpenDataFile(fio.OSFS{}, dir, 1, fio.StandardFIO)
+	assert.Nil(t, err)
+	assert.Nil(t, dataFile.Header)
+	assert.Equal(t, int64(0), dataFile.RecordStart())
+	assert.Equal(t, ChecksumIEEE, dataFile.Checksum())
+	record, _, err = dataFile.ReadLogRecord(0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("name"), record.Key)
+	assert.Nil(t, dataFile.Close())
+
+	//写了一半的文件头重新写
+	assert.Nil(t, os.WriteFile(GetDataFileName(dir, 2), EncodeFileHeader(newFileHeader(FileTypeData, DefaultChecksum))[:10], fio.DatafilePerm))
+	dataFile, err = OpenDataFile(fio.OSFS{}, dir, 2, fio.StandardFIO)
+	assert.Nil(t, err)
+	assert.NotNil(t, dataFile.Header)
+	assert.Nil(t, dataFile.Close())
+
+	//更新版本的文件不能打开
+	header := newFileHeader(FileTypeData, DefaultChecksum)
+	header.Version = FileFormatVersion + 1
+	assert.Nil(t, os.WriteFile(GetDataFileName(dir, 3), EncodeFileHeader(header), fio.DatafilePerm))
+	_, err = OpenDataFile(fio.OSFS{}, dir, 3, fio.StandardFIO)
+	assert.Equal(t, ErrUnsupportedFileVersion, err)
+}
@@ -16,15 +16,48 @@ const (
 	LogRecordTxnFinished
 )
 
+// type的最高位表示header中带有写入时间戳，没有时间戳的旧记录仍然可以读取
+const logRecordTimestampFlag byte = 0x80
+
 // crc type  keysize(变长) valueSize(变长)
 // 4 + 1 + 5 + 5
 const maxLogRecordHeaderSize = binary.MaxVarintLen32*2 + 5
 
+// 带时间戳的header timestamp(变长) 10
+const maxTimestampHeaderSize = maxLogRecordHeaderSize + binary.MaxVarintLen64
+
+// 日志记录使用的校验算法，记录在文件头的flags中
+type ChecksumType byte
+
+const (
+	//旧格式的文件和没有指定算法的文件使用IEEE
+	ChecksumIEEE ChecksumType = iota
+	//Castagnoli，现代CPU上有硬件指令加速
+	ChecksumCRC32C
+)
+
+// 新建文件默认使用的校验算法
+const DefaultChecksum = ChecksumCRC32C
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// 校验算法对应的crc表，不认识的算法返回nil
+func (checksum ChecksumType) table() *crc32.Table {
+	switch checksum {
+	case ChecksumIEEE:
+		return crc32.IEEETable
+	case ChecksumCRC32C:
+		return castagnoliTable
+	}
+	return nil
+}
+
 // 写入到数据文件的日志记录
 type LogRecord struct {
-	Key   []byte
-	Value []byte
-	Type  LogRecordType
+	Key       []byte
+	Value     []byte
+	Type      LogRecordType
+	Timestamp int64 //写入时间，UnixNano，为0表示不记录
 }
 
 // 索引的数据结构，主要描述数据在磁盘的位置
@@ -40,6 +73,7 @@ type LogRecordHeader struct {
 	recordType LogRecordType //操作类型
 	keySize    uint32        //key长度
 	valueSize  uint32        //value长度
+	timestamp  int64         //写入时间
 }
 
 // 暂存事务的日志结构
@@ -48,19 +82,31 @@ type TransactionReocrd struct {
 	Pos    *LogRecordPos
 }
 
-// 对LogRecord进行编码，返回字节数组以及长度
-// crc recordType keysize valuesize  key value
-// 4         1     5         5
+// 对LogRecord进行编码，返回字节数组以及长度，使用IEEE校验
+// 写入DataFile时使用DataFile.EncodeLogRecord，按文件记录的算法计算校验
 func EncodeLogRecord(log *LogRecord) ([]byte, int64) {
+	return EncodeLogRecordWithChecksum(log, ChecksumIEEE)
+}
+
+// 使用指定的校验算法对LogRecord进行编码
+// crc recordType keysize valuesize [timestamp] key value
+// 4         1     5         5        10
+func EncodeLogRecordWithChecksum(log *LogRecord, checksum ChecksumType) ([]byte, int64) {
 	//初始化header
-	header := make([]byte, maxLogRecordHeaderSize)
+	header := make([]byte, maxTimestampHeaderSize)
 
 	//recordType <= log.type
 	header[4] = byte(log.Type)
+	if log.Timestamp != 0 {
+		header[4] |= logRecordTimestampFlag
+	}
 	var index = 5
 	//這裏存儲key，value的長度信息
 	index += binary.PutVarint(header[index:], int64(len(log.Key)))
 	index += binary.PutVarint(header[index:], int64(len(log.Value)))
+	if log.Timestamp != 0 {
+		index += binary.PutVarint(header[index:], log.Timestamp)
+	}
 	//此時size為實際log大小
 	var size = index + len(log.Key) + len(log.Value)
 
@@ -72,7 +118,7 @@ func EncodeLogRecord(log *LogRecord) ([]byte, int64) {
 	copy(encBytes[index+len(log.Key):], log.Value)
 
 	//除了前面四個字節，其餘用於crc
-	crc := crc32.ChecksumIEEE(encBytes[4:])
+	crc := crc32.Checksum(encBytes[4:], checksum.table())
 
 	//這裏要百度一下
 	binary.LittleEndian.PutUint32(encBytes[:4], crc)
@@ -115,7 +161,7 @@ func decodeLogRecordHeader(buf []byte) (*LogRecordHeader, int64) {
 	}
 	header := &LogRecordHeader{
 		crc:        binary.LittleEndian.Uint32(buf[:4]),
-		recordType: LogRecordType(buf[4]),
+		recordType: LogRecordType(buf[4] &^ logRecordTimestampFlag),
 	}
 
 	var index = 5
@@ -128,18 +174,24 @@ func decodeLogRecordHeader(buf []byte) (*LogRecordHeader, int64) {
 	header.valueSize = uint32(valueSize)
 	index += n
 
+	if buf[4]&logRecordTimestampFlag != 0 {
+		timestamp, n := binary.Varint(buf[index:])
+		header.timestamp = timestamp
+		index += n
+	}
+
 	return header, int64(index)
 }
 
 // 通过Header和LogRecord制作CRC
-func getLogRecordCRC(lr *LogRecord, header []byte) uint32 {
+func getLogRecordCRC(lr *LogRecord, header []byte, table *crc32.Table) uint32 {
 	if lr == nil {
 		return 0
 	}
 
-	crc := crc32.ChecksumIEEE(header[:])
-	crc = crc32.Update(crc, crc32.IEEETable, lr.Key)
-	crc = crc32.Update(crc, crc32.IEEETable, lr.Value)
+	crc := crc32.Checksum(header[:], table)
+	crc = crc32.Update(crc, table, lr.Key)
+	crc = crc32.Update(crc, table, lr.Value)
 
 	return crc
 }
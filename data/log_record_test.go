@@ -101,7 +101,7 @@ func TestGetLogRecordCRC(t *testing.T) {
 	}
 	res1, _ := EncodeLogRecord(log)
 	log1, n := decodeLogRecordHeader(res1[:maxLogRecordHeaderSize])
-	crc1 := getLogRecordCRC(log, res1[crc32.Size:n])
+	crc1 := getLogRecordCRC(log, res1[crc32.Size:n], crc32.IEEETable)
 	assert.Equal(t, log1.crc, crc1)
 
 	log = &LogRecord{
@@ -110,7 +110,7 @@ func TestGetLogRecordCRC(t *testing.T) {
 	}
 	res2, _ := EncodeLogRecord(log)
 	log2, n2 := decodeLogRecordHeader(res2[:11])
-	crc2 := getLogRecordCRC(log, res2[crc32.Size:n2])
+	crc2 := getLogRecordCRC(log, res2[crc32.Size:n2], crc32.IEEETable)
 	assert.Equal(t, log2.crc, crc2)
 
 	log = &LogRecord{
@@ -131,7 +131,30 @@ func TestGetLogRecordCRC(t *testing.T) {
 	assert.Equal(t, uint32(290887979), log3.crc)
 	assert.Equal(t, uint32(4), log3.keySize)
 	assert.Equal(t, uint32(10), log3.valueSize)
-	crc3 := getLogRecordCRC(log, res3[crc32.Size:n3])
+	crc3 := getLogRecordCRC(log, res3[crc32.Size:n3], crc32.IEEETable)
 	assert.Equal(t, log3.crc, crc3)
 
 }
+
+func TestLogRecordTimestamp(t *testing.T) {
+	log := &LogRecord{
+		Key:       []byte("name"),
+		Value:     []byte("bitcask-go"),
+		Type:      LogRecordDelete,
+		Timestamp: 1700000000123456789,
+	}
+	res, size := EncodeLogRecord(log)
+	header, n := decodeLogRecordHeader(res)
+	assert.Equal(t, LogRecordDelete, header.recordType)
+	assert.Equal(t, log.Timestamp, header.timestamp)
+	assert.Equal(t, size, n+int64(len(log.Key)+len(log.Value)))
+	assert.Equal(t, header.crc, getLogRecordCRC(log, res[crc32.Size:n], crc32.IEEETable))
+
+	//没有时间戳的记录编码不变
+	log.Timestamp = 0
+	legacy, _ := EncodeLogRecord(log)
+	header, n = decodeLogRecordHeader(legacy)
+	assert.Equal(t, int64(7), n)
+	assert.Equal(t, int64(0), header.timestamp)
+	assert.Equal(t, LogRecordDelete, header.recordType)
+}
@@ -11,13 +11,10 @@ import (
 	"io"
 	"os"
 	"path/filepath"
-	"sort"
 	"strconv"
-	"strings"
 	"sync"
 	"sync/atomic"
-
-	"github.com/gofrs/flock"
+	"time"
 )
 
 const (
@@ -34,34 +31,60 @@ type DB struct {
 	index           index.Indexer             //内存索引
 	activeFile      *data.DataFile            //当前活跃文件，用于写入
 	oldFiles        map[uint32]*data.DataFile //旧数据文件，只用于读
+	sealedFiles     atomic.Value              //旧数据文件的只读快照，读取时不需要持有db锁
 	seqNo           uint64                    //事务执行的序列号
+	commitSeqNo     uint64                    //提交写入的序列号，持有db锁递增，上限记录在MANIFEST中，重新打开后继续递增，用于订阅事件
 	isMerging       bool                      //是否在merge
 	seqNoFileExists bool                      //seqNoFile是否存在
 	isInitial       bool                      //第一次初始化
-	filelock        *flock.Flock              //文件锁保证多进程之间互斥
+	filelock        fio.Locker                //文件锁保证多进程之间互斥
+	fs              fio.FS                    //数据文件所在的文件系统
 	bytesWrite      uint                      //记录写了多少字节，用于WritePerSync
 	reclaimSize     int64                     //表示有多少数据无效
+	keyLocks        *keyLocks                 //按key分段的写锁，不同分段的索引更新可以并行
+	checkpointIndex index.CheckpointIndexer   //记录检查点的持久化索引，为nil表示内存索引
+	mergeInstalled  bool                      //本次打开时是否安装了merge的结果
+	bloom           *utils.BloomFilter        //布隆过滤器，为nil表示没有开启
+	nsLock          *sync.RWMutex             //保护命名空间版本，删除命名空间时独占
+	namespaces      map[string]uint64         //命名空间当前的版本
+	watchHub        *watchHub                 //变更订阅
+	logStartFid     uint32                    //没有被merge重写过的最小文件id，日志从这里开始是完整的
+	follower        int32                     //是否是复制的从库，从库拒绝本地写入
+	manifest        *data.DataFile            //MANIFEST文件，记录数据文件集合的修改
+	manifestState   *manifestState            //MANIFEST回放得到的数据文件集合
 }
 
 // 打开bitcask数据库引擎
 func Open(options Options) (*DB, error) {
-	var isInitial = false
 	//对用户传入的配置项进行校验
 	if err := checkOptions(options); err != nil {
 		return nil, err
 	}
+	fs := options.FS
+	if fs == nil {
+		fs = fio.OSFS{}
+		if options.InMemory {
+			fs = fio.NewMemFS()
+		}
+	}
+	options.FS = fs
+	return open(options, fs)
+}
 
+// 在fs中打开数据库
+func open(options Options, fs fio.FS) (*DB, error) {
+	var isInitial = false
 	//判断数据库目录是存在，如果不存在的话，就创建目录
-	if _, err := os.Stat(options.DirPath); os.IsNotExist(err) {
+	if _, err := fs.Stat(options.DirPath); os.IsNotExist(err) {
 		isInitial = true
 		//创建目录
-		if err := os.MkdirAll(options.DirPath, os.ModePerm); err != nil {
+		if err := fio.MkdirAllSync(fs, options.DirPath, os.ModePerm); err != nil {
 			return nil, err
 		}
 	}
 
 	//判断当前数据目录路径是否在使用
-	filelock := flock.New(filepath.Join(options.DirPath, fileLockName))
+	filelock := fs.NewLocker(filepath.Join(options.DirPath, fileLockName))
 	hold, err := filelock.TryLock()
 	if err != nil {
 		return nil, err
@@ -69,68 +92,118 @@ func Open(options Options) (*DB, error) {
 	if !hold {
 		return nil, ErrDatabaseIsUsing
 	}
+	if options.ColdDirPath != "" {
+		if err := fio.MkdirAllSync(fs, options.ColdDirPath, os.ModePerm); err != nil {
+			return nil, err
+		}
+	}
 
-	entries, err := os.ReadDir(options.DirPath)
+	entries, err := fs.ReadDir(options.DirPath)
 	if err != nil {
 		return nil, err
 	}
-	if len(entries) == 0 {
-		isInitial = true
+	//文件锁是上面刚创建的，MANIFEST在没有写入数据时也会创建，都不算在内
+	isInitial = true
+	for _, entry := range entries {
+		if entry.Name() != fileLockName && entry.Name() != data.ManifestFileName {
+			isInitial = false
+		}
 	}
 
 	db := &DB{
-		mu:        new(sync.RWMutex),
-		options:   options,
-		oldFiles:  make(map[uint32]*data.DataFile),
-		index:     index.NewIndexer(options.IndexType, options.DirPath, options.SyncWrites),
-		isInitial: isInitial,
-		filelock:  filelock,
+		mu:         new(sync.RWMutex),
+		options:    options,
+		oldFiles:   make(map[uint32]*data.DataFile),
+		index:      newIndexer(options),
+		isInitial:  isInitial,
+		filelock:   filelock,
+		fs:         fs,
+		keyLocks:   newKeyLocks(keyLockNum),
+		nsLock:     new(sync.RWMutex),
+		namespaces: make(map[string]uint64),
+		watchHub:   newWatchHub(),
+	}
+	if cpIndex, ok := db.index.(index.CheckpointIndexer); ok {
+		db.checkpointIndex = cpIndex
+	}
+
+	//从MANIFEST加载数据文件集合
+	if err := db.loadManifest(); err != nil {
+		return nil, err
 	}
+	//崩溃时记录的是预留的上限，从上限继续分配不会和之前的序列号重复
+	db.commitSeqNo = db.manifestState.commitSeqNo
 
 	//加载merge数据目录
 	if err := db.loadMergeFile(); err != nil {
 		return nil, err
 	}
 
+	//清理不在MANIFEST中的文件
+	if err := db.collectGarbageFiles(); err != nil {
+		return nil, err
+	}
+
+	//清理超过保留时间的旧数据文件
+	if err := db.pruneArchive(); err != nil {
+		return nil, err
+	}
+
 	//加载数据文件
 	if err := db.loadDataFiles(); err != nil {
 		return nil, err
 	}
 
-	//从hint索引中加载索引
-	if err := db.loadIndexFromHintFile(); err != nil {
+	//merge之后比这个id小的文件都是merge重写过的
+	db.logStartFid = db.manifestState.logStart
+	//merge重写的记录不带事务序列号，从封存时间点恢复，保证序列号不会倒退
+	if err := db.loadMergeCutSeqNo(); err != nil {
 		return nil, err
 	}
 
-	//B+Tree持久化到磁盘了，不需要读文件加载索引
-	if options.IndexType != BPTree {
+	if db.checkpointIndex != nil {
+		//B+Tree持久化到磁盘了，只需要从检查点回放数据文件
+		if err := db.loadIndexFromCheckpoint(); err != nil {
+			return nil, err
+		}
+	} else {
+		//从hint索引中加载索引
+		if err := db.loadIndexFromHintFile(); err != nil {
+			return nil, err
+		}
+
 		//数据文件加载内存索引
 		if err := db.loadIndexFromDatafile(); err != nil {
 			return nil, err
 		}
 	}
 
-	if options.IndexType == BPTree {
-		if err := db.loadSeqNo(); err != nil {
-			return nil, err
-		}
-		if db.activeFile != nil {
-			size, err := db.activeFile.IoManger.Size()
-			if err != nil {
-				return nil, err
-			}
-			db.activeFile.Offset = size
-		}
+	//加载命名空间，清理已经删除的命名空间残留的索引
+	if err := db.loadNamespaces(); err != nil {
+		return nil, err
+	}
+
+	//索引加载完成后再加载布隆过滤器
+	if err := db.loadBloomFilter(); err != nil {
+		return nil, err
 	}
 
 	//这里我认为得放外面，你如果是BPTree打开的，你放在loadIndexFromDatafile里面，导致你使用BPTree做索引开库，你就不会执行重置io
 	//写入必出panic。
 	//如果使用了mmap就要重置io.manager(因为现在引入的mmap无法读写)
-	if db.options.MmapAtStartup {
+	if db.options.MmapAtStartup && (db.activeIoType() == StandardIO || db.sealedIoType() == StandardIO) {
 		if err := db.reseIoType(); err != nil {
 			return nil, err
 		}
 	}
+
+	//活跃文件末尾可能有崩溃时没写完的记录，或者mmap预先扩展的空间，截断到回放结束的位置
+	if err := db.truncateActiveFile(); err != nil {
+		return nil, err
+	}
+	if err := db.preallocateActiveFile(); err != nil {
+		return nil, err
+	}
 	return db, nil
 }
 
@@ -139,6 +212,20 @@ func (db *DB) Put(key, value []byte) error {
 	if len(key) == 0 {
 		return ErrKeyIsEmpty
 	}
+	if isReservedKey(key) {
+		return ErrKeyIsReserved
+	}
+	return db.put(key, value)
+}
+
+// 写入数据，不检查保留前缀，命名空间通过这里写入
+func (db *DB) put(key, value []byte) error {
+	if db.isFollower() {
+		return ErrFollowerReadOnly
+	}
+	if err := db.indexFlushErr(); err != nil {
+		return err
+	}
 
 	//构造LogRecord
 	log := &data.LogRecord{
@@ -147,44 +234,88 @@ func (db *DB) Put(key, value []byte) error {
 		Type:  data.LogRecordNormal,
 	}
 
-	//追加写入当前活跃数据文件中
-	pos, err := db.appendLogRecordWithLock(log)
+	//锁住key所在分段，保证同一个key的追加顺序和索引更新顺序一致
+	unlock := db.keyLocks.lock(key)
+	defer unlock()
+
+	//先加入布隆过滤器再更新索引，保证索引里的key都能通过过滤器
+	if db.bloom != nil {
+		db.bloom.Add(key)
+	}
+
+	//追加写入当前活跃数据文件中，结束后更新内存中的索引
+	var oldPos *data.LogRecordPos
+	_, commitSeqNo, err := db.appendAndUpdateIndex(log, func(pos *data.LogRecordPos) {
+		oldPos = db.index.Put(key, pos)
+	})
 	if err != nil {
 		return err
 	}
-
-	//结束后更新内存中的索引
-	if pos := db.index.Put(key, pos); pos != nil {
+	if oldPos != nil {
 		// db.reclaimSize += int64(pos.Size)
-		atomic.AddInt64(&db.reclaimSize, int64(pos.Size))
+		atomic.AddInt64(&db.reclaimSize, int64(oldPos.Size))
 	}
+	//通知订阅者，仍然持有key的锁保证同一个key的事件有序
+	db.watchHub.publish(commitSeqNo, []*data.LogRecord{{Key: key, Value: value, Type: data.LogRecordNormal}})
 	return nil
 }
 
 // 通过Key获取value数据，key不能为空
 func (db *DB) Get(key []byte) ([]byte, error) {
-	db.mu.RLock()
-	defer db.mu.RUnlock()
 	if len(key) == 0 {
 		return nil, ErrKeyIsEmpty
 	}
+	if isReservedKey(key) {
+		return nil, ErrKeyIsReserved
+	}
+	return db.get(key)
+}
+
+// 读取数据，不检查保留前缀
+func (db *DB) get(key []byte) ([]byte, error) {
+	//布隆过滤器判断一定不存在，不需要再查索引
+	if db.keyDefinitelyAbsent(key) {
+		return nil, ErrKeyNotFound
+	}
 
-	//从index读取索引信息
+	//从index读取索引信息，索引自身是并发安全的，不需要持有db锁
 	pos := db.index.Get(key)
 	//这里处理key不存在
 	if pos == nil {
 		return nil, ErrKeyNotFound
 	}
 
-	//从数据文件中取出value
-	return db.getValueByPosition(pos)
+	//从数据文件中取出value，旧数据文件的读取不需要持有db锁
+	return db.readValue(pos)
 }
 
-// 写入Key/Value数据，key不能为空
+// 删除Key数据，key不能为空
 func (db *DB) Delete(key []byte) error {
 	if len(key) == 0 {
 		return ErrKeyIsEmpty
 	}
+	if isReservedKey(key) {
+		return ErrKeyIsReserved
+	}
+	return db.delete(key)
+}
+
+// 删除数据，不检查保留前缀
+func (db *DB) delete(key []byte) error {
+	if db.isFollower() {
+		return ErrFollowerReadOnly
+	}
+	if err := db.indexFlushErr(); err != nil {
+		return err
+	}
+
+	//布隆过滤器判断一定不存在，和key不存在的处理一致
+	if db.keyDefinitelyAbsent(key) {
+		return nil
+	}
+
+	unlock := db.keyLocks.lock(key)
+	defer unlock()
 
 	//如果你读取的key不存在或已经删除，就没必要再追加写入当前活跃数据文件中
 	if pos := db.index.Get(key); pos == nil {
@@ -197,15 +328,17 @@ func (db *DB) Delete(key []byte) error {
 		Type: data.LogRecordDelete,
 	}
 
-	//追加写入当前活跃数据文件中
-	pos, err := db.appendLogRecordWithLock(log)
+	//追加写入当前活跃数据文件中，结束后更新内存中的索引
+	var oldPos *data.LogRecordPos
+	var ok bool
+	pos, commitSeqNo, err := db.appendAndUpdateIndex(log, func(pos *data.LogRecordPos) {
+		oldPos, ok = db.index.Delete(key)
+	})
 	if err != nil {
 		return err
 	}
 	// db.reclaimSize += int64(pos.Size)
 	atomic.AddInt64(&db.reclaimSize, int64(pos.Size))
-	//结束后更新内存中的索引
-	oldPos, ok := db.index.Delete(key)
 	if !ok {
 		return ErrIndexUpdateFail
 	}
@@ -213,18 +346,24 @@ func (db *DB) Delete(key []byte) error {
 		// db.reclaimSize += int64(oldPos.Size)
 		atomic.AddInt64(&db.reclaimSize, int64(oldPos.Size))
 	}
+	db.watchHub.publish(commitSeqNo, []*data.LogRecord{{Key: key, Type: data.LogRecordDelete}})
 	return nil
 }
 
-// 从数据库中获取所有的key
+// 从数据库中获取所有的key，索引读取失败时返回nil，错误由之后的写入返回
 func (db *DB) ListKeys() [][]byte {
 	it := db.index.Iterator(false)
 	defer it.Close()
-	keys := make([][]byte, db.index.Size())
-	idx := 0
+	keys := make([][]byte, 0, db.index.Size())
 	for it.Rewind(); it.Valid(); it.Next() {
-		keys[idx] = it.Key()
-		idx++
+		//命名空间的key不对外暴露
+		if isReservedKey(it.Key()) {
+			continue
+		}
+		keys = append(keys, it.Key())
+	}
+	if db.indexFlushErr() != nil {
+		return nil
 	}
 	return keys
 }
@@ -235,7 +374,14 @@ func (db *DB) Fold(fun func(key []byte, value []byte) bool) error {
 	defer db.mu.Unlock()
 
 	it := db.index.Iterator(false)
+	if err := db.indexFlushErr(); err != nil {
+		it.Close()
+		return err
+	}
 	for it.Rewind(); it.Valid(); it.Next() {
+		if isReservedKey(it.Key()) {
+			continue
+		}
 		//取出value
 		value, err := db.getValueByPosition(it.Value())
 		if err != nil {
@@ -259,11 +405,28 @@ func (db *DB) Close() error {
 		}
 	}()
 
+	//关闭所有订阅
+	db.watchHub.close()
+
 	//关闭index BPTree索引
 	if err := db.index.Close(); err != nil {
 		return err
 	}
 
+	//记录实际分配到的提交序列号，下次打开时连续递增
+	db.mu.Lock()
+	var err error
+	if db.commitSeqNo != db.manifestState.commitSeqNo {
+		err = db.appendManifestEdit(&manifestEdit{commitSeqNo: db.commitSeqNo})
+	}
+	db.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := db.manifest.Close(); err != nil {
+		return err
+	}
+
 	if db.activeFile == nil {
 		return nil
 	}
@@ -274,8 +437,13 @@ func (db *DB) Close() error {
 		return err
 	}
 
+	//保存布隆过滤器，下次打开可以直接使用
+	if err := db.saveBloomFilter(); err != nil {
+		return err
+	}
+
 	//保存当前序列号
-	seqNOFile, err := data.OpenSeqNoFile(db.options.DirPath)
+	seqNOFile, err := data.OpenSeqNoFile(db.fs, db.options.DirPath)
 
 	if err != nil {
 		return err
@@ -285,7 +453,7 @@ func (db *DB) Close() error {
 		Key:   []byte(seqNoKey),
 		Value: []byte(strconv.FormatUint(db.seqNo, 10)),
 	}
-	buf, _ := data.EncodeLogRecord(record)
+	buf, _ := seqNOFile.EncodeLogRecord(record)
 	if err := seqNOFile.Write(buf); err != nil {
 		return err
 	}
@@ -296,12 +464,12 @@ func (db *DB) Close() error {
 		return err
 	}
 
-	//逐一关闭数据库文件
-	if err := db.activeFile.Close(); err != nil {
+	//逐一下线数据库文件，正在读取的读者结束后才会真正关闭
+	if err := db.activeFile.Retire(); err != nil {
 		return err
 	}
 	for _, file := range db.oldFiles {
-		err := file.Close()
+		err := file.Retire()
 		if err != nil {
 			return err
 		}
@@ -320,7 +488,7 @@ func (db *DB) Sync() error {
 	return db.activeFile.Sync()
 }
 
-// 返回数据库相关信息
+// 返回数据库相关信息，索引读取失败时KeyNum为0，错误由之后的写入返回
 func (db *DB) Stat() *Stat {
 	db.mu.Lock()
 	defer db.mu.Unlock()
@@ -328,23 +496,31 @@ func (db *DB) Stat() *Stat {
 	if db.activeFile != nil {
 		dataFileNum += 1
 	}
-	diskSize, _ := DirSize(db.options.DirPath)
+	diskSize, _ := fio.DirSize(db.fs, db.options.DirPath)
+	var coldDiskSize int64
+	if db.options.ColdDirPath != "" {
+		coldDiskSize, _ = fio.DirSize(db.fs, db.options.ColdDirPath)
+	}
+	keyNum := uint(db.index.Size())
+	if db.indexFlushErr() != nil {
+		keyNum = 0
+	}
 	return &Stat{
-		KeyNum:          uint(db.index.Size()),
+		KeyNum:          keyNum,
 		DataFileNum:     dataFileNum,
 		ReclaimableSize: db.reclaimSize,
-		DiskSize:        diskSize,
+		DiskSize:        diskSize + coldDiskSize,
+		ColdDiskSize:    coldDiskSize,
 	}
 }
 
 // 备份数据库
 func (db *DB) Backup(dir string) error {
-	db.mu.RLock()
-	defer db.mu.RUnlock()
-	return utils.CopyDir(db.options.DirPath, dir, []string{fileLockName})
+	//旧数据文件不会再修改，直接硬链接，不需要长时间持有锁复制所有数据
+	return db.Checkpoint(dir)
 }
 
-// 根据索引从数据获取对应value
+// 根据索引从数据获取对应value，调用方必须持有db锁
 func (db *DB) getValueByPosition(pos *data.LogRecordPos) ([]byte, error) {
 	var dataFile *data.DataFile
 	//根据fid找到对应数据文件
@@ -358,7 +534,52 @@ func (db *DB) getValueByPosition(pos *data.LogRecordPos) ([]byte, error) {
 	if dataFile == nil {
 		return nil, ErrNoDataFile
 	}
+	return readValueFromFile(dataFile, pos)
+}
+
+// 根据索引从数据获取对应value，不需要持有db锁
+// 通过引用计数保证读取期间数据文件不会被关闭
+func (db *DB) readValue(pos *data.LogRecordPos) ([]byte, error) {
+	dataFile := db.acquireDataFile(pos.Fid)
+	if dataFile == nil {
+		return nil, ErrNoDataFile
+	}
+	defer dataFile.Release()
+	return readValueFromFile(dataFile, pos)
+}
+
+// 获取数据文件的读引用，使用完需要Release
+func (db *DB) acquireDataFile(fid uint32) *data.DataFile {
+	//旧数据文件不可变，直接从快照中查找
+	if files, ok := db.sealedFiles.Load().(map[uint32]*data.DataFile); ok {
+		if dataFile := files[fid]; dataFile != nil && dataFile.Acquire() {
+			return dataFile
+		}
+	}
+
+	//活跃文件或者刚转为旧文件还没发布快照的，需要持有读锁查找
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.activeFile != nil && db.activeFile.FileId == fid && db.activeFile.Acquire() {
+		return db.activeFile
+	}
+	if dataFile := db.oldFiles[fid]; dataFile != nil && dataFile.Acquire() {
+		return dataFile
+	}
+	return nil
+}
+
+// 发布旧数据文件的只读快照，在修改oldFiles之后调用，必须持有db锁
+func (db *DB) publishOldFiles() {
+	files := make(map[uint32]*data.DataFile, len(db.oldFiles))
+	for fid, dataFile := range db.oldFiles {
+		files[fid] = dataFile
+	}
+	db.sealedFiles.Store(files)
+}
 
+// 从数据文件中读取value
+func readValueFromFile(dataFile *data.DataFile, pos *data.LogRecordPos) ([]byte, error) {
 	//根据偏移读取数据
 	LogRecord, _, err := dataFile.ReadLogRecord(pos.Offset)
 	if err != nil {
@@ -380,6 +601,59 @@ func (db *DB) appendLogRecordWithLock(log *data.LogRecord) (*data.LogRecordPos,
 	return db.appendLogRecord(log)
 }
 
+// 追写到活跃文件中并更新索引，同时返回这次写入的提交序列号
+// 内存索引只有追加写文件需要持有db锁，索引更新可以并行
+// 记录检查点的持久化索引必须按日志顺序更新，所以整个过程都持有db锁
+func (db *DB) appendAndUpdateIndex(log *data.LogRecord, updateIndex func(pos *data.LogRecordPos)) (*data.LogRecordPos, uint64, error) {
+	db.mu.Lock()
+	if err := db.reserveCommitSeqNo(); err != nil {
+		db.mu.Unlock()
+		return nil, 0, err
+	}
+	pos, err := db.appendLogRecord(log)
+	if err != nil {
+		db.mu.Unlock()
+		return nil, 0, err
+	}
+	commitSeqNo := db.nextCommitSeqNo()
+	if db.checkpointIndex == nil {
+		db.mu.Unlock()
+		updateIndex(pos)
+		return pos, commitSeqNo, nil
+	}
+
+	defer db.mu.Unlock()
+	updateIndex(pos)
+	db.setCheckpoint(pos)
+	return pos, commitSeqNo, nil
+}
+
+// 每次在MANIFEST中预留这么多提交序列号
+const commitSeqNoReserve = 1 << 16
+
+// 下一个提交序列号超过了MANIFEST中的上限时，先持久化新的上限，必须持有db锁
+// 这样崩溃之后重新打开，从上限开始分配的序列号一定比之前的大
+func (db *DB) reserveCommitSeqNo() error {
+	if db.commitSeqNo < db.manifestState.commitSeqNo {
+		return nil
+	}
+	return db.appendManifestEdit(&manifestEdit{commitSeqNo: db.commitSeqNo + commitSeqNoReserve})
+}
+
+// 分配下一个提交序列号，必须持有db锁，并且已经通过reserveCommitSeqNo预留
+func (db *DB) nextCommitSeqNo() uint64 {
+	db.commitSeqNo++
+	return db.commitSeqNo
+}
+
+// 记录索引已经应用到pos这条日志，必须持有db锁
+func (db *DB) setCheckpoint(pos *data.LogRecordPos) {
+	db.checkpointIndex.SetCheckpoint(&data.LogRecordPos{
+		Fid:    pos.Fid,
+		Offset: pos.Offset + int64(pos.Size),
+	}, atomic.LoadUint64(&db.seqNo))
+}
+
 // 追写到活跃数据文件中
 func (db *DB) appendLogRecord(log *data.LogRecord) (*data.LogRecordPos, error) {
 
@@ -391,8 +665,13 @@ func (db *DB) appendLogRecord(log *data.LogRecord) (*data.LogRecordPos, error) {
 		}
 	}
 
+	//持有db锁时记录写入时间，时间戳和日志顺序一致，merge重写的记录保留原来的时间
+	if log.Timestamp == 0 {
+		log.Timestamp = time.Now().UnixNano()
+	}
+
 	//编码logRecord结构体,并写入
-	encRecord, size := data.EncodeLogRecord(log)
+	encRecord, size := db.activeFile.EncodeLogRecord(log)
 	//判断是否超过活跃文件的阈值，选择关闭数据文件打开新的数据文件
 	if db.activeFile.Offset+size > db.options.DataFileSize {
 		//当前文件进行数据持久化
@@ -401,12 +680,17 @@ func (db *DB) appendLogRecord(log *data.LogRecord) (*data.LogRecordPos, error) {
 		}
 
 		//当前活跃文件转化为旧数据文件
-		db.oldFiles[db.activeFile.FileId] = db.activeFile
+		if err := db.sealActiveFile(); err != nil {
+			return nil, err
+		}
 
 		//打开新数据文件
 		if err := db.setActiveDataFile(); err != nil {
 			return nil, err
 		}
+		db.publishOldFiles()
+		//新文件的校验算法可能和旧文件不同，重新编码
+		encRecord, _ = db.activeFile.EncodeLogRecord(log)
 	}
 
 	//记录当前的偏移，用于当索引
@@ -443,66 +727,117 @@ func (db *DB) appendLogRecord(log *data.LogRecord) (*data.LogRecordPos, error) {
 func (db *DB) setActiveDataFile() error {
 	var initialFileId uint32 = 0
 
+	//先提交到MANIFEST再创建文件，崩溃后缺失的活跃文件会重新创建
+	edit := &manifestEdit{}
 	if db.activeFile != nil {
+		//封存的文件截断到实际大小，mmap预先扩展的空间不再需要
+		if err := db.activeFile.IoManger.Truncate(db.activeFile.Offset); err != nil {
+			return err
+		}
 		initialFileId = db.activeFile.FileId + 1
+		edit.sealed = append(edit.sealed, manifestSealed{fid: db.activeFile.FileId, size: db.activeFile.Offset})
+	}
+	edit.added = append(edit.added, initialFileId)
+	if err := db.appendManifestEdit(edit); err != nil {
+		return err
 	}
-	dataFile, err := data.OpenDataFile(db.options.DirPath, initialFileId, fio.StandardFIO)
+	dataFile, err := data.OpenDataFileWithChecksum(db.fs, db.options.DirPath, initialFileId, db.activeIoType(), db.options.Checksum)
 	if err != nil {
 		return err
 	}
 	db.activeFile = dataFile
+	if err := db.preallocateActiveFile(); err != nil {
+		return err
+	}
+	return db.fs.SyncDir(db.options.DirPath)
+}
+
+// 索引后台刷盘失败之后拒绝写入，返回失败的错误
+func (db *DB) indexFlushErr() error {
+	if idx, ok := db.index.(index.FlushErrIndexer); ok {
+		return idx.FlushErr()
+	}
 	return nil
 }
 
+// 根据配置初始化索引，配置了分片数则使用分片索引
+func newIndexer(options Options) index.Indexer {
+	if options.IndexShards > 1 && (options.IndexType == Btree || options.IndexType == ART) {
+		return index.NewShardedIndex(options.IndexType, options.IndexShards)
+	}
+	indexer := index.NewIndexer(options.IndexType, options.DirPath, options.SyncWrites)
+	if options.IndexType == BPTree && options.BPTreeFlushBatchSize > 0 {
+		indexer.(*index.BPlusTree).EnableAsyncFlush(options.BPTreeFlushBatchSize)
+	}
+	return indexer
+}
+
 // 校验数据库设置
 func checkOptions(options Options) error {
 	if options.DirPath == "" {
 		return errors.New("database dir path is empty")
 	}
+	if options.ColdDirPath != "" && filepath.Clean(options.ColdDirPath) == filepath.Clean(options.DirPath) {
+		return errors.New("ColdDirPath sould be different from DirPath")
+	}
 	if options.DataFileSize <= 0 {
 		return errors.New("datafile size <= 0")
 	}
 	if options.DataFileMergeRatio < 0 || options.DataFileMergeRatio > 1 {
 		return errors.New("DataFileMergeRatio sould be in 0~1")
 	}
+	if options.IndexShards < 0 {
+		return errors.New("IndexShards sould be >= 0")
+	}
+	if options.BPTreeFlushBatchSize < 0 {
+		return errors.New("BPTreeFlushBatchSize sould be >= 0")
+	}
+	//B+Tree索引依赖操作系统文件系统上的bbolt文件，不能用在内存模式或者其他文件系统上
+	if options.IndexType == BPTree {
+		if _, ok := options.FS.(fio.OSFS); options.InMemory || (options.FS != nil && !ok) {
+			return errors.New("BPTree index requires the OS file system")
+		}
+	}
+	if options.DataFileRetention < 0 {
+		return errors.New("DataFileRetention sould be >= 0")
+	}
+	if options.Checksum != ChecksumIEEE && options.Checksum != ChecksumCRC32C {
+		return errors.New("unknown Checksum type")
+	}
+	if options.IOType != StandardIO && options.IOType != MMapIO && options.IOType != BufferedIO && options.IOType != DirectIO {
+		return errors.New("unknown IOType")
+	}
 	return nil
 }
 
 // 加载数据库文件
 func (db *DB) loadDataFiles() error {
-	dirEntry, err := os.ReadDir(db.options.DirPath)
-	if err != nil {
-		return err
-	}
+	//数据文件以MANIFEST为准，从小到大依次加载
 	var fileIds []int
-	//遍历 .data结尾的文件，约定为数据文件
-	for _, entry := range dirEntry {
-		//判断为 .data结尾
-		if strings.HasSuffix(entry.Name(), data.DataFileNameSuffix) {
-			//00001.data
-			sqlitNames := strings.Split(entry.Name(), ".")
-			fileId, err := strconv.Atoi(sqlitNames[0])
-			//当前情况可能数据目录损坏
-			if err != nil {
+	for _, fid := range db.manifestState.fileIds() {
+		//封存的文件必须完整，活跃文件缺失说明创建前崩溃了，打开时会重新创建
+		if size := db.manifestState.files[fid]; size != manifestActiveSize {
+			info, err := db.fs.Stat(data.GetDataFileName(db.dataFileDir(fid), fid))
+			if err != nil || info.Size() < size {
 				return ErrDataDirectoryCorrupdated
 			}
-			fileIds = append(fileIds, fileId)
 		}
+		fileIds = append(fileIds, int(fid))
 	}
 
-	//对文件id进行排序，从小到大依次加载
-	sort.Ints(fileIds)
-
 	db.fileIds = fileIds
 
 	for i, fid := range fileIds {
-		ioType := fio.StandardFIO
-		//这里开启就使用mmap加速打开数据文件
-		if db.options.MmapAtStartup {
+		ioType := db.sealedIoType()
+		if i == len(fileIds)-1 {
+			ioType = db.activeIoType()
+		}
+		//这里开启就使用mmap加速打开数据文件，可读写的mmap不需要切换
+		if db.options.MmapAtStartup && ioType == StandardIO {
 			ioType = fio.MemroyMap
 		}
 
-		datafile, err := data.OpenDataFile(db.options.DirPath, uint32(fid), ioType)
+		datafile, err := data.OpenDataFileWithChecksum(db.fs, db.dataFileDir(uint32(fid)), uint32(fid), ioType, db.options.Checksum)
 		if err != nil {
 			return err
 		}
@@ -512,6 +847,7 @@ func (db *DB) loadDataFiles() error {
 			db.oldFiles[uint32(fid)] = datafile
 		}
 	}
+	db.publishOldFiles()
 	return nil
 }
 
@@ -521,16 +857,14 @@ func (db *DB) loadIndexFromDatafile() error {
 		return nil
 	}
 
-	//查看是否发生过merge
-	hasMerge, nonMergeFileId := false, uint32(0)
-	mergeFinFileName := filepath.Join(db.options.DirPath, data.MergeFinishedName)
-	if _, err := os.Stat(mergeFinFileName); err == nil {
-		fid, err := db.getNonMergeFileId(db.options.DirPath)
-		if err != nil {
-			return err
-		}
-		hasMerge = true
-		nonMergeFileId = fid
+	//查看是否发生过merge，merge过的文件从hint文件加载
+	return db.replayDataFiles(&data.LogRecordPos{Fid: db.logStartFid, Offset: 0})
+}
+
+// 从start位置开始回放数据文件，更新索引
+func (db *DB) replayDataFiles(start *data.LogRecordPos) error {
+	if len(db.fileIds) == 0 {
+		return nil
 	}
 
 	//更新内存索引
@@ -556,8 +890,8 @@ func (db *DB) loadIndexFromDatafile() error {
 	for i, fid := range db.fileIds {
 		var fileId = uint32(fid)
 
-		//如果小于nonmergeFileId，表示从hint文件加载
-		if hasMerge && fileId < nonMergeFileId {
+		//如果小于起始文件，表示已经加载过(hint文件或者检查点之前)
+		if fileId < start.Fid {
 			continue
 		}
 		var datafile *data.DataFile
@@ -566,7 +900,10 @@ func (db *DB) loadIndexFromDatafile() error {
 		} else {
 			datafile = db.oldFiles[fileId]
 		}
-		var Offset int64 = 0
+		Offset := datafile.RecordStart()
+		if fileId == start.Fid && start.Offset > Offset {
+			Offset = start.Offset
+		}
 		for {
 			logRecord, size, err := datafile.ReadLogRecord(Offset)
 			if err != nil {
@@ -577,7 +914,7 @@ func (db *DB) loadIndexFromDatafile() error {
 			}
 
 			//将读取到的内存索引保存
-			logRecordPos := &data.LogRecordPos{Fid: fileId, Offset: Offset}
+			logRecordPos := &data.LogRecordPos{Fid: fileId, Offset: Offset, Size: uint32(size)}
 
 			//解析取出的key seq
 			realKey, seqNo := parseLogRecordKey(logRecord.Key)
@@ -616,21 +953,99 @@ func (db *DB) loadIndexFromDatafile() error {
 		}
 	}
 	//	更新序列号
-	db.seqNo = currentSeqNo
+	if currentSeqNo > db.seqNo {
+		db.seqNo = currentSeqNo
+	}
+	return nil
+}
+
+// 检查点是否超过了数据文件的末尾，说明索引中记录了已经丢失的数据
+func (db *DB) checkpointAheadOfData(checkpoint *data.LogRecordPos) (bool, error) {
+	if checkpoint == nil {
+		return false, nil
+	}
+	if db.activeFile == nil {
+		return checkpoint.Offset > 0, nil
+	}
+	if checkpoint.Fid > db.activeFile.FileId {
+		return true, nil
+	}
+	var dataFile *data.DataFile
+	if checkpoint.Fid == db.activeFile.FileId {
+		dataFile = db.activeFile
+	} else {
+		dataFile = db.oldFiles[checkpoint.Fid]
+	}
+	if dataFile == nil {
+		return false, nil
+	}
+	size, err := dataFile.IoManger.Size()
+	if err != nil {
+		return false, err
+	}
+	return checkpoint.Offset > size, nil
+}
+
+// 持久化索引从检查点开始回放数据文件，保证索引和数据文件一致
+func (db *DB) loadIndexFromCheckpoint() error {
+	//先读取上次关闭时保存的序列号
+	if err := db.loadSeqNo(); err != nil {
+		return err
+	}
+
+	checkpoint, seqNo := db.checkpointIndex.Checkpoint()
+	if err := db.indexFlushErr(); err != nil {
+		return err
+	}
+	aheadOfData, err := db.checkpointAheadOfData(checkpoint)
+	if err != nil {
+		return err
+	}
+	if checkpoint == nil || db.mergeInstalled || aheadOfData {
+		//没有检查点(旧版本的索引或者索引文件丢失)，或者刚安装了merge的结果导致索引中的位置失效
+		//又或者索引比数据文件更新(数据文件尾部丢失)
+		//清空索引，和内存索引一样从hint文件和数据文件重建
+		if err := db.checkpointIndex.Reset(); err != nil {
+			return err
+		}
+		if err := db.loadIndexFromHintFile(); err != nil {
+			return err
+		}
+		if err := db.loadIndexFromDatafile(); err != nil {
+			return err
+		}
+	} else {
+		if seqNo > db.seqNo {
+			db.seqNo = seqNo
+		}
+		if err := db.replayDataFiles(checkpoint); err != nil {
+			return err
+		}
+	}
+	//检查点中记录了序列号，和序列号文件存在效果一样
+	db.seqNoFileExists = true
+
+	//回放完成，更新检查点到活跃文件末尾
+	if db.activeFile != nil {
+		db.checkpointIndex.SetCheckpoint(&data.LogRecordPos{
+			Fid:    db.activeFile.FileId,
+			Offset: db.activeFile.Offset,
+		}, db.seqNo)
+	}
 	return nil
 }
 
 func (db *DB) loadSeqNo() error {
 	filename := filepath.Join(db.options.DirPath, data.SeqNoFileName)
-	if _, err := os.Stat(filename); os.IsNotExist(err) {
+	if _, err := db.fs.Stat(filename); os.IsNotExist(err) {
 		return nil
 	}
 
-	seqNoFile, err := data.OpenSeqNoFile(db.options.DirPath)
+	seqNoFile, err := data.OpenSeqNoFile(db.fs, db.options.DirPath)
 	if err != nil {
 		return err
 	}
-	record, _, err := seqNoFile.ReadLogRecord(0)
+	record, _, err := seqNoFile.ReadLogRecord(seqNoFile.RecordStart())
 	if err != nil {
 		return err
 	}
@@ -641,21 +1056,81 @@ func (db *DB) loadSeqNo() error {
 	db.seqNo = seqNo
 	db.seqNoFileExists = true
 	seqNoFile.Close()
-	return os.Remove(filename)
+	return db.fs.Remove(filename)
 }
 
 func (db *DB) reseIoType() error {
 	if db.activeFile == nil {
 		return nil
 	}
-	if err := db.activeFile.SetIOManager(db.options.DirPath, fio.StandardFIO); err != nil {
+	if err := db.activeFile.SetIOManager(db.dataFileDir(db.activeFile.FileId), db.activeIoType()); err != nil {
 		return err
 	}
 
 	for _, file := range db.oldFiles {
-		if err := file.SetIOManager(db.options.DirPath, fio.StandardFIO); err != nil {
+		if err := file.SetIOManager(db.dataFileDir(file.FileId), db.sealedIoType()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 活跃文件使用的IO类型
+func (db *DB) activeIoType() IOType {
+	if db.options.IOType == DirectIO && db.options.DirectIOSealedOnly {
+		return StandardIO
+	}
+	return db.options.IOType
+}
+
+// 封存的旧数据文件使用的IO类型
+func (db *DB) sealedIoType() IOType {
+	return db.options.IOType
+}
+
+// 活跃文件转为旧数据文件，调用方必须持有db锁，之后需要设置新的活跃文件
+// 封存文件和活跃文件的IO类型不同时重新打开，正在读取原来文件的读者结束后才会关闭
+func (db *DB) sealActiveFile() error {
+	sealed := db.activeFile
+	if db.sealedIoType() != db.activeIoType() {
+		dataFile, err := data.OpenDataFileWithChecksum(db.fs, db.dataFileDir(sealed.FileId), sealed.FileId, db.sealedIoType(), db.options.Checksum)
+		if err != nil {
 			return err
 		}
+		dataFile.Offset = sealed.Offset
+		if err := sealed.Retire(); err != nil {
+			_ = dataFile.Close()
+			return err
+		}
+		sealed = dataFile
+		db.activeFile = sealed
+	}
+	db.oldFiles[sealed.FileId] = sealed
+	return nil
+}
+
+// 支持预分配的IO按数据文件大小给活跃文件分配空间
+func (db *DB) preallocateActiveFile() error {
+	if db.activeFile == nil {
+		return nil
+	}
+	if p, ok := db.activeFile.IoManger.(fio.Preallocator); ok {
+		return p.Preallocate(db.options.DataFileSize)
 	}
 	return nil
 }
+
+// 把活跃文件截断到最后一条完整记录之后，后续写入接在这里
+func (db *DB) truncateActiveFile() error {
+	if db.activeFile == nil {
+		return nil
+	}
+	size, err := db.activeFile.IoManger.Size()
+	if err != nil {
+		return err
+	}
+	if size <= db.activeFile.Offset {
+		return nil
+	}
+	return db.activeFile.IoManger.Truncate(db.activeFile.Offset)
+}
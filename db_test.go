@@ -1,11 +1,15 @@
 package bitcask_go
 
 import (
+	"bitcask-go/data"
+	"bitcask-go/fio"
 	"bitcask-go/utils"
 	"bytes"
 	"fmt"
 	"os"
 	"path"
+	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 
@@ -28,6 +32,9 @@ func destroyDB(db *DB) {
 			fmt.Println("remove not!!!")
 			// panic(err)
 		}
+		if db.options.ColdDirPath != "" {
+			_ = os.RemoveAll(db.options.ColdDirPath)
+		}
 	}
 }
 
@@ -453,3 +460,566 @@ func TestDB_Backup(t *testing.T) {
 		assert.NotNil(t, val)
 	}
 }
+
+func TestDB_ConcurrentShardedIndex(t *testing.T) {
+	opts := DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-sharded")
+	opts.DirPath = dir
+	opts.IndexType = Btree
+	opts.IndexShards = 16
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	wg := new(sync.WaitGroup)
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				key := utils.GetTestKey(g*2000 + i)
+				assert.Nil(t, db.Put(key, key))
+				val, err := db.Get(key)
+				assert.Nil(t, err)
+				assert.NotNil(t, val)
+				if i%2 == 0 {
+					assert.Nil(t, db.Delete(key))
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	assert.Equal(t, 8000, len(db.ListKeys()))
+
+	//重启后索引一致
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 8000, len(db2.ListKeys()))
+	db2.Close()
+}
+
+func TestDB_ConcurrentReadSealedFiles(t *testing.T) {
+	opts := DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-sealed-read")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+	}
+
+	//读旧文件的同时不断写入，触发活跃文件切换
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 2000; i < 6000; i++ {
+			assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+		}
+	}()
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				val, err := db.Get(utils.GetTestKey(i))
+				assert.Nil(t, err)
+				assert.Equal(t, utils.GetTestKey(i), val)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.True(t, len(db.oldFiles) > 0)
+
+	//迭代器读取
+	iter := db.NewIterator(DefaultIterOptions)
+	var count int
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		val, err := iter.Value()
+		assert.Nil(t, err)
+		assert.Equal(t, iter.Key(), val)
+		count++
+	}
+	iter.Close()
+	assert.Equal(t, 6000, count)
+}
+
+func TestDB_BPTreeReplayFromCheckpoint(t *testing.T) {
+	opts := DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-bptree-replay")
+	opts.DirPath = dir
+	opts.IndexType = BPTree
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 100; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	err = db.Close()
+	assert.Nil(t, err)
+
+	//模拟崩溃：数据已经写入数据文件，但是索引没来得及更新
+	activeFile, err := data.OpenDataFile(fio.OSFS{}, dir, 0, fio.StandardFIO)
+	assert.Nil(t, err)
+	records := []*data.LogRecord{
+		{Key: logRecordKeyAddSeq(utils.GetTestKey(100), nonTransactionSeqNo), Value: utils.GetTestKey(100)},
+		{Key: logRecordKeyAddSeq(utils.GetTestKey(1), nonTransactionSeqNo), Type: data.LogRecordDelete},
+	}
+	for _, record := range records {
+		buf, _ := activeFile.EncodeLogRecord(record)
+		assert.Nil(t, activeFile.Write(buf))
+	}
+	assert.Nil(t, activeFile.Close())
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	val, err := db.Get(utils.GetTestKey(100))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(100), val)
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Equal(t, 100, len(db.ListKeys()))
+
+	//重启后继续写入的位置正确
+	err = db.Put(utils.GetTestKey(101), utils.GetTestKey(101))
+	assert.Nil(t, err)
+	val, err = db.Get(utils.GetTestKey(100))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(100), val)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	//索引文件丢失，从数据文件重建
+	err = os.Remove(filepath.Join(dir, bptreeIndexName))
+	assert.Nil(t, err)
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 101, len(db.ListKeys()))
+	val, err = db.Get(utils.GetTestKey(101))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(101), val)
+}
+
+func TestDB_BPTreeMergeRebuild(t *testing.T) {
+	opts := DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-bptree-merge")
+	opts.DirPath = dir
+	opts.IndexType = BPTree
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(64))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 500; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	err = db.Merge()
+	assert.Nil(t, err)
+	//merge之后还有新的写入
+	for i := 0; i < 100; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	err = db.Delete(utils.GetTestKey(999))
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 599, len(db.ListKeys()))
+	for i := 0; i < 100; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, utils.GetTestKey(i), val)
+	}
+	for i := 500; i < 999; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.NotNil(t, val)
+	}
+	_, err = db.Get(utils.GetTestKey(999))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestDB_BPTreeIndexAheadOfData(t *testing.T) {
+	opts := DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-bptree-ahead")
+	opts.DirPath = dir
+	opts.IndexType = BPTree
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 100; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	pos := db.index.Get(utils.GetTestKey(50))
+	err = db.Close()
+	assert.Nil(t, err)
+
+	//模拟数据文件尾部丢失，索引里还记录着丢失的数据
+	err = os.Truncate(data.GetDataFileName(dir, 0), pos.Offset)
+	assert.Nil(t, err)
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 50, len(db.ListKeys()))
+	_, err = db.Get(utils.GetTestKey(50))
+	assert.Equal(t, ErrKeyNotFound, err)
+	val, err := db.Get(utils.GetTestKey(49))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(49), val)
+}
+
+func TestDB_BloomFilter(t *testing.T) {
+	for _, indexType := range []IndexerType{Btree, BPTree} {
+		opts := DefaultDBOptions
+		dir, _ := os.MkdirTemp("", "bitcask-go-bloom")
+		opts.DirPath = dir
+		opts.IndexType = indexType
+		opts.BloomFilter = true
+		db, err := Open(opts)
+		assert.Nil(t, err)
+		assert.NotNil(t, db.bloom)
+
+		for i := 0; i < 100; i++ {
+			assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+		}
+		wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+		assert.Nil(t, wb.Put([]byte("batch-key"), []byte("batch-value")))
+		assert.Nil(t, wb.Delete([]byte("missing-key")))
+		assert.Nil(t, wb.Commit())
+
+		//不存在的key直接被过滤
+		assert.False(t, db.bloom.MayContain([]byte("missing-key")))
+		_, err = db.Get([]byte("missing-key"))
+		assert.Equal(t, ErrKeyNotFound, err)
+		assert.Nil(t, db.Delete([]byte("missing-key")))
+		val, err := db.Get([]byte("batch-key"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("batch-value"), val)
+
+		//关闭时保存，打开后加载并删除文件
+		assert.Nil(t, db.Close())
+		_, err = os.Stat(filepath.Join(dir, data.BloomFilterName))
+		assert.Nil(t, err)
+
+		db, err = Open(opts)
+		assert.Nil(t, err)
+		_, err = os.Stat(filepath.Join(dir, data.BloomFilterName))
+		assert.True(t, os.IsNotExist(err))
+		for i := 0; i < 100; i++ {
+			val, err := db.Get(utils.GetTestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, utils.GetTestKey(i), val)
+		}
+		assert.Nil(t, db.Close())
+
+		//不开启过滤器时写入的key，再次开启后也要能读到
+		opts.BloomFilter = false
+		db, err = Open(opts)
+		assert.Nil(t, err)
+		assert.Nil(t, db.bloom)
+		assert.Nil(t, db.Put([]byte("plain-key"), []byte("plain-value")))
+		assert.Nil(t, db.Close())
+
+		opts.BloomFilter = true
+		db, err = Open(opts)
+		assert.Nil(t, err)
+		val, err = db.Get([]byte("plain-key"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("plain-value"), val)
+		destroyDB(db)
+	}
+}
+
+func TestDB_Checksum(t *testing.T) {
+	opts := DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-checksum")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.Checksum = ChecksumIEEE
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+	}
+	assert.Equal(t, ChecksumIEEE, db.activeFile.Checksum())
+	ieeeFid := db.activeFile.FileId
+	assert.Nil(t, db.Close())
+
+	//已有的文件按原来的算法读取和追加，新文件使用新的算法
+	opts.Checksum = ChecksumCRC32C
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+	assert.Equal(t, ChecksumIEEE, db.activeFile.Checksum())
+	for i := 500; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+	}
+	assert.Greater(t, db.activeFile.FileId, ieeeFid)
+	assert.Equal(t, ChecksumCRC32C, db.activeFile.Checksum())
+	assert.Equal(t, ChecksumIEEE, db.oldFiles[ieeeFid].Checksum())
+	assert.Nil(t, db.Close())
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 1000, len(db.ListKeys()))
+	for i := 0; i < 1000; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, utils.GetTestKey(i), val)
+	}
+}
+
+func TestDB_MMapIO(t *testing.T) {
+	opts := DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-mmap-io")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.IOType = MMapIO
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+	}
+	assert.Greater(t, len(db.oldFiles), 0)
+	//封存的文件是实际大小
+	for fid, file := range db.oldFiles {
+		info, err := os.Stat(data.GetDataFileName(dir, fid))
+		assert.Nil(t, err)
+		assert.Equal(t, file.Offset, info.Size())
+	}
+	activeFid := db.activeFile.FileId
+	activeSize := db.activeFile.Offset
+	assert.Nil(t, db.Close())
+	info, err := os.Stat(data.GetDataFileName(dir, activeFid))
+	assert.Nil(t, err)
+	assert.Equal(t, activeSize, info.Size())
+
+	//模拟崩溃时mmap预先扩展的空间没有截断
+	file, err := os.OpenFile(data.GetDataFileName(dir, activeFid), os.O_WRONLY, fio.DatafilePerm)
+	assert.Nil(t, err)
+	assert.Nil(t, file.Truncate(activeSize+4096))
+	assert.Nil(t, file.Close())
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+	assert.Equal(t, activeSize, db.activeFile.Offset)
+	for i := 1000; i < 1100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+	}
+	assert.Nil(t, db.Close())
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 1100, len(db.ListKeys()))
+	for i := 0; i < 1100; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, utils.GetTestKey(i), val)
+	}
+}
+
+func TestDB_BufferedIO(t *testing.T) {
+	opts := DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-buffered-io")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.IOType = BufferedIO
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+		//还在缓冲中的数据可以读到
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, utils.GetTestKey(i), val)
+	}
+	assert.Greater(t, len(db.oldFiles), 0)
+	assert.Nil(t, db.Close())
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+	assert.Equal(t, 1000, len(db.ListKeys()))
+	for i := 0; i < 1000; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, utils.GetTestKey(i), val)
+	}
+}
+
+func TestDB_DirectIO(t *testing.T) {
+	for _, sealedOnly := range []bool{false, true} {
+		opts := DefaultDBOptions
+		dir, _ := os.MkdirTemp("", "bitcask-go-direct-io")
+		opts.DirPath = dir
+		opts.DataFileSize = 32 * 1024
+		opts.IOType = DirectIO
+		opts.DirectIOSealedOnly = sealedOnly
+		db, err := Open(opts)
+		assert.Nil(t, err)
+		for i := 0; i < 1000; i++ {
+			assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+			//还在对齐缓冲中的数据可以读到
+			val, err := db.Get(utils.GetTestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, utils.GetTestKey(i), val)
+		}
+		assert.Greater(t, len(db.oldFiles), 0)
+		//封存的文件是实际大小，补齐对齐的部分已经截断
+		for fid, file := range db.oldFiles {
+			info, err := os.Stat(data.GetDataFileName(dir, fid))
+			assert.Nil(t, err)
+			assert.Equal(t, file.Offset, info.Size())
+		}
+		if sealedOnly {
+			_, ok := db.activeFile.IoManger.(*fio.FileIO)
+			assert.True(t, ok)
+		}
+		for i := 0; i < 500; i++ {
+			assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+		}
+		assert.Nil(t, db.Merge())
+		assert.Nil(t, db.Close())
+
+		db, err = Open(opts)
+		assert.Nil(t, err)
+		assert.Equal(t, 500, len(db.ListKeys()))
+		for i := 500; i < 1000; i++ {
+			val, err := db.Get(utils.GetTestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, utils.GetTestKey(i), val)
+		}
+		destroyDB(db)
+	}
+}
+
+func TestDB_InMemory(t *testing.T) {
+	opts := DefaultDBOptions
+	dir := filepath.Join(os.TempDir(), "bitcask-go-in-memory")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	opts.IndexType = BPTree
+	opts.InMemory = true
+	//B+Tree索引不能在内存中使用
+	_, err := Open(opts)
+	assert.NotNil(t, err)
+
+	opts.IndexType = Btree
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	//数据文件写满后切换
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	assert.Greater(t, len(db.oldFiles), 0)
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	for i := 1000; i < 1100; i++ {
+		assert.Nil(t, wb.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+	}
+	assert.Nil(t, wb.Commit())
+
+	assert.Nil(t, db.Merge())
+	assert.Equal(t, 600, len(db.ListKeys()))
+	val, err := db.Get(utils.GetTestKey(1050))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(1050), val)
+	_, err = db.Get(utils.GetTestKey(10))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Greater(t, db.Stat().DiskSize, int64(0))
+
+	//同一个目录不能再打开
+	hold, err := db.fs.NewLocker(filepath.Join(dir, fileLockName)).TryLock()
+	assert.Nil(t, err)
+	assert.False(t, hold)
+
+	//磁盘上没有任何文件
+	_, err = os.Stat(dir)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(dir + mergeDirName)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDB_FS(t *testing.T) {
+	memfs := fio.NewMemFS()
+	opts := DefaultDBOptions
+	dir := filepath.Join(os.TempDir(), "bitcask-go-fs")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	opts.FS = memfs
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+
+	//同一个文件系统重新打开，安装merge的结果
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.True(t, db.mergeInstalled)
+	assert.Equal(t, 500, len(db.ListKeys()))
+
+	//检查点和备份都在同一个文件系统中
+	cpDir := dir + "-cp"
+	assert.Nil(t, db.Checkpoint(cpDir))
+	backupDir := dir + "-backup"
+	assert.Nil(t, db.BackupIncremental(backupDir))
+	var buf bytes.Buffer
+	assert.Nil(t, db.BackupTo(&buf))
+	assert.Nil(t, db.Close())
+
+	restoreDir := dir + "-restore"
+	assert.Nil(t, RestoreWithFS(memfs, backupDir, restoreDir))
+	archiveDir := dir + "-archive-restore"
+	assert.Nil(t, RestoreFromWithFS(memfs, &buf, archiveDir))
+	for _, path := range []string{cpDir, restoreDir, archiveDir} {
+		pathOpts := opts
+		pathOpts.DirPath = path
+		pathDB, err := Open(pathOpts)
+		assert.Nil(t, err)
+		assert.Equal(t, 500, len(pathDB.ListKeys()))
+		val, err := pathDB.Get(utils.GetTestKey(999))
+		assert.Nil(t, err)
+		assert.NotNil(t, val)
+		assert.Nil(t, pathDB.Close())
+	}
+
+	//磁盘上没有任何文件
+	for _, path := range []string{dir, dir + mergeDirName, cpDir, backupDir, restoreDir, archiveDir} {
+		_, err = os.Stat(path)
+		assert.True(t, os.IsNotExist(err))
+	}
+}
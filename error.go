@@ -13,4 +13,16 @@ var (
 	ErrDatabaseIsUsing          = errors.New("the database directory is used by another process")
 	ErrMergeRatioUnreached      = errors.New("the merge ratio has not reach the option")
 	ErrNoFreeSpaceForMerge      = errors.New("the disk no have free space to merge")
+	ErrKeyIsReserved            = errors.New("key uses the reserved namespace prefix")
+	ErrDatabaseIsClosed         = errors.New("the database is closed")
+	ErrLogCursorTooOld          = errors.New("the log cursor points to data rewritten by merge")
+	ErrInvalidLogCursor         = errors.New("the log cursor is beyond the end of the log")
+	ErrFollowerReadOnly         = errors.New("the database is a replication follower, local writes are rejected")
+	ErrCheckpointDirNotEmpty    = errors.New("the checkpoint dir is not empty")
+	ErrBackupNotFound           = errors.New("no complete backup found in the backup dir")
+	ErrBackupCorrupted          = errors.New("the backup file maybe corrupted")
+	ErrRestoreDirNotEmpty       = errors.New("the restore target dir is not empty")
+	ErrInvalidBackupArchive     = errors.New("invalid backup archive")
+	ErrRecoverTargetUnavailable = errors.New("the recover target is outside the retained history")
+	ErrInvalidRecoverTarget     = errors.New("the recover target has neither time nor transaction seqNo")
 )
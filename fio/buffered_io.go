@@ -0,0 +1,160 @@
+package fio
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// 写缓冲的大小，攒够之后一次写入文件
+const bufferedIOSize = 64 * 1024
+
+// BufferedIO 带写缓冲的文件IO，追加的数据先放在内存中，攒够或者Sync时才写入文件
+// 还没有写入文件的数据直接从缓冲中读取
+type BufferedIO struct {
+	mu      sync.RWMutex
+	fd      *os.File
+	buf     []byte //还没有写入文件的数据
+	flushed int64  //已经写入文件的大小
+}
+
+// 初始化带写缓冲的文件IO
+func NewBufferedIOManager(path string) (*BufferedIO, error) {
+	fd, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, DatafilePerm)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := fd.Stat()
+	if err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+	return &BufferedIO{
+		fd:      fd,
+		buf:     make([]byte, 0, bufferedIOSize),
+		flushed: stat.Size(),
+	}, nil
+}
+
+// 从文件的给定位置读取对应数据，没有写入文件的部分从缓冲读取
+func (bio *BufferedIO) Read(b []byte, offset int64) (int, error) {
+	bio.mu.RLock()
+	defer bio.mu.RUnlock()
+	var n int
+	if offset < bio.flushed {
+		end := int64(len(b))
+		if offset+end > bio.flushed {
+			end = bio.flushed - offset
+		}
+		read, err := bio.fd.ReadAt(b[:end], offset)
+		n += read
+		if err != nil {
+			return n, err
+		}
+		if n == len(b) {
+			return n, nil
+		}
+	}
+	start := offset + int64(n) - bio.flushed
+	if start >= int64(len(bio.buf)) {
+		return n, io.EOF
+	}
+	n += copy(b[n:], bio.buf[start:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// 写入字节到缓冲中，缓冲满了写入文件
+// 写入失败时b整个不算写入，已经写进文件的部分截断掉，之前缓冲的数据保留，之后的写入仍然接在它们后面
+func (bio *BufferedIO) Write(b []byte) (int, error) {
+	bio.mu.Lock()
+	defer bio.mu.Unlock()
+	prevFlushed, prevLen := bio.flushed, int64(len(bio.buf))
+	bio.buf = append(bio.buf, b...)
+	if len(bio.buf) >= bufferedIOSize {
+		if err := bio.flush(); err != nil {
+			if bio.flushed-prevFlushed > prevLen {
+				//b的一部分已经写进文件
+				if truncErr := bio.fd.Truncate(prevFlushed + prevLen); truncErr != nil {
+					return 0, truncErr
+				}
+				bio.flushed = prevFlushed + prevLen
+				bio.buf = bio.buf[:0]
+			} else {
+				bio.buf = bio.buf[:len(bio.buf)-len(b)]
+			}
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// 缓冲写入文件，调用方需要持有写锁
+func (bio *BufferedIO) flush() error {
+	if len(bio.buf) == 0 {
+		return nil
+	}
+	n, err := bio.fd.Write(bio.buf)
+	bio.flushed += int64(n)
+	//写入失败时保留没写进去的部分
+	bio.buf = append(bio.buf[:0], bio.buf[n:]...)
+	if err != nil {
+		return err
+	}
+	//大记录撑大的缓冲不保留
+	if cap(bio.buf) > bufferedIOSize*4 {
+		bio.buf = make([]byte, 0, bufferedIOSize)
+	}
+	return nil
+}
+
+// Sync把缓冲写入文件并持久化
+func (bio *BufferedIO) Sync() error {
+	bio.mu.Lock()
+	defer bio.mu.Unlock()
+	if err := bio.flush(); err != nil {
+		return err
+	}
+	return bio.fd.Sync()
+}
+
+// Close把缓冲写入文件后关闭
+func (bio *BufferedIO) Close() error {
+	bio.mu.Lock()
+	defer bio.mu.Unlock()
+	if err := bio.flush(); err != nil {
+		_ = bio.fd.Close()
+		return err
+	}
+	return bio.fd.Close()
+}
+
+// Size获取文件大小，包括还在缓冲中的数据
+func (bio *BufferedIO) Size() (int64, error) {
+	bio.mu.RLock()
+	defer bio.mu.RUnlock()
+	return bio.flushed + int64(len(bio.buf)), nil
+}
+
+// Truncate截断文件，之后的写入从新的末尾开始
+func (bio *BufferedIO) Truncate(size int64) error {
+	bio.mu.Lock()
+	defer bio.mu.Unlock()
+	if err := bio.flush(); err != nil {
+		return err
+	}
+	if err := bio.fd.Truncate(size); err != nil {
+		return err
+	}
+	bio.flushed = size
+	return nil
+}
+
+// Preallocate预先给文件分配size大小的磁盘空间，不改变文件大小
+func (bio *BufferedIO) Preallocate(size int64) error {
+	bio.mu.Lock()
+	defer bio.mu.Unlock()
+	return preallocate(bio.fd, size)
+}
@@ -0,0 +1,107 @@
+package fio
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBufferedIO(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-buffered-io")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "buffered.data")
+
+	bio, err := NewBufferedIOManager(path)
+	assert.Nil(t, err)
+	//预分配不改变文件大小
+	assert.Nil(t, bio.Preallocate(1024*1024))
+	size, err := bio.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), size)
+
+	//没有写入文件的数据从缓冲读取
+	_, err = bio.Write([]byte("key-a"))
+	assert.Nil(t, err)
+	_, err = bio.Write([]byte("value-a"))
+	assert.Nil(t, err)
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), info.Size())
+	size, err = bio.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(12), size)
+	b := make([]byte, 7)
+	n, err := bio.Read(b, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, 7, n)
+	assert.Equal(t, []byte("value-a"), b)
+	_, err = bio.Read(b, 6)
+	assert.Equal(t, io.EOF, err)
+
+	//Sync之后写入文件，读取可以跨越文件和缓冲
+	assert.Nil(t, bio.Sync())
+	info, err = os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(12), info.Size())
+	_, err = bio.Write([]byte("key-b"))
+	assert.Nil(t, err)
+	b = make([]byte, 10)
+	_, err = bio.Read(b, 7)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("lue-akey-b"), b)
+
+	//缓冲满了自动写入文件
+	_, err = bio.Write(make([]byte, bufferedIOSize))
+	assert.Nil(t, err)
+	info, err = os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(17+bufferedIOSize), info.Size())
+
+	assert.Nil(t, bio.Truncate(12))
+	_, err = bio.Write([]byte("key-c"))
+	assert.Nil(t, err)
+	assert.Nil(t, bio.Close())
+	content, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("key-avalue-akey-c"), content)
+}
+
+// 写入文件失败之后，失败的数据不算写入，之后的写入和读取位置不变
+func TestBufferedIO_WriteFailed(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-buffered-io-failed")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "buffered.data")
+
+	bio, err := NewBufferedIOManager(path)
+	assert.Nil(t, err)
+	defer bio.Close()
+	_, err = bio.Write([]byte("key-a"))
+	assert.Nil(t, err)
+
+	//换成只读的文件，缓冲满了写入文件时失败
+	fd := bio.fd
+	bio.fd, err = os.Open(path)
+	assert.Nil(t, err)
+	n, err := bio.Write(make([]byte, bufferedIOSize))
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, n)
+	size, err := bio.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), size)
+	_ = bio.fd.Close()
+	bio.fd = fd
+
+	_, err = bio.Write([]byte("value-a"))
+	assert.Nil(t, err)
+	b := make([]byte, 7)
+	_, err = bio.Read(b, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value-a"), b)
+	assert.Nil(t, bio.Sync())
+	content, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("key-avalue-a"), content)
+}
@@ -0,0 +1,249 @@
+//go:build linux
+// +build linux
+
+package fio
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	//直接IO要求读写的内存地址、文件偏移和长度都按块对齐
+	directIOAlignSize = 4096
+
+	//写缓冲的大小，也是缓冲池中每块内存的大小，必须是对齐大小的整数倍
+	directIOBufferSize = 64 * 1024
+)
+
+// 对齐内存的缓冲池，读取时按块对齐读入再拷贝出去
+var alignedBufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := alignedBlock(directIOBufferSize)
+		return &buf
+	},
+}
+
+// 分配起始地址按块对齐的内存，size必须是对齐大小的整数倍
+func alignedBlock(size int) []byte {
+	buf := make([]byte, size+directIOAlignSize)
+	var start int
+	if rem := int(uintptr(unsafe.Pointer(&buf[0])) & (directIOAlignSize - 1)); rem != 0 {
+		start = directIOAlignSize - rem
+	}
+	return buf[start : start+size]
+}
+
+func alignDown(n int64) int64 {
+	return n &^ (directIOAlignSize - 1)
+}
+
+func alignUp(n int64) int64 {
+	return alignDown(n + directIOAlignSize - 1)
+}
+
+// DirectIO 使用O_DIRECT绕过页缓存的文件IO，读取大量冷数据时不会挤掉应用的内存
+// 写入先攒在对齐的缓冲中，攒满一块缓冲整块写入；Sync时最后不满一块的部分补零写入，再截断回实际大小
+// 缓冲中保留最后不满一块的数据，下次写入时连同新数据重新写这一块
+type DirectIO struct {
+	mu   sync.RWMutex
+	fd   *os.File
+	base int64  //缓冲开头在文件中的偏移，按块对齐，之前的数据都已经写入文件
+	buf  []byte //文件从base开始到末尾的数据，可能还没有写入文件
+	n    int    //缓冲中数据的长度，文件大小是base+n
+}
+
+// 初始化直接IO，文件系统不支持O_DIRECT时(比如tmpfs)退回标准文件IO
+func NewDirectIOManager(path string) (IOManager, error) {
+	fd, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|syscall.O_DIRECT, DatafilePerm)
+	if err != nil {
+		if errors.Is(err, syscall.EINVAL) {
+			return NewFileIOManager(path)
+		}
+		return nil, err
+	}
+	stat, err := fd.Stat()
+	if err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+	dio := &DirectIO{fd: fd, buf: alignedBlock(directIOBufferSize)}
+	if err := dio.reset(stat.Size()); err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+	return dio, nil
+}
+
+// 文件大小变成size之后重新加载缓冲，把最后不满一块的数据读进来，调用方需要持有写锁
+func (dio *DirectIO) reset(size int64) error {
+	dio.base = alignDown(size)
+	dio.n = int(size - dio.base)
+	if dio.n == 0 {
+		return nil
+	}
+	read, err := dio.fd.ReadAt(dio.buf[:directIOAlignSize], dio.base)
+	if read < dio.n {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return nil
+}
+
+// 从文件的给定位置读取对应数据，已经写入文件的部分按块对齐读取，其余部分从缓冲读取
+func (dio *DirectIO) Read(b []byte, offset int64) (int, error) {
+	dio.mu.RLock()
+	defer dio.mu.RUnlock()
+	var n int
+	if offset < dio.base {
+		end := offset + int64(len(b))
+		if end > dio.base {
+			end = dio.base
+		}
+		read, err := dio.readAligned(b[:end-offset], offset)
+		n += read
+		if err != nil {
+			return n, err
+		}
+		if n == len(b) {
+			return n, nil
+		}
+	}
+	start := offset + int64(n) - dio.base
+	if start >= int64(dio.n) {
+		return n, io.EOF
+	}
+	n += copy(b[n:], dio.buf[start:dio.n])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// 按块对齐从文件中读取b，调用方保证读取的范围都已经写入文件
+func (dio *DirectIO) readAligned(b []byte, offset int64) (int, error) {
+	start := alignDown(offset)
+	size := int(alignUp(offset+int64(len(b))) - start)
+	var block []byte
+	if size <= directIOBufferSize {
+		pooled := alignedBufferPool.Get().(*[]byte)
+		defer alignedBufferPool.Put(pooled)
+		block = (*pooled)[:size]
+	} else {
+		block = alignedBlock(size)
+	}
+	//最后一块可能超过文件末尾，读到需要的部分就可以
+	read, err := dio.fd.ReadAt(block, start)
+	skip := int(offset - start)
+	if read < skip+len(b) {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if read <= skip {
+			return 0, err
+		}
+		return copy(b, block[skip:read]), err
+	}
+	return copy(b, block[skip:]), nil
+}
+
+// 写入字节到缓冲中，攒满一块缓冲整块写入文件
+func (dio *DirectIO) Write(b []byte) (int, error) {
+	dio.mu.Lock()
+	defer dio.mu.Unlock()
+	var written int
+	for written < len(b) {
+		copied := copy(dio.buf[dio.n:], b[written:])
+		dio.n += copied
+		written += copied
+		if dio.n == len(dio.buf) {
+			if _, err := dio.fd.WriteAt(dio.buf, dio.base); err != nil {
+				//写入失败的这一块中新拷贝的数据丢弃，之前写入文件的部分算作已经写入
+				dio.n -= copied
+				return written - copied, err
+			}
+			dio.base += int64(len(dio.buf))
+			dio.n = 0
+		}
+	}
+	return written, nil
+}
+
+// 缓冲中的数据补零对齐后写入文件，再截断掉补的零，调用方需要持有写锁
+func (dio *DirectIO) flush() error {
+	if dio.n == 0 {
+		return nil
+	}
+	padded := int(alignUp(int64(dio.n)))
+	for i := dio.n; i < padded; i++ {
+		dio.buf[i] = 0
+	}
+	if _, err := dio.fd.WriteAt(dio.buf[:padded], dio.base); err != nil {
+		return err
+	}
+	if padded > dio.n {
+		if err := dio.fd.Truncate(dio.base + int64(dio.n)); err != nil {
+			return err
+		}
+	}
+	//完整的块已经写入文件，缓冲中只保留最后不满一块的部分
+	full := int(alignDown(int64(dio.n)))
+	copy(dio.buf, dio.buf[full:dio.n])
+	dio.base += int64(full)
+	dio.n -= full
+	return nil
+}
+
+// Sync把缓冲写入文件并持久化，O_DIRECT不保证文件大小等元数据持久化，仍然需要fsync
+func (dio *DirectIO) Sync() error {
+	dio.mu.Lock()
+	defer dio.mu.Unlock()
+	if err := dio.flush(); err != nil {
+		return err
+	}
+	return dio.fd.Sync()
+}
+
+// Close把缓冲写入文件后关闭
+func (dio *DirectIO) Close() error {
+	dio.mu.Lock()
+	defer dio.mu.Unlock()
+	if err := dio.flush(); err != nil {
+		_ = dio.fd.Close()
+		return err
+	}
+	return dio.fd.Close()
+}
+
+// Size获取文件大小，包括还在缓冲中的数据
+func (dio *DirectIO) Size() (int64, error) {
+	dio.mu.RLock()
+	defer dio.mu.RUnlock()
+	return dio.base + int64(dio.n), nil
+}
+
+// Truncate截断文件，之后的写入从新的末尾开始
+func (dio *DirectIO) Truncate(size int64) error {
+	dio.mu.Lock()
+	defer dio.mu.Unlock()
+	if err := dio.flush(); err != nil {
+		return err
+	}
+	if err := dio.fd.Truncate(size); err != nil {
+		return err
+	}
+	return dio.reset(size)
+}
+
+// Preallocate预先给文件分配size大小的磁盘空间，不改变文件大小
+func (dio *DirectIO) Preallocate(size int64) error {
+	dio.mu.Lock()
+	defer dio.mu.Unlock()
+	return preallocate(dio.fd, size)
+}
@@ -0,0 +1,82 @@
+package fio
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDirectIO(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-direct-io")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "direct.data")
+
+	dio, err := NewDirectIOManager(path)
+	assert.Nil(t, err)
+	//文件系统不支持O_DIRECT时退回了标准文件IO，测试没有意义
+	if _, ok := dio.(*DirectIO); !ok {
+		_ = dio.Close()
+		t.Skip("the file system does not support O_DIRECT")
+	}
+
+	//不对齐的小写入，Sync之后文件大小是实际写入的大小
+	_, err = dio.Write([]byte("key-a"))
+	assert.Nil(t, err)
+	_, err = dio.Write([]byte("value-a"))
+	assert.Nil(t, err)
+	assert.Nil(t, dio.Sync())
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(12), info.Size())
+	b := make([]byte, 7)
+	n, err := dio.Read(b, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, 7, n)
+	assert.Equal(t, []byte("value-a"), b)
+	_, err = dio.Read(b, 6)
+	assert.Equal(t, io.EOF, err)
+
+	//跨越多个块的写入，读取可以跨越已经写入文件的部分和缓冲
+	big := bytes.Repeat([]byte("0123456789"), 20000)
+	_, err = dio.Write(big)
+	assert.Nil(t, err)
+	size, err := dio.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(12+len(big)), size)
+	b = make([]byte, 10000)
+	_, err = dio.Read(b, 12+190000)
+	assert.Nil(t, err)
+	assert.Equal(t, big[190000:], b)
+	b = make([]byte, len(big)+12)
+	_, err = dio.Read(b, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, append([]byte("key-avalue-a"), big...), b)
+
+	//截断之后从新的末尾继续写入
+	assert.Nil(t, dio.Truncate(5000))
+	_, err = dio.Write([]byte("tail"))
+	assert.Nil(t, err)
+	assert.Nil(t, dio.Close())
+
+	content, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, 5004, len(content))
+	assert.Equal(t, []byte("tail"), content[5000:])
+	assert.Equal(t, big[:5000-12], content[12:5000])
+
+	//重新打开，最后不满一块的数据可以继续追加
+	dio, err = NewDirectIOManager(path)
+	assert.Nil(t, err)
+	assert.IsType(t, &DirectIO{}, dio)
+	defer dio.Close()
+	_, err = dio.Write([]byte("-more"))
+	assert.Nil(t, err)
+	b = make([]byte, 9)
+	_, err = dio.Read(b, 5000)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("tail-more"), b)
+}
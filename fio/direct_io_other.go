@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package fio
+
+// 只有linux上使用O_DIRECT，其他系统退回标准文件IO
+func NewDirectIOManager(path string) (IOManager, error) {
+	return NewFileIOManager(path)
+}
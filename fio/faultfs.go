@@ -0,0 +1,555 @@
+package fio
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrInjectedFault = errors.New("injected fault")
+	ErrCrashed       = errors.New("the file system has crashed")
+)
+
+// FaultFS 可以注入故障的文件系统，用于测试崩溃一致性
+// 修改类的操作都会计数，FailAfter之后的第n次操作失败，并且之后的修改都失败，相当于进程在这里崩溃
+// Crash模拟断电，文件内容回到最后一次Sync时的状态，新建、删除和改名的目录项回到所在目录最后一次SyncDir时的状态
+type FaultFS struct {
+	mu      sync.Mutex
+	fs      FS
+	ops     int               //修改操作的次数
+	failAt  int               //第几次操作失败，0表示不注入故障
+	short   bool              //失败的写入是否写入一半
+	failed  bool              //已经发生过故障
+	gen     int               //每次Crash加一，Crash之前打开的文件全部失效
+	durable map[string][]byte //修改过的文件最后一次Sync时的内容
+	dirOps  []*dirOp          //还没有持久化的目录修改，按发生顺序
+	lockers []Locker
+}
+
+// 一次目录修改，涉及的目录都SyncDir之后才持久化
+type dirOp struct {
+	dirs map[string]bool //还没有持久化的目录
+	undo func() error    //撤销这次修改，调用方需要持有锁
+}
+
+func NewFaultFS(fs FS) *FaultFS {
+	return &FaultFS{fs: fs, durable: make(map[string][]byte)}
+}
+
+// 之后的第n次修改操作失败，short为true时失败的写入只写一半
+func (ffs *FaultFS) FailAfter(n int, short bool) {
+	ffs.mu.Lock()
+	defer ffs.mu.Unlock()
+	ffs.ops = 0
+	ffs.failAt = n
+	ffs.short = short
+	ffs.failed = false
+}
+
+// 到目前为止的修改操作次数
+func (ffs *FaultFS) Ops() int {
+	ffs.mu.Lock()
+	defer ffs.mu.Unlock()
+	return ffs.ops
+}
+
+// 是否已经注入了故障
+func (ffs *FaultFS) Failed() bool {
+	ffs.mu.Lock()
+	defer ffs.mu.Unlock()
+	return ffs.failed
+}
+
+// 模拟断电：没有Sync的数据和没有SyncDir的目录修改全部丢失，释放所有文件锁，之前打开的文件不能再使用，取消故障注入
+func (ffs *FaultFS) Crash() error {
+	return ffs.crash(false)
+}
+
+// 模拟断电时没有Sync的追加写入只落盘了一部分
+// 在持久化内容之后追加的文件保留追加部分的前一半，通常会留下写了一半的记录，其他和Crash相同
+func (ffs *FaultFS) CrashWithTornWrites() error {
+	return ffs.crash(true)
+}
+
+func (ffs *FaultFS) crash(torn bool) error {
+	ffs.mu.Lock()
+	defer ffs.mu.Unlock()
+	for name, content := range ffs.durable {
+		if torn {
+			current, err := ffs.readFile(name)
+			if err != nil {
+				return err
+			}
+			if len(current) > len(content) && bytes.Equal(current[:len(content)], content) {
+				content = current[:len(content)+(len(current)-len(content)+1)/2]
+			}
+		}
+		if err := ffs.restore(name, content); err != nil {
+			return err
+		}
+	}
+	ffs.durable = make(map[string][]byte)
+	//文件内容恢复之后，再从后往前撤销没有持久化的目录修改
+	for i := len(ffs.dirOps) - 1; i >= 0; i-- {
+		if err := ffs.dirOps[i].undo(); err != nil {
+			return err
+		}
+	}
+	ffs.dirOps = nil
+	for _, locker := range ffs.lockers {
+		if err := locker.Unlock(); err != nil {
+			return err
+		}
+	}
+	ffs.lockers = nil
+	ffs.gen++
+	ffs.ops = 0
+	ffs.failAt = 0
+	ffs.failed = false
+	return nil
+}
+
+// 把文件恢复成content，调用方需要持有锁
+func (ffs *FaultFS) restore(name string, content []byte) error {
+	if _, err := ffs.fs.Stat(name); os.IsNotExist(err) {
+		return nil
+	}
+	file, err := ffs.fs.OpenFile(name, os.O_WRONLY|os.O_TRUNC, DatafilePerm)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(content); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// 写入文件的全部内容，不存在时创建，调用方需要持有锁
+func (ffs *FaultFS) writeFile(name string, content []byte) error {
+	if err := ffs.fs.MkdirAll(filepath.Dir(name), os.ModePerm); err != nil {
+		return err
+	}
+	file, err := ffs.fs.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, DatafilePerm)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(content); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// 记录一次目录修改，paths是修改的目录项，它们所在的目录都需要SyncDir
+func (ffs *FaultFS) addDirOp(undo func() error, paths ...string) {
+	ffs.mu.Lock()
+	defer ffs.mu.Unlock()
+	op := &dirOp{dirs: make(map[string]bool), undo: undo}
+	for _, path := range paths {
+		op.dirs[filepath.Dir(filepath.Clean(path))] = true
+	}
+	ffs.dirOps = append(ffs.dirOps, op)
+}
+
+// 目录SyncDir之后，其中的修改都持久化了
+func (ffs *FaultFS) syncedDir(dir string) {
+	ffs.mu.Lock()
+	defer ffs.mu.Unlock()
+	dir = filepath.Clean(dir)
+	var pending []*dirOp
+	for _, op := range ffs.dirOps {
+		delete(op.dirs, dir)
+		if len(op.dirs) > 0 {
+			pending = append(pending, op)
+		}
+	}
+	ffs.dirOps = pending
+}
+
+// 记录新建的目录项，崩溃时删除
+func (ffs *FaultFS) addCreateOp(name string) {
+	ffs.addDirOp(func() error {
+		return ffs.fs.RemoveAll(name)
+	}, name)
+}
+
+// 删除之前保存path下持久化的内容，崩溃时恢复，调用方需要持有锁
+func (ffs *FaultFS) saveTree(path string) (func() error, error) {
+	path = filepath.Clean(path)
+	info, err := ffs.fs.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return func() error { return nil }, nil
+		}
+		return nil, err
+	}
+	if !info.IsDir() {
+		content, ok := ffs.durable[path]
+		if !ok {
+			if content, err = ffs.readFile(path); err != nil {
+				return nil, err
+			}
+		}
+		return func() error {
+			return ffs.writeFile(path, content)
+		}, nil
+	}
+	entries, err := ffs.fs.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	var undos []func() error
+	for _, entry := range entries {
+		undo, err := ffs.saveTree(filepath.Join(path, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		undos = append(undos, undo)
+	}
+	return func() error {
+		if err := ffs.fs.MkdirAll(path, os.ModePerm); err != nil {
+			return err
+		}
+		for _, undo := range undos {
+			if err := undo(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, nil
+}
+
+// 删除path之前保存持久化的内容
+func (ffs *FaultFS) prepareRemove(path string) (func() error, error) {
+	ffs.mu.Lock()
+	defer ffs.mu.Unlock()
+	return ffs.saveTree(path)
+}
+
+// 一次修改操作，返回失败的写入是否写一半和需要注入的错误
+func (ffs *FaultFS) op(gen int) (bool, error) {
+	ffs.mu.Lock()
+	defer ffs.mu.Unlock()
+	if gen != ffs.gen {
+		return false, ErrCrashed
+	}
+	if ffs.failed {
+		return false, ErrInjectedFault
+	}
+	ffs.ops++
+	if ffs.failAt > 0 && ffs.ops >= ffs.failAt {
+		ffs.failed = true
+		return ffs.short, ErrInjectedFault
+	}
+	return false, nil
+}
+
+func (ffs *FaultFS) currentGen() int {
+	ffs.mu.Lock()
+	defer ffs.mu.Unlock()
+	return ffs.gen
+}
+
+// 文件第一次修改之前记录持久化的内容
+func (ffs *FaultFS) markDirty(name string) error {
+	ffs.mu.Lock()
+	defer ffs.mu.Unlock()
+	name = filepath.Clean(name)
+	if _, ok := ffs.durable[name]; ok {
+		return nil
+	}
+	content, err := ffs.readFile(name)
+	if err != nil {
+		return err
+	}
+	ffs.durable[name] = content
+	return nil
+}
+
+// Sync之后当前内容就是持久化的内容
+func (ffs *FaultFS) markSynced(name string) error {
+	ffs.mu.Lock()
+	defer ffs.mu.Unlock()
+	name = filepath.Clean(name)
+	if _, ok := ffs.durable[name]; !ok {
+		return nil
+	}
+	content, err := ffs.readFile(name)
+	if err != nil {
+		return err
+	}
+	ffs.durable[name] = content
+	return nil
+}
+
+// 读取文件的全部内容，不存在的文件为空，调用方需要持有锁
+func (ffs *FaultFS) readFile(name string) ([]byte, error) {
+	file, err := ffs.fs.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+// 改名和删除之后，持久化的内容跟着文件名走
+func (ffs *FaultFS) moveDurable(oldpath, newpath string) {
+	ffs.mu.Lock()
+	defer ffs.mu.Unlock()
+	oldpath = filepath.Clean(oldpath)
+	prefix := oldpath + string(filepath.Separator)
+	moved := make(map[string][]byte)
+	for name, content := range ffs.durable {
+		if name == oldpath || strings.HasPrefix(name, prefix) {
+			delete(ffs.durable, name)
+			if newpath != "" {
+				moved[filepath.Join(newpath, strings.TrimPrefix(name, oldpath))] = content
+			}
+		}
+	}
+	for name, content := range moved {
+		ffs.durable[name] = content
+	}
+}
+
+func (ffs *FaultFS) OpenIOManager(name string, ioType FileIOType) (IOManager, error) {
+	gen := ffs.currentGen()
+	_, statErr := ffs.fs.Stat(name)
+	created := os.IsNotExist(statErr)
+	if created {
+		if _, err := ffs.op(gen); err != nil {
+			return nil, err
+		}
+		if err := ffs.markDirty(name); err != nil {
+			return nil, err
+		}
+	}
+	m, err := ffs.fs.OpenIOManager(name, ioType)
+	if err != nil {
+		return nil, err
+	}
+	if created {
+		ffs.addCreateOp(name)
+	}
+	return &faultIOManager{IOManager: m, fs: ffs, name: name, gen: gen}, nil
+}
+
+func (ffs *FaultFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	gen := ffs.currentGen()
+	var created bool
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC) != 0 {
+		if _, err := ffs.op(gen); err != nil {
+			return nil, err
+		}
+		if flag&os.O_CREATE != 0 {
+			_, statErr := ffs.fs.Stat(name)
+			created = os.IsNotExist(statErr)
+		}
+		if err := ffs.markDirty(name); err != nil {
+			return nil, err
+		}
+	}
+	file, err := ffs.fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	if created {
+		ffs.addCreateOp(name)
+	}
+	return &faultFile{File: file, fs: ffs, name: name, gen: gen}, nil
+}
+
+func (ffs *FaultFS) Stat(name string) (os.FileInfo, error) {
+	return ffs.fs.Stat(name)
+}
+
+func (ffs *FaultFS) ReadDir(name string) ([]os.DirEntry, error) {
+	return ffs.fs.ReadDir(name)
+}
+
+func (ffs *FaultFS) MkdirAll(path string, perm os.FileMode) error {
+	if _, err := ffs.op(ffs.currentGen()); err != nil {
+		return err
+	}
+	//新建的每一级目录都要在上一级目录中持久化
+	var created []string
+	for dir := filepath.Clean(path); ; dir = filepath.Dir(dir) {
+		if _, err := ffs.fs.Stat(dir); !os.IsNotExist(err) {
+			break
+		}
+		created = append(created, dir)
+		if dir == filepath.Dir(dir) {
+			break
+		}
+	}
+	if err := ffs.fs.MkdirAll(path, perm); err != nil {
+		return err
+	}
+	for i := len(created) - 1; i >= 0; i-- {
+		ffs.addCreateOp(created[i])
+	}
+	return nil
+}
+
+func (ffs *FaultFS) Remove(name string) error {
+	return ffs.remove(name, ffs.fs.Remove)
+}
+
+func (ffs *FaultFS) RemoveAll(path string) error {
+	return ffs.remove(path, ffs.fs.RemoveAll)
+}
+
+// 删除之前保存持久化的内容，崩溃时如果目录没有持久化就恢复
+func (ffs *FaultFS) remove(path string, remove func(string) error) error {
+	if _, err := ffs.op(ffs.currentGen()); err != nil {
+		return err
+	}
+	undo, err := ffs.prepareRemove(path)
+	if err != nil {
+		return err
+	}
+	if err := remove(path); err != nil {
+		return err
+	}
+	ffs.moveDurable(path, "")
+	ffs.addDirOp(undo, path)
+	return nil
+}
+
+func (ffs *FaultFS) Rename(oldpath, newpath string) error {
+	if _, err := ffs.op(ffs.currentGen()); err != nil {
+		return err
+	}
+	//被覆盖的目标崩溃时要恢复
+	undoOverwrite, err := ffs.prepareRemove(newpath)
+	if err != nil {
+		return err
+	}
+	if err := ffs.fs.Rename(oldpath, newpath); err != nil {
+		return err
+	}
+	ffs.moveDurable(newpath, "")
+	ffs.moveDurable(oldpath, newpath)
+	ffs.addDirOp(func() error {
+		if err := ffs.fs.Rename(newpath, oldpath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return undoOverwrite()
+	}, oldpath, newpath)
+	return nil
+}
+
+func (ffs *FaultFS) Link(oldname, newname string) error {
+	if _, err := ffs.op(ffs.currentGen()); err != nil {
+		return err
+	}
+	if err := ffs.fs.Link(oldname, newname); err != nil {
+		return err
+	}
+	ffs.addCreateOp(newname)
+	return nil
+}
+
+func (ffs *FaultFS) SyncDir(dir string) error {
+	if _, err := ffs.op(ffs.currentGen()); err != nil {
+		return err
+	}
+	if err := ffs.fs.SyncDir(dir); err != nil {
+		return err
+	}
+	ffs.syncedDir(dir)
+	return nil
+}
+
+func (ffs *FaultFS) NewLocker(name string) Locker {
+	locker := ffs.fs.NewLocker(name)
+	ffs.mu.Lock()
+	ffs.lockers = append(ffs.lockers, locker)
+	ffs.mu.Unlock()
+	return locker
+}
+
+// 注入故障的写入，short为true时只写入一半
+func (ffs *FaultFS) write(gen int, name string, buf []byte, write func([]byte) (int, error)) (int, error) {
+	short, err := ffs.op(gen)
+	if err != nil && !short {
+		return 0, err
+	}
+	if dirtyErr := ffs.markDirty(name); dirtyErr != nil {
+		return 0, dirtyErr
+	}
+	if err != nil {
+		n, _ := write(buf[:len(buf)/2])
+		return n, err
+	}
+	return write(buf)
+}
+
+func (ffs *FaultFS) sync(gen int, name string, sync func() error) error {
+	if _, err := ffs.op(gen); err != nil {
+		return err
+	}
+	if err := sync(); err != nil {
+		return err
+	}
+	return ffs.markSynced(name)
+}
+
+func (ffs *FaultFS) truncate(gen int, name string, size int64, truncate func(int64) error) error {
+	if _, err := ffs.op(gen); err != nil {
+		return err
+	}
+	if err := ffs.markDirty(name); err != nil {
+		return err
+	}
+	return truncate(size)
+}
+
+// 注入故障的IOManager
+type faultIOManager struct {
+	IOManager
+	fs   *FaultFS
+	name string
+	gen  int
+}
+
+func (m *faultIOManager) Write(buf []byte) (int, error) {
+	return m.fs.write(m.gen, m.name, buf, m.IOManager.Write)
+}
+
+func (m *faultIOManager) Sync() error {
+	return m.fs.sync(m.gen, m.name, m.IOManager.Sync)
+}
+
+func (m *faultIOManager) Truncate(size int64) error {
+	return m.fs.truncate(m.gen, m.name, size, m.IOManager.Truncate)
+}
+
+// 注入故障的普通文件
+type faultFile struct {
+	File
+	fs   *FaultFS
+	name string
+	gen  int
+}
+
+func (f *faultFile) Write(buf []byte) (int, error) {
+	return f.fs.write(f.gen, f.name, buf, f.File.Write)
+}
+
+func (f *faultFile) Sync() error {
+	return f.fs.sync(f.gen, f.name, f.File.Sync)
+}
+
+func (f *faultFile) Truncate(size int64) error {
+	return f.fs.truncate(f.gen, f.name, size, f.File.Truncate)
+}
@@ -0,0 +1,152 @@
+package fio
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFaultFS_FailAfter(t *testing.T) {
+	ffs := NewFaultFS(NewMemFS())
+	m, err := ffs.OpenIOManager("/mem/db/a", StandardFIO)
+	assert.Nil(t, err)
+	assert.Nil(t, ffs.SyncDir("/mem/db"))
+	assert.Equal(t, 2, ffs.Ops())
+
+	//第二次写入只写一半然后失败，之后的修改都失败
+	ffs.FailAfter(2, true)
+	_, err = m.Write([]byte("aaaa"))
+	assert.Nil(t, err)
+	n, err := m.Write([]byte("bbbb"))
+	assert.Equal(t, ErrInjectedFault, err)
+	assert.Equal(t, 2, n)
+	assert.True(t, ffs.Failed())
+	assert.Equal(t, ErrInjectedFault, m.Sync())
+	assert.Equal(t, ErrInjectedFault, ffs.Rename("/mem/db/a", "/mem/db/b"))
+	size, _ := m.Size()
+	assert.Equal(t, int64(6), size)
+
+	//没有Sync的数据在崩溃后丢失，之前打开的文件不能再写
+	assert.Nil(t, ffs.Crash())
+	assert.False(t, ffs.Failed())
+	_, err = m.Write([]byte("c"))
+	assert.Equal(t, ErrCrashed, err)
+	info, err := ffs.Stat("/mem/db/a")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), info.Size())
+}
+
+func TestFaultFS_Crash(t *testing.T) {
+	ffs := NewFaultFS(NewMemFS())
+	m, err := ffs.OpenIOManager("/mem/db/a", StandardFIO)
+	assert.Nil(t, err)
+	_, err = m.Write([]byte("synced"))
+	assert.Nil(t, err)
+	assert.Nil(t, m.Sync())
+	_, err = m.Write([]byte("-lost"))
+	assert.Nil(t, err)
+
+	//改名之后持久化的内容跟着新的文件名
+	assert.Nil(t, ffs.Rename("/mem/db/a", "/mem/db/b"))
+	f, err := ffs.OpenFile("/mem/db/c", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, DatafilePerm)
+	assert.Nil(t, err)
+	_, err = f.Write([]byte("file"))
+	assert.Nil(t, err)
+	assert.Nil(t, f.Sync())
+	assert.Nil(t, f.Truncate(2))
+	assert.Nil(t, ffs.SyncDir("/mem/db"))
+
+	locker := ffs.NewLocker("/mem/db/flock")
+	hold, err := locker.TryLock()
+	assert.Nil(t, err)
+	assert.True(t, hold)
+
+	assert.Nil(t, ffs.Crash())
+	info, err := ffs.Stat("/mem/db/b")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(6), info.Size())
+	info, err = ffs.Stat("/mem/db/c")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), info.Size())
+	//崩溃后文件锁都释放了
+	hold, err = ffs.NewLocker("/mem/db/flock").TryLock()
+	assert.Nil(t, err)
+	assert.True(t, hold)
+}
+
+func TestFaultFS_CrashDirectory(t *testing.T) {
+	ffs := NewFaultFS(NewMemFS())
+	for _, name := range []string{"/mem/db/a", "/mem/db/b", "/mem/db/c"} {
+		f, err := ffs.OpenFile(name, os.O_CREATE|os.O_WRONLY, DatafilePerm)
+		assert.Nil(t, err)
+		_, err = f.Write([]byte(name))
+		assert.Nil(t, err)
+		assert.Nil(t, f.Sync())
+		assert.Nil(t, f.Close())
+	}
+	assert.Nil(t, ffs.SyncDir("/mem/db"))
+
+	//没有SyncDir的新建、删除和改名在崩溃后都撤销
+	f, err := ffs.OpenFile("/mem/db/d", os.O_CREATE|os.O_WRONLY, DatafilePerm)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Sync())
+	assert.Nil(t, ffs.Remove("/mem/db/a"))
+	assert.Nil(t, ffs.Rename("/mem/db/b", "/mem/db/c"))
+	assert.Nil(t, ffs.MkdirAll("/mem/db-merge/sub", os.ModePerm))
+	assert.Nil(t, ffs.Crash())
+
+	_, err = ffs.Stat("/mem/db/d")
+	assert.True(t, os.IsNotExist(err))
+	_, err = ffs.Stat("/mem/db-merge")
+	assert.True(t, os.IsNotExist(err))
+	for _, name := range []string{"/mem/db/a", "/mem/db/b", "/mem/db/c"} {
+		info, err := ffs.Stat(name)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(len(name)), info.Size())
+	}
+
+	//SyncDir之后的修改在崩溃后保留
+	assert.Nil(t, ffs.Remove("/mem/db/a"))
+	assert.Nil(t, ffs.Rename("/mem/db/b", "/mem/db/c"))
+	assert.Nil(t, ffs.SyncDir("/mem/db"))
+	assert.Nil(t, ffs.Crash())
+	_, err = ffs.Stat("/mem/db/a")
+	assert.True(t, os.IsNotExist(err))
+	_, err = ffs.Stat("/mem/db/b")
+	assert.True(t, os.IsNotExist(err))
+	content, err := ffs.OpenFile("/mem/db/c", os.O_RDONLY, 0)
+	assert.Nil(t, err)
+	buf := make([]byte, 16)
+	n, _ := content.Read(buf)
+	assert.Equal(t, "/mem/db/b", string(buf[:n]))
+}
+
+func TestFaultFS_CrashWithTornWrites(t *testing.T) {
+	ffs := NewFaultFS(NewMemFS())
+	m, err := ffs.OpenIOManager("/mem/db/a", StandardFIO)
+	assert.Nil(t, err)
+	_, err = m.Write([]byte("synced"))
+	assert.Nil(t, err)
+	assert.Nil(t, m.Sync())
+	_, err = m.Write([]byte("-torn-write"))
+	assert.Nil(t, err)
+
+	//截断过的文件不是在持久化内容之后追加，按Crash恢复
+	f, err := ffs.OpenFile("/mem/db/b", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, DatafilePerm)
+	assert.Nil(t, err)
+	_, err = f.Write([]byte("file"))
+	assert.Nil(t, err)
+	assert.Nil(t, f.Sync())
+	assert.Nil(t, f.Truncate(2))
+	assert.Nil(t, ffs.SyncDir("/mem/db"))
+
+	//没有Sync的追加写入保留前一半
+	assert.Nil(t, ffs.CrashWithTornWrites())
+	content, err := ffs.readFile("/mem/db/a")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("synced-torn-"), content)
+	content, err = ffs.readFile("/mem/db/b")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("file"), content)
+}
@@ -40,6 +40,11 @@ func (fio *FileIO) Close() error {
 	return fio.fd.Close()
 }
 
+// Truncate截断文件，文件以追加方式打开，之后的写入从新的末尾开始
+func (fio *FileIO) Truncate(size int64) error {
+	return fio.fd.Truncate(size)
+}
+
 // Size获取文件大小
 func (fio *FileIO) Size() (int64, error) {
 	stat, err := fio.fd.Stat()
@@ -0,0 +1,211 @@
+package fio
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+
+	"github.com/gofrs/flock"
+)
+
+// 文件系统的抽象，数据库对文件和目录的操作都通过它完成
+type FS interface {
+	//打开文件并返回对应IO类型的IOManager，文件不存在时创建
+	OpenIOManager(name string, ioType FileIOType) (IOManager, error)
+	//按flag打开普通文件，用于文件头、复制等顺序读写
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Stat(name string) (os.FileInfo, error)
+	//目录中的文件，按文件名排序
+	ReadDir(name string) ([]os.DirEntry, error)
+	MkdirAll(path string, perm os.FileMode) error
+	Remove(name string) error
+	RemoveAll(path string) error
+	Rename(oldpath, newpath string) error
+	//硬链接，不支持时返回错误，调用方退化为复制
+	Link(oldname, newname string) error
+	//持久化目录，保证目录中新建、删除和改名的文件在崩溃后仍然有效
+	SyncDir(dir string) error
+	//文件锁，保证同一个目录同时只被一个实例打开
+	NewLocker(name string) Locker
+}
+
+// FS打开的普通文件
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.Closer
+	Sync() error
+	Stat() (os.FileInfo, error)
+	Truncate(size int64) error
+}
+
+// 文件锁
+type Locker interface {
+	//尝试获取锁，已经被持有时返回false
+	TryLock() (bool, error)
+	Unlock() error
+}
+
+// 操作系统的文件系统
+type OSFS struct{}
+
+func (OSFS) OpenIOManager(name string, ioType FileIOType) (IOManager, error) {
+	return NewIOManager(name, ioType)
+}
+
+func (OSFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	return os.OpenFile(name, flag, perm)
+}
+
+func (OSFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (OSFS) ReadDir(name string) ([]os.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+func (OSFS) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (OSFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (OSFS) RemoveAll(path string) error {
+	return os.RemoveAll(path)
+}
+
+func (OSFS) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (OSFS) Link(oldname, newname string) error {
+	return os.Link(oldname, newname)
+}
+
+func (OSFS) SyncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+func (OSFS) NewLocker(name string) Locker {
+	return flock.New(name)
+}
+
+// 在fs中复制文件
+func CopyFile(fs FS, src, dest string) error {
+	srcFile, err := fs.OpenFile(src, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+	destFile, err := fs.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, DatafilePerm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(destFile, srcFile); err != nil {
+		_ = destFile.Close()
+		return err
+	}
+	if err := destFile.Sync(); err != nil {
+		_ = destFile.Close()
+		return err
+	}
+	return destFile.Close()
+}
+
+// 硬链接文件，跨文件系统等无法链接的情况退化为复制
+// 只能用于不会再修改的文件，链接后两边共享同一份数据
+func LinkOrCopyFile(fs FS, src, dest string) error {
+	if err := fs.Link(src, dest); err == nil {
+		return nil
+	}
+	return CopyFile(fs, src, dest)
+}
+
+// 移动文件，跨文件系统不能改名时复制之后删除源文件
+func MoveFile(fs FS, src, dest string) error {
+	err := fs.Rename(src, dest)
+	if err == nil || !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	if err := CopyFile(fs, src, dest); err != nil {
+		return err
+	}
+	return fs.Remove(src)
+}
+
+// 创建目录，新建的每一级目录都在上一级目录中持久化，崩溃后目录仍然存在
+func MkdirAllSync(fs FS, path string, perm os.FileMode) error {
+	var created []string
+	for dir := filepath.Clean(path); ; dir = filepath.Dir(dir) {
+		if _, err := fs.Stat(dir); !os.IsNotExist(err) {
+			break
+		}
+		created = append(created, dir)
+		if dir == filepath.Dir(dir) {
+			break
+		}
+	}
+	if err := fs.MkdirAll(path, perm); err != nil {
+		return err
+	}
+	for i := len(created) - 1; i >= 0; i-- {
+		if err := fs.SyncDir(filepath.Dir(created[i])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 在dir中创建一个名字以prefix开头的新目录
+func MkdirTemp(fs FS, dir, prefix string) (string, error) {
+	for i := 0; i < 10000; i++ {
+		name := filepath.Join(dir, prefix+strconv.FormatUint(uint64(rand.Uint32()), 10))
+		if _, err := fs.Stat(name); !os.IsNotExist(err) {
+			continue
+		}
+		if err := fs.MkdirAll(name, os.ModePerm); err != nil {
+			return "", err
+		}
+		return name, nil
+	}
+	return "", &os.PathError{Op: "mkdirtemp", Path: filepath.Join(dir, prefix+"*"), Err: os.ErrExist}
+}
+
+// fs中目录下所有文件的大小
+func DirSize(fs FS, dir string) (int64, error) {
+	entries, err := fs.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if entry.IsDir() {
+			sub, err := DirSize(fs, path)
+			if err != nil {
+				return 0, err
+			}
+			size += sub
+			continue
+		}
+		info, err := fs.Stat(path)
+		if err != nil {
+			return 0, err
+		}
+		size += info.Size()
+	}
+	return size, nil
+}
@@ -11,8 +11,17 @@ const (
 	//标准文件IO
 	StandardFIO FileIOType = iota
 
-	//MemoryMap内存文件映射
+	//MemoryMap内存文件映射，只读，用于启动时加速加载
 	MemroyMap
+
+	//可读写的内存文件映射，可以在运行期间使用
+	MemoryMapRW
+
+	//带写缓冲的文件IO
+	BufferedFIO
+
+	//绕过页缓存的直接IO，只有linux支持，其他系统退回标准文件IO
+	DirectFIO
 )
 
 // 抽象IO管理接口，可以接入不同的IO类型，目前先用标准文件的IO
@@ -27,6 +36,13 @@ type IOManager interface {
 	Close() error
 	//Size获取文件大小
 	Size() (int64, error)
+	//Truncate截断到给定大小，之后的写入从这里开始
+	Truncate(int64) error
+}
+
+// 可以预先分配磁盘空间的IO，活跃文件创建时按数据文件大小分配，减少碎片和元数据更新
+type Preallocator interface {
+	Preallocate(size int64) error
 }
 
 //初始化IOManager,目前只支持标准FileIO
@@ -36,6 +52,12 @@ func NewIOManager(filename string, ioType FileIOType) (IOManager, error) {
 		return NewFileIOManager(filename)
 	case MemroyMap:
 		return NewMMapIOManager(filename)
+	case MemoryMapRW:
+		return NewMMapRWIOManager(filename)
+	case BufferedFIO:
+		return NewBufferedIOManager(filename)
+	case DirectFIO:
+		return NewDirectIOManager(filename)
 	default:
 		panic("Unknow IOType!")
 	}
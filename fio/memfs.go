@@ -0,0 +1,456 @@
+package fio
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrMemFileClosed = errors.New("the memory file is closed")
+
+// MemFS 内存中的文件系统，所有文件只保存在内存中，进程退出后数据丢失
+// 用于临时数据库和测试，和磁盘上的文件系统语义一致
+type MemFS struct {
+	mu    sync.Mutex
+	files map[string]*memFile
+	dirs  map[string]bool
+	locks map[string]bool
+}
+
+func NewMemFS() *MemFS {
+	return &MemFS{
+		files: make(map[string]*memFile),
+		dirs:  make(map[string]bool),
+		locks: make(map[string]bool),
+	}
+}
+
+// 内存中的文件内容
+type memFile struct {
+	mu      sync.RWMutex
+	data    []byte
+	modTime time.Time
+}
+
+func (f *memFile) readAt(buf []byte, offset int64) (int, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if offset >= int64(len(f.data)) {
+		return 0, io.EOF
+	}
+	n := copy(buf, f.data[offset:])
+	if n < len(buf) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// 在offset处写入，超出文件大小的部分扩展文件
+func (f *memFile) writeAt(buf []byte, offset int64) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if end := offset + int64(len(buf)); end > int64(len(f.data)) {
+		f.resize(end)
+	}
+	copy(f.data[offset:], buf)
+	f.modTime = time.Now()
+	return len(buf)
+}
+
+func (f *memFile) truncate(size int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.resize(size)
+	f.modTime = time.Now()
+}
+
+func (f *memFile) resize(size int64) {
+	if size <= int64(cap(f.data)) {
+		old := len(f.data)
+		f.data = f.data[:size]
+		//缩小后再扩大的部分要清零
+		for i := old; i < int(size); i++ {
+			f.data[i] = 0
+		}
+		return
+	}
+	data := make([]byte, size, size*2)
+	copy(data, f.data)
+	f.data = data
+}
+
+func (f *memFile) size() int64 {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return int64(len(f.data))
+}
+
+func (f *memFile) stat(name string) os.FileInfo {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return &memFileInfo{name: filepath.Base(name), size: int64(len(f.data)), modTime: f.modTime}
+}
+
+// 文件和目录的信息
+type memFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (info *memFileInfo) Name() string       { return info.name }
+func (info *memFileInfo) Size() int64        { return info.size }
+func (info *memFileInfo) ModTime() time.Time { return info.modTime }
+func (info *memFileInfo) IsDir() bool        { return info.dir }
+func (info *memFileInfo) Sys() interface{}   { return nil }
+
+func (info *memFileInfo) Mode() os.FileMode {
+	if info.dir {
+		return os.ModeDir | 0755
+	}
+	return DatafilePerm
+}
+
+func notExist(op, name string) error {
+	return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+}
+
+// 创建文件所在的目录，调用方需要持有锁
+func (memfs *MemFS) mkdirParents(name string) {
+	for dir := filepath.Dir(name); !memfs.dirs[dir]; dir = filepath.Dir(dir) {
+		memfs.dirs[dir] = true
+		if dir == filepath.Dir(dir) {
+			break
+		}
+	}
+}
+
+// 打开文件，不存在时按create决定是否创建，excl表示文件必须不存在
+func (memfs *MemFS) open(op, name string, create, excl bool) (*memFile, error) {
+	name = filepath.Clean(name)
+	memfs.mu.Lock()
+	defer memfs.mu.Unlock()
+	if file, ok := memfs.files[name]; ok {
+		if create && excl {
+			return nil, &os.PathError{Op: op, Path: name, Err: os.ErrExist}
+		}
+		return file, nil
+	}
+	if !create {
+		return nil, notExist(op, name)
+	}
+	if memfs.dirs[name] {
+		return nil, &os.PathError{Op: op, Path: name, Err: errors.New("is a directory")}
+	}
+	file := &memFile{modTime: time.Now()}
+	memfs.files[name] = file
+	memfs.mkdirParents(name)
+	return file, nil
+}
+
+func (memfs *MemFS) OpenIOManager(name string, ioType FileIOType) (IOManager, error) {
+	file, err := memfs.open("open", name, true, false)
+	if err != nil {
+		return nil, err
+	}
+	//内存中没有IO类型的区别，都直接读写文件内容
+	return &memIOManager{file: file}, nil
+}
+
+func (memfs *MemFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	file, err := memfs.open("open", name, flag&os.O_CREATE != 0, flag&os.O_EXCL != 0)
+	if err != nil {
+		return nil, err
+	}
+	if flag&os.O_TRUNC != 0 {
+		file.truncate(0)
+	}
+	handle := &memFileHandle{file: file, name: name, append: flag&os.O_APPEND != 0}
+	return handle, nil
+}
+
+func (memfs *MemFS) Stat(name string) (os.FileInfo, error) {
+	name = filepath.Clean(name)
+	memfs.mu.Lock()
+	defer memfs.mu.Unlock()
+	if file, ok := memfs.files[name]; ok {
+		return file.stat(name), nil
+	}
+	if memfs.dirs[name] {
+		return &memFileInfo{name: filepath.Base(name), dir: true}, nil
+	}
+	return nil, notExist("stat", name)
+}
+
+func (memfs *MemFS) ReadDir(name string) ([]os.DirEntry, error) {
+	name = filepath.Clean(name)
+	memfs.mu.Lock()
+	defer memfs.mu.Unlock()
+	if !memfs.dirs[name] {
+		return nil, notExist("open", name)
+	}
+	var entries []os.DirEntry
+	for path, file := range memfs.files {
+		if filepath.Dir(path) == name {
+			entries = append(entries, fs.FileInfoToDirEntry(file.stat(path)))
+		}
+	}
+	for path := range memfs.dirs {
+		if path != name && filepath.Dir(path) == name {
+			entries = append(entries, fs.FileInfoToDirEntry(&memFileInfo{name: filepath.Base(path), dir: true}))
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries, nil
+}
+
+func (memfs *MemFS) MkdirAll(path string, perm os.FileMode) error {
+	path = filepath.Clean(path)
+	memfs.mu.Lock()
+	defer memfs.mu.Unlock()
+	if _, ok := memfs.files[path]; ok {
+		return &os.PathError{Op: "mkdir", Path: path, Err: errors.New("not a directory")}
+	}
+	memfs.dirs[path] = true
+	memfs.mkdirParents(path)
+	return nil
+}
+
+func (memfs *MemFS) Remove(name string) error {
+	name = filepath.Clean(name)
+	memfs.mu.Lock()
+	defer memfs.mu.Unlock()
+	if _, ok := memfs.files[name]; ok {
+		delete(memfs.files, name)
+		return nil
+	}
+	if memfs.dirs[name] {
+		prefix := name + string(filepath.Separator)
+		for path := range memfs.files {
+			if strings.HasPrefix(path, prefix) {
+				return &os.PathError{Op: "remove", Path: name, Err: errors.New("directory not empty")}
+			}
+		}
+		for path := range memfs.dirs {
+			if strings.HasPrefix(path, prefix) {
+				return &os.PathError{Op: "remove", Path: name, Err: errors.New("directory not empty")}
+			}
+		}
+		delete(memfs.dirs, name)
+		return nil
+	}
+	return notExist("remove", name)
+}
+
+func (memfs *MemFS) RemoveAll(path string) error {
+	path = filepath.Clean(path)
+	memfs.mu.Lock()
+	defer memfs.mu.Unlock()
+	prefix := path + string(filepath.Separator)
+	for name := range memfs.files {
+		if name == path || strings.HasPrefix(name, prefix) {
+			delete(memfs.files, name)
+		}
+	}
+	for name := range memfs.dirs {
+		if name == path || strings.HasPrefix(name, prefix) {
+			delete(memfs.dirs, name)
+		}
+	}
+	return nil
+}
+
+// 改名文件或目录，目标是文件时覆盖
+func (memfs *MemFS) Rename(oldpath, newpath string) error {
+	oldpath, newpath = filepath.Clean(oldpath), filepath.Clean(newpath)
+	memfs.mu.Lock()
+	defer memfs.mu.Unlock()
+	if file, ok := memfs.files[oldpath]; ok {
+		delete(memfs.files, oldpath)
+		memfs.files[newpath] = file
+		memfs.mkdirParents(newpath)
+		return nil
+	}
+	if !memfs.dirs[oldpath] {
+		return notExist("rename", oldpath)
+	}
+	prefix := oldpath + string(filepath.Separator)
+	for name, file := range memfs.files {
+		if strings.HasPrefix(name, prefix) {
+			delete(memfs.files, name)
+			memfs.files[newpath+name[len(oldpath):]] = file
+		}
+	}
+	for name := range memfs.dirs {
+		if name == oldpath || strings.HasPrefix(name, prefix) {
+			delete(memfs.dirs, name)
+			memfs.dirs[newpath+name[len(oldpath):]] = true
+		}
+	}
+	memfs.mkdirParents(newpath)
+	return nil
+}
+
+// 硬链接，两个文件名共享同一份内容
+func (memfs *MemFS) Link(oldname, newname string) error {
+	oldname, newname = filepath.Clean(oldname), filepath.Clean(newname)
+	memfs.mu.Lock()
+	defer memfs.mu.Unlock()
+	file, ok := memfs.files[oldname]
+	if !ok {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: os.ErrNotExist}
+	}
+	if _, ok := memfs.files[newname]; ok || memfs.dirs[newname] {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: os.ErrExist}
+	}
+	if !memfs.dirs[filepath.Dir(newname)] {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: os.ErrNotExist}
+	}
+	memfs.files[newname] = file
+	return nil
+}
+
+// 内存中的目录不需要持久化
+func (memfs *MemFS) SyncDir(dir string) error {
+	return nil
+}
+
+func (memfs *MemFS) NewLocker(name string) Locker {
+	return &memLocker{fs: memfs, name: filepath.Clean(name)}
+}
+
+// 内存中的文件锁，同一个MemFS中同一个文件只能被锁一次
+type memLocker struct {
+	fs     *MemFS
+	name   string
+	locked bool
+}
+
+func (l *memLocker) TryLock() (bool, error) {
+	l.fs.mu.Lock()
+	defer l.fs.mu.Unlock()
+	if l.locked {
+		return true, nil
+	}
+	if l.fs.locks[l.name] {
+		return false, nil
+	}
+	l.fs.locks[l.name] = true
+	l.locked = true
+	return true, nil
+}
+
+func (l *memLocker) Unlock() error {
+	l.fs.mu.Lock()
+	defer l.fs.mu.Unlock()
+	if l.locked {
+		delete(l.fs.locks, l.name)
+		l.locked = false
+	}
+	return nil
+}
+
+// 内存文件的IOManager，写入追加到文件末尾
+type memIOManager struct {
+	file   *memFile
+	closed bool
+}
+
+func (m *memIOManager) Read(buf []byte, offset int64) (int, error) {
+	if m.closed {
+		return 0, ErrMemFileClosed
+	}
+	return m.file.readAt(buf, offset)
+}
+
+func (m *memIOManager) Write(buf []byte) (int, error) {
+	if m.closed {
+		return 0, ErrMemFileClosed
+	}
+	return m.file.writeAt(buf, m.file.size()), nil
+}
+
+func (m *memIOManager) Sync() error {
+	return nil
+}
+
+func (m *memIOManager) Close() error {
+	m.closed = true
+	return nil
+}
+
+func (m *memIOManager) Size() (int64, error) {
+	return m.file.size(), nil
+}
+
+func (m *memIOManager) Truncate(size int64) error {
+	m.file.truncate(size)
+	return nil
+}
+
+// 通过OpenFile打开的内存文件，按顺序读写
+type memFileHandle struct {
+	file   *memFile
+	name   string
+	offset int64
+	append bool
+	closed bool
+}
+
+func (h *memFileHandle) Read(buf []byte) (int, error) {
+	if h.closed {
+		return 0, ErrMemFileClosed
+	}
+	n, err := h.file.readAt(buf, h.offset)
+	h.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (h *memFileHandle) ReadAt(buf []byte, offset int64) (int, error) {
+	if h.closed {
+		return 0, ErrMemFileClosed
+	}
+	return h.file.readAt(buf, offset)
+}
+
+func (h *memFileHandle) Write(buf []byte) (int, error) {
+	if h.closed {
+		return 0, ErrMemFileClosed
+	}
+	if h.append {
+		h.offset = h.file.size()
+	}
+	n := h.file.writeAt(buf, h.offset)
+	h.offset += int64(n)
+	return n, nil
+}
+
+func (h *memFileHandle) Close() error {
+	h.closed = true
+	return nil
+}
+
+func (h *memFileHandle) Sync() error {
+	return nil
+}
+
+func (h *memFileHandle) Stat() (os.FileInfo, error) {
+	return h.file.stat(h.name), nil
+}
+
+func (h *memFileHandle) Truncate(size int64) error {
+	h.file.truncate(size)
+	return nil
+}
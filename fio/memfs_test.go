@@ -0,0 +1,164 @@
+package fio
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemFS_IOManager(t *testing.T) {
+	memfs := NewMemFS()
+	path := filepath.Join("/mem", "db", "000000000.data")
+
+	m, err := memfs.OpenIOManager(path, StandardFIO)
+	assert.Nil(t, err)
+	_, err = m.Write([]byte("key-a"))
+	assert.Nil(t, err)
+	_, err = m.Write([]byte("value-a"))
+	assert.Nil(t, err)
+	size, err := m.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(12), size)
+
+	b := make([]byte, 7)
+	n, err := m.Read(b, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, 7, n)
+	assert.Equal(t, []byte("value-a"), b)
+	_, err = m.Read(b, 6)
+	assert.Equal(t, io.EOF, err)
+
+	//截断之后从截断的位置继续写
+	assert.Nil(t, m.Truncate(5))
+	_, err = m.Write([]byte("-b"))
+	assert.Nil(t, err)
+	b = make([]byte, 7)
+	n, _ = m.Read(b, 0)
+	assert.Equal(t, []byte("key-a-b"), b[:n])
+	assert.Nil(t, m.Close())
+	_, err = m.Write([]byte("x"))
+	assert.Equal(t, ErrMemFileClosed, err)
+
+	//重新打开可以读到之前的内容，目录自动创建
+	m, err = memfs.OpenIOManager(path, MemroyMap)
+	assert.Nil(t, err)
+	size, _ = m.Size()
+	assert.Equal(t, int64(7), size)
+	info, err := memfs.Stat(filepath.Join("/mem", "db"))
+	assert.Nil(t, err)
+	assert.True(t, info.IsDir())
+}
+
+func TestMemFS_Dir(t *testing.T) {
+	memfs := NewMemFS()
+	assert.Nil(t, memfs.MkdirAll("/mem/db", os.ModePerm))
+	for _, name := range []string{"b", "a", "c"} {
+		f, err := memfs.OpenFile(filepath.Join("/mem/db", name), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, DatafilePerm)
+		assert.Nil(t, err)
+		_, err = f.Write([]byte(name))
+		assert.Nil(t, err)
+		assert.Nil(t, f.Close())
+	}
+	assert.Nil(t, memfs.MkdirAll("/mem/db/sub", os.ModePerm))
+
+	entries, err := memfs.ReadDir("/mem/db")
+	assert.Nil(t, err)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	assert.Equal(t, []string{"a", "b", "c", "sub"}, names)
+	assert.True(t, entries[3].IsDir())
+
+	_, err = memfs.Stat("/mem/db/d")
+	assert.True(t, os.IsNotExist(err))
+	_, err = memfs.OpenFile("/mem/db/d", os.O_RDONLY, 0)
+	assert.True(t, os.IsNotExist(err))
+	assert.NotNil(t, memfs.Remove("/mem/db"))
+
+	//文件改名覆盖目标，目录改名带上里面的文件
+	assert.Nil(t, memfs.Rename("/mem/db/a", "/mem/db/b"))
+	f, err := memfs.OpenFile("/mem/db/b", os.O_RDONLY, 0)
+	assert.Nil(t, err)
+	buf, err := io.ReadAll(f)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("a"), buf)
+	assert.Nil(t, memfs.Rename("/mem/db", "/mem/db2"))
+	_, err = memfs.Stat("/mem/db/b")
+	assert.True(t, os.IsNotExist(err))
+	size, err := DirSize(memfs, "/mem/db2")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), size)
+
+	//追加写
+	f, err = memfs.OpenFile("/mem/db2/c", os.O_WRONLY|os.O_APPEND, 0)
+	assert.Nil(t, err)
+	_, err = f.Write([]byte("cc"))
+	assert.Nil(t, err)
+	info, err := f.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), info.Size())
+
+	assert.Nil(t, memfs.RemoveAll("/mem/db2"))
+	_, err = memfs.ReadDir("/mem/db2")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestMemFS_Locker(t *testing.T) {
+	memfs := NewMemFS()
+	l1 := memfs.NewLocker("/mem/db/flock")
+	l2 := memfs.NewLocker("/mem/db/flock")
+	hold, err := l1.TryLock()
+	assert.Nil(t, err)
+	assert.True(t, hold)
+	hold, err = l2.TryLock()
+	assert.Nil(t, err)
+	assert.False(t, hold)
+	assert.Nil(t, l1.Unlock())
+	hold, err = l2.TryLock()
+	assert.Nil(t, err)
+	assert.True(t, hold)
+}
+
+func TestMemFS_Link(t *testing.T) {
+	memfs := NewMemFS()
+	m, err := memfs.OpenIOManager("/mem/db/a", StandardFIO)
+	assert.Nil(t, err)
+	_, err = m.Write([]byte("aaa"))
+	assert.Nil(t, err)
+
+	//链接后两边共享同一份内容
+	assert.Nil(t, LinkOrCopyFile(memfs, "/mem/db/a", "/mem/db/b"))
+	_, err = m.Write([]byte("bb"))
+	assert.Nil(t, err)
+	info, err := memfs.Stat("/mem/db/b")
+	assert.Nil(t, err)
+	assert.Equal(t, "b", info.Name())
+	assert.Equal(t, int64(5), info.Size())
+	assert.NotNil(t, memfs.Link("/mem/db/a", "/mem/db/b"))
+	assert.NotNil(t, memfs.Link("/mem/db/a", "/mem/other/b"))
+
+	//不能链接时复制
+	assert.Nil(t, memfs.MkdirAll("/mem/other", os.ModePerm))
+	assert.Nil(t, CopyFile(memfs, "/mem/db/a", "/mem/other/c"))
+	_, err = m.Write([]byte("c"))
+	assert.Nil(t, err)
+	info, err = memfs.Stat("/mem/other/c")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), info.Size())
+
+	//临时目录的名字不会重复
+	tmp1, err := MkdirTemp(memfs, "/mem", "tmp-")
+	assert.Nil(t, err)
+	tmp2, err := MkdirTemp(memfs, "/mem", "tmp-")
+	assert.Nil(t, err)
+	assert.NotEqual(t, tmp1, tmp2)
+	info, err = memfs.Stat(tmp1)
+	assert.Nil(t, err)
+	assert.True(t, info.IsDir())
+	_, err = memfs.OpenFile("/mem/db/a", os.O_CREATE|os.O_EXCL|os.O_WRONLY, DatafilePerm)
+	assert.True(t, os.IsExist(err))
+}
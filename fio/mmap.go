@@ -1,6 +1,7 @@
 package fio
 
 import (
+	"errors"
 	"os"
 
 	"golang.org/x/exp/mmap"
@@ -44,6 +45,11 @@ func (mmap *MMap) Close() error {
 	return mmap.readerAt.Close()
 }
 
+// Truncate只读的mmap不能截断
+func (mmap *MMap) Truncate(int64) error {
+	return errors.New("this mmap can't be truncated")
+}
+
 // Size获取文件大小
 func (mmap *MMap) Size() (int64, error) {
 	return int64(mmap.readerAt.Len()), nil
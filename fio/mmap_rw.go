@@ -0,0 +1,161 @@
+//go:build !windows
+// +build !windows
+
+package fio
+
+import (
+	"io"
+	"os"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// 映射区域每次至少扩展的大小
+const mmapGrowSize = 4 * 1024 * 1024
+
+// MMapRW 可读写的内存文件映射，可以在运行期间一直使用
+// 文件按映射大小预先扩展，写入直接拷贝到映射区域，空间不够时扩展文件重新映射
+// 映射区域中数据之后的部分都是0，关闭时把文件截断到实际写入的大小
+type MMapRW struct {
+	mu   sync.RWMutex
+	fd   *os.File
+	data []byte //映射区域，长度就是文件当前的大小
+	size int64  //实际写入的数据大小
+}
+
+// 初始化可读写的MMap
+func NewMMapRWIOManager(filename string) (*MMapRW, error) {
+	fd, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR, DatafilePerm)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := fd.Stat()
+	if err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+	mmap := &MMapRW{fd: fd, size: stat.Size()}
+	if err := mmap.remap(stat.Size()); err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+	return mmap, nil
+}
+
+// 把文件扩展到capacity并重新映射，调用方需要持有写锁
+func (mmap *MMapRW) remap(capacity int64) error {
+	if mmap.data != nil {
+		if err := unix.Munmap(mmap.data); err != nil {
+			return err
+		}
+		mmap.data = nil
+	}
+	stat, err := mmap.fd.Stat()
+	if err != nil {
+		return err
+	}
+	if stat.Size() != capacity {
+		if err := mmap.fd.Truncate(capacity); err != nil {
+			return err
+		}
+	}
+	if capacity == 0 {
+		return nil
+	}
+	data, err := unix.Mmap(int(mmap.fd.Fd()), 0, int(capacity), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+	mmap.data = data
+	return nil
+}
+
+// 空间不够时扩展，每次至少翻倍
+func (mmap *MMapRW) grow(need int64) error {
+	capacity := int64(len(mmap.data))
+	if need <= capacity {
+		return nil
+	}
+	newCapacity := capacity * 2
+	if newCapacity < mmapGrowSize {
+		newCapacity = mmapGrowSize
+	}
+	for newCapacity < need {
+		newCapacity *= 2
+	}
+	return mmap.remap(newCapacity)
+}
+
+// 从文件的给定位置读取对应数据
+func (mmap *MMapRW) Read(buf []byte, offset int64) (int, error) {
+	mmap.mu.RLock()
+	defer mmap.mu.RUnlock()
+	if offset >= mmap.size {
+		return 0, io.EOF
+	}
+	n := copy(buf, mmap.data[offset:mmap.size])
+	if n < len(buf) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// 写入字节到文件末尾
+func (mmap *MMapRW) Write(buf []byte) (int, error) {
+	mmap.mu.Lock()
+	defer mmap.mu.Unlock()
+	if err := mmap.grow(mmap.size + int64(len(buf))); err != nil {
+		return 0, err
+	}
+	n := copy(mmap.data[mmap.size:], buf)
+	mmap.size += int64(n)
+	return n, nil
+}
+
+// Sync持久化数据，先刷映射区域，再刷文件大小等元数据
+func (mmap *MMapRW) Sync() error {
+	mmap.mu.RLock()
+	defer mmap.mu.RUnlock()
+	if mmap.data != nil {
+		if err := unix.Msync(mmap.data, unix.MS_SYNC); err != nil {
+			return err
+		}
+	}
+	return mmap.fd.Sync()
+}
+
+// Close关闭IO，解除映射并把文件截断到实际大小
+func (mmap *MMapRW) Close() error {
+	mmap.mu.Lock()
+	defer mmap.mu.Unlock()
+	if mmap.data != nil {
+		if err := unix.Munmap(mmap.data); err != nil {
+			return err
+		}
+		mmap.data = nil
+	}
+	if err := mmap.fd.Truncate(mmap.size); err != nil {
+		_ = mmap.fd.Close()
+		return err
+	}
+	return mmap.fd.Close()
+}
+
+// Size获取实际写入的数据大小
+func (mmap *MMapRW) Size() (int64, error) {
+	mmap.mu.RLock()
+	defer mmap.mu.RUnlock()
+	return mmap.size, nil
+}
+
+// Truncate把文件截断到size并重新映射，之后的写入从size开始，需要时再扩展
+func (mmap *MMapRW) Truncate(size int64) error {
+	mmap.mu.Lock()
+	defer mmap.mu.Unlock()
+	if err := mmap.remap(size); err != nil {
+		return err
+	}
+	mmap.size = size
+	return nil
+}
@@ -0,0 +1,75 @@
+//go:build !windows
+// +build !windows
+
+package fio
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMMapRW(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-mmap-rw")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "mmap-rw.data")
+
+	mmap, err := NewMMapRWIOManager(path)
+	assert.Nil(t, err)
+	size, err := mmap.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), size)
+
+	//写入后文件预先扩展，大小按实际写入计算
+	data := []byte("test String")
+	n, err := mmap.Write(data)
+	assert.Nil(t, err)
+	assert.Equal(t, len(data), n)
+	_, err = mmap.Write(data)
+	assert.Nil(t, err)
+	size, err = mmap.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(data)*2), size)
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(mmapGrowSize), info.Size())
+
+	buf := make([]byte, len(data))
+	n, err = mmap.Read(buf, int64(len(data)))
+	assert.Nil(t, err)
+	assert.Equal(t, data, buf)
+	_, err = mmap.Read(buf, int64(len(data))+1)
+	assert.Equal(t, io.EOF, err)
+
+	//超过映射区域时扩展并重新映射
+	big := make([]byte, mmapGrowSize)
+	big[len(big)-1] = 'x'
+	_, err = mmap.Write(big)
+	assert.Nil(t, err)
+	assert.Nil(t, mmap.Sync())
+	last := make([]byte, 1)
+	_, err = mmap.Read(last, int64(len(data)*2+mmapGrowSize-1))
+	assert.Nil(t, err)
+	assert.Equal(t, byte('x'), last[0])
+
+	//截断之后从新的末尾写入
+	assert.Nil(t, mmap.Truncate(int64(len(data))))
+	_, err = mmap.Write([]byte("abc"))
+	assert.Nil(t, err)
+	assert.Nil(t, mmap.Close())
+
+	//关闭时截断到实际大小
+	content, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, append(append([]byte{}, data...), "abc"...), content)
+
+	mmap, err = NewMMapRWIOManager(path)
+	assert.Nil(t, err)
+	size, err = mmap.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(content)), size)
+	assert.Nil(t, mmap.Close())
+}
@@ -0,0 +1,9 @@
+//go:build windows
+// +build windows
+
+package fio
+
+// windows上没有实现可读写的mmap，使用标准文件IO
+func NewMMapRWIOManager(filename string) (*FileIO, error) {
+	return NewFileIOManager(filename)
+}
@@ -0,0 +1,20 @@
+//go:build linux
+// +build linux
+
+package fio
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// 使用fallocate预先分配空间，KEEP_SIZE保持文件大小不变，读取时不会读到预分配的部分
+// 文件系统不支持时忽略
+func preallocate(fd *os.File, size int64) error {
+	err := unix.Fallocate(int(fd.Fd()), unix.FALLOC_FL_KEEP_SIZE, 0, size)
+	if err == unix.EOPNOTSUPP || err == unix.ENOSYS {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package fio
+
+import "os"
+
+// 只有linux上使用fallocate预先分配空间，其他系统不做处理
+func preallocate(fd *os.File, size int64) error {
+	return nil
+}
@@ -0,0 +1,56 @@
+package fio
+
+import (
+	"errors"
+	"os"
+)
+
+var ErrReadOnlyFile = errors.New("the file is opened read only")
+
+// 只读打开的文件IO，不会创建或修改文件，用于离线读取恢复源和归档
+type ReadOnlyIO struct {
+	file File
+}
+
+// 只读打开文件，文件不存在时返回错误
+func NewReadOnlyIOManager(fs FS, name string) (*ReadOnlyIO, error) {
+	file, err := fs.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &ReadOnlyIO{file: file}, nil
+}
+
+// 从文件的给定位置读取对应数据
+func (rio *ReadOnlyIO) Read(data []byte, off int64) (int, error) {
+	return rio.file.ReadAt(data, off)
+}
+
+// 只读文件不能写入
+func (rio *ReadOnlyIO) Write(data []byte) (int, error) {
+	return 0, ErrReadOnlyFile
+}
+
+// 没有写入，不需要持久化
+func (rio *ReadOnlyIO) Sync() error {
+	return nil
+}
+
+// Close关闭IO
+func (rio *ReadOnlyIO) Close() error {
+	return rio.file.Close()
+}
+
+// 只读文件不能截断
+func (rio *ReadOnlyIO) Truncate(size int64) error {
+	return ErrReadOnlyFile
+}
+
+// Size获取文件大小
+func (rio *ReadOnlyIO) Size() (int64, error) {
+	stat, err := rio.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return stat.Size(), nil
+}
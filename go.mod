@@ -6,6 +6,7 @@ require (
 	github.com/google/btree v1.1.2
 	github.com/plar/go-adaptive-radix-tree v1.0.5
 	github.com/stretchr/testify v1.9.0
+	golang.org/x/sys v0.5.0
 )
 
 require (
@@ -19,6 +20,5 @@ require (
 	github.com/tidwall/redcon v1.6.2 // indirect
 	go.etcd.io/bbolt v1.3.9 // indirect
 	golang.org/x/exp v0.0.0-20240416160154-fe59bbe5cc7f // indirect
-	golang.org/x/sys v0.5.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -2,7 +2,11 @@ package index
 
 import (
 	"bitcask-go/data"
+	"encoding/binary"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"go.etcd.io/bbolt"
 )
@@ -12,10 +16,34 @@ import (
 
 const bptreeIndexFileName = "bptree-index"
 
-var indexBucketName = []byte("bitcask-index")
+var (
+	indexBucketName = []byte("bitcask-index")
+	metaBucketName  = []byte("bitcask-meta")
+	checkpointKey   = []byte("checkpoint")
+)
+
+// 异步刷盘模式下，后台定时刷盘的间隔
+const bptreeFlushInterval = time.Second
 
 type BPlusTree struct {
 	tree *bbolt.DB
+
+	//异步刷盘模式，索引更新先暂存在内存，攒够一批再用一个bbolt事务写入
+	lock      *sync.RWMutex
+	pending   map[string]*data.LogRecordPos //暂存还没写入bbolt的索引，nil表示删除
+	flushSize int                           //暂存多少条后刷盘，0表示不开启异步刷盘
+	closeCh   chan struct{}                 //关闭后台刷盘协程
+	flushDone chan struct{}                 //后台刷盘协程已经退出
+	flushErr  error                         //刷盘或者bbolt事务失败的错误，之后的更新和关闭都返回它
+
+	checkpoint atomic.Value //最新的检查点，随下一次更新事务一起写入bbolt
+	closed     bool         //是否已经关闭
+}
+
+// 检查点，记录已经应用到索引的日志末尾位置以及当时的事务序列号
+type checkpoint struct {
+	pos   *data.LogRecordPos
+	seqNo uint64
 }
 
 func NewBPlusTree(path string, syncWrite bool) *BPlusTree {
@@ -27,7 +55,10 @@ func NewBPlusTree(path string, syncWrite bool) *BPlusTree {
 	}
 	//创建相关的bucket
 	if err := bptree.Update(func(tx *bbolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists(indexBucketName)
+		if _, err := tx.CreateBucketIfNotExists(indexBucketName); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(metaBucketName)
 		return err
 	}); err != nil {
 		panic("failed to create bucket in bptree")
@@ -35,24 +66,157 @@ func NewBPlusTree(path string, syncWrite bool) *BPlusTree {
 
 	return &BPlusTree{
 		tree: bptree,
+		lock: new(sync.RWMutex),
+	}
+}
+
+// 开启异步刷盘模式，适用于批量导入
+// 索引更新暂存在内存中，达到flushSize条或者定时器触发时用一个事务写入bbolt
+// 注意崩溃时还没刷盘的索引会丢失，需要从数据文件恢复
+func (bpt *BPlusTree) EnableAsyncFlush(flushSize int) {
+	if flushSize <= 0 || bpt.flushSize > 0 {
+		return
+	}
+	bpt.flushSize = flushSize
+	bpt.pending = make(map[string]*data.LogRecordPos)
+	bpt.closeCh = make(chan struct{})
+	bpt.flushDone = make(chan struct{})
+	//协程只使用创建时的channel，Close会把字段置空
+	closeCh, flushDone := bpt.closeCh, bpt.flushDone
+	go func() {
+		defer close(flushDone)
+		ticker := time.NewTicker(bptreeFlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				//后台协程不能panic，错误保存下来由调用方返回
+				bpt.lock.Lock()
+				if bpt.flushErr == nil {
+					bpt.flushErr = bpt.flush()
+				}
+				bpt.lock.Unlock()
+			case <-closeCh:
+				return
+			}
+		}
+	}()
+}
+
+// 刷盘或者bbolt事务失败的错误，失败之后不应该再写入数据
+// 同步模式下的更新和读取失败时也不会panic，返回零值并把错误保存在这里
+func (bpt *BPlusTree) FlushErr() error {
+	bpt.lock.RLock()
+	defer bpt.lock.RUnlock()
+	return bpt.flushErr
+}
+
+// 保存第一次失败的错误
+func (bpt *BPlusTree) setErr(err error) {
+	bpt.lock.Lock()
+	defer bpt.lock.Unlock()
+	if bpt.flushErr == nil {
+		bpt.flushErr = err
+	}
+}
+
+// 将暂存的索引用一个事务写入bbolt
+func (bpt *BPlusTree) Flush() error {
+	bpt.lock.Lock()
+	defer bpt.lock.Unlock()
+	return bpt.flush()
+}
+
+// 刷盘，调用方必须持有写锁
+func (bpt *BPlusTree) flush() error {
+	if len(bpt.pending) == 0 {
+		return nil
+	}
+	if err := bpt.update(func(bucket *bbolt.Bucket) error {
+		for key, pos := range bpt.pending {
+			if pos == nil {
+				if err := bucket.Delete([]byte(key)); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := bucket.Put([]byte(key), data.EncodeLogRecordPos(pos)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
 	}
+	bpt.pending = make(map[string]*data.LogRecordPos)
+	return nil
+}
+
+// 异步模式下写入暂存区，返回key上一次的索引值，调用方必须持有写锁
+func (bpt *BPlusTree) putPending(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
+	oldPos, ok := bpt.pending[string(key)]
+	if !ok {
+		var err error
+		if oldPos, err = bpt.getFromTree(key); err != nil && bpt.flushErr == nil {
+			bpt.flushErr = err
+		}
+	}
+	if pos == nil && oldPos == nil {
+		//本来就不存在，不需要记录删除
+		return nil
+	}
+	bpt.pending[string(key)] = pos
+	if len(bpt.pending) >= bpt.flushSize && bpt.flushErr == nil {
+		bpt.flushErr = bpt.flush()
+	}
+	return oldPos
 }
 
 func (bpt *BPlusTree) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
-	var oldVal []byte
-	if err := bpt.tree.Update(func(tx *bbolt.Tx) error {
-		bucket := tx.Bucket(indexBucketName)
-		oldVal = bucket.Get(key)
+	if bpt.flushSize > 0 {
+		bpt.lock.Lock()
+		defer bpt.lock.Unlock()
+		return bpt.putPending(key, pos)
+	}
+
+	var oldPos *data.LogRecordPos
+	if err := bpt.update(func(bucket *bbolt.Bucket) error {
+		//bbolt返回的值只在事务内有效，需要在事务内解码
+		if oldVal := bucket.Get(key); len(oldVal) != 0 {
+			oldPos = data.DecodeLogRecordPos(oldVal)
+		}
 		return bucket.Put(key, data.EncodeLogRecordPos(pos))
 	}); err != nil {
-		panic("failed to put value (in bucket) in bptree")
-	}
-	if len(oldVal) == 0 {
+		bpt.setErr(err)
 		return nil
 	}
-	return data.DecodeLogRecordPos(oldVal)
+	return oldPos
 }
 func (bpt *BPlusTree) Get(key []byte) *data.LogRecordPos {
+	if bpt.flushSize > 0 {
+		bpt.lock.RLock()
+		pos, ok := bpt.pending[string(key)]
+		if ok {
+			bpt.lock.RUnlock()
+			return pos
+		}
+		//持有读锁读取bbolt，保证暂存区刷盘的过程中读不到中间状态
+		pos, err := bpt.getFromTree(key)
+		bpt.lock.RUnlock()
+		if err != nil {
+			bpt.setErr(err)
+		}
+		return pos
+	}
+	pos, err := bpt.getFromTree(key)
+	if err != nil {
+		bpt.setErr(err)
+	}
+	return pos
+}
+
+// 直接从bbolt中读取索引
+func (bpt *BPlusTree) getFromTree(key []byte) (*data.LogRecordPos, error) {
 	var pos *data.LogRecordPos
 	if err := bpt.tree.View(func(tx *bbolt.Tx) error {
 		bucket := tx.Bucket(indexBucketName)
@@ -62,49 +226,220 @@ func (bpt *BPlusTree) Get(key []byte) *data.LogRecordPos {
 		}
 		return nil
 	}); err != nil {
-		println(err.Error())
-		panic("failed to get value (in bucket) in bptree")
+		return nil, err
 	}
-	return pos
+	return pos, nil
 }
 func (bpt *BPlusTree) Delete(key []byte) (*data.LogRecordPos, bool) {
-	var oldVal []byte
-	if err := bpt.tree.Update(func(tx *bbolt.Tx) error {
-		bucket := tx.Bucket(indexBucketName)
-		if oldVal = bucket.Get(key); len(oldVal) != 0 {
+	if bpt.flushSize > 0 {
+		bpt.lock.Lock()
+		defer bpt.lock.Unlock()
+		oldPos := bpt.putPending(key, nil)
+		return oldPos, oldPos != nil
+	}
+
+	var oldPos *data.LogRecordPos
+	if err := bpt.update(func(bucket *bbolt.Bucket) error {
+		if oldVal := bucket.Get(key); len(oldVal) != 0 {
+			oldPos = data.DecodeLogRecordPos(oldVal)
 			return bucket.Delete(key)
 		}
 		return nil
 	}); err != nil {
-		panic("failed to delete value (in bucket) in bptree")
-	}
-	if len(oldVal) == 0 {
+		bpt.setErr(err)
 		return nil, false
 	}
-	return data.DecodeLogRecordPos(oldVal), true
+	return oldPos, oldPos != nil
 }
 
-// 返回创建的索引迭代器
+// 批量put，所有key在一个bbolt事务中写入，返回每个key上一次的索引值
+func (bpt *BPlusTree) PutBatch(keys [][]byte, poses []*data.LogRecordPos) []*data.LogRecordPos {
+	oldPoses := make([]*data.LogRecordPos, len(keys))
+	if bpt.flushSize > 0 {
+		bpt.lock.Lock()
+		defer bpt.lock.Unlock()
+		for i, key := range keys {
+			oldPoses[i] = bpt.putPending(key, poses[i])
+		}
+		return oldPoses
+	}
+
+	if err := bpt.update(func(bucket *bbolt.Bucket) error {
+		for i, key := range keys {
+			if oldVal := bucket.Get(key); len(oldVal) != 0 {
+				oldPoses[i] = data.DecodeLogRecordPos(oldVal)
+			}
+			if err := bucket.Put(key, data.EncodeLogRecordPos(poses[i])); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		bpt.setErr(err)
+		return make([]*data.LogRecordPos, len(keys))
+	}
+	return oldPoses
+}
+
+// 批量delete，所有key在一个bbolt事务中删除，返回每个key上一次的索引值
+func (bpt *BPlusTree) DeleteBatch(keys [][]byte) []*data.LogRecordPos {
+	oldPoses := make([]*data.LogRecordPos, len(keys))
+	if bpt.flushSize > 0 {
+		bpt.lock.Lock()
+		defer bpt.lock.Unlock()
+		for i, key := range keys {
+			oldPoses[i] = bpt.putPending(key, nil)
+		}
+		return oldPoses
+	}
+
+	if err := bpt.update(func(bucket *bbolt.Bucket) error {
+		for i, key := range keys {
+			if oldVal := bucket.Get(key); len(oldVal) != 0 {
+				oldPoses[i] = data.DecodeLogRecordPos(oldVal)
+				if err := bucket.Delete(key); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}); err != nil {
+		bpt.setErr(err)
+		return make([]*data.LogRecordPos, len(keys))
+	}
+	return oldPoses
+}
+
+// 返回创建的索引迭代器，异步模式下先把暂存的索引刷盘
+// 刷盘或者开启事务失败时返回空的迭代器，调用方通过FlushErr检查
 func (bpt *BPlusTree) Iterator(reverse bool) Iterator {
-	return newBptreeIterator(bpt.tree, reverse)
+	if err := bpt.Flush(); err != nil {
+		bpt.setErr(err)
+		return emptyIterator{}
+	}
+	it, err := newBptreeIterator(bpt.tree, reverse)
+	if err != nil {
+		bpt.setErr(err)
+		return emptyIterator{}
+	}
+	return it
 }
 
-// 返回大小
+// 返回大小，失败时返回0，调用方通过FlushErr检查
 func (bpt *BPlusTree) Size() int {
+	if err := bpt.Flush(); err != nil {
+		bpt.setErr(err)
+		return 0
+	}
 	var size int
 	if err := bpt.tree.View(func(tx *bbolt.Tx) error {
 		bucket := tx.Bucket(indexBucketName)
 		size = bucket.Stats().KeyN
 		return nil
 	}); err != nil {
-		panic("failed to Size() (in bucket) in bptree")
+		bpt.setErr(err)
+		return 0
 	}
 	return size
 }
 
-// 关闭
+// 执行一个更新事务，同时写入最新的检查点
+// 检查点总是在索引更新之后才设置，所以持久化的检查点不会超过已经写入的索引
+func (bpt *BPlusTree) update(fn func(bucket *bbolt.Bucket) error) error {
+	return bpt.tree.Update(func(tx *bbolt.Tx) error {
+		if err := fn(tx.Bucket(indexBucketName)); err != nil {
+			return err
+		}
+		cp, ok := bpt.checkpoint.Load().(*checkpoint)
+		if !ok {
+			return nil
+		}
+		posBuf := data.EncodeLogRecordPos(cp.pos)
+		buf := make([]byte, binary.MaxVarintLen64+len(posBuf))
+		n := binary.PutUvarint(buf, cp.seqNo)
+		n += copy(buf[n:], posBuf)
+		return tx.Bucket(metaBucketName).Put(checkpointKey, buf[:n])
+	})
+}
+
+// 设置已经应用到索引的日志末尾位置，随下一次更新事务(或者关闭)一起持久化
+func (bpt *BPlusTree) SetCheckpoint(pos *data.LogRecordPos, seqNo uint64) {
+	bpt.checkpoint.Store(&checkpoint{pos: pos, seqNo: seqNo})
+}
+
+// 读取持久化的检查点，没有记录或者读取失败时返回nil，从数据文件重建索引
+func (bpt *BPlusTree) Checkpoint() (*data.LogRecordPos, uint64) {
+	var pos *data.LogRecordPos
+	var seqNo uint64
+	if err := bpt.tree.View(func(tx *bbolt.Tx) error {
+		buf := tx.Bucket(metaBucketName).Get(checkpointKey)
+		if len(buf) == 0 {
+			return nil
+		}
+		var n int
+		seqNo, n = binary.Uvarint(buf)
+		pos = data.DecodeLogRecordPos(buf[n:])
+		return nil
+	}); err != nil {
+		bpt.setErr(err)
+		return nil, 0
+	}
+	return pos, seqNo
+}
+
+// 清空索引和检查点，用于从数据文件重建索引
+func (bpt *BPlusTree) Reset() error {
+	bpt.lock.Lock()
+	defer bpt.lock.Unlock()
+	if bpt.flushSize > 0 {
+		bpt.pending = make(map[string]*data.LogRecordPos)
+	}
+	bpt.checkpoint = atomic.Value{}
+	return bpt.tree.Update(func(tx *bbolt.Tx) error {
+		if err := tx.DeleteBucket(indexBucketName); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucket(indexBucketName); err != nil {
+			return err
+		}
+		return tx.Bucket(metaBucketName).Delete(checkpointKey)
+	})
+}
+
+// 关闭，异步模式下先停止后台刷盘并把暂存的索引写入，最后持久化检查点
 func (bpt *BPlusTree) Close() error {
-	return bpt.tree.Close()
+	bpt.lock.Lock()
+	if bpt.closed {
+		bpt.lock.Unlock()
+		return nil
+	}
+	closeCh, flushDone := bpt.closeCh, bpt.flushDone
+	bpt.closeCh = nil
+	bpt.lock.Unlock()
+	//等待后台刷盘协程退出，协程刷盘时需要锁，等待时不能持有
+	if closeCh != nil {
+		close(closeCh)
+		<-flushDone
+	}
+
+	bpt.lock.Lock()
+	defer bpt.lock.Unlock()
+	if bpt.closed {
+		return nil
+	}
+	bpt.closed = true
+	//之前刷盘失败时不再写入，检查点停在上一次成功的位置，打开时从数据文件回放
+	err := bpt.flushErr
+	if err == nil {
+		err = bpt.flush()
+	}
+	if err == nil {
+		err = bpt.update(func(*bbolt.Bucket) error { return nil })
+	}
+	if closeErr := bpt.tree.Close(); err == nil {
+		err = closeErr
+	}
+	return err
 }
 
 // B+Tree迭代器
@@ -116,11 +451,11 @@ type bptreeIterator struct {
 	value   []byte
 }
 
-func newBptreeIterator(tree *bbolt.DB, reverse bool) *bptreeIterator {
+func newBptreeIterator(tree *bbolt.DB, reverse bool) (*bptreeIterator, error) {
 	//手动开启一个事务
 	tx, err := tree.Begin(false)
 	if err != nil {
-		panic("failed to begin a transaction")
+		return nil, err
 	}
 	bpi := &bptreeIterator{
 		tx:      tx,
@@ -128,7 +463,7 @@ func newBptreeIterator(tree *bbolt.DB, reverse bool) *bptreeIterator {
 		reverse: reverse,
 	}
 	bpi.Rewind()
-	return bpi
+	return bpi, nil
 }
 
 // 回到迭代器起点
@@ -174,3 +509,14 @@ func (bpti *bptreeIterator) Close() {
 	//只读事务必须使用RollBack而不是commit
 	bpti.tx.Rollback()
 }
+
+// 空迭代器，索引读取失败时返回
+type emptyIterator struct{}
+
+func (emptyIterator) Rewind()                   {}
+func (emptyIterator) Seek([]byte)               {}
+func (emptyIterator) Next()                     {}
+func (emptyIterator) Valid() bool               { return false }
+func (emptyIterator) Key() []byte               { return nil }
+func (emptyIterator) Value() *data.LogRecordPos { return nil }
+func (emptyIterator) Close()                    {}
@@ -2,11 +2,13 @@ package index
 
 import (
 	"bitcask-go/data"
+	"bitcask-go/utils"
 	"os"
 	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"go.etcd.io/bbolt"
 )
 
 func TestBPTPut(t *testing.T) {
@@ -114,3 +116,112 @@ func TestBPT_IT(t *testing.T) {
 	// t.Fail()
 
 }
+
+func TestBPTBatch(t *testing.T) {
+	path, _ := os.MkdirTemp("", "bitcask-go-bptree-batch")
+	defer os.RemoveAll(path)
+	tree := NewBPlusTree(path, false)
+	defer tree.Close()
+
+	keys := [][]byte{[]byte("a"), []byte("b"), []byte("c")}
+	poses := []*data.LogRecordPos{{Fid: 1, Offset: 1}, {Fid: 1, Offset: 2}, {Fid: 1, Offset: 3}}
+	oldPoses := tree.PutBatch(keys, poses)
+	assert.Equal(t, 3, len(oldPoses))
+	for _, oldPos := range oldPoses {
+		assert.Nil(t, oldPos)
+	}
+	assert.Equal(t, 3, tree.Size())
+
+	oldPoses = tree.PutBatch(keys[:1], []*data.LogRecordPos{{Fid: 2, Offset: 9}})
+	assert.Equal(t, int64(1), oldPoses[0].Offset)
+
+	oldPoses = tree.DeleteBatch([][]byte{[]byte("b"), []byte("not exist")})
+	assert.Equal(t, int64(2), oldPoses[0].Offset)
+	assert.Nil(t, oldPoses[1])
+	assert.Nil(t, tree.Get([]byte("b")))
+	assert.Equal(t, 2, tree.Size())
+}
+
+func TestBPTAsyncFlush(t *testing.T) {
+	path, _ := os.MkdirTemp("", "bitcask-go-bptree-async")
+	defer os.RemoveAll(path)
+	tree := NewBPlusTree(path, false)
+	tree.EnableAsyncFlush(100)
+
+	for i := 0; i < 250; i++ {
+		oldPos := tree.Put(utils.GetTestKey(i), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+		assert.Nil(t, oldPos)
+	}
+	//暂存区内的数据也能读到
+	pos := tree.Get(utils.GetTestKey(249))
+	assert.Equal(t, int64(249), pos.Offset)
+	oldPos, ok := tree.Delete(utils.GetTestKey(249))
+	assert.True(t, ok)
+	assert.Equal(t, int64(249), oldPos.Offset)
+	assert.Nil(t, tree.Get(utils.GetTestKey(249)))
+	_, ok = tree.Delete(utils.GetTestKey(249))
+	assert.False(t, ok)
+
+	oldPos = tree.Put(utils.GetTestKey(0), &data.LogRecordPos{Fid: 2, Offset: 0})
+	assert.Equal(t, uint32(1), oldPos.Fid)
+	assert.Equal(t, 249, tree.Size())
+
+	//关闭后暂存的索引都已经写入
+	err := tree.Close()
+	assert.Nil(t, err)
+	tree2 := NewBPlusTree(path, false)
+	assert.Equal(t, 249, tree2.Size())
+	assert.Equal(t, uint32(2), tree2.Get(utils.GetTestKey(0)).Fid)
+	assert.Nil(t, tree2.Get(utils.GetTestKey(249)))
+	tree2.Close()
+}
+
+func TestBPTAsyncFlushErr(t *testing.T) {
+	path, _ := os.MkdirTemp("", "bitcask-go-bptree-async-err")
+	defer os.RemoveAll(path)
+	tree := NewBPlusTree(path, false)
+	tree.EnableAsyncFlush(10)
+
+	//bbolt换成只读的，刷盘失败不会panic，错误保存下来
+	assert.Nil(t, tree.tree.Close())
+	readOnly, err := bbolt.Open(filepath.Join(path, bptreeIndexFileName), 0644, &bbolt.Options{ReadOnly: true})
+	assert.Nil(t, err)
+	tree.tree = readOnly
+	for i := 0; i < 20; i++ {
+		tree.Put(utils.GetTestKey(i), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+	assert.NotNil(t, tree.FlushErr())
+	//关闭时等待后台协程退出，返回刷盘失败的错误
+	assert.Equal(t, tree.FlushErr(), tree.Close())
+	assert.Nil(t, tree.Close())
+}
+
+func TestBPTSyncErr(t *testing.T) {
+	path, _ := os.MkdirTemp("", "bitcask-go-bptree-sync-err")
+	defer os.RemoveAll(path)
+	tree := NewBPlusTree(path, false)
+	tree.Put(utils.GetTestKey(0), &data.LogRecordPos{Fid: 1, Offset: 0})
+
+	//同步模式下bbolt换成只读的，更新失败不会panic，错误保存下来
+	assert.Nil(t, tree.tree.Close())
+	readOnly, err := bbolt.Open(filepath.Join(path, bptreeIndexFileName), 0644, &bbolt.Options{ReadOnly: true})
+	assert.Nil(t, err)
+	tree.tree = readOnly
+	assert.Nil(t, tree.Put(utils.GetTestKey(1), &data.LogRecordPos{Fid: 1, Offset: 1}))
+	assert.NotNil(t, tree.FlushErr())
+	oldPoses := tree.PutBatch([][]byte{utils.GetTestKey(0)}, []*data.LogRecordPos{{Fid: 2}})
+	assert.Equal(t, 1, len(oldPoses))
+	oldPoses = tree.DeleteBatch([][]byte{utils.GetTestKey(0)})
+	assert.Equal(t, 1, len(oldPoses))
+
+	//bbolt关闭之后读取也不会panic，返回空的结果
+	assert.Nil(t, readOnly.Close())
+	assert.Nil(t, tree.Get(utils.GetTestKey(0)))
+	assert.Equal(t, 0, tree.Size())
+	it := tree.Iterator(false)
+	assert.False(t, it.Valid())
+	it.Close()
+	pos, _ := tree.Checkpoint()
+	assert.Nil(t, pos)
+	assert.NotNil(t, tree.FlushErr())
+}
@@ -35,7 +35,9 @@ func (bt *BTree) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
 }
 func (bt *BTree) Get(key []byte) *data.LogRecordPos {
 	it := &Item{key: key}
+	bt.lock.RLock()
 	btItem := bt.tree.Get(it)
+	bt.lock.RUnlock()
 	if btItem == nil {
 		return nil
 	}
@@ -62,6 +64,8 @@ func (bt *BTree) Iterator(reverse bool) Iterator {
 }
 
 func (bt *BTree) Size() int {
+	bt.lock.RLock()
+	defer bt.lock.RUnlock()
 	return bt.tree.Len()
 }
 
@@ -0,0 +1,163 @@
+package index
+
+import (
+	"bitcask-go/data"
+	"bytes"
+	"sort"
+	"sync"
+)
+
+// 哈希表分片数量
+const hashMapShardNum = 64
+
+// 哈希表索引，适用于只有点查的场景(比如纯kv缓存)
+// 相比有序树更省内存和CPU，但是本身无序，迭代器需要在创建时排序
+type HashMap struct {
+	shards []*hashMapShard
+}
+
+// 哈希表的分片，每个分片有自己的锁，减少锁竞争
+type hashMapShard struct {
+	items map[string]*data.LogRecordPos
+	lock  *sync.RWMutex
+}
+
+// 初始化哈希表索引
+func NewHashMap() *HashMap {
+	shards := make([]*hashMapShard, hashMapShardNum)
+	for i := range shards {
+		shards[i] = &hashMapShard{
+			items: make(map[string]*data.LogRecordPos),
+			lock:  new(sync.RWMutex),
+		}
+	}
+	return &HashMap{shards: shards}
+}
+
+// 根据key找到对应的分片
+func (hm *HashMap) getShard(key []byte) *hashMapShard {
+	return hm.shards[ShardOf(key, hashMapShardNum)]
+}
+
+func (hm *HashMap) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
+	shard := hm.getShard(key)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	oldPos := shard.items[string(key)]
+	shard.items[string(key)] = pos
+	return oldPos
+}
+
+func (hm *HashMap) Get(key []byte) *data.LogRecordPos {
+	shard := hm.getShard(key)
+	shard.lock.RLock()
+	defer shard.lock.RUnlock()
+	return shard.items[string(key)]
+}
+
+func (hm *HashMap) Delete(key []byte) (*data.LogRecordPos, bool) {
+	shard := hm.getShard(key)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	oldPos, ok := shard.items[string(key)]
+	if !ok {
+		return nil, false
+	}
+	delete(shard.items, string(key))
+	return oldPos, true
+}
+
+// 返回创建的索引迭代器，哈希表本身无序，这里会把所有key取出来排序
+func (hm *HashMap) Iterator(reverse bool) Iterator {
+	return newHashMapIterator(hm, reverse)
+}
+
+// 返回大小
+func (hm *HashMap) Size() int {
+	var size int
+	for _, shard := range hm.shards {
+		shard.lock.RLock()
+		size += len(shard.items)
+		shard.lock.RUnlock()
+	}
+	return size
+}
+
+func (hm *HashMap) Close() error {
+	return nil
+}
+
+// 哈希表索引迭代器，同btree迭代器一样，牺牲内存去做一个排好序的Item数组
+type hashMapIterator struct {
+	currIndex int     //当前遍历的下标
+	reverse   bool    //是否是反向遍历
+	values    []*Item //索引内的信息
+}
+
+func newHashMapIterator(hm *HashMap, reverse bool) *hashMapIterator {
+	var values []*Item
+	//逐个分片取出数据，每次只锁一个分片
+	for _, shard := range hm.shards {
+		shard.lock.RLock()
+		for key, pos := range shard.items {
+			values = append(values, &Item{key: []byte(key), pos: pos})
+		}
+		shard.lock.RUnlock()
+	}
+
+	sort.Slice(values, func(i, j int) bool {
+		if reverse {
+			return bytes.Compare(values[i].key, values[j].key) > 0
+		}
+		return bytes.Compare(values[i].key, values[j].key) < 0
+	})
+
+	return &hashMapIterator{
+		currIndex: 0,
+		reverse:   reverse,
+		values:    values,
+	}
+}
+
+// 回到迭代器起点
+func (hit *hashMapIterator) Rewind() {
+	hit.currIndex = 0
+}
+
+// 根据传入key值找到第一个大于(或小于)等于目标的key，根据这个key开始遍历
+func (hit *hashMapIterator) Seek(key []byte) {
+	if hit.reverse {
+		hit.currIndex = sort.Search(len(hit.values), func(i int) bool {
+			return bytes.Compare(hit.values[i].key, key) <= 0
+		})
+	} else {
+		hit.currIndex = sort.Search(len(hit.values), func(i int) bool {
+			return bytes.Compare(hit.values[i].key, key) >= 0
+		})
+	}
+}
+
+// 下一个key
+func (hit *hashMapIterator) Next() {
+	hit.currIndex++
+}
+
+// 是否有效，如果表示true则表示currIndex还在下标内，false则代表currIndex无效了
+func (hit *hashMapIterator) Valid() bool {
+	return hit.currIndex < len(hit.values)
+}
+
+// 遍历当前位置Key
+func (hit *hashMapIterator) Key() []byte {
+	return hit.values[hit.currIndex].key
+}
+
+// 遍历当前位置Value，这里数据文件拿取数据
+func (hit *hashMapIterator) Value() *data.LogRecordPos {
+	return hit.values[hit.currIndex].pos
+}
+
+// 关闭迭代器
+func (hit *hashMapIterator) Close() {
+	hit.values = nil
+}
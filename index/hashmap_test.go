@@ -0,0 +1,89 @@
+package index
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/utils"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHashMap_Put(t *testing.T) {
+	hm := NewHashMap()
+	res := hm.Put(nil, &data.LogRecordPos{Fid: 1, Offset: 100})
+	assert.Nil(t, res)
+
+	res1 := hm.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 7})
+	assert.Nil(t, res1)
+	res2 := hm.Put([]byte("a"), &data.LogRecordPos{Fid: 3, Offset: 2})
+	assert.Equal(t, uint32(1), res2.Fid)
+	assert.Equal(t, int64(7), res2.Offset)
+}
+
+func TestHashMap_Get(t *testing.T) {
+	hm := NewHashMap()
+	hm.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 7})
+	hm.Put([]byte("b"), &data.LogRecordPos{Fid: 3, Offset: 2})
+	hm.Put([]byte("b"), &data.LogRecordPos{Fid: 4, Offset: 235})
+
+	pos1 := hm.Get([]byte("a"))
+	assert.Equal(t, uint32(1), pos1.Fid)
+	assert.Equal(t, int64(7), pos1.Offset)
+
+	pos2 := hm.Get([]byte("b"))
+	assert.Equal(t, uint32(4), pos2.Fid)
+	assert.Equal(t, int64(235), pos2.Offset)
+
+	assert.Nil(t, hm.Get([]byte("not exist")))
+}
+
+func TestHashMap_Delete(t *testing.T) {
+	hm := NewHashMap()
+	hm.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 7})
+
+	oldPos, ok := hm.Delete([]byte("a"))
+	assert.True(t, ok)
+	assert.Equal(t, uint32(1), oldPos.Fid)
+	assert.Nil(t, hm.Get([]byte("a")))
+
+	oldPos, ok = hm.Delete([]byte("a"))
+	assert.False(t, ok)
+	assert.Nil(t, oldPos)
+	assert.Equal(t, 0, hm.Size())
+}
+
+func TestHashMap_Iterator(t *testing.T) {
+	hm := NewHashMap()
+	//空的迭代器
+	it := hm.Iterator(false)
+	assert.False(t, it.Valid())
+	it.Close()
+
+	for i := 9; i >= 0; i-- {
+		hm.Put(utils.GetTestKey(i), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+	assert.Equal(t, 10, hm.Size())
+
+	//正向遍历有序
+	it = hm.Iterator(false)
+	var i int
+	for it.Rewind(); it.Valid(); it.Next() {
+		assert.Equal(t, utils.GetTestKey(i), it.Key())
+		assert.Equal(t, int64(i), it.Value().Offset)
+		i++
+	}
+	assert.Equal(t, 10, i)
+	it.Seek(utils.GetTestKey(5))
+	assert.Equal(t, utils.GetTestKey(5), it.Key())
+	it.Close()
+
+	//反向遍历
+	it = hm.Iterator(true)
+	it.Rewind()
+	assert.Equal(t, utils.GetTestKey(9), it.Key())
+	it.Seek(utils.GetTestKey(5))
+	assert.Equal(t, utils.GetTestKey(5), it.Key())
+	it.Next()
+	assert.Equal(t, utils.GetTestKey(4), it.Key())
+	it.Close()
+}
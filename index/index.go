@@ -22,6 +22,34 @@ type Indexer interface {
 	Close() error
 }
 
+// 支持批量更新的索引，一次批量操作只需要一次持久化事务
+// 可选实现，WriteBatch提交时如果索引实现了该接口会优先使用
+type BatchIndexer interface {
+	Indexer
+	//批量put，返回每个key上一次put的索引值
+	PutBatch(keys [][]byte, poses []*data.LogRecordPos) []*data.LogRecordPos
+	//批量delete，返回每个key上一次put的索引值，不存在为nil
+	DeleteBatch(keys [][]byte) []*data.LogRecordPos
+}
+
+// 持久化索引的检查点，记录已经应用到索引的日志位置
+// 打开数据库时只需要从检查点开始回放数据文件，就能让索引和数据文件保持一致
+type CheckpointIndexer interface {
+	Indexer
+	//设置已经应用到索引的日志末尾位置以及当前事务序列号
+	SetCheckpoint(pos *data.LogRecordPos, seqNo uint64)
+	//读取持久化的检查点，没有记录时返回nil
+	Checkpoint() (*data.LogRecordPos, uint64)
+	//清空索引和检查点，用于重建索引
+	Reset() error
+}
+
+// 后台异步刷盘的索引，刷盘失败的错误保存下来，调用方在下一次更新之前检查
+type FlushErrIndexer interface {
+	Indexer
+	FlushErr() error
+}
+
 type IndexType = int8
 
 // 这里枚举,索引类型
@@ -32,6 +60,8 @@ const (
 	ART
 	//B+Tree,且持久化到磁盘
 	BPTree
+	//哈希表，只支持点查的场景，迭代时需要排序
+	Hash
 )
 
 // 根据索引类型初始化索引
@@ -43,6 +73,8 @@ func NewIndexer(typ IndexType, dirPath string, syncWrite bool) Indexer {
 		return NewART()
 	case BPTree:
 		return NewBPlusTree(dirPath, syncWrite)
+	case Hash:
+		return NewHashMap()
 	default:
 		panic("unkown IndexType")
 	}
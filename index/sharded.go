@@ -0,0 +1,157 @@
+package index
+
+import (
+	"bitcask-go/data"
+	"bytes"
+	"hash/fnv"
+)
+
+// 分片索引，按key的哈希值把数据分散到多个子索引中
+// 每个子索引有自己的锁，不同分片的读写可以并行，避免单个索引锁成为瓶颈
+type ShardedIndex struct {
+	shards []Indexer
+}
+
+// 初始化分片索引，子索引只能是内存索引(BTree/ART)
+func NewShardedIndex(typ IndexType, shardNum int) *ShardedIndex {
+	if shardNum <= 0 {
+		panic("shard num must be greater than 0")
+	}
+	shards := make([]Indexer, shardNum)
+	for i := range shards {
+		switch typ {
+		case Btree:
+			shards[i] = NewBTree()
+		case ART:
+			shards[i] = NewART()
+		default:
+			panic("unsupported IndexType for sharded index")
+		}
+	}
+	return &ShardedIndex{shards: shards}
+}
+
+// 根据key找到对应的子索引
+func (si *ShardedIndex) getShard(key []byte) Indexer {
+	return si.shards[ShardOf(key, len(si.shards))]
+}
+
+func (si *ShardedIndex) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
+	return si.getShard(key).Put(key, pos)
+}
+
+func (si *ShardedIndex) Get(key []byte) *data.LogRecordPos {
+	return si.getShard(key).Get(key)
+}
+
+func (si *ShardedIndex) Delete(key []byte) (*data.LogRecordPos, bool) {
+	return si.getShard(key).Delete(key)
+}
+
+// 返回创建的索引迭代器，对各个子索引的迭代器做多路归并，保证有序
+func (si *ShardedIndex) Iterator(reverse bool) Iterator {
+	iters := make([]Iterator, len(si.shards))
+	for i, shard := range si.shards {
+		iters[i] = shard.Iterator(reverse)
+	}
+	sit := &shardedIterator{iters: iters, reverse: reverse}
+	sit.Rewind()
+	return sit
+}
+
+// 返回大小
+func (si *ShardedIndex) Size() int {
+	var size int
+	for _, shard := range si.shards {
+		size += shard.Size()
+	}
+	return size
+}
+
+func (si *ShardedIndex) Close() error {
+	for _, shard := range si.shards {
+		if err := shard.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 计算key所在的分片下标
+func ShardOf(key []byte, shardNum int) int {
+	h := fnv.New32a()
+	_, _ = h.Write(key)
+	return int(h.Sum32() % uint32(shardNum))
+}
+
+// 分片索引迭代器，每次从所有子迭代器中选出最小(反向则最大)的key
+type shardedIterator struct {
+	iters   []Iterator //各个分片的迭代器
+	reverse bool       //是否是反向遍历
+	curr    int        //当前key所在的子迭代器下标，-1表示遍历完毕
+}
+
+// 选出当前应该返回的子迭代器
+func (sit *shardedIterator) pick() {
+	sit.curr = -1
+	for i, it := range sit.iters {
+		if !it.Valid() {
+			continue
+		}
+		if sit.curr == -1 {
+			sit.curr = i
+			continue
+		}
+		cmp := bytes.Compare(it.Key(), sit.iters[sit.curr].Key())
+		if (!sit.reverse && cmp < 0) || (sit.reverse && cmp > 0) {
+			sit.curr = i
+		}
+	}
+}
+
+// 回到迭代器起点
+func (sit *shardedIterator) Rewind() {
+	for _, it := range sit.iters {
+		it.Rewind()
+	}
+	sit.pick()
+}
+
+// 根据传入key值找到第一个大于(或小于)等于目标的key，根据这个key开始遍历
+func (sit *shardedIterator) Seek(key []byte) {
+	for _, it := range sit.iters {
+		it.Seek(key)
+	}
+	sit.pick()
+}
+
+// 下一个key
+func (sit *shardedIterator) Next() {
+	if sit.curr == -1 {
+		return
+	}
+	sit.iters[sit.curr].Next()
+	sit.pick()
+}
+
+// 是否有效，指key是否遍历完毕
+func (sit *shardedIterator) Valid() bool {
+	return sit.curr != -1
+}
+
+// 遍历当前位置Key
+func (sit *shardedIterator) Key() []byte {
+	return sit.iters[sit.curr].Key()
+}
+
+// 遍历当前位置Value
+func (sit *shardedIterator) Value() *data.LogRecordPos {
+	return sit.iters[sit.curr].Value()
+}
+
+// 关闭迭代器
+func (sit *shardedIterator) Close() {
+	for _, it := range sit.iters {
+		it.Close()
+	}
+}
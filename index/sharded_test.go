@@ -0,0 +1,78 @@
+package index
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/utils"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShardedIndex_PutGetDelete(t *testing.T) {
+	si := NewShardedIndex(Btree, 8)
+	res := si.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 7})
+	assert.Nil(t, res)
+	res = si.Put([]byte("a"), &data.LogRecordPos{Fid: 2, Offset: 9})
+	assert.Equal(t, uint32(1), res.Fid)
+
+	pos := si.Get([]byte("a"))
+	assert.Equal(t, uint32(2), pos.Fid)
+	assert.Equal(t, int64(9), pos.Offset)
+	assert.Nil(t, si.Get([]byte("b")))
+
+	oldPos, ok := si.Delete([]byte("a"))
+	assert.True(t, ok)
+	assert.Equal(t, uint32(2), oldPos.Fid)
+	assert.Equal(t, 0, si.Size())
+}
+
+func TestShardedIndex_Iterator(t *testing.T) {
+	si := NewShardedIndex(ART, 4)
+	for i := 0; i < 100; i++ {
+		si.Put(utils.GetTestKey(i), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+	assert.Equal(t, 100, si.Size())
+
+	//多个分片归并后依然有序
+	it := si.Iterator(false)
+	var i int
+	for it.Rewind(); it.Valid(); it.Next() {
+		assert.Equal(t, utils.GetTestKey(i), it.Key())
+		assert.Equal(t, int64(i), it.Value().Offset)
+		i++
+	}
+	assert.Equal(t, 100, i)
+	it.Seek(utils.GetTestKey(50))
+	assert.Equal(t, utils.GetTestKey(50), it.Key())
+	it.Close()
+
+	it = si.Iterator(true)
+	i = 99
+	for it.Rewind(); it.Valid(); it.Next() {
+		assert.Equal(t, utils.GetTestKey(i), it.Key())
+		i--
+	}
+	assert.Equal(t, -1, i)
+	it.Seek(utils.GetTestKey(50))
+	assert.Equal(t, utils.GetTestKey(50), it.Key())
+	it.Close()
+}
+
+func TestShardedIndex_Concurrent(t *testing.T) {
+	si := NewShardedIndex(Btree, 16)
+	wg := new(sync.WaitGroup)
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				key := utils.GetTestKey(g*1000 + i)
+				si.Put(key, &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+				assert.NotNil(t, si.Get(key))
+			}
+		}(g)
+	}
+	wg.Wait()
+	assert.Equal(t, 8000, si.Size())
+}
@@ -0,0 +1,63 @@
+package bitcask_go
+
+import (
+	"bitcask-go/index"
+	"sort"
+	"sync"
+)
+
+// key分段锁的数量
+const keyLockNum = 256
+
+// 按key分段的锁
+// 同一分段内的写操作(追加+更新索引)串行，保证索引和日志的顺序一致
+// 不同分段的索引更新可以并行，只有追加写文件需要持有db.mu
+type keyLocks struct {
+	locks []sync.Mutex
+}
+
+func newKeyLocks(n int) *keyLocks {
+	return &keyLocks{locks: make([]sync.Mutex, n)}
+}
+
+// 锁住key所在的分段，返回解锁函数
+func (kl *keyLocks) lock(key []byte) func() {
+	mu := &kl.locks[index.ShardOf(key, len(kl.locks))]
+	mu.Lock()
+	return mu.Unlock
+}
+
+// 锁住一批key所在的所有分段，按下标顺序加锁避免死锁
+func (kl *keyLocks) lockAll(keys [][]byte) func() {
+	seen := make(map[int]struct{}, len(keys))
+	var ids []int
+	for _, key := range keys {
+		id := index.ShardOf(key, len(kl.locks))
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		kl.locks[id].Lock()
+	}
+	return func() {
+		for i := len(ids) - 1; i >= 0; i-- {
+			kl.locks[ids[i]].Unlock()
+		}
+	}
+}
+
+// 锁住所有分段，持有期间没有写入在追加日志和更新索引之间
+func (kl *keyLocks) lockEvery() func() {
+	for i := range kl.locks {
+		kl.locks[i].Lock()
+	}
+	return func() {
+		for i := len(kl.locks) - 1; i >= 0; i-- {
+			kl.locks[i].Unlock()
+		}
+	}
+}
@@ -0,0 +1,391 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/fio"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	//MANIFEST中每条记录的key
+	manifestEditKey = "manifestEdit"
+	//重写MANIFEST时的临时文件后缀
+	manifestTempSuffix = ".tmp"
+	//MANIFEST不完整时，不在其中的数据文件移到这个目录
+	quarantineDirName = "-quarantine"
+	//安装merge结果时，新文件先以这个后缀放进数据目录，提交之后再改成正式的名字
+	mergeTempSuffix = ".merge"
+)
+
+// MANIFEST记录中的修改类型
+const (
+	manifestAddFile      byte = iota + 1 //新建数据文件
+	manifestSealFile                     //封存数据文件，记录封存时的大小
+	manifestDeleteFile                   //删除数据文件
+	manifestLogStart                     //merge之后原始日志的起始文件
+	manifestMergePending                 //merge的结果已经提交，文件还没有全部改名
+	manifestMergeDone                    //merge的结果安装完成
+	manifestCommitSeqNo                  //订阅事件的提交序列号分配到的上限
+)
+
+// 活跃文件在MANIFEST中的大小，表示还没有封存
+const manifestActiveSize int64 = -1
+
+// 对数据文件集合的一次原子修改，编码成一条LogRecord写入MANIFEST
+type manifestEdit struct {
+	added       []uint32
+	sealed      []manifestSealed
+	deleted     []uint32
+	logStart    *uint32
+	mergeState  byte   //manifestMergePending或者manifestMergeDone，为0表示不修改
+	commitSeqNo uint64 //提交序列号的上限，为0表示不修改
+}
+
+type manifestSealed struct {
+	fid  uint32
+	size int64
+}
+
+// MANIFEST回放得到的数据文件集合
+type manifestState struct {
+	files        map[uint32]int64 //文件id -> 封存时的大小，活跃文件为-1
+	logStart     uint32
+	mergePending bool
+	commitSeqNo  uint64 //已经分配或者预留的提交序列号上限，重新打开后从这里继续
+}
+
+func newManifestState() *manifestState {
+	return &manifestState{files: make(map[uint32]int64)}
+}
+
+// 编码修改 类型 文件id [大小] ...
+func (edit *manifestEdit) encode() []byte {
+	buf := make([]byte, 0, 32)
+	varint := make([]byte, binary.MaxVarintLen64)
+	put := func(tag byte, values ...uint64) {
+		buf = append(buf, tag)
+		for _, v := range values {
+			buf = append(buf, varint[:binary.PutUvarint(varint, v)]...)
+		}
+	}
+	for _, fid := range edit.deleted {
+		put(manifestDeleteFile, uint64(fid))
+	}
+	for _, fid := range edit.added {
+		put(manifestAddFile, uint64(fid))
+	}
+	for _, sealed := range edit.sealed {
+		put(manifestSealFile, uint64(sealed.fid), uint64(sealed.size))
+	}
+	if edit.logStart != nil {
+		put(manifestLogStart, uint64(*edit.logStart))
+	}
+	if edit.mergeState != 0 {
+		put(edit.mergeState)
+	}
+	if edit.commitSeqNo != 0 {
+		put(manifestCommitSeqNo, edit.commitSeqNo)
+	}
+	return buf
+}
+
+// 解码并应用到文件集合上
+func (state *manifestState) apply(buf []byte) error {
+	var index = 0
+	next := func() (uint64, error) {
+		v, n := binary.Uvarint(buf[index:])
+		if n <= 0 {
+			return 0, ErrDataDirectoryCorrupdated
+		}
+		index += n
+		return v, nil
+	}
+	for index < len(buf) {
+		tag := buf[index]
+		index++
+		switch tag {
+		case manifestAddFile, manifestDeleteFile, manifestLogStart, manifestCommitSeqNo:
+			v, err := next()
+			if err != nil {
+				return err
+			}
+			switch tag {
+			case manifestAddFile:
+				state.files[uint32(v)] = manifestActiveSize
+			case manifestDeleteFile:
+				delete(state.files, uint32(v))
+			case manifestCommitSeqNo:
+				state.commitSeqNo = v
+			default:
+				state.logStart = uint32(v)
+			}
+		case manifestSealFile:
+			fid, err := next()
+			if err != nil {
+				return err
+			}
+			size, err := next()
+			if err != nil {
+				return err
+			}
+			state.files[uint32(fid)] = int64(size)
+		case manifestMergePending:
+			state.mergePending = true
+		case manifestMergeDone:
+			state.mergePending = false
+		default:
+			return ErrDataDirectoryCorrupdated
+		}
+	}
+	return nil
+}
+
+// 当前文件集合的快照，重写MANIFEST时作为第一条记录
+func (state *manifestState) snapshot() *manifestEdit {
+	edit := &manifestEdit{logStart: &state.logStart}
+	for fid, size := range state.files {
+		edit.added = append(edit.added, fid)
+		if size != manifestActiveSize {
+			edit.sealed = append(edit.sealed, manifestSealed{fid: fid, size: size})
+		}
+	}
+	sort.Slice(edit.added, func(i, j int) bool { return edit.added[i] < edit.added[j] })
+	sort.Slice(edit.sealed, func(i, j int) bool { return edit.sealed[i].fid < edit.sealed[j].fid })
+	if state.mergePending {
+		edit.mergeState = manifestMergePending
+	}
+	edit.commitSeqNo = state.commitSeqNo
+	return edit
+}
+
+// 从小到大的文件id
+func (state *manifestState) fileIds() []uint32 {
+	fids := make([]uint32, 0, len(state.files))
+	for fid := range state.files {
+		fids = append(fids, fid)
+	}
+	sort.Slice(fids, func(i, j int) bool { return fids[i] < fids[j] })
+	return fids
+}
+
+// 打开时加载MANIFEST，得到数据文件集合，然后重写成只有一条快照的新文件
+// 旧版本的数据目录没有MANIFEST，按目录中的数据文件生成
+// 只有最后一条记录可以写了一半，说明修改没有提交，直接丢弃；中间的记录损坏返回错误
+func (db *DB) loadManifest() error {
+	state := newManifestState()
+	var torn bool
+	manifestName := filepath.Join(db.options.DirPath, data.ManifestFileName)
+	if _, err := db.fs.Stat(manifestName); err == nil {
+		manifestFile, err := data.OpenManifestFile(db.fs, db.options.DirPath, data.ManifestFileName)
+		if err != nil {
+			return err
+		}
+		offset := manifestFile.RecordStart()
+		for {
+			record, size, err := manifestFile.ReadLogRecord(offset)
+			if err != nil {
+				if torn, err = isManifestTornTail(manifestFile, offset, err); err != nil {
+					_ = manifestFile.Close()
+					return err
+				}
+				break
+			}
+			if err := state.apply(record.Value); err != nil {
+				_ = manifestFile.Close()
+				return err
+			}
+			offset += size
+		}
+		if err := manifestFile.Close(); err != nil {
+			return err
+		}
+	} else {
+		fileIds, err := db.listDataFileIds()
+		if err != nil {
+			return err
+		}
+		for i, fid := range fileIds {
+			state.files[fid] = manifestActiveSize
+			if i < len(fileIds)-1 {
+				info, err := db.fs.Stat(data.GetDataFileName(db.dataFileDir(fid), fid))
+				if err != nil {
+					return err
+				}
+				state.files[fid] = info.Size()
+			}
+		}
+		if state.logStart, err = db.loadNonMergeFileId(); err != nil {
+			return err
+		}
+	}
+	db.manifestState = state
+	//MANIFEST不完整时，回放结果可能缺少最后一次修改，不在其中的文件先移到隔离目录再重写MANIFEST
+	if torn {
+		quarantineDir := filepath.Join(db.getSiblingPath(quarantineDirName), strconv.FormatInt(time.Now().UnixNano(), 10))
+		if err := db.removeUnreferencedFiles(func(fileName string) error {
+			return db.quarantineFile(fileName, quarantineDir)
+		}); err != nil {
+			return err
+		}
+	}
+	return db.rewriteManifest()
+}
+
+// 读取MANIFEST在offset处出错时，判断是不是末尾不完整的记录
+// 正常读到末尾返回false，末尾的记录不完整返回true，其他情况返回错误
+// 出错记录头中的长度可能也损坏了，不能用来判断它是不是最后一条，只有后面再也解析不出完整的记录才算末尾
+func isManifestTornTail(manifestFile *data.DataFile, offset int64, err error) (bool, error) {
+	if err != io.EOF && err != io.ErrUnexpectedEOF && err != data.ErrInvalidCRC {
+		return false, err
+	}
+	fileSize, sizeErr := manifestFile.IoManger.Size()
+	if sizeErr != nil {
+		return false, sizeErr
+	}
+	if offset >= fileSize {
+		return false, nil
+	}
+	for pos := offset + 1; pos < fileSize; pos++ {
+		record, _, err := manifestFile.ReadLogRecord(pos)
+		if err == nil && string(record.Key) == manifestEditKey {
+			return false, ErrDataDirectoryCorrupdated
+		}
+	}
+	return true, nil
+}
+
+// 把当前文件集合写成新的MANIFEST，先写临时文件再改名，改名是原子的
+func (db *DB) rewriteManifest() error {
+	tempName := data.ManifestFileName + manifestTempSuffix
+	tempPath := filepath.Join(db.options.DirPath, tempName)
+	if err := db.fs.RemoveAll(tempPath); err != nil {
+		return err
+	}
+	if err := writeManifestFile(db.fs, db.options.DirPath, tempName, db.manifestState); err != nil {
+		return err
+	}
+
+	if db.manifest != nil {
+		if err := db.manifest.Close(); err != nil {
+			return err
+		}
+		db.manifest = nil
+	}
+	if err := db.fs.Rename(tempPath, filepath.Join(db.options.DirPath, data.ManifestFileName)); err != nil {
+		return err
+	}
+	if err := db.fs.SyncDir(db.options.DirPath); err != nil {
+		return err
+	}
+	manifestFile, err := data.OpenManifestFile(db.fs, db.options.DirPath, data.ManifestFileName)
+	if err != nil {
+		return err
+	}
+	db.manifest = manifestFile
+	return nil
+}
+
+// 在dir中写入只有一条state快照的MANIFEST文件
+func writeManifestFile(fs fio.FS, dir, name string, state *manifestState) error {
+	manifestFile, err := data.OpenManifestFile(fs, dir, name)
+	if err != nil {
+		return err
+	}
+	record, _ := manifestFile.EncodeLogRecord(&data.LogRecord{
+		Key:   []byte(manifestEditKey),
+		Value: state.snapshot().encode(),
+	})
+	if err := manifestFile.Write(record); err != nil {
+		_ = manifestFile.Close()
+		return err
+	}
+	if err := manifestFile.Sync(); err != nil {
+		_ = manifestFile.Close()
+		return err
+	}
+	return manifestFile.Close()
+}
+
+// 追加一条修改并持久化，写入成功才算提交，之后应用到内存中的文件集合
+// 运行期间调用方必须持有db锁
+func (db *DB) appendManifestEdit(edit *manifestEdit) error {
+	value := edit.encode()
+	record, _ := db.manifest.EncodeLogRecord(&data.LogRecord{Key: []byte(manifestEditKey), Value: value})
+	if err := db.manifest.Write(record); err != nil {
+		return err
+	}
+	if err := db.manifest.Sync(); err != nil {
+		return err
+	}
+	return db.manifestState.apply(value)
+}
+
+// 删除目录中不在MANIFEST里的数据文件，它们是创建或者merge过程中崩溃留下的
+func (db *DB) collectGarbageFiles() error {
+	return db.removeUnreferencedFiles(db.fs.Remove)
+}
+
+// 用remove移走所有目录中不在MANIFEST里的数据文件
+func (db *DB) removeUnreferencedFiles(remove func(fileName string) error) error {
+	for _, dir := range db.dataDirs() {
+		fileIds, err := listDataFileIds(db.fs, dir)
+		if err != nil {
+			return err
+		}
+		var removed bool
+		for _, fid := range fileIds {
+			if _, ok := db.manifestState.files[fid]; ok {
+				continue
+			}
+			if err := remove(data.GetDataFileName(dir, fid)); err != nil {
+				return err
+			}
+			removed = true
+		}
+		if removed {
+			if err := db.fs.SyncDir(dir); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// 把文件移到隔离目录，隔离目录先持久化，保证文件移走之后不会丢失
+func (db *DB) quarantineFile(fileName, quarantineDir string) error {
+	if err := fio.MkdirAllSync(db.fs, quarantineDir, os.ModePerm); err != nil {
+		return err
+	}
+	if err := fio.MoveFile(db.fs, fileName, filepath.Join(quarantineDir, filepath.Base(fileName))); err != nil {
+		return err
+	}
+	return db.fs.SyncDir(quarantineDir)
+}
+
+// 目录中的数据文件id，从小到大
+func listDataFileIds(fs fio.FS, dir string) ([]uint32, error) {
+	entries, err := fs.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var fileIds []uint32
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), data.DataFileNameSuffix) {
+			continue
+		}
+		fileId, err := strconv.Atoi(strings.TrimSuffix(entry.Name(), data.DataFileNameSuffix))
+		if err != nil {
+			return nil, ErrDataDirectoryCorrupdated
+		}
+		fileIds = append(fileIds, uint32(fileId))
+	}
+	sort.Slice(fileIds, func(i, j int) bool { return fileIds[i] < fileIds[j] })
+	return fileIds, nil
+}
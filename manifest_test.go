@@ -0,0 +1,208 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/fio"
+	"bitcask-go/utils"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_Manifest(t *testing.T) {
+	opts := DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-manifest")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = os.RemoveAll(dir)
+		_ = os.RemoveAll(dir + quarantineDirName)
+	}()
+
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+	}
+	activeFid := db.activeFile.FileId
+	assert.Greater(t, activeFid, uint32(0))
+	//每个封存的文件都记录了大小
+	for fid, size := range db.manifestState.files {
+		if fid == activeFid {
+			assert.Equal(t, manifestActiveSize, size)
+		} else {
+			assert.Equal(t, db.oldFiles[fid].Offset, size)
+		}
+	}
+	assert.Nil(t, db.Close())
+
+	//末尾写了一半的记录被丢弃，MANIFEST不完整，不在其中的数据文件移到隔离目录
+	garbage := data.GetDataFileName(dir, activeFid+10)
+	assert.Nil(t, os.WriteFile(garbage, []byte("garbage"), 0644))
+	manifest, err := os.OpenFile(filepath.Join(dir, data.ManifestFileName), os.O_WRONLY|os.O_APPEND, 0644)
+	assert.Nil(t, err)
+	_, err = manifest.Write([]byte{1, 2, 3, 4, 5, 6, 7})
+	assert.Nil(t, err)
+	assert.Nil(t, manifest.Close())
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	_, err = os.Stat(garbage)
+	assert.True(t, os.IsNotExist(err))
+	quarantined, err := filepath.Glob(filepath.Join(dir+quarantineDirName, "*", filepath.Base(garbage)))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(quarantined))
+	assert.Equal(t, activeFid, db.activeFile.FileId)
+	for i := 0; i < 1000; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, utils.GetTestKey(i), val)
+	}
+
+	//封存的文件缺失说明目录损坏
+	assert.Nil(t, db.Close())
+	assert.Nil(t, os.Remove(data.GetDataFileName(dir, 0)))
+	_, err = Open(opts)
+	assert.Equal(t, ErrDataDirectoryCorrupdated, err)
+}
+
+// MANIFEST中间的记录损坏时不能打开，也不能清理任何文件
+func TestDB_ManifestCorrupted(t *testing.T) {
+	opts := DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-manifest-corrupted")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+	}
+	activeFid := db.activeFile.FileId
+	assert.Nil(t, db.Close())
+
+	//打开时重写成一条快照，之后每次切换文件追加一条修改，第一条记录在中间
+	manifestName := filepath.Join(dir, data.ManifestFileName)
+	content, err := os.ReadFile(manifestName)
+	assert.Nil(t, err)
+	content[data.FileHeaderSize+8] ^= 0xff
+	assert.Nil(t, os.WriteFile(manifestName, content, 0644))
+	garbage := data.GetDataFileName(dir, activeFid+10)
+	assert.Nil(t, os.WriteFile(garbage, []byte("garbage"), 0644))
+
+	_, err = Open(opts)
+	assert.Equal(t, ErrDataDirectoryCorrupdated, err)
+	_, err = os.Stat(garbage)
+	assert.Nil(t, err)
+	for fid := uint32(0); fid <= activeFid; fid++ {
+		_, err = os.Stat(data.GetDataFileName(dir, fid))
+		assert.Nil(t, err)
+	}
+	_, err = os.Stat(dir + quarantineDirName)
+	assert.True(t, os.IsNotExist(err))
+}
+
+// 没有MANIFEST的旧数据目录
+func TestDB_ManifestBootstrap(t *testing.T) {
+	opts := DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-manifest-bootstrap")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+	}
+	assert.Nil(t, db.Close())
+	assert.Nil(t, os.Remove(filepath.Join(dir, data.ManifestFileName)))
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+	assert.Equal(t, len(db.oldFiles)+1, len(db.manifestState.files))
+	assert.Equal(t, 1000, len(db.ListKeys()))
+}
+
+// merge的结果提交之后，替换文件的过程中崩溃
+func TestDB_ManifestMergeCrash(t *testing.T) {
+	opts := DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-manifest-merge")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Put([]byte("after-merge"), []byte("v")))
+	assert.Nil(t, db.Close())
+
+	//只执行到提交，再替换一部分文件
+	crashed := &DB{options: opts, fs: fio.OSFS{}}
+	assert.Nil(t, crashed.loadManifest())
+	assert.Nil(t, crashed.commitMergeInstall())
+	assert.True(t, crashed.manifestState.mergePending)
+	tempIds, err := listMergeTempFileIds(fio.OSFS{}, dir)
+	assert.Nil(t, err)
+	assert.Greater(t, len(tempIds), 0)
+	name := data.GetDataFileName(dir, tempIds[0])
+	assert.Nil(t, os.Rename(name+mergeTempSuffix, name))
+	assert.Nil(t, crashed.manifest.Close())
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+	assert.False(t, db.manifestState.mergePending)
+	tempIds, err = listMergeTempFileIds(fio.OSFS{}, dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(tempIds))
+	assert.Equal(t, 1001, len(db.ListKeys()))
+	for i := 1000; i < 2000; i++ {
+		_, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	val, err := db.Get([]byte("after-merge"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v"), val)
+}
+
+// merge的结果提交之前崩溃，旧文件保持不变
+func TestDB_ManifestMergeCrashBeforeCommit(t *testing.T) {
+	opts := DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-manifest-merge-uncommitted")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+
+	//merge目录被清理前留下的临时文件
+	mergePath := dir + mergeDirName
+	assert.Nil(t, fio.CopyFile(db.fs, data.GetDataFileName(mergePath, 0), data.GetDataFileName(dir, 0)+mergeTempSuffix))
+	assert.Nil(t, os.RemoveAll(mergePath))
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+	_, err = os.Stat(data.GetDataFileName(dir, 0) + mergeTempSuffix)
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, uint32(0), db.logStartFid)
+	assert.Equal(t, 1000, len(db.ListKeys()))
+}
@@ -2,6 +2,7 @@ package bitcask_go
 
 import (
 	"bitcask-go/data"
+	"bitcask-go/fio"
 	"io"
 	"os"
 	"path"
@@ -9,6 +10,8 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
 const mergeDirName = "-merge"
@@ -28,7 +31,7 @@ func (db *DB) Merge() error {
 	}
 
 	//查看是否达到阈值
-	size, err := DirSize(db.options.DirPath)
+	size, err := db.diskSize()
 	if err != nil {
 		db.mu.Unlock()
 		return err
@@ -38,15 +41,17 @@ func (db *DB) Merge() error {
 		return ErrMergeRatioUnreached
 	}
 
-	//查看剩余空间是否足够merge
-	freeSize, err := AvailableDiskSize()
-	if err != nil {
-		db.mu.Unlock()
-		return err
-	}
-	if uint64(size-db.reclaimSize) >= freeSize {
-		db.mu.Unlock()
-		return ErrNoFreeSpaceForMerge
+	//查看剩余空间是否足够merge，只有操作系统的文件系统占用磁盘
+	if _, ok := db.fs.(fio.OSFS); ok {
+		freeSize, err := AvailableDiskSize()
+		if err != nil {
+			db.mu.Unlock()
+			return err
+		}
+		if uint64(size-db.reclaimSize) >= freeSize {
+			db.mu.Unlock()
+			return ErrNoFreeSpaceForMerge
+		}
 	}
 
 	//开始merging
@@ -63,15 +68,21 @@ func (db *DB) Merge() error {
 	}
 
 	//当前活跃文件纳入oldfiles
-	db.oldFiles[db.activeFile.FileId] = db.activeFile
+	if err := db.sealActiveFile(); err != nil {
+		db.mu.Unlock()
+		return err
+	}
 	//设置新活跃文件
 	if err := db.setActiveDataFile(); err != nil {
 		db.mu.Unlock()
 		return err
 	}
+	db.publishOldFiles()
 
 	//记录没merge的文件
 	nonMergeFileId := db.activeFile.FileId
+	//记录封存的时间点，merge的结果就是这一刻的数据，按时间点恢复时作为起点
+	cut := &mergeCut{timestamp: time.Now().UnixNano(), seqNo: atomic.LoadUint64(&db.seqNo)}
 
 	//取出需要merge的文件
 	var mergeFiles []*data.DataFile
@@ -87,14 +98,14 @@ func (db *DB) Merge() error {
 
 	mergePath := db.getMergePath()
 	//如果存在，说明之前调用过，就删了
-	if _, err := os.Stat(mergePath); err == nil {
-		if err := os.RemoveAll(mergePath); err != nil {
+	if _, err := db.fs.Stat(mergePath); err == nil {
+		if err := db.fs.RemoveAll(mergePath); err != nil {
 			return err
 		}
 	}
 
 	//新建merger目录
-	if err := os.MkdirAll(mergePath, os.ModePerm); err != nil {
+	if err := fio.MkdirAllSync(db.fs, mergePath, os.ModePerm); err != nil {
 		return err
 	}
 
@@ -103,20 +114,27 @@ func (db *DB) Merge() error {
 	mergeOption.DirPath = mergePath
 	//因为如果因为零时关闭导致merge失败，这些数据我们是不需要的。不如自己控制sync
 	mergeOption.SyncWrites = false
-	mergedb, err := Open(mergeOption)
+	//临时实例的key是直接追加进去的，不需要布隆过滤器
+	mergeOption.BloomFilter = false
+	//临时实例没有自己的历史文件
+	mergeOption.DataFileRetention = 0
+	//临时实例的数据都在merge目录中，不分层
+	mergeOption.ColdDirPath = ""
+	//临时实例和当前实例在同一个文件系统中
+	mergedb, err := open(mergeOption, db.fs)
 	if err != nil {
 		return err
 	}
 
 	//打开hint文件存储索引
-	hintFile, err := data.OpenHintFile(mergePath)
+	hintFile, err := data.OpenHintFile(db.fs, mergePath)
 	if err != nil {
 		return err
 	}
 
 	//遍历处理每个数据文件
 	for _, datafile := range mergeFiles {
-		var offset int64 = 0
+		offset := datafile.RecordStart()
 		for {
 			logRecord, size, err := datafile.ReadLogRecord(offset)
 			if err != nil {
@@ -157,19 +175,24 @@ func (db *DB) Merge() error {
 		return err
 	}
 
-	// 写标识的merge完成的文件
-	MergeFinishedFile, err := data.OpenMergeFinishFile(mergePath)
+	// 写标识的merge完成的文件，先写临时文件，持久化之后再改名，崩溃时不会留下不完整的完成标识
+	finTempName := data.MergeFinishedName + mergeTempSuffix
+	MergeFinishedFile, err := data.OpenMergeFinishFileWithName(db.fs, mergePath, finTempName)
 	if err != nil {
-		return nil
+		return err
 	}
 	mergeFinishRecord := &data.LogRecord{
 		Key:   []byte("mergeFinishedKey"),
 		Value: []byte(strconv.Itoa(int(nonMergeFileId))),
 	}
-	encRecord, _ := data.EncodeLogRecord(mergeFinishRecord)
+	encRecord, _ := MergeFinishedFile.EncodeLogRecord(mergeFinishRecord)
 	if err := MergeFinishedFile.Write(encRecord); err != nil {
 		return err
 	}
+	cutRecord, _ := MergeFinishedFile.EncodeLogRecord(&data.LogRecord{Key: []byte(mergeCutKey), Value: cut.encode()})
+	if err := MergeFinishedFile.Write(cutRecord); err != nil {
+		return err
+	}
 
 	//持久化标识的merge完成的文件
 	if err := MergeFinishedFile.Sync(); err != nil {
@@ -186,13 +209,24 @@ func (db *DB) Merge() error {
 	if err := MergeFinishedFile.Close(); err != nil {
 		return err
 	}
-
-	return nil
+	if err := db.fs.Rename(filepath.Join(mergePath, finTempName), filepath.Join(mergePath, data.MergeFinishedName)); err != nil {
+		return err
+	}
+	return db.fs.SyncDir(mergePath)
 }
 
 // eg /tmp/bitcask /tmp/bitcask-merge
+// 分层存储时在冷目录旁边，merge结果改名安装到冷目录时不会跨文件系统
 func (db *DB) getMergePath() string {
-	dirPath := db.options.DirPath
+	return siblingPath(db.mergedDirPath(), mergeDirName)
+}
+
+// 数据目录旁边带后缀的目录 eg /tmp/bitcask /tmp/bitcask-suffix
+func (db *DB) getSiblingPath(suffix string) string {
+	return siblingPath(db.options.DirPath, suffix)
+}
+
+func siblingPath(dirPath, suffix string) string {
 	//windows使用os.MkdirTemp("","file-id")，会出现文件dir和base函数压根无法使用的问题。
 	dir := path.Dir(path.Clean(dirPath))
 	if dir == "." { //说明无法识别
@@ -201,22 +235,32 @@ func (db *DB) getMergePath() string {
 	}
 	//获取路径的最后一个文件
 	base := path.Base(dirPath)
-	return filepath.Join(dir, base+mergeDirName)
+	return filepath.Join(dir, base+suffix)
 }
 
 // 加载merge数据目录
+// merge的结果先以临时后缀放进数据目录，然后在MANIFEST中提交，提交之后再替换旧文件
+// 提交之前崩溃，临时文件会被当作垃圾清理；提交之后崩溃，下次打开时继续替换
 func (db *DB) loadMergeFile() error {
+	if err := db.commitMergeInstall(); err != nil {
+		return err
+	}
+	return db.finishMergeInstall()
+}
+
+// 把完成的merge结果放进数据目录并在MANIFEST中提交
+func (db *DB) commitMergeInstall() error {
 	mergePath := db.getMergePath()
 
 	//如果目录不存在没必要进行
-	if _, err := os.Stat(mergePath); os.IsNotExist(err) {
+	if _, err := db.fs.Stat(mergePath); os.IsNotExist(err) {
 		return nil
 	}
 	defer func() {
-		_ = os.RemoveAll(mergePath)
+		_ = db.fs.RemoveAll(mergePath)
 	}()
 
-	dirEntries, err := os.ReadDir(mergePath)
+	dirEntries, err := db.fs.ReadDir(mergePath)
 	if err != nil {
 		return err
 	}
@@ -228,15 +272,24 @@ func (db *DB) loadMergeFile() error {
 		//说明完成了
 		if entry.Name() == data.MergeFinishedName {
 			mergeFinished = true
+			continue
 		}
 		//临时数据库关闭后会触发保存SeqNoFileName，这个是无效文件，甚至会影响原来的SeqNo，需要删掉
 		if entry.Name() == data.SeqNoFileName {
 			continue
 		}
+		//布隆过滤器只属于关闭它的那个实例，不能粘贴过去
+		if entry.Name() == data.BloomFilterName {
+			continue
+		}
 		//flock文件也不需要粘贴过去
 		if entry.Name() == fileLockName {
 			continue
 		}
+		//临时实例的MANIFEST只描述merge目录
+		if entry.Name() == data.ManifestFileName {
+			continue
+		}
 		//如果是bptree-index也不应该传过去，首先BPTree是持久化的索引，他就已经记录好了最新的索引。直接替代会丢失所有数据,merge过程没有记录任何索引，
 		//实测rename还会报错，因为你再上面已经创建了index，所以这里bptree会被占用导致失败。这里跳过
 		if entry.Name() == bptreeIndexName {
@@ -255,39 +308,179 @@ func (db *DB) loadMergeFile() error {
 		return err
 	}
 
-	//删除旧数据文件
-	var fileId uint32 = 0
-	for ; fileId < nonMergeFileId; fileId++ {
-		filename := data.GetDataFileName(db.options.DirPath, fileId)
-		if _, err := os.Stat(filename); err == nil {
-			if err := os.Remove(filename); err != nil {
+	//nonMergeFileId每次merge都会增大，相等说明已经提交过了
+	if db.manifestState.logStart != nonMergeFileId {
+		// 将新的数据文件以临时后缀移动过来
+		// /temp/bitcask-marge 000.data 001.data
+		// update to  /temp/bitcask 000.data.merge 001.data.merge
+		for _, filename := range mergeFileName {
+			srcPath := filepath.Join(mergePath, filename)
+			destPath := filepath.Join(db.mergedDirPath(), filename+mergeTempSuffix)
+			if err := db.fs.Rename(srcPath, destPath); err != nil {
+				return err
+			}
+		}
+		//完成标识留在merge目录，提交之前崩溃可以重新来过
+		if err := fio.CopyFile(db.fs, filepath.Join(mergePath, data.MergeFinishedName),
+			filepath.Join(db.mergedDirPath(), data.MergeFinishedName+mergeTempSuffix)); err != nil {
+			return err
+		}
+		if err := db.fs.SyncDir(db.mergedDirPath()); err != nil {
+			return err
+		}
+
+		//一次修改替换掉所有比nonMergeFileId小的文件
+		edit := &manifestEdit{logStart: &nonMergeFileId, mergeState: manifestMergePending}
+		for fid := range db.manifestState.files {
+			if fid < nonMergeFileId {
+				edit.deleted = append(edit.deleted, fid)
+			}
+		}
+		mergedIds, err := listMergeTempFileIds(db.fs, db.mergedDirPath())
+		if err != nil {
+			return err
+		}
+		for _, fid := range mergedIds {
+			info, err := db.fs.Stat(data.GetDataFileName(db.mergedDirPath(), fid) + mergeTempSuffix)
+			if err != nil {
 				return err
 			}
+			edit.added = append(edit.added, fid)
+			edit.sealed = append(edit.sealed, manifestSealed{fid: fid, size: info.Size()})
 		}
+		return db.appendManifestEdit(edit)
 	}
+	return nil
+}
 
-	// 将新的数据文件移动过来
-	for _, filename := range mergeFileName {
-		// /temp/bitcask-marge 000.data 001.data
-		// update to  /temp/bitcask 000.data 001.data
-		srcPath := filepath.Join(mergePath, filename)
-		destPath := filepath.Join(db.options.DirPath, filename)
-		err := os.Rename(srcPath, destPath)
+// 完成已经提交的merge：移走被替换的旧文件，把临时文件改成正式的名字
+// 可以重复执行，没有提交的临时文件直接删除
+func (db *DB) finishMergeInstall() error {
+	//分层存储时临时文件在冷目录中，被替换的旧文件可能在任意一个目录中
+	var tempPaths []string
+	for _, dir := range db.dataDirs() {
+		dirEntries, err := db.fs.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, entry := range dirEntries {
+			if strings.HasSuffix(entry.Name(), mergeTempSuffix) {
+				tempPaths = append(tempPaths, filepath.Join(dir, entry.Name()))
+			}
+		}
+	}
+	if !db.manifestState.mergePending {
+		for _, path := range tempPaths {
+			if err := db.fs.Remove(path); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	//被替换的旧文件：不在MANIFEST中的旧数据文件，以及有同名临时文件的文件
+	logStart := db.manifestState.logStart
+	replaced := make(map[string]bool)
+	for _, path := range tempPaths {
+		replaced[strings.TrimSuffix(filepath.Base(path), mergeTempSuffix)] = true
+	}
+	var oldPaths []string
+	for _, dir := range db.dataDirs() {
+		fileIds, err := listDataFileIds(db.fs, dir)
 		if err != nil {
 			return err
 		}
+		for _, fid := range fileIds {
+			path := data.GetDataFileName(dir, fid)
+			if _, ok := db.manifestState.files[fid]; fid < logStart && (!ok || replaced[filepath.Base(path)]) {
+				oldPaths = append(oldPaths, path)
+			}
+		}
+		for _, name := range []string{data.HintFileName, data.MergeFinishedName} {
+			if _, err := db.fs.Stat(filepath.Join(dir, name)); err == nil && replaced[name] {
+				oldPaths = append(oldPaths, filepath.Join(dir, name))
+			}
+		}
+	}
+
+	if db.options.DataFileRetention > 0 && len(oldPaths) > 0 {
+		//旧数据文件移动到归档目录，保留一段时间用于按时间点恢复
+		if err := db.archiveFiles(oldPaths, logStart); err != nil {
+			return err
+		}
+	} else {
+		//删除旧数据文件
+		for _, path := range oldPaths {
+			if err := db.fs.Remove(path); err != nil {
+				return err
+			}
+		}
+	}
+
+	//完成标识最后改名
+	sort.Slice(tempPaths, func(i, j int) bool {
+		return filepath.Base(tempPaths[j]) == data.MergeFinishedName+mergeTempSuffix
+	})
+	for _, path := range tempPaths {
+		if err := db.fs.Rename(path, strings.TrimSuffix(path, mergeTempSuffix)); err != nil {
+			return err
+		}
+	}
+	for _, dir := range db.dataDirs() {
+		if err := db.fs.SyncDir(dir); err != nil {
+			return err
+		}
+	}
+	if err := db.appendManifestEdit(&manifestEdit{mergeState: manifestMergeDone}); err != nil {
+		return err
 	}
+	db.mergeInstalled = true
 
 	return nil
 }
 
+// 数据目录中merge结果的临时数据文件id
+func listMergeTempFileIds(fs fio.FS, dir string) ([]uint32, error) {
+	entries, err := fs.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var fileIds []uint32
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), mergeTempSuffix)
+		if name == entry.Name() || !strings.HasSuffix(name, data.DataFileNameSuffix) {
+			continue
+		}
+		fileId, err := strconv.Atoi(strings.TrimSuffix(name, data.DataFileNameSuffix))
+		if err != nil {
+			return nil, ErrDataDirectoryCorrupdated
+		}
+		fileIds = append(fileIds, uint32(fileId))
+	}
+	return fileIds, nil
+}
+
+// 读取数据目录中上一次merge的完成标识，没有发生过merge返回0
+func (db *DB) loadNonMergeFileId() (uint32, error) {
+	dir := db.mergeFileDir(data.MergeFinishedName)
+	mergeFinFileName := filepath.Join(dir, data.MergeFinishedName)
+	if _, err := db.fs.Stat(mergeFinFileName); err != nil {
+		return 0, nil
+	}
+	return db.getNonMergeFileId(dir)
+}
+
 // 这里找到MergeFile然后读取fileId
 func (db *DB) getNonMergeFileId(mergePath string) (uint32, error) {
-	hintFinishFile, err := data.OpenMergeFinishFile(mergePath)
+	return readNonMergeFileId(db.fs, mergePath)
+}
+
+func readNonMergeFileId(fs fio.FS, mergePath string) (uint32, error) {
+	hintFinishFile, err := data.OpenMergeFinishFileReadOnly(fs, mergePath)
 	if err != nil {
 		return 0, err
 	}
-	finishRecord, _, err := hintFinishFile.ReadLogRecord(0)
+	finishRecord, _, err := hintFinishFile.ReadLogRecord(hintFinishFile.RecordStart())
 	if err != nil {
 		return 0, err
 	}
@@ -300,20 +493,21 @@ func (db *DB) getNonMergeFileId(mergePath string) (uint32, error) {
 
 func (db *DB) loadIndexFromHintFile() error {
 	//查看hint文件是否存在
-	hintFileName := filepath.Join(db.options.DirPath, data.HintFileName)
-	if _, err := os.Stat(hintFileName); os.IsNotExist(err) {
+	hintDir := db.mergeFileDir(data.HintFileName)
+	hintFileName := filepath.Join(hintDir, data.HintFileName)
+	if _, err := db.fs.Stat(hintFileName); os.IsNotExist(err) {
 		return nil
 	}
 
 	//打开hint索引文件
-	hintfile, err := data.OpenHintFile(db.options.DirPath)
+	hintfile, err := data.OpenHintFile(db.fs, hintDir)
 
 	if err != nil {
 		return err
 	}
 
 	//读取hint索引文件
-	var offset int64 = 0
+	offset := hintfile.RecordStart()
 	for {
 		logRecord, size, err := hintfile.ReadLogRecord(offset)
 		if err != nil {
@@ -323,23 +517,8 @@ func (db *DB) loadIndexFromHintFile() error {
 			return err
 		}
 		pos := data.DecodeLogRecordPos(logRecord.Value)
-		//这里是只考虑bptree的情况
-		if db.options.IndexType == BPTree {
-			nonMergeFileId, err := db.getNonMergeFileId(db.options.DirPath)
-			if err != nil {
-				return err
-			}
-			oldPos := db.index.Get(logRecord.Key)
-			//当你的oldPos的取出来(不是被delete掉了)，且取出来的值小于你merge的值，我觉得应该是
-			//这里说明如果hint取出来一个key在index找不到，默认index在接下来的过程中删掉了该key
-			//如果能取出来且得出的fileid是以前的，merge之前的文件，默认没改过，修正pos
-			//感觉这里的默认还是有点绝对，还需要做更细致的判断
-			if oldPos != nil && oldPos.Fid < nonMergeFileId {
-				db.index.Put(logRecord.Key, pos)
-			}
-		} else {
-			db.index.Put(logRecord.Key, pos)
-		}
+		//B+Tree在安装merge结果后会先清空索引，所以这里和内存索引一样直接写入
+		db.index.Put(logRecord.Key, pos)
 		offset += size
 	}
 
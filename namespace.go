@@ -0,0 +1,325 @@
+package bitcask_go
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strconv"
+	"sync/atomic"
+)
+
+// 命名空间使用的保留前缀，普通的key不能以它开头
+var reservedKeyPrefix = []byte("\x00bitcask-ns\x00")
+
+var (
+	//命名空间元数据 prefix + m + name -> version
+	nsMetaPrefix = append(append([]byte{}, reservedKeyPrefix...), 'm')
+	//命名空间数据 prefix + d + len(name) + name + version + key
+	nsDataPrefix = append(append([]byte{}, reservedKeyPrefix...), 'd')
+)
+
+// 命名空间，在同一个DB内提供相互隔离的key空间
+// 删除命名空间只是提升版本号并清理索引，旧版本的数据在下次merge时回收
+type Namespace struct {
+	db   *DB
+	name string
+}
+
+// 命名空间的统计信息
+type NamespaceStat struct {
+	KeyNum   uint  //key的数量
+	DataSize int64 //有效数据在磁盘上占用的字节数
+}
+
+// 是否是命名空间使用的保留key
+func isReservedKey(key []byte) bool {
+	return bytes.HasPrefix(key, reservedKeyPrefix)
+}
+
+func nsMetaKey(name string) []byte {
+	return append(append([]byte{}, nsMetaPrefix...), name...)
+}
+
+// 某个版本命名空间的数据前缀
+func nsDataKeyPrefix(name string, version uint64) []byte {
+	buf := make([]byte, len(nsDataPrefix)+binary.MaxVarintLen64+len(name)+8)
+	var index = copy(buf, nsDataPrefix)
+	index += binary.PutUvarint(buf[index:], uint64(len(name)))
+	index += copy(buf[index:], name)
+	binary.BigEndian.PutUint64(buf[index:], version)
+	return buf[:index+8]
+}
+
+// 从数据key中解析出命名空间名称、版本和用户的key
+func parseNsDataKey(key []byte) (string, uint64, []byte, bool) {
+	if !bytes.HasPrefix(key, nsDataPrefix) {
+		return "", 0, nil, false
+	}
+	buf := key[len(nsDataPrefix):]
+	nameLen, n := binary.Uvarint(buf)
+	if n <= 0 || uint64(len(buf)-n) < nameLen+8 {
+		return "", 0, nil, false
+	}
+	name := string(buf[n : n+int(nameLen)])
+	version := binary.BigEndian.Uint64(buf[n+int(nameLen):])
+	return name, version, buf[n+int(nameLen)+8:], true
+}
+
+// 获取命名空间，不存在的命名空间在第一次写入时自然产生
+func (db *DB) Namespace(name string) *Namespace {
+	return &Namespace{db: db, name: name}
+}
+
+// 删除命名空间的所有数据
+// 写入新的版本号后旧版本的key全部失效，同时从索引中移除，磁盘空间在下次merge时回收
+func (db *DB) DropNamespace(name string) error {
+	db.nsLock.Lock()
+	defer db.nsLock.Unlock()
+
+	if db.isFollower() {
+		return ErrFollowerReadOnly
+	}
+	version := db.namespaces[name]
+	if err := db.put(nsMetaKey(name), []byte(strconv.FormatUint(version+1, 10))); err != nil {
+		return err
+	}
+	db.setNamespaceVersion(name, version+1)
+	return nil
+}
+
+// 设置命名空间的版本，并从索引中移除其他版本的key，调用方必须持有命名空间写锁
+func (db *DB) setNamespaceVersion(name string, version uint64) {
+	if version == 0 {
+		delete(db.namespaces, name)
+	} else {
+		db.namespaces[name] = version
+	}
+
+	//先收集再删除，B+树的迭代器持有读事务，不能边遍历边删除
+	prefix := nsDataKeyPrefix(name, version)
+	prefix = prefix[:len(prefix)-8]
+	var keys [][]byte
+	it := db.index.Iterator(false)
+	for it.Seek(prefix); it.Valid() && bytes.HasPrefix(it.Key(), prefix); it.Next() {
+		if _, v, _, ok := parseNsDataKey(it.Key()); ok && v != version {
+			keys = append(keys, it.Key())
+		}
+	}
+	it.Close()
+	db.removeFromIndex(keys)
+}
+
+// 从索引中移除失效的key，原来的数据算作可回收空间
+func (db *DB) removeFromIndex(keys [][]byte) {
+	for _, key := range keys {
+		if oldPos, ok := db.index.Delete(key); ok && oldPos != nil {
+			atomic.AddInt64(&db.reclaimSize, int64(oldPos.Size))
+		}
+	}
+}
+
+// 调用方必须持有命名空间锁
+func (db *DB) namespaceVersion(name string) uint64 {
+	return db.namespaces[name]
+}
+
+// key是否属于已经删除的命名空间版本，调用方必须持有命名空间锁
+func (db *DB) isStaleNamespaceKey(key []byte) bool {
+	name, version, _, ok := parseNsDataKey(key)
+	return ok && version != db.namespaces[name]
+}
+
+// 打开时加载命名空间的版本
+// 删除命名空间后没有merge就重启，旧版本的数据会重新加载进索引，这里把它们清理掉
+func (db *DB) loadNamespaces() error {
+	var stale [][]byte
+	it := db.index.Iterator(false)
+	for it.Seek(nsMetaPrefix); it.Valid() && bytes.HasPrefix(it.Key(), nsMetaPrefix); it.Next() {
+		value, err := db.readValue(it.Value())
+		if err != nil {
+			it.Close()
+			return err
+		}
+		version, err := strconv.ParseUint(string(value), 10, 64)
+		if err != nil {
+			it.Close()
+			return err
+		}
+		db.namespaces[string(it.Key()[len(nsMetaPrefix):])] = version
+	}
+	for it.Seek(nsDataPrefix); it.Valid() && bytes.HasPrefix(it.Key(), nsDataPrefix); it.Next() {
+		if db.isStaleNamespaceKey(it.Key()) {
+			stale = append(stale, it.Key())
+		}
+	}
+	it.Close()
+	db.removeFromIndex(stale)
+	return nil
+}
+
+// 命名空间名称
+func (ns *Namespace) Name() string {
+	return ns.name
+}
+
+// 当前版本的数据前缀
+func (ns *Namespace) prefix() []byte {
+	ns.db.nsLock.RLock()
+	defer ns.db.nsLock.RUnlock()
+	return nsDataKeyPrefix(ns.name, ns.db.namespaceVersion(ns.name))
+}
+
+func (ns *Namespace) dataKey(prefix, key []byte) []byte {
+	return append(append(make([]byte, 0, len(prefix)+len(key)), prefix...), key...)
+}
+
+// 写入Key/Value数据，key不能为空
+func (ns *Namespace) Put(key, value []byte) error {
+	if len(key) == 0 {
+		return ErrKeyIsEmpty
+	}
+	//持有读锁，写入过程中命名空间不会被删除
+	ns.db.nsLock.RLock()
+	defer ns.db.nsLock.RUnlock()
+	prefix := nsDataKeyPrefix(ns.name, ns.db.namespaceVersion(ns.name))
+	return ns.db.put(ns.dataKey(prefix, key), value)
+}
+
+// 通过Key获取value数据，key不能为空
+func (ns *Namespace) Get(key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, ErrKeyIsEmpty
+	}
+	return ns.db.get(ns.dataKey(ns.prefix(), key))
+}
+
+// 删除Key数据，key不能为空
+func (ns *Namespace) Delete(key []byte) error {
+	if len(key) == 0 {
+		return ErrKeyIsEmpty
+	}
+	ns.db.nsLock.RLock()
+	defer ns.db.nsLock.RUnlock()
+	prefix := nsDataKeyPrefix(ns.name, ns.db.namespaceVersion(ns.name))
+	return ns.db.delete(ns.dataKey(prefix, key))
+}
+
+// 从命名空间中获取所有的key
+func (ns *Namespace) ListKeys() [][]byte {
+	var keys [][]byte
+	it := ns.NewIterator(DefaultIterOptions)
+	defer it.Close()
+	for it.Rewind(); it.Valid(); it.Next() {
+		keys = append(keys, it.Key())
+	}
+	return keys
+}
+
+// 返回命名空间的统计信息
+func (ns *Namespace) Stat() *NamespaceStat {
+	prefix := ns.prefix()
+	stat := &NamespaceStat{}
+	it := ns.db.index.Iterator(false)
+	defer it.Close()
+	for it.Seek(prefix); it.Valid() && bytes.HasPrefix(it.Key(), prefix); it.Next() {
+		stat.KeyNum++
+		stat.DataSize += int64(it.Value().Size)
+	}
+	return stat
+}
+
+// 命名空间迭代器，返回的key不带命名空间前缀
+type NamespaceIterator struct {
+	it     *Iterator
+	prefix []byte
+}
+
+// 创建命名空间迭代器，迭代期间命名空间被删除的话仍然遍历旧版本的数据
+func (ns *Namespace) NewIterator(options IteratorOptions) *NamespaceIterator {
+	prefix := ns.prefix()
+	iterOptions := options
+	iterOptions.Prefix = ns.dataKey(prefix, options.Prefix)
+	it := ns.db.NewIterator(iterOptions)
+	it.internal = true
+	return &NamespaceIterator{it: it, prefix: prefix}
+}
+
+// 回到迭代器起点，正向遍历直接定位到命名空间的起点
+func (nit *NamespaceIterator) Rewind() {
+	if nit.it.options.Reverse {
+		nit.it.Rewind()
+		return
+	}
+	nit.it.Seek(nit.it.options.Prefix)
+}
+
+// 根据传入key值找到第一个大于或小于等于目标的key
+func (nit *NamespaceIterator) Seek(key []byte) {
+	nit.it.Seek(append(append([]byte{}, nit.prefix...), key...))
+}
+
+// 下一个key
+func (nit *NamespaceIterator) Next() {
+	nit.it.Next()
+}
+
+// 是否有效
+func (nit *NamespaceIterator) Valid() bool {
+	return nit.it.Valid()
+}
+
+// 遍历当前位置Key
+func (nit *NamespaceIterator) Key() []byte {
+	return nit.it.Key()[len(nit.prefix):]
+}
+
+// 遍历当前位置Value
+func (nit *NamespaceIterator) Value() ([]byte, error) {
+	return nit.it.Value()
+}
+
+// 关闭迭代器
+func (nit *NamespaceIterator) Close() {
+	nit.it.Close()
+}
+
+// 命名空间内的原子批量写，多个命名空间的视图可以共享同一个WriteBatch，一次提交
+type NamespaceWriteBatch struct {
+	wb *WriteBatch
+	ns *Namespace
+}
+
+// 创建命名空间的批量写
+func (ns *Namespace) NewWriteBatch(options WriteBatchOptions) *NamespaceWriteBatch {
+	return ns.db.NewWriteBatch(options).Namespace(ns)
+}
+
+// 返回WriteBatch在某个命名空间下的视图，写入的数据和WriteBatch一起提交
+func (wb *WriteBatch) Namespace(ns *Namespace) *NamespaceWriteBatch {
+	return &NamespaceWriteBatch{wb: wb, ns: ns}
+}
+
+// 放置数据
+func (nwb *NamespaceWriteBatch) Put(key, value []byte) error {
+	if len(key) == 0 {
+		return ErrKeyIsEmpty
+	}
+	return nwb.wb.put(nwb.ns.dataKey(nwb.ns.prefix(), key), value)
+}
+
+// 删除数据
+func (nwb *NamespaceWriteBatch) Delete(key []byte) error {
+	if len(key) == 0 {
+		return ErrKeyIsEmpty
+	}
+	return nwb.wb.delete(nwb.ns.dataKey(nwb.ns.prefix(), key))
+}
+
+// 提交底层的WriteBatch，包括其他命名空间视图写入的数据
+func (nwb *NamespaceWriteBatch) Commit() error {
+	return nwb.wb.Commit()
+}
+
+// 底层的WriteBatch
+func (nwb *NamespaceWriteBatch) WriteBatch() *WriteBatch {
+	return nwb.wb
+}
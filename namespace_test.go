@@ -0,0 +1,209 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/utils"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_Namespace(t *testing.T) {
+	opts := DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-namespace")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	users := db.Namespace("users")
+	sessions := db.Namespace("sessions")
+	assert.Nil(t, users.Put([]byte("a"), []byte("user-a")))
+	assert.Nil(t, sessions.Put([]byte("a"), []byte("session-a")))
+	assert.Nil(t, db.Put([]byte("a"), []byte("raw-a")))
+
+	//相同的key在不同命名空间互不影响
+	val, err := users.Get([]byte("a"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("user-a"), val)
+	val, err = sessions.Get([]byte("a"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("session-a"), val)
+	val, err = db.Get([]byte("a"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("raw-a"), val)
+
+	//普通的接口看不到命名空间的key
+	assert.Equal(t, [][]byte{[]byte("a")}, db.ListKeys())
+	it := db.NewIterator(DefaultIterOptions)
+	var count int
+	for it.Rewind(); it.Valid(); it.Next() {
+		count++
+	}
+	it.Close()
+	assert.Equal(t, 1, count)
+	_, err = db.Get(nsMetaKey("users"))
+	assert.Equal(t, ErrKeyIsReserved, err)
+	assert.Equal(t, ErrKeyIsReserved, db.Put(reservedKeyPrefix, []byte("x")))
+
+	assert.Nil(t, users.Delete([]byte("a")))
+	_, err = users.Get([]byte("a"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = sessions.Get([]byte("a"))
+	assert.Nil(t, err)
+}
+
+func TestNamespace_Iterator(t *testing.T) {
+	opts := DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-namespace-iter")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	users := db.Namespace("users")
+	for _, key := range []string{"b", "a", "c", "ab"} {
+		assert.Nil(t, users.Put([]byte(key), []byte(key)))
+	}
+	assert.Nil(t, db.Namespace("user").Put([]byte("z"), []byte("z")))
+	assert.Nil(t, db.Put([]byte("zz"), []byte("zz")))
+
+	assert.Equal(t, [][]byte{[]byte("a"), []byte("ab"), []byte("b"), []byte("c")}, users.ListKeys())
+
+	it := users.NewIterator(IteratorOptions{Reverse: true})
+	var keys []string
+	for it.Rewind(); it.Valid(); it.Next() {
+		val, err := it.Value()
+		assert.Nil(t, err)
+		assert.Equal(t, it.Key(), val)
+		keys = append(keys, string(it.Key()))
+	}
+	it.Close()
+	assert.Equal(t, []string{"c", "b", "ab", "a"}, keys)
+
+	it = users.NewIterator(IteratorOptions{Prefix: []byte("a")})
+	keys = nil
+	for it.Rewind(); it.Valid(); it.Next() {
+		keys = append(keys, string(it.Key()))
+	}
+	it.Close()
+	assert.Equal(t, []string{"a", "ab"}, keys)
+
+	it = users.NewIterator(DefaultIterOptions)
+	it.Seek([]byte("b"))
+	assert.True(t, it.Valid())
+	assert.Equal(t, []byte("b"), it.Key())
+	it.Close()
+
+	stat := users.Stat()
+	assert.Equal(t, uint(4), stat.KeyNum)
+	assert.True(t, stat.DataSize > 0)
+}
+
+func TestNamespace_WriteBatch(t *testing.T) {
+	opts := DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-namespace-batch")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	users := db.Namespace("users")
+	counters := db.Namespace("counters")
+	assert.Nil(t, counters.Put([]byte("old"), []byte("1")))
+
+	//跨命名空间的原子批量写
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, wb.Namespace(users).Put([]byte("u1"), []byte("v1")))
+	assert.Nil(t, wb.Namespace(counters).Put([]byte("c1"), []byte("1")))
+	assert.Nil(t, wb.Namespace(counters).Delete([]byte("old")))
+	assert.Nil(t, wb.Put([]byte("raw"), []byte("raw")))
+	assert.Equal(t, ErrKeyIsReserved, wb.Put(nsMetaKey("users"), []byte("1")))
+
+	_, err = users.Get([]byte("u1"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Nil(t, wb.Commit())
+
+	val, err := users.Get([]byte("u1"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), val)
+	val, err = counters.Get([]byte("c1"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("1"), val)
+	_, err = counters.Get([]byte("old"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	nwb := users.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, nwb.Put([]byte("u2"), []byte("v2")))
+	//提交前命名空间被删除，暂存的数据不再写入
+	assert.Nil(t, db.DropNamespace("users"))
+	assert.Nil(t, nwb.Commit())
+	_, err = users.Get([]byte("u2"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Equal(t, uint(0), users.Stat().KeyNum)
+}
+
+func TestDB_DropNamespace(t *testing.T) {
+	for _, indexType := range []IndexerType{Btree, BPTree} {
+		opts := DefaultDBOptions
+		dir, _ := os.MkdirTemp("", "bitcask-go-namespace-drop")
+		opts.DirPath = dir
+		opts.IndexType = indexType
+		opts.DataFileMergeRatio = 0
+		db, err := Open(opts)
+		assert.Nil(t, err)
+
+		users := db.Namespace("users")
+		sessions := db.Namespace("sessions")
+		for i := 0; i < 100; i++ {
+			assert.Nil(t, users.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+			assert.Nil(t, sessions.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+		}
+		assert.Nil(t, db.DropNamespace("users"))
+		assert.Equal(t, uint(0), users.Stat().KeyNum)
+		assert.Equal(t, uint(100), sessions.Stat().KeyNum)
+		assert.True(t, db.Stat().ReclaimableSize > 0)
+
+		//删除后可以继续使用，旧数据不会出现
+		assert.Nil(t, users.Put([]byte("new"), []byte("new")))
+		assert.Equal(t, [][]byte{[]byte("new")}, users.ListKeys())
+
+		//没有merge就重启，旧版本的数据不能恢复
+		assert.Nil(t, db.Close())
+		db, err = Open(opts)
+		assert.Nil(t, err)
+		users = db.Namespace("users")
+		assert.Equal(t, [][]byte{[]byte("new")}, users.ListKeys())
+		_, err = users.Get(utils.GetTestKey(1))
+		assert.Equal(t, ErrKeyNotFound, err)
+		assert.Equal(t, uint(100), db.Namespace("sessions").Stat().KeyNum)
+
+		//merge之后旧数据不再占用空间
+		sizeBefore := dataFilesSize(dir)
+		assert.Nil(t, db.Merge())
+		assert.Nil(t, db.Close())
+		db, err = Open(opts)
+		assert.Nil(t, err)
+		sizeAfter := dataFilesSize(dir)
+		assert.True(t, sizeAfter < sizeBefore)
+		assert.Equal(t, [][]byte{[]byte("new")}, db.Namespace("users").ListKeys())
+		assert.Equal(t, uint(100), db.Namespace("sessions").Stat().KeyNum)
+		destroyDB(db)
+	}
+}
+
+// 数据文件的总大小
+func dataFilesSize(dir string) int64 {
+	var size int64
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), data.DataFileNameSuffix) {
+			info, _ := os.Stat(filepath.Join(dir, entry.Name()))
+			size += info.Size()
+		}
+	}
+	return size
+}
@@ -1,10 +1,17 @@
 package bitcask_go
 
-import "os"
+import (
+	"bitcask-go/data"
+	"bitcask-go/fio"
+	"os"
+	"time"
+)
 
 type Options struct {
 	DirPath string //数据库数据路径
 
+	ColdDirPath string //冷数据路径，比如大容量的慢盘，merge生成的数据文件写到这里，活跃文件和最近写入的数据留在DirPath，为空时不分层
+
 	DataFileSize int64 //配置数据文件大小
 
 	SyncWrites bool //是否每次都写入文件都进行持久化
@@ -16,6 +23,24 @@ type Options struct {
 	IndexType IndexerType //索引类型
 
 	DataFileMergeRatio float32 //数据合并的阈值
+
+	IndexShards int //索引分片数，大于1时BTree/ART索引按key分片，减少锁竞争
+
+	BPTreeFlushBatchSize int //B+树索引异步刷盘的批大小，大于0时索引先暂存内存攒批写入，适合批量导入
+
+	BloomFilter bool //是否开启布隆过滤器，开启后查询一定不存在的key不需要访问索引
+
+	DataFileRetention time.Duration //merge替换掉的旧数据文件保留多久，用于按时间点恢复，为0时直接删除
+
+	Checksum ChecksumType //新建数据文件使用的校验算法，记录在文件头中，已有的文件按原来的算法读取
+
+	IOType IOType //运行期间数据文件的IO类型，默认标准文件IO
+
+	DirectIOSealedOnly bool //IOType为DirectIO时，只有封存的旧数据文件使用直接IO，活跃文件使用标准IO，刚写入的数据仍然可以从页缓存读取
+
+	InMemory bool //内存模式，所有文件都保存在内存中，关闭后数据丢失，不能使用B+Tree索引
+
+	FS fio.FS //数据库所有文件操作使用的文件系统，为nil时使用操作系统的文件系统，内存模式下使用新的内存文件系统；B+Tree索引只能使用操作系统的文件系统
 }
 
 type IteratorOptions struct {
@@ -43,6 +68,35 @@ const (
 
 	//B+Tree主要持久化索引
 	BPTree
+
+	//哈希表索引，适用于只有点查的场景，迭代时按需排序
+	Hash
+)
+
+type ChecksumType = data.ChecksumType
+
+const (
+	//IEEE，旧版本数据文件使用的算法
+	ChecksumIEEE = data.ChecksumIEEE
+
+	//CRC32C，有硬件加速，新建数据库的默认算法
+	ChecksumCRC32C = data.ChecksumCRC32C
+)
+
+type IOType = fio.FileIOType
+
+const (
+	//标准文件IO
+	StandardIO = fio.StandardFIO
+
+	//可读写的mmap，写入直接拷贝到映射区域，启动和运行期间都使用
+	MMapIO = fio.MemoryMapRW
+
+	//带写缓冲的文件IO，写入先攒在内存中，Sync或者攒够之后写入文件，活跃文件预先分配空间
+	BufferedIO = fio.BufferedFIO
+
+	//O_DIRECT直接IO，读写绕过页缓存，适合远大于内存的冷数据，只有linux支持，其他系统退回标准IO
+	DirectIO = fio.DirectFIO
 )
 
 var DefaultDBOptions = Options{
@@ -53,6 +107,7 @@ var DefaultDBOptions = Options{
 	IndexType:          ART,
 	MmapAtStartup:      true,
 	DataFileMergeRatio: 0.5,
+	Checksum:           ChecksumCRC32C,
 }
 
 var DefaultIterOptions = IteratorOptions{
@@ -0,0 +1,548 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/fio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	//保留旧数据文件的目录后缀，每次安装merge结果时替换掉的文件放在一个编号递增的子目录里
+	archiveDirName = "-archive"
+	//merge完成标识文件中记录封存时间点的key
+	mergeCutKey = "mergeCutKey"
+	//归档完成标识的key
+	archiveFinishedKey = "archiveFinishedKey"
+)
+
+// merge封存活跃文件的时间点，比nonMergeFileId小的文件包含这一刻之前的全部写入
+type mergeCut struct {
+	timestamp int64
+	seqNo     uint64
+}
+
+func (cut *mergeCut) encode() []byte {
+	buf := make([]byte, binary.MaxVarintLen64*2)
+	var index = 0
+	index += binary.PutVarint(buf[index:], cut.timestamp)
+	index += binary.PutUvarint(buf[index:], cut.seqNo)
+	return buf[:index]
+}
+
+// 读取merge完成标识中的封存时间点，旧版本merge没有记录时返回nil
+func readMergeCut(fs fio.FS, dir string) (*mergeCut, error) {
+	finishedFile, err := data.OpenMergeFinishFileReadOnly(fs, dir)
+	if err != nil {
+		return nil, err
+	}
+	defer finishedFile.Close()
+
+	_, size, err := finishedFile.ReadLogRecord(finishedFile.RecordStart())
+	if err != nil {
+		return nil, err
+	}
+	record, _, err := finishedFile.ReadLogRecord(finishedFile.RecordStart() + size)
+	if err != nil {
+		if err == io.EOF {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if string(record.Key) != mergeCutKey {
+		return nil, nil
+	}
+	timestamp, n := binary.Varint(record.Value)
+	if n <= 0 {
+		return nil, ErrDataDirectoryCorrupdated
+	}
+	seqNo, m := binary.Uvarint(record.Value[n:])
+	if m <= 0 {
+		return nil, ErrDataDirectoryCorrupdated
+	}
+	return &mergeCut{timestamp: timestamp, seqNo: seqNo}, nil
+}
+
+// 用merge封存时的事务序列号初始化seqNo
+func (db *DB) loadMergeCutSeqNo() error {
+	if db.logStartFid == 0 {
+		return nil
+	}
+	cut, err := readMergeCut(db.fs, db.mergeFileDir(data.MergeFinishedName))
+	if err != nil {
+		return err
+	}
+	if cut != nil && cut.seqNo > db.seqNo {
+		db.seqNo = cut.seqNo
+	}
+	return nil
+}
+
+// 安装merge结果时把被替换的文件移动到归档目录
+// 包括比nonMergeFileId小的数据文件，以及上一次merge的hint文件和完成标识，归档目录本身就是一个可以回放的起点
+// 分层存储时冷目录中的文件可能和归档目录不在同一个文件系统上，改名失败时复制过去
+func (db *DB) archiveFiles(paths []string, nonMergeFileId uint32) error {
+	archivePath := db.getSiblingPath(archiveDirName)
+	genDir, err := nextArchiveGeneration(db.fs, archivePath)
+	if err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		if err := fio.MoveFile(db.fs, path, filepath.Join(genDir, filepath.Base(path))); err != nil {
+			return err
+		}
+	}
+
+	//最后写入完成标识，记录归档时间和这一批文件的结束位置
+	buf := make([]byte, binary.MaxVarintLen64*2)
+	var index = 0
+	index += binary.PutVarint(buf[index:], time.Now().UnixNano())
+	index += binary.PutUvarint(buf[index:], uint64(nonMergeFileId))
+	finishedFile, err := data.OpenArchiveFinishedFile(db.fs, genDir)
+	if err != nil {
+		return err
+	}
+	record, _ := finishedFile.EncodeLogRecord(&data.LogRecord{Key: []byte(archiveFinishedKey), Value: buf[:index]})
+	if err := finishedFile.Write(record); err != nil {
+		return err
+	}
+	if err := finishedFile.Sync(); err != nil {
+		return err
+	}
+	if err := finishedFile.Close(); err != nil {
+		return err
+	}
+	if err := db.fs.SyncDir(genDir); err != nil {
+		return err
+	}
+	for _, dir := range db.dataDirs() {
+		if err := db.fs.SyncDir(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 返回这一次归档使用的目录，上一次归档没有完成时继续使用它
+func nextArchiveGeneration(fs fio.FS, archivePath string) (string, error) {
+	if err := fio.MkdirAllSync(fs, archivePath, os.ModePerm); err != nil {
+		return "", err
+	}
+	gens, err := listArchiveGenerations(fs, archivePath)
+	if err != nil {
+		return "", err
+	}
+	var gen = 1
+	if len(gens) > 0 {
+		last := gens[len(gens)-1]
+		gen = last + 1
+		if _, err := fs.Stat(filepath.Join(archiveGenPath(archivePath, last), data.ArchiveFinishedName)); err != nil {
+			gen = last
+		}
+	}
+	genDir := archiveGenPath(archivePath, gen)
+	if err := fio.MkdirAllSync(fs, genDir, os.ModePerm); err != nil {
+		return "", err
+	}
+	return genDir, nil
+}
+
+func archiveGenPath(archivePath string, gen int) string {
+	return filepath.Join(archivePath, fmt.Sprintf("%09d", gen))
+}
+
+// 归档目录下的编号，从小到大
+func listArchiveGenerations(fs fio.FS, archivePath string) ([]int, error) {
+	entries, err := fs.ReadDir(archivePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var gens []int
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if gen, err := strconv.Atoi(entry.Name()); err == nil {
+			gens = append(gens, gen)
+		}
+	}
+	sort.Ints(gens)
+	return gens, nil
+}
+
+// 读取归档完成标识，返回归档时间和这一批文件的结束位置
+func readArchiveFinished(fs fio.FS, genDir string) (int64, uint32, error) {
+	finishedFile, err := data.OpenArchiveFinishedFileReadOnly(fs, genDir)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer finishedFile.Close()
+	record, _, err := finishedFile.ReadLogRecord(finishedFile.RecordStart())
+	if err != nil {
+		return 0, 0, err
+	}
+	archivedAt, n := binary.Varint(record.Value)
+	if n <= 0 {
+		return 0, 0, ErrDataDirectoryCorrupdated
+	}
+	endFid, m := binary.Uvarint(record.Value[n:])
+	if m <= 0 {
+		return 0, 0, ErrDataDirectoryCorrupdated
+	}
+	return archivedAt, uint32(endFid), nil
+}
+
+// 删除超过保留时间的归档
+func (db *DB) pruneArchive() error {
+	if db.options.DataFileRetention <= 0 {
+		return nil
+	}
+	archivePath := db.getSiblingPath(archiveDirName)
+	gens, err := listArchiveGenerations(db.fs, archivePath)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(-db.options.DataFileRetention).UnixNano()
+	for _, gen := range gens {
+		genDir := archiveGenPath(archivePath, gen)
+		if _, err := db.fs.Stat(filepath.Join(genDir, data.ArchiveFinishedName)); err != nil {
+			continue
+		}
+		archivedAt, _, err := readArchiveFinished(db.fs, genDir)
+		if err != nil {
+			return err
+		}
+		if archivedAt < deadline {
+			if err := db.fs.RemoveAll(genDir); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// 恢复的目标，Time不为零时恢复到这个时间点，否则恢复到事务序列号SeqNo提交之后
+// 只有WriteBatch有序列号，非事务写入的序列号都是0，SeqNo只能在事务之间截断
+// 目标事务之前的非事务写入都会恢复，之后的都不会，需要在非事务写入之间截断时使用Time
+type RecoverTarget struct {
+	Time  time.Time
+	SeqNo uint64
+}
+
+// 回放的起点，一个归档目录或者数据目录本身
+// 比baseFid小的是merge重写过的文件，包含cut时刻之前的全部数据，其余是原始的日志
+type recoverSource struct {
+	dir      string //merge完成标识和hint文件所在的目录
+	fileIds  []uint32
+	fileDirs map[uint32]string //数据文件所在的目录，分层存储时数据目录的文件分布在冷热两个目录中
+	baseFid  uint32
+	cut      *mergeCut
+	endFid   uint32 //归档的结束位置，数据目录为最大值
+}
+
+// 起点的数据是否都在目标之前
+func (src *recoverSource) usable(target RecoverTarget) bool {
+	if src.baseFid == 0 {
+		return true
+	}
+	if src.cut == nil {
+		return false
+	}
+	if !target.Time.IsZero() {
+		return src.cut.timestamp <= target.Time.UnixNano()
+	}
+	return src.cut.seqNo < target.SeqNo
+}
+
+// dirs中热目录在前，同一个文件在冷目录中时以冷目录为准
+func loadRecoverSource(fs fio.FS, dirs []string, endFid uint32) (*recoverSource, error) {
+	src := &recoverSource{dir: dirs[0], fileDirs: make(map[uint32]string), endFid: endFid}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		fileIds, err := listDataFileIds(fs, dirs[i])
+		if err != nil {
+			return nil, err
+		}
+		for _, fid := range fileIds {
+			if _, ok := src.fileDirs[fid]; !ok {
+				src.fileDirs[fid] = dirs[i]
+				src.fileIds = append(src.fileIds, fid)
+			}
+		}
+	}
+	sort.Slice(src.fileIds, func(i, j int) bool { return src.fileIds[i] < src.fileIds[j] })
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if _, err := fs.Stat(filepath.Join(dirs[i], data.MergeFinishedName)); err != nil {
+			continue
+		}
+		src.dir = dirs[i]
+		var err error
+		if src.baseFid, err = readNonMergeFileId(fs, src.dir); err != nil {
+			return nil, err
+		}
+		if src.cut, err = readMergeCut(fs, src.dir); err != nil {
+			return nil, err
+		}
+		break
+	}
+	return src, nil
+}
+
+// 要回放的一个原始日志文件
+type recoverFile struct {
+	dir string
+	fid uint32
+}
+
+// 离线恢复，在targetDir中重建dir在target时刻的数据，targetDir必须为空
+// 从归档目录中找到最近一个不晚于target的merge结果作为起点，按日志顺序回放原始日志直到target
+// 需要打开数据库时设置DataFileRetention保留merge替换掉的文件
+func RecoverTo(dir, targetDir string, target RecoverTarget) error {
+	return RecoverToWithFS(fio.OSFS{}, dir, targetDir, target)
+}
+
+// 在fs中离线恢复，dir和targetDir都在fs中
+func RecoverToWithFS(fs fio.FS, dir, targetDir string, target RecoverTarget) error {
+	options := DefaultDBOptions
+	options.DirPath = dir
+	options.FS = fs
+	return RecoverToWithOptions(options, targetDir, target)
+}
+
+// 离线恢复options中的数据目录，只使用DirPath、ColdDirPath和FS，targetDir和数据目录在同一个文件系统中
+// 配置了冷数据目录时merge的结果从冷目录中读取，恢复出来的数据都在targetDir中
+func RecoverToWithOptions(options Options, targetDir string, target RecoverTarget) error {
+	fs := options.FS
+	if fs == nil {
+		fs = fio.OSFS{}
+	}
+	if target.Time.IsZero() && target.SeqNo == nonTransactionSeqNo {
+		return ErrInvalidRecoverTarget
+	}
+	dir := options.DirPath
+	dataDirs := []string{dir}
+	if options.ColdDirPath != "" {
+		dataDirs = append(dataDirs, options.ColdDirPath)
+	}
+	//离线操作，不能和打开的数据库同时进行
+	filelock := fs.NewLocker(filepath.Join(dir, fileLockName))
+	hold, err := filelock.TryLock()
+	if err != nil {
+		return err
+	}
+	if !hold {
+		return ErrDatabaseIsUsing
+	}
+	defer func() {
+		_ = filelock.Unlock()
+	}()
+
+	if err := fio.MkdirAllSync(fs, targetDir, os.ModePerm); err != nil {
+		return err
+	}
+	entries, err := fs.ReadDir(targetDir)
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return ErrRestoreDirNotEmpty
+	}
+
+	//归档从旧到新，最后是数据目录
+	var sources []*recoverSource
+	archivePath := siblingPath(dir, archiveDirName)
+	gens, err := listArchiveGenerations(fs, archivePath)
+	if err != nil {
+		return err
+	}
+	for _, gen := range gens {
+		genDir := archiveGenPath(archivePath, gen)
+		if _, err := fs.Stat(filepath.Join(genDir, data.ArchiveFinishedName)); err != nil {
+			continue
+		}
+		_, endFid, err := readArchiveFinished(fs, genDir)
+		if err != nil {
+			return err
+		}
+		src, err := loadRecoverSource(fs, []string{genDir}, endFid)
+		if err != nil {
+			return err
+		}
+		sources = append(sources, src)
+	}
+	live, err := loadRecoverSource(fs, dataDirs, math.MaxUint32)
+	if err != nil {
+		return err
+	}
+	sources = append(sources, live)
+
+	//最近的一个可用起点
+	start := -1
+	for i := len(sources) - 1; i >= 0; i-- {
+		if sources[i].usable(target) {
+			start = i
+			break
+		}
+	}
+	if start < 0 {
+		return ErrRecoverTargetUnavailable
+	}
+	base := sources[start]
+
+	//起点之后的原始日志，相邻两段必须首尾相接
+	var files []*recoverFile
+	var broken bool
+	for i := start; i < len(sources); i++ {
+		src := sources[i]
+		if i > start && src.baseFid != sources[i-1].endFid {
+			broken = true
+			break
+		}
+		for _, fid := range src.fileIds {
+			if fid >= src.baseFid && fid < src.endFid {
+				files = append(files, &recoverFile{dir: src.fileDirs[fid], fid: fid})
+			}
+		}
+	}
+
+	var seqNo uint64
+	if base.cut != nil {
+		seqNo = base.cut.seqNo
+	}
+	cutIndex, cutOffset, reached, maxSeqNo, err := findRecoverCut(fs, files, target)
+	if err != nil {
+		return err
+	}
+	//日志断开了，而且断开之前还没到达目标
+	if broken && !reached {
+		return ErrRecoverTargetUnavailable
+	}
+	if maxSeqNo > seqNo {
+		seqNo = maxSeqNo
+	}
+
+	//复制起点merge过的文件
+	for _, fid := range base.fileIds {
+		if fid < base.baseFid {
+			if err := fio.CopyFile(fs, data.GetDataFileName(base.fileDirs[fid], fid), data.GetDataFileName(targetDir, fid)); err != nil {
+				return err
+			}
+		}
+	}
+	for _, name := range []string{data.HintFileName, data.MergeFinishedName} {
+		if _, err := fs.Stat(filepath.Join(base.dir, name)); err == nil {
+			if err := fio.CopyFile(fs, filepath.Join(base.dir, name), filepath.Join(targetDir, name)); err != nil {
+				return err
+			}
+		}
+	}
+
+	//复制回放的日志，最后一个文件截断到目标位置
+	for i := 0; i <= cutIndex && i < len(files); i++ {
+		src := data.GetDataFileName(files[i].dir, files[i].fid)
+		dest := data.GetDataFileName(targetDir, files[i].fid)
+		if i < cutIndex {
+			if err := fio.CopyFile(fs, src, dest); err != nil {
+				return err
+			}
+		} else if cutOffset > 0 {
+			if err := copyFilePrefix(fs, src, dest, cutOffset); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := writeSeqNoFile(fs, targetDir, seqNo); err != nil {
+		return err
+	}
+	return fs.SyncDir(targetDir)
+}
+
+// 按日志顺序找到target之后的第一条记录，返回截断的文件下标和偏移
+// 单条写入和完整的事务是最小的单位，事务以完成标识的时间为准，没有完成标识的事务在打开时会被丢弃
+// 源目录和归档中的文件只读打开，不能因为补写文件头而修改
+func findRecoverCut(fs fio.FS, files []*recoverFile, target RecoverTarget) (int, int64, bool, uint64, error) {
+	byTime := !target.Time.IsZero()
+	targetTime := target.Time.UnixNano()
+	cutIndex, cutOffset := 0, int64(0)
+	var maxSeqNo uint64
+
+	for i, file := range files {
+		dataFile, err := data.OpenDataFileReadOnly(fs, file.dir, file.fid)
+		if err != nil {
+			return 0, 0, false, 0, err
+		}
+		offset := dataFile.RecordStart()
+		for {
+			logRecord, size, err := dataFile.ReadLogRecord(offset)
+			if err != nil {
+				if err == io.EOF {
+					break
+				}
+				_ = dataFile.Close()
+				return 0, 0, false, 0, err
+			}
+			_, seqNo := parseLogRecordKey(logRecord.Key)
+			switch {
+			case logRecord.Type == data.LogRecordTxnFinished:
+				if byTime && logRecord.Timestamp > targetTime {
+					_ = dataFile.Close()
+					return cutIndex, cutOffset, true, maxSeqNo, nil
+				}
+				cutIndex, cutOffset = i, offset+size
+				if seqNo > maxSeqNo {
+					maxSeqNo = seqNo
+				}
+				if !byTime && seqNo == target.SeqNo {
+					_ = dataFile.Close()
+					return cutIndex, cutOffset, true, maxSeqNo, nil
+				}
+			case seqNo == nonTransactionSeqNo:
+				if byTime && logRecord.Timestamp > targetTime {
+					_ = dataFile.Close()
+					return cutIndex, cutOffset, true, maxSeqNo, nil
+				}
+				cutIndex, cutOffset = i, offset+size
+			default:
+				//目标事务之后的事务
+				if !byTime && seqNo > target.SeqNo {
+					_ = dataFile.Close()
+					return cutIndex, cutOffset, true, maxSeqNo, nil
+				}
+			}
+			offset += size
+		}
+		if err := dataFile.Close(); err != nil {
+			return 0, 0, false, 0, err
+		}
+	}
+	return cutIndex, cutOffset, false, maxSeqNo, nil
+}
+
+// 复制文件的前n个字节
+func copyFilePrefix(fs fio.FS, src, dest string, n int64) error {
+	srcFile, err := fs.OpenFile(src, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+	destFile, err := fs.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, fio.DatafilePerm)
+	if err != nil {
+		return err
+	}
+	defer destFile.Close()
+	if _, err := io.CopyN(destFile, srcFile, n); err != nil {
+		return err
+	}
+	return destFile.Sync()
+}
@@ -0,0 +1,217 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/fio"
+	"bitcask-go/utils"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 恢复到target并打开恢复出来的数据库
+func recoverAndOpen(t *testing.T, opts Options, target RecoverTarget) *DB {
+	targetDir, _ := os.MkdirTemp("", "bitcask-go-pitr-target")
+	assert.Nil(t, RecoverTo(opts.DirPath, targetDir, target))
+	recoverOpts := opts
+	recoverOpts.DirPath = targetDir
+	recoverOpts.DataFileRetention = 0
+	db, err := Open(recoverOpts)
+	assert.Nil(t, err)
+	return db
+}
+
+// 在时间上和之后的写入分开
+func recoverPoint() time.Time {
+	time.Sleep(time.Millisecond)
+	now := time.Now()
+	time.Sleep(time.Millisecond)
+	return now
+}
+
+func assertRecoveredValues(t *testing.T, db *DB, value string, deleted int) {
+	for i := 0; i < 500; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		if i < deleted {
+			assert.Equal(t, ErrKeyNotFound, err)
+			continue
+		}
+		assert.Nil(t, err)
+		assert.Equal(t, []byte(value), val)
+	}
+}
+
+func TestRecoverTo(t *testing.T) {
+	opts := DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-pitr")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	opts.DataFileRetention = time.Hour
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = os.RemoveAll(dir + archiveDirName)
+	}()
+
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), []byte("v1")))
+	}
+	t1 := recoverPoint()
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, wb.Put([]byte("txn"), []byte("v")))
+	assert.Nil(t, wb.Commit())
+	seqNo := db.seqNo
+
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), []byte("v2")))
+	}
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	t2 := recoverPoint()
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), []byte("v3")))
+	}
+	t3 := recoverPoint()
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put([]byte("after"), []byte("v")))
+
+	//两次merge替换掉的文件都保留了
+	gens, err := listArchiveGenerations(fio.OSFS{}, dir+archiveDirName)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(gens))
+
+	//数据库打开时不能恢复
+	busyDir, _ := os.MkdirTemp("", "bitcask-go-pitr-busy")
+	assert.Equal(t, ErrDatabaseIsUsing, RecoverTo(dir, busyDir, RecoverTarget{Time: t1}))
+	_ = os.RemoveAll(busyDir)
+	assert.Nil(t, db.Close())
+
+	recovered := recoverAndOpen(t, opts, RecoverTarget{Time: t1})
+	assertRecoveredValues(t, recovered, "v1", 0)
+	_, err = recovered.Get([]byte("txn"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	destroyDB(recovered)
+
+	//恢复到事务提交之后，之后的单条写入不包括在内
+	recovered = recoverAndOpen(t, opts, RecoverTarget{SeqNo: seqNo})
+	assertRecoveredValues(t, recovered, "v1", 0)
+	val, err := recovered.Get([]byte("txn"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v"), val)
+	destroyDB(recovered)
+
+	recovered = recoverAndOpen(t, opts, RecoverTarget{Time: t2})
+	assertRecoveredValues(t, recovered, "v2", 100)
+	destroyDB(recovered)
+
+	recovered = recoverAndOpen(t, opts, RecoverTarget{Time: t3})
+	assertRecoveredValues(t, recovered, "v3", 0)
+	_, err = recovered.Get([]byte("after"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	//恢复出来的数据库可以继续写入
+	assert.Nil(t, recovered.Put([]byte("new"), []byte("v")))
+	destroyDB(recovered)
+
+	recovered = recoverAndOpen(t, opts, RecoverTarget{Time: time.Now()})
+	assertRecoveredValues(t, recovered, "v3", 0)
+	val, err = recovered.Get([]byte("after"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v"), val)
+	destroyDB(recovered)
+
+	//超过保留时间的归档被清理，早于最近一次merge的时间点无法恢复
+	pruneOpts := opts
+	pruneOpts.DataFileRetention = time.Nanosecond
+	db, err = Open(pruneOpts)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Close())
+	gens, err = listArchiveGenerations(fio.OSFS{}, dir+archiveDirName)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(gens))
+	targetDir, _ := os.MkdirTemp("", "bitcask-go-pitr-pruned")
+	assert.Equal(t, ErrRecoverTargetUnavailable, RecoverTo(dir, targetDir, RecoverTarget{Time: t1}))
+	_ = os.RemoveAll(targetDir)
+
+	_ = os.RemoveAll(dir)
+}
+
+func TestRecoverToWithoutMerge(t *testing.T) {
+	opts := DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-pitr-nomerge")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), []byte("v1")))
+	}
+	t1 := recoverPoint()
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), []byte("v2")))
+	}
+	assert.Nil(t, db.Close())
+
+	recovered := recoverAndOpen(t, opts, RecoverTarget{Time: t1})
+	assertRecoveredValues(t, recovered, "v1", 0)
+	destroyDB(recovered)
+
+	//目标目录非空
+	nonEmpty, _ := os.MkdirTemp("", "bitcask-go-pitr-nonempty")
+	assert.Nil(t, os.WriteFile(filepath.Join(nonEmpty, "file"), nil, 0644))
+	assert.Equal(t, ErrRestoreDirNotEmpty, RecoverTo(dir, nonEmpty, RecoverTarget{Time: t1}))
+	_ = os.RemoveAll(nonEmpty)
+	_ = os.RemoveAll(dir)
+}
+
+func TestRecoverToReadOnlySource(t *testing.T) {
+	opts := DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-pitr-readonly")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), []byte("v1")))
+	}
+	activeFid := db.activeFile.FileId
+	assert.Nil(t, db.Close())
+
+	//崩溃时刚创建还没有写入文件头的数据文件
+	emptyFile := data.GetDataFileName(dir, activeFid+1)
+	assert.Nil(t, os.WriteFile(emptyFile, nil, 0644))
+	before := make(map[string][]byte)
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		content, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		assert.Nil(t, err)
+		before[entry.Name()] = content
+	}
+
+	recovered := recoverAndOpen(t, opts, RecoverTarget{Time: time.Now()})
+	assertRecoveredValues(t, recovered, "v1", 0)
+	destroyDB(recovered)
+
+	//源目录中的文件没有被修改
+	for name, content := range before {
+		after, err := os.ReadFile(filepath.Join(dir, name))
+		assert.Nil(t, err)
+		assert.Equal(t, content, after, name)
+	}
+
+	//没有时间也没有事务序列号的目标
+	targetDir, _ := os.MkdirTemp("", "bitcask-go-pitr-target")
+	assert.Equal(t, ErrInvalidRecoverTarget, RecoverTo(dir, targetDir, RecoverTarget{}))
+	_ = os.RemoveAll(targetDir)
+	_ = os.RemoveAll(dir)
+}
@@ -0,0 +1,391 @@
+package raftfsm
+
+import (
+	bitcask "bitcask-go"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 测试用的内存集群，只实现了验证状态机需要的最小共识逻辑
+// 日志复制、多数派提交、按日志新旧选主、落后太多时通过快照追赶
+// 节点之间通过内存传输直接调用，可以断开节点模拟网络分区
+
+var errNoQuorum = errors.New("no quorum")
+
+type appendRequest struct {
+	term         uint64
+	prevIndex    uint64
+	prevTerm     uint64
+	entries      []*Entry
+	leaderCommit uint64
+}
+
+type node struct {
+	id        int
+	mu        sync.Mutex
+	dir       string
+	db        *bitcask.DB
+	fsm       *FSM
+	term      uint64
+	log       []*Entry //快照之后的日志
+	snapIndex uint64   //快照包含的最后一条日志
+	snapTerm  uint64
+	commit    uint64
+	results   map[uint64]*Result //leader上等待返回给客户端的结果
+}
+
+func (n *node) lastIndex() uint64 {
+	return n.snapIndex + uint64(len(n.log))
+}
+
+func (n *node) termAt(index uint64) (uint64, bool) {
+	if index == n.snapIndex {
+		return n.snapTerm, true
+	}
+	if index < n.snapIndex || index > n.lastIndex() {
+		return 0, false
+	}
+	return n.log[index-n.snapIndex-1].Term, true
+}
+
+func (n *node) lastTerm() uint64 {
+	term, _ := n.termAt(n.lastIndex())
+	return term
+}
+
+// 应用已经提交的日志
+func (n *node) applyCommitted() {
+	for applied := n.fsm.AppliedIndex(); applied < n.commit; applied++ {
+		entry := n.log[applied-n.snapIndex]
+		res := n.fsm.Apply(entry)
+		if n.results != nil {
+			n.results[entry.Index] = res
+		}
+	}
+}
+
+// 处理leader的日志复制请求
+func (n *node) handleAppend(req *appendRequest) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if req.term < n.term {
+		return false
+	}
+	n.term = req.term
+	if term, ok := n.termAt(req.prevIndex); !ok || term != req.prevTerm {
+		return false
+	}
+	for i, entry := range req.entries {
+		index := req.prevIndex + uint64(i) + 1
+		if index <= n.snapIndex {
+			continue
+		}
+		if term, ok := n.termAt(index); ok {
+			if term == entry.Term {
+				continue
+			}
+			//冲突的日志截断
+			n.log = n.log[:index-n.snapIndex-1]
+		}
+		n.log = append(n.log, entry)
+	}
+	if req.leaderCommit > n.commit {
+		n.commit = req.leaderCommit
+		if last := req.prevIndex + uint64(len(req.entries)); n.commit > last {
+			n.commit = last
+		}
+	}
+	n.applyCommitted()
+	return true
+}
+
+// 安装leader的快照
+func (n *node) handleSnapshot(term, index, snapTerm uint64, snapshot []byte) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if err := n.fsm.Restore(bytes.NewReader(snapshot)); err != nil {
+		return err
+	}
+	n.term = term
+	n.log = nil
+	n.snapIndex, n.snapTerm = index, snapTerm
+	n.commit = index
+	return nil
+}
+
+// 丢弃已经应用的日志
+func (n *node) compact() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	applied := n.fsm.AppliedIndex()
+	term, _ := n.termAt(applied)
+	n.log = append([]*Entry{}, n.log[applied-n.snapIndex:]...)
+	n.snapIndex, n.snapTerm = applied, term
+}
+
+type cluster struct {
+	t         *testing.T
+	mu        sync.Mutex //客户端请求串行提交给leader
+	nodes     []*node
+	down      map[int]bool //断开的节点
+	leader    *node
+	nextIndex map[int]uint64
+}
+
+func newCluster(t *testing.T, size int) *cluster {
+	c := &cluster{t: t, down: make(map[int]bool)}
+	for i := 0; i < size; i++ {
+		dir, _ := os.MkdirTemp("", fmt.Sprintf("bitcask-go-raft-%d", i))
+		n := &node{id: i, dir: dir}
+		c.openNode(n)
+		c.nodes = append(c.nodes, n)
+	}
+	assert.Nil(t, c.elect())
+	return c
+}
+
+func (c *cluster) openNode(n *node) {
+	options := bitcask.DefaultDBOptions
+	options.DirPath = n.dir
+	db, err := bitcask.Open(options)
+	assert.Nil(c.t, err)
+	fsm, err := NewFSM(db)
+	assert.Nil(c.t, err)
+	n.db, n.fsm = db, fsm
+}
+
+func (c *cluster) destroy() {
+	for _, n := range c.nodes {
+		_ = n.db.Close()
+		_ = os.RemoveAll(n.dir)
+	}
+}
+
+// 重启节点，日志保留(模拟持久化的raft日志)，状态机从数据库恢复
+func (c *cluster) restart(n *node) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	assert.Nil(c.t, n.db.Close())
+	c.openNode(n)
+	n.applyCommitted()
+}
+
+// 在能连通的节点中选出日志最新的作为leader，需要多数派
+func (c *cluster) elect() error {
+	var candidates []*node
+	var term uint64
+	for _, n := range c.nodes {
+		if n.term > term {
+			term = n.term
+		}
+		if !c.down[n.id] {
+			candidates = append(candidates, n)
+		}
+	}
+	if len(candidates) <= len(c.nodes)/2 {
+		return errNoQuorum
+	}
+	leader := candidates[0]
+	for _, n := range candidates[1:] {
+		if n.lastTerm() > leader.lastTerm() || (n.lastTerm() == leader.lastTerm() && n.lastIndex() > leader.lastIndex()) {
+			leader = n
+		}
+	}
+	leader.term = term + 1
+	leader.results = make(map[uint64]*Result)
+	if c.leader != nil && c.leader != leader {
+		c.leader.results = nil
+	}
+	c.leader = leader
+	c.nextIndex = make(map[int]uint64)
+	for _, n := range c.nodes {
+		c.nextIndex[n.id] = leader.lastIndex() + 1
+	}
+	//新leader提交一条自己任期的空日志，之前任期的日志随之提交
+	_, err := c.proposeLocked(&Command{})
+	return err
+}
+
+// 把leader的日志复制给peer
+func (c *cluster) replicate(peer *node) bool {
+	leader := c.leader
+	if c.down[peer.id] || c.down[leader.id] {
+		return false
+	}
+	for {
+		next := c.nextIndex[peer.id]
+		if next <= leader.snapIndex {
+			//需要的日志已经被压缩，发送快照
+			snapshot, err := leader.fsm.Snapshot()
+			assert.Nil(c.t, err)
+			buf, err := io.ReadAll(snapshot)
+			assert.Nil(c.t, err)
+			index := leader.fsm.AppliedIndex()
+			term, _ := leader.termAt(index)
+			assert.Nil(c.t, peer.handleSnapshot(leader.term, index, term, buf))
+			c.nextIndex[peer.id] = index + 1
+			continue
+		}
+		prevTerm, _ := leader.termAt(next - 1)
+		req := &appendRequest{
+			term:         leader.term,
+			prevIndex:    next - 1,
+			prevTerm:     prevTerm,
+			entries:      append([]*Entry{}, leader.log[next-leader.snapIndex-1:]...),
+			leaderCommit: leader.commit,
+		}
+		if peer.handleAppend(req) {
+			c.nextIndex[peer.id] = leader.lastIndex() + 1
+			return true
+		}
+		c.nextIndex[peer.id] = next - 1
+	}
+}
+
+// 客户端请求，多数派复制成功后提交并返回leader上的结果
+func (c *cluster) propose(cmd *Command) (*Result, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.proposeLocked(cmd)
+}
+
+func (c *cluster) proposeLocked(cmd *Command) (*Result, error) {
+	leader := c.leader
+	leader.mu.Lock()
+	entry := &Entry{Index: leader.lastIndex() + 1, Term: leader.term, Data: EncodeCommand(cmd)}
+	leader.log = append(leader.log, entry)
+	leader.mu.Unlock()
+
+	acks := 1
+	for _, peer := range c.nodes {
+		if peer != leader && c.replicate(peer) {
+			acks++
+		}
+	}
+	if acks <= len(c.nodes)/2 {
+		return nil, errNoQuorum
+	}
+
+	leader.mu.Lock()
+	leader.commit = entry.Index
+	leader.applyCommitted()
+	res := leader.results[entry.Index]
+	leader.mu.Unlock()
+	//通知follower新的提交位置
+	for _, peer := range c.nodes {
+		if peer != leader {
+			c.replicate(peer)
+		}
+	}
+	return res, nil
+}
+
+func (c *cluster) put(key, value []byte) error {
+	res, err := c.propose(&Command{Ops: []Op{{Type: OpPut, Key: key, Value: value}}})
+	if err != nil {
+		return err
+	}
+	return res.Err
+}
+
+// 读也通过日志，保证线性一致
+func (c *cluster) get(key []byte) ([]byte, error) {
+	res, err := c.propose(&Command{Ops: []Op{{Type: OpGet, Key: key}}})
+	if err != nil {
+		return nil, err
+	}
+	return res.Values[0], res.Err
+}
+
+// 所有节点的数据一致
+func (c *cluster) assertConverged() {
+	expected := c.leader.db.ListKeys()
+	for _, n := range c.nodes {
+		n.mu.Lock()
+		assert.Equal(c.t, c.leader.fsm.AppliedIndex(), n.fsm.AppliedIndex())
+		assert.Equal(c.t, expected, n.db.ListKeys())
+		for _, key := range expected {
+			v1, _ := c.leader.db.Get(key)
+			v2, _ := n.db.Get(key)
+			assert.Equal(c.t, v1, v2)
+		}
+		n.mu.Unlock()
+	}
+}
+
+func TestCluster_Linearizable(t *testing.T) {
+	c := newCluster(t, 3)
+	defer c.destroy()
+
+	//并发的客户端，每个写入成功返回后，之后的读一定能读到
+	var wg sync.WaitGroup
+	var historyLock sync.Mutex
+	acked := make(map[string][]byte)
+	for client := 0; client < 4; client++ {
+		wg.Add(1)
+		go func(client int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(int64(client)))
+			for i := 0; i < 50; i++ {
+				key := []byte(fmt.Sprintf("client-%d-key-%d", client, r.Intn(5)))
+				value := []byte(fmt.Sprintf("value-%d-%d", client, i))
+				assert.Nil(t, c.put(key, value))
+				historyLock.Lock()
+				acked[string(key)] = value
+				historyLock.Unlock()
+				got, err := c.get(key)
+				assert.Nil(t, err)
+				assert.Equal(t, value, got)
+			}
+		}(client)
+	}
+	wg.Wait()
+	c.assertConverged()
+
+	//断开一个follower，剩下的多数派继续服务
+	follower := c.nodes[(c.leader.id+1)%3]
+	c.down[follower.id] = true
+	assert.Nil(t, c.put([]byte("during-partition"), []byte("v1")))
+
+	//leader也断开，没有多数派时写入失败，不会返回旧的数据
+	oldLeader := c.leader
+	c.down[oldLeader.id] = true
+	_, err := c.get([]byte("during-partition"))
+	assert.Equal(t, errNoQuorum, err)
+	assert.Equal(t, errNoQuorum, c.elect())
+
+	//恢复follower，旧leader继续断开，日志最新的节点当选
+	c.down[follower.id] = false
+	assert.Nil(t, c.elect())
+	assert.NotEqual(t, oldLeader, c.leader)
+	for key, value := range acked {
+		got, err := c.get([]byte(key))
+		assert.Nil(t, err)
+		assert.Equal(t, value, got)
+	}
+	got, err := c.get([]byte("during-partition"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), got)
+
+	//压缩日志后旧leader只能通过快照追赶
+	for i := 0; i < 20; i++ {
+		assert.Nil(t, c.put([]byte(fmt.Sprintf("after-failover-%d", i)), []byte("v")))
+	}
+	c.leader.compact()
+	c.down[oldLeader.id] = false
+	assert.Nil(t, c.put([]byte("healed"), []byte("v")))
+	c.assertConverged()
+
+	//重启节点，已经应用的日志不会重复执行
+	c.restart(oldLeader)
+	assert.Nil(t, c.put([]byte("after-restart"), []byte("v")))
+	c.assertConverged()
+}
@@ -0,0 +1,94 @@
+package raftfsm
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var ErrInvalidCommand = errors.New("invalid raft command")
+
+type OpType = byte
+
+const (
+	OpPut OpType = iota + 1
+	OpDelete
+	//读操作也通过日志执行，保证线性一致
+	OpGet
+)
+
+// 一次操作
+type Op struct {
+	Type  OpType
+	Key   []byte
+	Value []byte
+}
+
+// 一条日志中的命令，包含的写操作原子执行
+type Command struct {
+	Ops []Op
+}
+
+// 编码命令 count [type keySize key valueSize value]...
+func EncodeCommand(cmd *Command) []byte {
+	size := binary.MaxVarintLen64
+	for _, op := range cmd.Ops {
+		size += 1 + binary.MaxVarintLen64*2 + len(op.Key) + len(op.Value)
+	}
+	buf := make([]byte, size)
+	var index = binary.PutUvarint(buf, uint64(len(cmd.Ops)))
+	for _, op := range cmd.Ops {
+		buf[index] = op.Type
+		index++
+		index += binary.PutUvarint(buf[index:], uint64(len(op.Key)))
+		index += copy(buf[index:], op.Key)
+		index += binary.PutUvarint(buf[index:], uint64(len(op.Value)))
+		index += copy(buf[index:], op.Value)
+	}
+	return buf[:index]
+}
+
+// 解码命令
+func DecodeCommand(buf []byte) (*Command, error) {
+	count, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return nil, ErrInvalidCommand
+	}
+	var index = n
+	//每个操作至少三个字节
+	if count > uint64(len(buf)) {
+		return nil, ErrInvalidCommand
+	}
+	cmd := &Command{Ops: make([]Op, 0, count)}
+	readBytes := func() ([]byte, bool) {
+		size, n := binary.Uvarint(buf[index:])
+		if n <= 0 || uint64(len(buf)-index-n) < size {
+			return nil, false
+		}
+		index += n
+		b := buf[index : index+int(size)]
+		index += int(size)
+		return b, true
+	}
+	for i := uint64(0); i < count; i++ {
+		if index >= len(buf) {
+			return nil, ErrInvalidCommand
+		}
+		op := Op{Type: buf[index]}
+		index++
+		if op.Type < OpPut || op.Type > OpGet {
+			return nil, ErrInvalidCommand
+		}
+		var ok bool
+		if op.Key, ok = readBytes(); !ok {
+			return nil, ErrInvalidCommand
+		}
+		if op.Value, ok = readBytes(); !ok {
+			return nil, ErrInvalidCommand
+		}
+		cmd.Ops = append(cmd.Ops, op)
+	}
+	if index != len(buf) {
+		return nil, ErrInvalidCommand
+	}
+	return cmd, nil
+}
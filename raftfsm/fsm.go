@@ -0,0 +1,214 @@
+// 把bitcask作为共识算法(raft)的状态机
+// 共识库负责日志复制，这里只负责按顺序应用已经提交的日志、生成快照和从快照恢复
+package raftfsm
+
+import (
+	bitcask "bitcask-go"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+)
+
+// 保存状态机元数据的命名空间，和用户数据隔离
+const fsmNamespace = "\x00raftfsm"
+
+// 已经应用的日志下标
+var appliedIndexKey = []byte("applied-index")
+
+// 已经提交的一条日志
+type Entry struct {
+	Index uint64
+	Term  uint64
+	Data  []byte //EncodeCommand编码的命令
+}
+
+// 应用日志的结果
+type Result struct {
+	Values [][]byte //按顺序对应命令中的每个读操作，key不存在为nil
+	Err    error
+}
+
+// 基于DB的状态机
+type FSM struct {
+	db      *bitcask.DB
+	ns      *bitcask.Namespace
+	mu      *sync.Mutex
+	applied uint64 //已经应用的日志下标
+}
+
+// 创建状态机，重启后从数据库中恢复已经应用的日志下标
+func NewFSM(db *bitcask.DB) (*FSM, error) {
+	fsm := &FSM{
+		db: db,
+		ns: db.Namespace(fsmNamespace),
+		mu: new(sync.Mutex),
+	}
+	if err := fsm.loadAppliedIndex(); err != nil {
+		return nil, err
+	}
+	return fsm, nil
+}
+
+func (fsm *FSM) loadAppliedIndex() error {
+	value, err := fsm.ns.Get(appliedIndexKey)
+	if err == bitcask.ErrKeyNotFound {
+		fsm.applied = 0
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(value) != 8 {
+		return errors.New("invalid applied index")
+	}
+	fsm.applied = binary.BigEndian.Uint64(value)
+	return nil
+}
+
+// 已经应用的日志下标
+func (fsm *FSM) AppliedIndex() uint64 {
+	fsm.mu.Lock()
+	defer fsm.mu.Unlock()
+	return fsm.applied
+}
+
+// 应用一条已经提交的日志
+// 写操作和日志下标在同一个WriteBatch中提交，重启后重复应用的日志会被跳过
+func (fsm *FSM) Apply(entry *Entry) *Result {
+	fsm.mu.Lock()
+	defer fsm.mu.Unlock()
+
+	cmd, err := DecodeCommand(entry.Data)
+	if err != nil {
+		return &Result{Err: err}
+	}
+
+	if entry.Index > fsm.applied {
+		wb := fsm.db.NewWriteBatch(bitcask.WriteBatchOptions{
+			MaxBatchNum: uint(len(cmd.Ops)) + 1,
+			SyncWrites:  bitcask.DefaultWriteBatchOptions.SyncWrites,
+		})
+		for _, op := range cmd.Ops {
+			switch op.Type {
+			case OpPut:
+				err = wb.Put(op.Key, op.Value)
+			case OpDelete:
+				err = wb.Delete(op.Key)
+			}
+			//命令本身不合法(比如key为空)，所有节点结果一致，只记录下标
+			if err != nil {
+				return fsm.skip(entry.Index, err)
+			}
+		}
+		index := make([]byte, 8)
+		binary.BigEndian.PutUint64(index, entry.Index)
+		if err := wb.Namespace(fsm.ns).Put(appliedIndexKey, index); err != nil {
+			return &Result{Err: err}
+		}
+		if err := wb.Commit(); err != nil {
+			return &Result{Err: err}
+		}
+		fsm.applied = entry.Index
+	}
+
+	result := &Result{}
+	for _, op := range cmd.Ops {
+		if op.Type != OpGet {
+			continue
+		}
+		value, err := fsm.db.Get(op.Key)
+		if err != nil && err != bitcask.ErrKeyNotFound {
+			return &Result{Err: err}
+		}
+		result.Values = append(result.Values, value)
+	}
+	return result
+}
+
+// 跳过不合法的命令，只推进日志下标
+func (fsm *FSM) skip(index uint64, cmdErr error) *Result {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, index)
+	if err := fsm.ns.Put(appliedIndexKey, buf); err != nil {
+		return &Result{Err: err}
+	}
+	fsm.applied = index
+	return &Result{Err: cmdErr}
+}
+
+// 生成当前状态的快照，返回的流可以在之后慢慢读取，不会阻塞后续的Apply
+func (fsm *FSM) Snapshot() (io.ReadCloser, error) {
+	fsm.mu.Lock()
+	defer fsm.mu.Unlock()
+
+	reader, writer := io.Pipe()
+	//索引迭代器创建时就固定了要遍历的数据，等它创建好再释放锁
+	ready := make(chan struct{})
+	var once sync.Once
+	markReady := func() { once.Do(func() { close(ready) }) }
+	go func() {
+		sw := newSnapshotWriter(writer)
+		_, err := fsm.db.SnapshotLog(func(entry *bitcask.LogEntry) error {
+			markReady()
+			return sw.writeEntry(entry.Key, entry.Value)
+		})
+		//没有数据的时候不会调用上面的函数，写入管道前必须先放行，否则没有人读取
+		markReady()
+		if err == nil {
+			err = sw.finish()
+		}
+		_ = writer.CloseWithError(err)
+	}()
+	<-ready
+	return reader, nil
+}
+
+// 从快照恢复，替换掉当前的所有数据
+// 先把快照完整读到数据库文件系统中的暂存文件并校验，损坏的快照不会破坏当前的数据
+func (fsm *FSM) Restore(r io.Reader) error {
+	fsm.mu.Lock()
+	defer fsm.mu.Unlock()
+
+	stagingFile, cleanup, err := fsm.db.CreateSnapshotStaging()
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	if err := verifySnapshot(io.TeeReader(r, stagingFile)); err != nil {
+		return err
+	}
+	info, err := stagingFile.Stat()
+	if err != nil {
+		return err
+	}
+
+	sr, err := newSnapshotReader(io.NewSectionReader(stagingFile, 0, info.Size()))
+	if err != nil {
+		return err
+	}
+	if err := fsm.db.ResetForSnapshot(); err != nil {
+		return err
+	}
+	var chunk []*bitcask.LogEntry
+	for {
+		key, value, err := sr.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		chunk = append(chunk, &bitcask.LogEntry{Key: key, Value: value, Type: bitcask.EventPut})
+		if len(chunk) == snapshotChunkSize {
+			if err := fsm.db.ApplySnapshot(chunk); err != nil {
+				return err
+			}
+			chunk = nil
+		}
+	}
+	if err := fsm.db.ApplySnapshot(chunk); err != nil {
+		return err
+	}
+	return fsm.loadAppliedIndex()
+}
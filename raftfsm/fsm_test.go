@@ -0,0 +1,185 @@
+package raftfsm
+
+import (
+	bitcask "bitcask-go"
+	"bitcask-go/utils"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func openDB(t *testing.T, name string) (*bitcask.DB, string) {
+	dir, _ := os.MkdirTemp("", name)
+	options := bitcask.DefaultDBOptions
+	options.DirPath = dir
+	db, err := bitcask.Open(options)
+	assert.Nil(t, err)
+	return db, dir
+}
+
+func destroyDB(db *bitcask.DB, dir string) {
+	_ = db.Close()
+	_ = os.RemoveAll(dir)
+}
+
+func putCmd(key, value []byte) []byte {
+	return EncodeCommand(&Command{Ops: []Op{{Type: OpPut, Key: key, Value: value}}})
+}
+
+func TestCommand(t *testing.T) {
+	cmd := &Command{Ops: []Op{
+		{Type: OpPut, Key: []byte("k1"), Value: []byte("v1")},
+		{Type: OpDelete, Key: []byte("k2")},
+		{Type: OpGet, Key: []byte("k1")},
+	}}
+	decoded, err := DecodeCommand(EncodeCommand(cmd))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(decoded.Ops))
+	assert.Equal(t, OpDelete, decoded.Ops[1].Type)
+	assert.Equal(t, []byte("v1"), decoded.Ops[0].Value)
+
+	empty, err := DecodeCommand(EncodeCommand(&Command{}))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(empty.Ops))
+
+	buf := EncodeCommand(cmd)
+	_, err = DecodeCommand(buf[:len(buf)-1])
+	assert.Equal(t, ErrInvalidCommand, err)
+	_, err = DecodeCommand([]byte{1, 9, 0, 0})
+	assert.Equal(t, ErrInvalidCommand, err)
+}
+
+func TestFSM_Apply(t *testing.T) {
+	db, dir := openDB(t, "bitcask-go-fsm-apply")
+	fsm, err := NewFSM(db)
+	assert.Nil(t, err)
+
+	res := fsm.Apply(&Entry{Index: 1, Data: putCmd([]byte("k1"), []byte("v1"))})
+	assert.Nil(t, res.Err)
+	res = fsm.Apply(&Entry{Index: 2, Data: EncodeCommand(&Command{Ops: []Op{
+		{Type: OpPut, Key: []byte("k2"), Value: []byte("v2")},
+		{Type: OpDelete, Key: []byte("k1")},
+		{Type: OpGet, Key: []byte("k1")},
+		{Type: OpGet, Key: []byte("k2")},
+	}})})
+	assert.Nil(t, res.Err)
+	assert.Equal(t, [][]byte{nil, []byte("v2")}, res.Values)
+	assert.Equal(t, uint64(2), fsm.AppliedIndex())
+
+	//不合法的命令所有节点都会失败，下标照样推进
+	res = fsm.Apply(&Entry{Index: 3, Data: putCmd(nil, []byte("v"))})
+	assert.Equal(t, bitcask.ErrKeyIsEmpty, res.Err)
+	assert.Equal(t, uint64(3), fsm.AppliedIndex())
+
+	//重启后已经应用过的日志被跳过
+	assert.Nil(t, db.Close())
+	options := bitcask.DefaultDBOptions
+	options.DirPath = dir
+	db, err = bitcask.Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db, dir)
+	fsm, err = NewFSM(db)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(3), fsm.AppliedIndex())
+	res = fsm.Apply(&Entry{Index: 1, Data: putCmd([]byte("k1"), []byte("v1"))})
+	assert.Nil(t, res.Err)
+	_, err = db.Get([]byte("k1"))
+	assert.Equal(t, bitcask.ErrKeyNotFound, err)
+
+	//状态机的元数据对用户不可见
+	assert.Equal(t, [][]byte{[]byte("k2")}, db.ListKeys())
+}
+
+func TestFSM_SnapshotRestore(t *testing.T) {
+	db, dir := openDB(t, "bitcask-go-fsm-snapshot")
+	defer destroyDB(db, dir)
+	fsm, err := NewFSM(db)
+	assert.Nil(t, err)
+	for i := 1; i <= 3000; i++ {
+		res := fsm.Apply(&Entry{Index: uint64(i), Data: putCmd(utils.GetTestKey(i), utils.GetTestKey(i))})
+		assert.Nil(t, res.Err)
+	}
+	assert.Nil(t, db.Namespace("users").Put([]byte("u1"), []byte("v1")))
+
+	snapshot, err := fsm.Snapshot()
+	assert.Nil(t, err)
+	//快照创建之后的写入不在快照里
+	res := fsm.Apply(&Entry{Index: 3001, Data: putCmd([]byte("after"), []byte("v"))})
+	assert.Nil(t, res.Err)
+	buf, err := io.ReadAll(snapshot)
+	assert.Nil(t, err)
+	assert.Nil(t, snapshot.Close())
+
+	db2, dir2 := openDB(t, "bitcask-go-fsm-restore")
+	defer destroyDB(db2, dir2)
+	assert.Nil(t, db2.Put([]byte("stale"), []byte("v")))
+	fsm2, err := NewFSM(db2)
+	assert.Nil(t, err)
+
+	//损坏的快照不会破坏现有数据
+	corrupted := append([]byte{}, buf...)
+	corrupted[len(corrupted)/2] ^= 0xff
+	assert.Equal(t, ErrInvalidSnapshot, fsm2.Restore(bytes.NewReader(corrupted)))
+	assert.Equal(t, ErrInvalidSnapshot, fsm2.Restore(bytes.NewReader(buf[:len(buf)-1])))
+	_, err = db2.Get([]byte("stale"))
+	assert.Nil(t, err)
+
+	assert.Nil(t, fsm2.Restore(bytes.NewReader(buf)))
+	assert.Equal(t, uint64(3000), fsm2.AppliedIndex())
+	assert.Equal(t, 3000, len(db2.ListKeys()))
+	_, err = db2.Get([]byte("stale"))
+	assert.Equal(t, bitcask.ErrKeyNotFound, err)
+	_, err = db2.Get([]byte("after"))
+	assert.Equal(t, bitcask.ErrKeyNotFound, err)
+	v, err := db2.Namespace("users").Get([]byte("u1"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), v)
+
+	//空数据库的快照
+	db3, dir3 := openDB(t, "bitcask-go-fsm-empty")
+	defer destroyDB(db3, dir3)
+	fsm3, err := NewFSM(db3)
+	assert.Nil(t, err)
+	snapshot, err = fsm3.Snapshot()
+	assert.Nil(t, err)
+	assert.Nil(t, fsm2.Restore(snapshot))
+	assert.Equal(t, uint64(0), fsm2.AppliedIndex())
+	assert.Equal(t, 0, len(db2.ListKeys()))
+}
+
+func TestFSM_RestoreInMemory(t *testing.T) {
+	db, dir := openDB(t, "bitcask-go-fsm-snapshot-src")
+	defer destroyDB(db, dir)
+	fsm, err := NewFSM(db)
+	assert.Nil(t, err)
+	for i := 1; i <= 100; i++ {
+		res := fsm.Apply(&Entry{Index: uint64(i), Data: putCmd(utils.GetTestKey(i), utils.GetTestKey(i))})
+		assert.Nil(t, res.Err)
+	}
+	snapshot, err := fsm.Snapshot()
+	assert.Nil(t, err)
+
+	//内存模式下暂存的快照也在内存中，磁盘上没有任何文件
+	options := bitcask.DefaultDBOptions
+	options.DirPath = filepath.Join(os.TempDir(), "bitcask-go-fsm-in-memory")
+	options.InMemory = true
+	db2, err := bitcask.Open(options)
+	assert.Nil(t, err)
+	defer db2.Close()
+	fsm2, err := NewFSM(db2)
+	assert.Nil(t, err)
+	assert.Nil(t, fsm2.Restore(snapshot))
+	assert.Equal(t, uint64(100), fsm2.AppliedIndex())
+	assert.Equal(t, 100, len(db2.ListKeys()))
+
+	entries, err := os.ReadDir(os.TempDir())
+	assert.Nil(t, err)
+	for _, entry := range entries {
+		assert.False(t, strings.HasPrefix(entry.Name(), "bitcask-go-fsm-in-memory"))
+	}
+}
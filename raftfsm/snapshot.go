@@ -0,0 +1,170 @@
+package raftfsm
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+// 快照格式 magic [1 keySize key valueSize value]... 0 crc
+// crc覆盖前面所有的字节
+var snapshotMagic = []byte("BCFSM\x01")
+
+const (
+	snapshotEntryFlag byte = 1
+	snapshotEndFlag   byte = 0
+	//恢复时每批写入的数据条数
+	snapshotChunkSize = 1024
+)
+
+var ErrInvalidSnapshot = errors.New("invalid fsm snapshot")
+
+type snapshotWriter struct {
+	w   *bufio.Writer
+	crc hash.Hash32
+	buf [binary.MaxVarintLen64]byte
+	err error
+}
+
+func newSnapshotWriter(w io.Writer) *snapshotWriter {
+	sw := &snapshotWriter{w: bufio.NewWriter(w), crc: crc32.NewIEEE()}
+	sw.write(snapshotMagic)
+	return sw
+}
+
+func (sw *snapshotWriter) write(b []byte) {
+	if sw.err != nil {
+		return
+	}
+	_, _ = sw.crc.Write(b)
+	_, sw.err = sw.w.Write(b)
+}
+
+func (sw *snapshotWriter) writeBytes(b []byte) {
+	n := binary.PutUvarint(sw.buf[:], uint64(len(b)))
+	sw.write(sw.buf[:n])
+	sw.write(b)
+}
+
+func (sw *snapshotWriter) writeEntry(key, value []byte) error {
+	sw.write([]byte{snapshotEntryFlag})
+	sw.writeBytes(key)
+	sw.writeBytes(value)
+	return sw.err
+}
+
+func (sw *snapshotWriter) finish() error {
+	sw.write([]byte{snapshotEndFlag})
+	if sw.err != nil {
+		return sw.err
+	}
+	var crc [4]byte
+	binary.BigEndian.PutUint32(crc[:], sw.crc.Sum32())
+	if _, err := sw.w.Write(crc[:]); err != nil {
+		return err
+	}
+	return sw.w.Flush()
+}
+
+type snapshotReader struct {
+	r   *bufio.Reader
+	crc hash.Hash32
+}
+
+func newSnapshotReader(r io.Reader) (*snapshotReader, error) {
+	sr := &snapshotReader{r: bufio.NewReader(r), crc: crc32.NewIEEE()}
+	magic := make([]byte, len(snapshotMagic))
+	if err := sr.read(magic); err != nil {
+		return nil, err
+	}
+	if string(magic) != string(snapshotMagic) {
+		return nil, ErrInvalidSnapshot
+	}
+	return sr, nil
+}
+
+func (sr *snapshotReader) read(b []byte) error {
+	if _, err := io.ReadFull(sr.r, b); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrInvalidSnapshot
+		}
+		return err
+	}
+	_, _ = sr.crc.Write(b)
+	return nil
+}
+
+func (sr *snapshotReader) readBytes() ([]byte, error) {
+	var size uint64
+	var shift uint
+	//逐字节读取uvarint，同时计入crc
+	for i := 0; ; i++ {
+		var b [1]byte
+		if err := sr.read(b[:]); err != nil {
+			return nil, err
+		}
+		if i == binary.MaxVarintLen64 {
+			return nil, ErrInvalidSnapshot
+		}
+		size |= uint64(b[0]&0x7f) << shift
+		if b[0] < 0x80 {
+			break
+		}
+		shift += 7
+	}
+	buf := make([]byte, size)
+	if err := sr.read(buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// 读取下一条数据，读完并校验通过后返回io.EOF
+func (sr *snapshotReader) next() ([]byte, []byte, error) {
+	var flag [1]byte
+	if err := sr.read(flag[:]); err != nil {
+		return nil, nil, err
+	}
+	if flag[0] == snapshotEndFlag {
+		expected := sr.crc.Sum32()
+		var crc [4]byte
+		if _, err := io.ReadFull(sr.r, crc[:]); err != nil {
+			return nil, nil, ErrInvalidSnapshot
+		}
+		if binary.BigEndian.Uint32(crc[:]) != expected {
+			return nil, nil, ErrInvalidSnapshot
+		}
+		return nil, nil, io.EOF
+	}
+	if flag[0] != snapshotEntryFlag {
+		return nil, nil, ErrInvalidSnapshot
+	}
+	key, err := sr.readBytes()
+	if err != nil {
+		return nil, nil, err
+	}
+	value, err := sr.readBytes()
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, value, nil
+}
+
+// 完整读取一遍快照，校验格式和crc
+func verifySnapshot(r io.Reader) error {
+	sr, err := newSnapshotReader(r)
+	if err != nil {
+		return err
+	}
+	for {
+		if _, _, err := sr.next(); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"io"
+)
+
+// 每次读取日志最多返回的条数，事务不会被拆开，所以实际可能会多一些
+const readLogBatchNum = 1024
+
+// 日志位置，指向下一条要读取的记录
+type LogCursor struct {
+	Fid    uint32
+	Offset int64
+}
+
+// 日志中的一次变更，命名空间的key保持内部编码
+type LogEntry struct {
+	Key   []byte
+	Value []byte //删除为空
+	Type  EventType
+	SeqNo uint64 //事务序列号，非事务写入为0
+}
+
+// 从from开始读取日志中已经提交的变更，返回变更和下一次读取的位置
+// 返回的位置总是在完整的提交之后，消费者可以保存下来在重启后继续读取
+// 位置所在的文件被merge重写之后返回ErrLogCursorTooOld，需要重新全量同步
+func (db *DB) ReadLog(from LogCursor) ([]*LogEntry, LogCursor, error) {
+	if from.Fid < db.logStartFid {
+		return nil, from, ErrLogCursorTooOld
+	}
+
+	//只读到当前活跃文件已经写完的位置，写入持有db锁，所以这里一定是完整的提交
+	db.mu.RLock()
+	if db.activeFile == nil {
+		db.mu.RUnlock()
+		return nil, from, nil
+	}
+	activeFid, activeEnd := db.activeFile.FileId, db.activeFile.Offset
+	db.mu.RUnlock()
+	if from.Fid > activeFid || (from.Fid == activeFid && from.Offset > activeEnd) {
+		return nil, from, ErrInvalidLogCursor
+	}
+
+	var entries []*LogEntry
+	//事务的记录是连续写入的，同时最多只有一个未完成的事务
+	var pending []*LogEntry
+	var pendingSeqNo uint64
+	cursor := from
+	fid, offset := from.Fid, from.Offset
+	for fid <= activeFid && len(entries) < readLogBatchNum {
+		dataFile := db.acquireDataFile(fid)
+		if dataFile == nil {
+			if fid == from.Fid {
+				return nil, from, ErrLogCursorTooOld
+			}
+			fid, offset = fid+1, 0
+			continue
+		}
+		//位置为0表示文件开头，新格式的文件要跳过文件头
+		if offset < dataFile.RecordStart() {
+			offset = dataFile.RecordStart()
+		}
+		eof := false
+		for len(entries) < readLogBatchNum || len(pending) > 0 {
+			if fid == activeFid && offset >= activeEnd {
+				break
+			}
+			logRecord, size, err := dataFile.ReadLogRecord(offset)
+			if err != nil {
+				if err == io.EOF {
+					eof = true
+					break
+				}
+				dataFile.Release()
+				return nil, from, err
+			}
+			offset += size
+
+			realKey, seqNo := parseLogRecordKey(logRecord.Key)
+			//崩溃导致没有写完的事务，后面已经是别的写入了，直接丢弃
+			if len(pending) > 0 && seqNo != pendingSeqNo {
+				pending = nil
+			}
+			entry := &LogEntry{Key: realKey, Value: logRecord.Value, Type: EventPut, SeqNo: seqNo}
+			if logRecord.Type == data.LogRecordDelete {
+				entry.Type = EventDelete
+				entry.Value = nil
+			}
+			switch {
+			case seqNo == nonTransactionSeqNo:
+				entries = append(entries, entry)
+			case logRecord.Type == data.LogRecordTxnFinished:
+				entries = append(entries, pending...)
+				pending = nil
+			default:
+				pending = append(pending, entry)
+				pendingSeqNo = seqNo
+			}
+			if len(pending) == 0 {
+				cursor = LogCursor{Fid: fid, Offset: offset}
+			}
+		}
+		dataFile.Release()
+
+		//旧文件读完了，位置移动到下一个文件开头
+		if eof && len(pending) == 0 && fid < activeFid {
+			cursor = LogCursor{Fid: fid + 1, Offset: 0}
+		}
+		if !eof {
+			break
+		}
+		fid, offset = fid+1, 0
+	}
+	return entries, cursor, nil
+}
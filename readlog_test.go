@@ -0,0 +1,184 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/utils"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 从from开始读完所有日志
+func readAllLog(t *testing.T, db *DB, from LogCursor) ([]*LogEntry, LogCursor) {
+	var all []*LogEntry
+	for {
+		entries, next, err := db.ReadLog(from)
+		assert.Nil(t, err)
+		all = append(all, entries...)
+		if len(entries) == 0 {
+			return all, next
+		}
+		from = next
+	}
+}
+
+func TestDB_ReadLog(t *testing.T) {
+	opts := DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-readlog")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	entries, cursor, err := db.ReadLog(LogCursor{})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(entries))
+	assert.Equal(t, LogCursor{}, cursor)
+
+	//写满多个文件
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+	}
+	assert.True(t, len(db.oldFiles) > 0)
+	assert.Nil(t, db.Delete(utils.GetTestKey(0)))
+
+	//一次最多返回readLogBatchNum条
+	entries, cursor, err = db.ReadLog(LogCursor{})
+	assert.Nil(t, err)
+	assert.Equal(t, readLogBatchNum, len(entries))
+	assert.Equal(t, utils.GetTestKey(0), entries[0].Key)
+	assert.Equal(t, EventPut, entries[0].Type)
+
+	rest, tail := readAllLog(t, db, cursor)
+	assert.Equal(t, 2001-readLogBatchNum, len(rest))
+	last := rest[len(rest)-1]
+	assert.Equal(t, utils.GetTestKey(0), last.Key)
+	assert.Equal(t, EventDelete, last.Type)
+	assert.Nil(t, last.Value)
+
+	//事务提交后才能读到，同一个事务的记录序列号相同
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, wb.Put([]byte("txn-1"), []byte("v1")))
+	assert.Nil(t, wb.Put([]byte("txn-2"), []byte("v2")))
+	assert.Nil(t, wb.Commit())
+	entries, tail2 := readAllLog(t, db, tail)
+	assert.Equal(t, 2, len(entries))
+	assert.Equal(t, entries[0].SeqNo, entries[1].SeqNo)
+	assert.NotEqual(t, nonTransactionSeqNo, entries[0].SeqNo)
+
+	//没有新的写入
+	entries, next, err := db.ReadLog(tail2)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(entries))
+	assert.Equal(t, tail2, next)
+
+	_, _, err = db.ReadLog(LogCursor{Fid: tail2.Fid + 1})
+	assert.Equal(t, ErrInvalidLogCursor, err)
+}
+
+func TestDB_ReadLogTornTxn(t *testing.T) {
+	opts := DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-readlog-torn")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	//模拟崩溃时没有写完的事务
+	_, err = db.appendLogRecordWithLock(&data.LogRecord{
+		Key:   logRecordKeyAddSeq([]byte("torn"), 100),
+		Value: []byte("torn"),
+		Type:  data.LogRecordNormal,
+	})
+	assert.Nil(t, err)
+	entries, cursor, err := db.ReadLog(LogCursor{})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(entries))
+	//位置停在事务开始之前
+	assert.Equal(t, LogCursor{}, cursor)
+
+	assert.Nil(t, db.Put([]byte("after"), []byte("after")))
+	entries, _, err = db.ReadLog(cursor)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, []byte("after"), entries[0].Key)
+}
+
+func TestDB_ReadLogAfterMerge(t *testing.T) {
+	opts := DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-readlog-merge")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i%100), utils.GetTestKey(i)))
+	}
+	_, beforeMerge := readAllLog(t, db, LogCursor{})
+	assert.Nil(t, db.Merge())
+	//merge会封存当前的活跃文件，读完之后位置移动到新的活跃文件
+	_, afterMerge := readAllLog(t, db, beforeMerge)
+	assert.Equal(t, LogCursor{Fid: beforeMerge.Fid + 1}, afterMerge)
+	assert.Nil(t, db.Put([]byte("after-merge"), []byte("v")))
+	assert.Nil(t, db.Close())
+
+	db, err = Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	//merge之前的文件都被重写了
+	_, _, err = db.ReadLog(LogCursor{})
+	assert.Equal(t, ErrLogCursorTooOld, err)
+	_, _, err = db.ReadLog(beforeMerge)
+	assert.Equal(t, ErrLogCursorTooOld, err)
+
+	//merge之后的位置还能继续读
+	entries, _ := readAllLog(t, db, afterMerge)
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, []byte("after-merge"), entries[0].Key)
+}
+
+// 全量数据加上从返回位置开始的日志，包含遍历期间并发写入的所有数据
+func TestDB_SnapshotLogConcurrentWrites(t *testing.T) {
+	opts := DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-snapshot-log")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	for round := 0; round < 20; round++ {
+		var wg sync.WaitGroup
+		for w := 0; w < 4; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; i < 200; i++ {
+					key := []byte(fmt.Sprintf("round-%d-writer-%d-%d", round, w, i))
+					assert.Nil(t, db.Put(key, key))
+				}
+			}(w)
+		}
+		keys := make(map[string]bool)
+		cursor, err := db.SnapshotLog(func(entry *LogEntry) error {
+			keys[string(entry.Key)] = true
+			return nil
+		})
+		assert.Nil(t, err)
+		wg.Wait()
+
+		entries, _ := readAllLog(t, db, cursor)
+		for _, entry := range entries {
+			keys[string(entry.Key)] = true
+		}
+		for _, key := range db.ListKeys() {
+			assert.True(t, keys[string(key)], string(key))
+		}
+	}
+}
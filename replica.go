@@ -0,0 +1,228 @@
+package bitcask_go
+
+import (
+	"bitcask-go/fio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"strconv"
+	"sync/atomic"
+)
+
+// 复制使用的内部命名空间，保存从库已经应用到的日志位置
+const replicationNamespace = "\x00replication"
+
+var replicationCursorKey = []byte("cursor")
+
+// 暂存快照的文件，放在数据目录旁边
+const snapshotStagingSuffix = "-snapshot-staging"
+
+// 设置为复制的从库，从库只接受复制日志的写入
+func (db *DB) SetFollower(follower bool) {
+	var v int32 = 0
+	if follower {
+		v = 1
+	}
+	atomic.StoreInt32(&db.follower, v)
+}
+
+func (db *DB) isFollower() bool {
+	return atomic.LoadInt32(&db.follower) == 1
+}
+
+// 是否是复制内部使用的key，这些key不会在主从之间同步
+func isReplicationKey(key []byte) bool {
+	if name, _, _, ok := parseNsDataKey(key); ok {
+		return name == replicationNamespace
+	}
+	return bytes.Equal(key, nsMetaKey(replicationNamespace))
+}
+
+func encodeLogCursor(cursor LogCursor) []byte {
+	buf := make([]byte, 12)
+	binary.BigEndian.PutUint32(buf[:4], cursor.Fid)
+	binary.BigEndian.PutUint64(buf[4:], uint64(cursor.Offset))
+	return buf
+}
+
+func decodeLogCursor(buf []byte) (LogCursor, error) {
+	if len(buf) != 12 {
+		return LogCursor{}, errors.New("invalid replication cursor")
+	}
+	return LogCursor{
+		Fid:    binary.BigEndian.Uint32(buf[:4]),
+		Offset: int64(binary.BigEndian.Uint64(buf[4:])),
+	}, nil
+}
+
+// 从库已经应用到的主库日志位置，没有同步过返回false
+func (db *DB) ReplicationCursor() (LogCursor, bool, error) {
+	value, err := db.Namespace(replicationNamespace).Get(replicationCursorKey)
+	if err == ErrKeyNotFound {
+		return LogCursor{}, false, nil
+	}
+	if err != nil {
+		return LogCursor{}, false, err
+	}
+	cursor, err := decodeLogCursor(value)
+	if err != nil {
+		return LogCursor{}, false, err
+	}
+	return cursor, true, nil
+}
+
+// 主库遍历当前的全量数据(包括命名空间)，返回遍历开始时的日志位置
+// 遍历期间的写入可能出现在全量数据中，从返回的位置继续应用日志后结果是一致的
+func (db *DB) SnapshotLog(fn func(entry *LogEntry) error) (LogCursor, error) {
+	//写入在追加日志之后才更新索引，持有所有key的分段锁，保证位置之前的日志都已经在索引中
+	unlock := db.keyLocks.lockEvery()
+	db.mu.RLock()
+	var cursor = LogCursor{Fid: db.logStartFid}
+	if db.activeFile != nil {
+		cursor = LogCursor{Fid: db.activeFile.FileId, Offset: db.activeFile.Offset}
+	}
+	db.mu.RUnlock()
+	//迭代器创建时就固定了要遍历的数据
+	it := db.index.Iterator(false)
+	unlock()
+	defer it.Close()
+	for it.Rewind(); it.Valid(); it.Next() {
+		if isReplicationKey(it.Key()) {
+			continue
+		}
+		value, err := db.readValue(it.Value())
+		if err != nil {
+			return LogCursor{}, err
+		}
+		if err := fn(&LogEntry{Key: it.Key(), Value: value, Type: EventPut}); err != nil {
+			return LogCursor{}, err
+		}
+	}
+	return cursor, nil
+}
+
+// 在数据库的文件系统中创建暂存快照的文件，内存模式下也保存在内存中
+// 调用方用完后调用返回的函数关闭并删除文件
+func (db *DB) CreateSnapshotStaging() (fio.File, func(), error) {
+	name := siblingPath(db.options.DirPath, snapshotStagingSuffix)
+	file, err := db.fs.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_RDWR, fio.DatafilePerm)
+	if err != nil {
+		return nil, nil, err
+	}
+	return file, func() {
+		_ = file.Close()
+		_ = db.fs.Remove(name)
+	}, nil
+}
+
+// 从库开始全量同步前清空所有数据
+// 先删除同步位置，中途失败的话下次连接会重新全量同步
+func (db *DB) ResetForSnapshot() error {
+	wb := db.newApplyBatch(1)
+	if err := wb.Namespace(db.Namespace(replicationNamespace)).Delete(replicationCursorKey); err != nil {
+		return err
+	}
+	if err := wb.Commit(); err != nil {
+		return err
+	}
+
+	var keys [][]byte
+	it := db.index.Iterator(false)
+	for it.Rewind(); it.Valid(); it.Next() {
+		keys = append(keys, it.Key())
+	}
+	it.Close()
+
+	batchNum := int(DefaultWriteBatchOptions.MaxBatchNum)
+	for start := 0; start < len(keys); start += batchNum {
+		end := start + batchNum
+		if end > len(keys) {
+			end = len(keys)
+		}
+		wb := db.newApplyBatch(end - start)
+		for _, key := range keys[start:end] {
+			if err := wb.Delete(key); err != nil {
+				return err
+			}
+		}
+		if err := wb.Commit(); err != nil {
+			return err
+		}
+	}
+
+	//命名空间的元数据都删掉了，版本回到0
+	db.nsLock.Lock()
+	defer db.nsLock.Unlock()
+	for name := range db.namespaces {
+		db.setNamespaceVersion(name, 0)
+	}
+	return nil
+}
+
+// 从库应用一批全量数据
+func (db *DB) ApplySnapshot(entries []*LogEntry) error {
+	return db.applyEntries(entries, nil)
+}
+
+// 从库应用主库的日志，并和同步位置一起原子提交
+func (db *DB) ApplyLog(entries []*LogEntry, next LogCursor) error {
+	return db.applyEntries(entries, &next)
+}
+
+func (db *DB) newApplyBatch(num int) *WriteBatch {
+	wb := db.NewWriteBatch(WriteBatchOptions{MaxBatchNum: uint(num) + 1, SyncWrites: true})
+	wb.apply = true
+	return wb
+}
+
+func (db *DB) applyEntries(entries []*LogEntry, cursor *LogCursor) error {
+	wb := db.newApplyBatch(len(entries))
+	var metaKeys [][]byte
+	for _, entry := range entries {
+		if isReplicationKey(entry.Key) {
+			continue
+		}
+		var err error
+		if entry.Type == EventDelete {
+			err = wb.Delete(entry.Key)
+		} else {
+			err = wb.Put(entry.Key, entry.Value)
+		}
+		if err != nil {
+			return err
+		}
+		if bytes.HasPrefix(entry.Key, nsMetaPrefix) {
+			metaKeys = append(metaKeys, entry.Key)
+		}
+	}
+	if cursor != nil {
+		if err := wb.Namespace(db.Namespace(replicationNamespace)).Put(replicationCursorKey, encodeLogCursor(*cursor)); err != nil {
+			return err
+		}
+	}
+	if err := wb.Commit(); err != nil {
+		return err
+	}
+	if len(metaKeys) == 0 {
+		return nil
+	}
+
+	//主库删除了命名空间，同步更新版本并清理旧版本的key
+	db.nsLock.Lock()
+	defer db.nsLock.Unlock()
+	for _, key := range metaKeys {
+		var version uint64
+		value, err := db.get(key)
+		if err != nil && err != ErrKeyNotFound {
+			return err
+		}
+		if err == nil {
+			if version, err = strconv.ParseUint(string(value), 10, 64); err != nil {
+				return err
+			}
+		}
+		db.setNamespaceVersion(string(key[len(nsMetaPrefix):]), version)
+	}
+	return nil
+}
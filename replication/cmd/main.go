@@ -0,0 +1,82 @@
+package main
+
+import (
+	bitcask "bitcask-go"
+	"bitcask-go/replication"
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+)
+
+// 两个进程演示主从复制
+// go run ./replication/cmd -role primary -dir /tmp/bitcask-primary
+// go run ./replication/cmd -role follower -dir /tmp/bitcask-follower
+// 从标准输入读取命令：put key value / del key / get key / keys
+func main() {
+	role := flag.String("role", "primary", "primary or follower")
+	dir := flag.String("dir", "", "database dir path")
+	addr := flag.String("addr", "127.0.0.1:7969", "primary listen address")
+	flag.Parse()
+
+	options := bitcask.DefaultDBOptions
+	if *dir != "" {
+		options.DirPath = *dir
+	}
+	db, err := bitcask.Open(options)
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	switch *role {
+	case "primary":
+		listener, err := net.Listen("tcp", *addr)
+		if err != nil {
+			panic(err)
+		}
+		primary := replication.NewPrimary(db, replication.DefaultPrimaryOptions)
+		defer primary.Close()
+		go func() {
+			_ = primary.Serve(listener)
+		}()
+		log.Printf("primary serving on %s\n", *addr)
+	case "follower":
+		follower := replication.NewFollower(db, *addr, replication.DefaultFollowerOptions)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			_ = follower.Run(ctx)
+		}()
+		log.Printf("follower replicating from %s\n", *addr)
+	default:
+		log.Fatalf("unknown role %s", *role)
+	}
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		args := strings.Fields(scanner.Text())
+		if len(args) == 0 {
+			continue
+		}
+		switch {
+		case args[0] == "put" && len(args) == 3:
+			fmt.Println(db.Put([]byte(args[1]), []byte(args[2])))
+		case args[0] == "del" && len(args) == 2:
+			fmt.Println(db.Delete([]byte(args[1])))
+		case args[0] == "get" && len(args) == 2:
+			value, err := db.Get([]byte(args[1]))
+			fmt.Println(string(value), err)
+		case args[0] == "keys":
+			for _, key := range db.ListKeys() {
+				fmt.Println(string(key))
+			}
+		default:
+			fmt.Println("unknown command")
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package replication
+
+import (
+	bitcask "bitcask-go"
+	"context"
+	"encoding/gob"
+	"errors"
+	"net"
+	"time"
+)
+
+// 从库，连接主库并应用日志，断开后从上次应用的位置继续
+type Follower struct {
+	db      *bitcask.DB
+	addr    string
+	options FollowerOptions
+}
+
+// 创建从库，数据库会进入从库模式，拒绝本地写入
+func NewFollower(db *bitcask.DB, addr string, options FollowerOptions) *Follower {
+	db.SetFollower(true)
+	return &Follower{db: db, addr: addr, options: options}
+}
+
+// 持续同步直到ctx取消，连接失败或断开后会自动重连
+func (f *Follower) Run(ctx context.Context) error {
+	for {
+		_ = f.syncOnce(ctx)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(f.options.RetryInterval):
+		}
+	}
+}
+
+// 连接一次主库，直到连接断开
+func (f *Follower) syncOnce(ctx context.Context) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", f.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	//ctx取消时关闭连接，打断阻塞的读取
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+		case <-done:
+		}
+	}()
+
+	cursor, ok, err := f.db.ReplicationCursor()
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(conn).Encode(&request{Cursor: cursor, HasCursor: ok}); err != nil {
+		return err
+	}
+
+	dec := gob.NewDecoder(conn)
+	for {
+		//主库没有新日志时也会发送心跳，超时说明连接已经失效
+		if f.options.ReadTimeout > 0 {
+			if err := conn.SetReadDeadline(time.Now().Add(f.options.ReadTimeout)); err != nil {
+				return err
+			}
+		}
+		var msg message
+		if err := dec.Decode(&msg); err != nil {
+			return err
+		}
+		if err := f.apply(&msg); err != nil {
+			return err
+		}
+	}
+}
+
+func (f *Follower) apply(msg *message) error {
+	switch msg.Type {
+	case msgSnapshotBegin:
+		return f.db.ResetForSnapshot()
+	case msgSnapshotChunk:
+		return f.db.ApplySnapshot(msg.Entries)
+	case msgSnapshotEnd, msgEntries:
+		return f.db.ApplyLog(msg.Entries, msg.Cursor)
+	case msgHeartbeat:
+		return nil
+	default:
+		return errors.New("unknown replication message type")
+	}
+}
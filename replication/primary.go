@@ -0,0 +1,199 @@
+package replication
+
+import (
+	bitcask "bitcask-go"
+	"encoding/gob"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// 主库，监听TCP连接，向每个从库推送日志
+type Primary struct {
+	db       *bitcask.DB
+	options  PrimaryOptions
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closeCh  chan struct{}
+	wg       sync.WaitGroup
+	closed   bool
+}
+
+func NewPrimary(db *bitcask.DB, options PrimaryOptions) *Primary {
+	return &Primary{
+		db:      db,
+		options: options,
+		conns:   make(map[net.Conn]struct{}),
+		closeCh: make(chan struct{}),
+	}
+}
+
+// 在listener上接收从库连接，直到Close
+func (p *Primary) Serve(listener net.Listener) error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return net.ErrClosed
+	}
+	p.listener = listener
+	p.mu.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-p.closeCh:
+				return nil
+			default:
+				return err
+			}
+		}
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			_ = conn.Close()
+			return nil
+		}
+		p.conns[conn] = struct{}{}
+		p.wg.Add(1)
+		p.mu.Unlock()
+
+		go func() {
+			defer p.wg.Done()
+			_ = p.serveConn(conn)
+			p.mu.Lock()
+			delete(p.conns, conn)
+			p.mu.Unlock()
+			_ = conn.Close()
+		}()
+	}
+}
+
+// 关闭监听和所有从库连接
+func (p *Primary) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	close(p.closeCh)
+	var err error
+	if p.listener != nil {
+		err = p.listener.Close()
+	}
+	for conn := range p.conns {
+		_ = conn.Close()
+	}
+	p.mu.Unlock()
+	p.wg.Wait()
+	return err
+}
+
+// 带超时的消息发送，从库太久没有收下消息时返回超时错误
+type sender struct {
+	conn    net.Conn
+	enc     *gob.Encoder
+	timeout time.Duration
+	lastAt  time.Time //最后一次发送的时间
+}
+
+func (s *sender) send(msg *message) error {
+	if s.timeout > 0 {
+		if err := s.conn.SetWriteDeadline(time.Now().Add(s.timeout)); err != nil {
+			return err
+		}
+	}
+	if err := s.enc.Encode(msg); err != nil {
+		return err
+	}
+	s.lastAt = time.Now()
+	return nil
+}
+
+// 处理一个从库，先按需全量同步，再持续推送增量日志
+// 读取请求和发送消息都有超时，没有新日志时定时发送心跳，出错或者超时返回后连接会被关闭
+func (p *Primary) serveConn(conn net.Conn) error {
+	if p.options.Timeout > 0 {
+		if err := conn.SetReadDeadline(time.Now().Add(p.options.Timeout)); err != nil {
+			return err
+		}
+	}
+	var req request
+	if err := gob.NewDecoder(conn).Decode(&req); err != nil {
+		return err
+	}
+	s := &sender{conn: conn, enc: gob.NewEncoder(conn), timeout: p.options.Timeout, lastAt: time.Now()}
+
+	cursor := req.Cursor
+	needSnapshot := !req.HasCursor
+	for {
+		if needSnapshot {
+			next, err := p.sendSnapshot(s)
+			if err != nil {
+				return err
+			}
+			cursor = next
+			needSnapshot = false
+		}
+
+		entries, next, err := p.db.ReadLog(cursor)
+		//位置所在的文件被merge重写了，或者位置不属于这个主库
+		if errors.Is(err, bitcask.ErrLogCursorTooOld) || errors.Is(err, bitcask.ErrInvalidLogCursor) {
+			needSnapshot = true
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if len(entries) > 0 {
+			if err := s.send(&message{Type: msgEntries, Entries: entries, Cursor: next}); err != nil {
+				return err
+			}
+		}
+		cursor = next
+		if len(entries) == 0 {
+			if p.options.HeartbeatInterval > 0 && time.Since(s.lastAt) >= p.options.HeartbeatInterval {
+				if err := s.send(&message{Type: msgHeartbeat}); err != nil {
+					return err
+				}
+			}
+			select {
+			case <-p.closeCh:
+				return nil
+			case <-time.After(p.options.PollInterval):
+			}
+		}
+	}
+}
+
+// 发送全量数据，返回之后增量日志的起点
+func (p *Primary) sendSnapshot(s *sender) (bitcask.LogCursor, error) {
+	if err := s.send(&message{Type: msgSnapshotBegin}); err != nil {
+		return bitcask.LogCursor{}, err
+	}
+	var chunk []*bitcask.LogEntry
+	cursor, err := p.db.SnapshotLog(func(entry *bitcask.LogEntry) error {
+		chunk = append(chunk, entry)
+		if len(chunk) < p.options.SnapshotChunkSize {
+			return nil
+		}
+		err := s.send(&message{Type: msgSnapshotChunk, Entries: chunk})
+		chunk = nil
+		return err
+	})
+	if err != nil {
+		return bitcask.LogCursor{}, err
+	}
+	if len(chunk) > 0 {
+		if err := s.send(&message{Type: msgSnapshotChunk, Entries: chunk}); err != nil {
+			return bitcask.LogCursor{}, err
+		}
+	}
+	if err := s.send(&message{Type: msgSnapshotEnd, Cursor: cursor}); err != nil {
+		return bitcask.LogCursor{}, err
+	}
+	return cursor, nil
+}
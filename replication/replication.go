@@ -0,0 +1,65 @@
+// 主从复制，主库通过TCP把数据文件中的日志推送给从库
+package replication
+
+import (
+	bitcask "bitcask-go"
+	"time"
+)
+
+type msgType = byte
+
+const (
+	//开始全量同步，从库清空数据
+	msgSnapshotBegin msgType = iota + 1
+	//一批全量数据
+	msgSnapshotChunk
+	//全量同步结束，带上之后增量日志的起点
+	msgSnapshotEnd
+	//一批增量日志
+	msgEntries
+	//心跳，没有新日志时定时发送，从库据此判断连接是否还活着
+	msgHeartbeat
+)
+
+// 从库连接后发送的请求
+type request struct {
+	Cursor    bitcask.LogCursor //已经应用到的位置
+	HasCursor bool              //为false表示从来没有同步过，需要全量同步
+}
+
+// 主库发送给从库的消息
+type message struct {
+	Type    msgType
+	Entries []*bitcask.LogEntry
+	Cursor  bitcask.LogCursor //应用完这条消息之后的位置
+}
+
+type PrimaryOptions struct {
+	//没有新日志时轮询的间隔
+	PollInterval time.Duration
+	//全量同步时每条消息包含的数据条数
+	SnapshotChunkSize int
+	//没有新日志时发送心跳的间隔，0表示不发送
+	HeartbeatInterval time.Duration
+	//读取从库请求和发送每条消息的超时，超时后关闭连接，0表示不超时
+	Timeout time.Duration
+}
+
+type FollowerOptions struct {
+	//断开后重连的间隔
+	RetryInterval time.Duration
+	//超过这个时间没有收到主库的任何消息(包括心跳)就断开重连，需要大于主库的心跳间隔，0表示不超时
+	ReadTimeout time.Duration
+}
+
+var DefaultPrimaryOptions = PrimaryOptions{
+	PollInterval:      50 * time.Millisecond,
+	SnapshotChunkSize: 1024,
+	HeartbeatInterval: time.Second,
+	Timeout:           10 * time.Second,
+}
+
+var DefaultFollowerOptions = FollowerOptions{
+	RetryInterval: time.Second,
+	ReadTimeout:   10 * time.Second,
+}
@@ -0,0 +1,258 @@
+package replication
+
+import (
+	bitcask "bitcask-go"
+	"bitcask-go/utils"
+	"context"
+	"encoding/gob"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func openDB(t *testing.T, name string, options bitcask.Options) (*bitcask.DB, string) {
+	dir, _ := os.MkdirTemp("", name)
+	options.DirPath = dir
+	db, err := bitcask.Open(options)
+	assert.Nil(t, err)
+	return db, dir
+}
+
+func destroyDB(db *bitcask.DB, dir string) {
+	_ = db.Close()
+	_ = os.RemoveAll(dir)
+}
+
+// 等待条件满足
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("timeout waiting for replication")
+}
+
+func hasValue(db *bitcask.DB, key, value []byte) func() bool {
+	return func() bool {
+		v, err := db.Get(key)
+		return err == nil && string(v) == string(value)
+	}
+}
+
+func startPrimary(t *testing.T, db *bitcask.DB) (*Primary, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	primary := NewPrimary(db, DefaultPrimaryOptions)
+	go func() {
+		_ = primary.Serve(listener)
+	}()
+	return primary, listener.Addr().String()
+}
+
+func TestReplication(t *testing.T) {
+	options := bitcask.DefaultDBOptions
+	primaryDB, primaryDir := openDB(t, "bitcask-go-primary", options)
+	defer destroyDB(primaryDB, primaryDir)
+	followerDB, followerDir := openDB(t, "bitcask-go-follower", options)
+	defer destroyDB(followerDB, followerDir)
+
+	//已有的数据通过全量同步
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, primaryDB.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+	}
+	assert.Nil(t, primaryDB.Namespace("users").Put([]byte("u1"), []byte("v1")))
+
+	primary, addr := startPrimary(t, primaryDB)
+	defer primary.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	follower := NewFollower(followerDB, addr, FollowerOptions{RetryInterval: 50 * time.Millisecond})
+	go func() {
+		_ = follower.Run(ctx)
+	}()
+
+	waitFor(t, hasValue(followerDB, utils.GetTestKey(99), utils.GetTestKey(99)))
+	v, err := followerDB.Namespace("users").Get([]byte("u1"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), v)
+	assert.Equal(t, 100, len(followerDB.ListKeys()))
+
+	//从库拒绝本地写入
+	assert.Equal(t, bitcask.ErrFollowerReadOnly, followerDB.Put([]byte("local"), []byte("v")))
+	assert.Equal(t, bitcask.ErrFollowerReadOnly, followerDB.Delete(utils.GetTestKey(1)))
+	assert.Equal(t, bitcask.ErrFollowerReadOnly, followerDB.DropNamespace("users"))
+
+	//增量同步，包括删除、事务和删除命名空间
+	assert.Nil(t, primaryDB.Delete(utils.GetTestKey(0)))
+	wb := primaryDB.NewWriteBatch(bitcask.DefaultWriteBatchOptions)
+	assert.Nil(t, wb.Put([]byte("txn-1"), []byte("v1")))
+	assert.Nil(t, wb.Put([]byte("txn-2"), []byte("v2")))
+	assert.Nil(t, wb.Commit())
+	assert.Nil(t, primaryDB.DropNamespace("users"))
+	assert.Nil(t, primaryDB.Namespace("users").Put([]byte("u2"), []byte("v2")))
+	assert.Nil(t, primaryDB.Put([]byte("last"), []byte("v")))
+
+	waitFor(t, hasValue(followerDB, []byte("last"), []byte("v")))
+	_, err = followerDB.Get(utils.GetTestKey(0))
+	assert.Equal(t, bitcask.ErrKeyNotFound, err)
+	v, err = followerDB.Get([]byte("txn-2"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v2"), v)
+	assert.Equal(t, [][]byte{[]byte("u2")}, followerDB.Namespace("users").ListKeys())
+
+	cursor, ok, err := followerDB.ReplicationCursor()
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.NotEqual(t, bitcask.LogCursor{}, cursor)
+}
+
+func TestReplicationResume(t *testing.T) {
+	options := bitcask.DefaultDBOptions
+	primaryDB, primaryDir := openDB(t, "bitcask-go-primary-resume", options)
+	defer destroyDB(primaryDB, primaryDir)
+	followerDir, _ := os.MkdirTemp("", "bitcask-go-follower-resume")
+	followerOptions := options
+	followerOptions.DirPath = followerDir
+	followerDB, err := bitcask.Open(followerOptions)
+	assert.Nil(t, err)
+
+	primary, addr := startPrimary(t, primaryDB)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		_ = NewFollower(followerDB, addr, FollowerOptions{RetryInterval: 50 * time.Millisecond}).Run(ctx)
+		close(done)
+	}()
+	assert.Nil(t, primaryDB.Put([]byte("k1"), []byte("v1")))
+	waitFor(t, hasValue(followerDB, []byte("k1"), []byte("v1")))
+
+	//主库断开期间的写入，重连后继续同步
+	assert.Nil(t, primary.Close())
+	assert.Nil(t, primaryDB.Put([]byte("k2"), []byte("v2")))
+	primary, addr2 := startPrimaryAt(t, primaryDB, addr)
+	defer primary.Close()
+	assert.Equal(t, addr, addr2)
+	waitFor(t, hasValue(followerDB, []byte("k2"), []byte("v2")))
+
+	//从库重启后从保存的位置继续，不需要全量同步
+	cancel()
+	<-done
+	assert.Nil(t, followerDB.Close())
+	assert.Nil(t, primaryDB.Put([]byte("k3"), []byte("v3")))
+	followerDB, err = bitcask.Open(followerOptions)
+	assert.Nil(t, err)
+	defer destroyDB(followerDB, followerDir)
+	cursor, ok, err := followerDB.ReplicationCursor()
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = NewFollower(followerDB, addr, FollowerOptions{RetryInterval: 50 * time.Millisecond}).Run(ctx)
+	}()
+	waitFor(t, hasValue(followerDB, []byte("k3"), []byte("v3")))
+	next, _, err := followerDB.ReplicationCursor()
+	assert.Nil(t, err)
+	assert.True(t, next.Offset > cursor.Offset)
+	assert.Equal(t, 3, len(followerDB.ListKeys()))
+}
+
+func startPrimaryAt(t *testing.T, db *bitcask.DB, addr string) (*Primary, string) {
+	listener, err := net.Listen("tcp", addr)
+	assert.Nil(t, err)
+	primary := NewPrimary(db, DefaultPrimaryOptions)
+	go func() {
+		_ = primary.Serve(listener)
+	}()
+	return primary, listener.Addr().String()
+}
+
+func TestReplicationAfterMerge(t *testing.T) {
+	options := bitcask.DefaultDBOptions
+	options.DataFileSize = 32 * 1024
+	options.DataFileMergeRatio = 0
+	primaryDir, _ := os.MkdirTemp("", "bitcask-go-primary-merge")
+	primaryOptions := options
+	primaryOptions.DirPath = primaryDir
+	primaryDB, err := bitcask.Open(primaryOptions)
+	assert.Nil(t, err)
+	followerDB, followerDir := openDB(t, "bitcask-go-follower-merge", options)
+	defer destroyDB(followerDB, followerDir)
+
+	primary, addr := startPrimary(t, primaryDB)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = NewFollower(followerDB, addr, FollowerOptions{RetryInterval: 50 * time.Millisecond}).Run(ctx)
+	}()
+	assert.Nil(t, primaryDB.Put([]byte("first"), []byte("v")))
+	waitFor(t, hasValue(followerDB, []byte("first"), []byte("v")))
+
+	//主库merge重启后，从库的位置失效，需要重新全量同步
+	assert.Nil(t, primary.Close())
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, primaryDB.Put(utils.GetTestKey(i%100), utils.GetTestKey(i)))
+	}
+	assert.Nil(t, primaryDB.Delete([]byte("first")))
+	assert.Nil(t, primaryDB.Merge())
+	assert.Nil(t, primaryDB.Close())
+	primaryDB, err = bitcask.Open(primaryOptions)
+	assert.Nil(t, err)
+	defer destroyDB(primaryDB, primaryDir)
+	primary, _ = startPrimaryAt(t, primaryDB, addr)
+	defer primary.Close()
+
+	waitFor(t, hasValue(followerDB, utils.GetTestKey(99), utils.GetTestKey(1999)))
+	_, err = followerDB.Get([]byte("first"))
+	assert.Equal(t, bitcask.ErrKeyNotFound, err)
+	assert.Equal(t, 100, len(followerDB.ListKeys()))
+}
+
+func TestPrimaryTimeoutAndHeartbeat(t *testing.T) {
+	db, dir := openDB(t, "bitcask-go-repl-timeout", bitcask.DefaultDBOptions)
+	defer destroyDB(db, dir)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	options := DefaultPrimaryOptions
+	options.HeartbeatInterval = 20 * time.Millisecond
+	options.Timeout = 100 * time.Millisecond
+	primary := NewPrimary(db, options)
+	go func() {
+		_ = primary.Serve(listener)
+	}()
+	defer primary.Close()
+	addr := listener.Addr().String()
+
+	//连接之后一直不发送请求，超时后主库关闭连接
+	conn, err := net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	assert.Nil(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+	_ = conn.Close()
+
+	//没有新日志时收到心跳
+	conn, err = net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer conn.Close()
+	assert.Nil(t, gob.NewEncoder(conn).Encode(&request{}))
+	assert.Nil(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	dec := gob.NewDecoder(conn)
+	var types []msgType
+	for len(types) == 0 || types[len(types)-1] != msgHeartbeat {
+		var msg message
+		if !assert.Nil(t, dec.Decode(&msg)) {
+			return
+		}
+		types = append(types, msg.Type)
+	}
+	assert.Equal(t, []msgType{msgSnapshotBegin, msgSnapshotEnd, msgHeartbeat}, types)
+}
@@ -18,6 +18,7 @@ type Stat struct {
 	DataFileNum     uint  //数据文件的数量
 	ReclaimableSize int64 //磁盘可回收字节空间，单位为字节
 	DiskSize        int64 //所占磁盘空间
+	ColdDiskSize    int64 //冷数据目录所占磁盘空间，包含在DiskSize中
 }
 
 // 获取一个目录的占用大小
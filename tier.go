@@ -0,0 +1,81 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/fio"
+	"path/filepath"
+	"sort"
+)
+
+// 分层存储：DirPath是热数据目录，放活跃文件、最近写入的数据文件以及MANIFEST等元数据
+// ColdDirPath是冷数据目录，merge生成的数据文件、hint文件和完成标识都写到这里
+// 索引中的位置只记录文件id，数据文件按所在目录打开之后，读取和目录无关
+
+// 数据文件可能所在的目录，热目录在前
+func (db *DB) dataDirs() []string {
+	if db.options.ColdDirPath == "" {
+		return []string{db.options.DirPath}
+	}
+	return []string{db.options.DirPath, db.options.ColdDirPath}
+}
+
+// merge结果安装到的目录，没有配置冷目录时就是数据目录
+func (db *DB) mergedDirPath() string {
+	if db.options.ColdDirPath == "" {
+		return db.options.DirPath
+	}
+	return db.options.ColdDirPath
+}
+
+// 数据文件所在的目录，冷目录中只有merge安装的文件，不在冷目录中就在热目录
+func (db *DB) dataFileDir(fid uint32) string {
+	if db.options.ColdDirPath != "" {
+		if _, err := db.fs.Stat(data.GetDataFileName(db.options.ColdDirPath, fid)); err == nil {
+			return db.options.ColdDirPath
+		}
+	}
+	return db.options.DirPath
+}
+
+// hint文件和完成标识所在的目录，开启分层之前merge的结果还在热目录中
+func (db *DB) mergeFileDir(name string) string {
+	if db.options.ColdDirPath != "" {
+		if _, err := db.fs.Stat(filepath.Join(db.options.ColdDirPath, name)); err == nil {
+			return db.options.ColdDirPath
+		}
+	}
+	return db.options.DirPath
+}
+
+// 所有目录中的数据文件id，从小到大
+func (db *DB) listDataFileIds() ([]uint32, error) {
+	var fileIds []uint32
+	seen := make(map[uint32]bool)
+	for _, dir := range db.dataDirs() {
+		ids, err := listDataFileIds(db.fs, dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, fid := range ids {
+			if !seen[fid] {
+				seen[fid] = true
+				fileIds = append(fileIds, fid)
+			}
+		}
+	}
+	sort.Slice(fileIds, func(i, j int) bool { return fileIds[i] < fileIds[j] })
+	return fileIds, nil
+}
+
+// 所有数据目录占用的磁盘空间
+func (db *DB) diskSize() (int64, error) {
+	var size int64
+	for _, dir := range db.dataDirs() {
+		dirSize, err := fio.DirSize(db.fs, dir)
+		if err != nil {
+			return 0, err
+		}
+		size += dirSize
+	}
+	return size, nil
+}
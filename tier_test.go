@@ -0,0 +1,220 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/fio"
+	"bitcask-go/utils"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 数据库中0~n的key，小于deleted的已经删除
+func assertTierData(t *testing.T, db *DB, n, deleted int) {
+	assert.Equal(t, n-deleted, len(db.ListKeys()))
+	for i := deleted; i < n; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, utils.GetTestKey(i), val)
+	}
+}
+
+func TestDB_ColdDirPath(t *testing.T) {
+	opts := DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-tier-hot")
+	coldDir, _ := os.MkdirTemp("", "bitcask-go-tier-cold")
+	opts.DirPath = dir
+	opts.ColdDirPath = coldDir
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+	}
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	//merge之前所有数据文件都在热目录中
+	ids, err := listDataFileIds(db.fs, coldDir)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(ids))
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+
+	//打开时安装merge结果，merge生成的文件都在冷目录中，活跃文件在热目录中
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assertTierData(t, db, 1000, 500)
+	coldIds, err := listDataFileIds(db.fs, coldDir)
+	assert.Nil(t, err)
+	assert.Greater(t, len(coldIds), 0)
+	for _, fid := range coldIds {
+		assert.Less(t, fid, db.logStartFid)
+		_, err := os.Stat(data.GetDataFileName(dir, fid))
+		assert.True(t, os.IsNotExist(err))
+	}
+	hotIds, err := listDataFileIds(db.fs, dir)
+	assert.Nil(t, err)
+	for _, fid := range hotIds {
+		assert.GreaterOrEqual(t, fid, db.logStartFid)
+	}
+	assert.Equal(t, db.activeFile.FileId, hotIds[len(hotIds)-1])
+	for _, name := range []string{data.HintFileName, data.MergeFinishedName} {
+		_, err := os.Stat(filepath.Join(coldDir, name))
+		assert.Nil(t, err)
+		_, err = os.Stat(filepath.Join(dir, name))
+		assert.True(t, os.IsNotExist(err))
+	}
+	stat := db.Stat()
+	assert.Greater(t, stat.ColdDiskSize, int64(0))
+	assert.Greater(t, stat.DiskSize, stat.ColdDiskSize)
+
+	//继续写入之后再merge一次
+	for i := 1000; i < 1500; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+	}
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assertTierData(t, db, 1500, 500)
+
+	//检查点包含两个目录的文件，可以不分层直接打开
+	cpDir, _ := os.MkdirTemp("", "bitcask-go-tier-checkpoint")
+	assert.Nil(t, db.Checkpoint(cpDir))
+	cpOpts := DefaultDBOptions
+	cpOpts.DirPath = cpDir
+	cpDB, err := Open(cpOpts)
+	assert.Nil(t, err)
+	assertTierData(t, cpDB, 1500, 500)
+	destroyDB(cpDB)
+}
+
+func TestDB_ColdDirPathMigrate(t *testing.T) {
+	//不分层的数据库先merge一次，hint文件在数据目录中
+	opts := DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-tier-migrate")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+	}
+	for i := 0; i < 200; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Close())
+
+	//开启分层后原来的文件留在热目录中，仍然可以读到
+	coldDir, _ := os.MkdirTemp("", "bitcask-go-tier-migrate-cold")
+	opts.ColdDirPath = coldDir
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+	assertTierData(t, db, 1000, 200)
+
+	//下一次merge之后旧文件全部被替换，只剩冷目录中的hint文件
+	for i := 200; i < 400; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assertTierData(t, db, 1000, 400)
+	_, err = os.Stat(filepath.Join(dir, data.HintFileName))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(coldDir, data.HintFileName))
+	assert.Nil(t, err)
+	hotIds, err := listDataFileIds(db.fs, dir)
+	assert.Nil(t, err)
+	for _, fid := range hotIds {
+		assert.GreaterOrEqual(t, fid, db.logStartFid)
+	}
+}
+
+// merge的结果在冷目录中，恢复时从两个目录读取
+func TestDB_ColdDirPathRecoverTo(t *testing.T) {
+	opts := DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-tier-pitr")
+	coldDir, _ := os.MkdirTemp("", "bitcask-go-tier-pitr-cold")
+	opts.DirPath = dir
+	opts.ColdDirPath = coldDir
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+	}
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	for i := 1000; i < 1200; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+	}
+	target := recoverPoint()
+	for i := 1200; i < 1300; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+	}
+	assert.Nil(t, db.Close())
+
+	targetDir, _ := os.MkdirTemp("", "bitcask-go-tier-pitr-target")
+	assert.Nil(t, RecoverToWithOptions(opts, targetDir, RecoverTarget{Time: target}))
+	recoverOpts := DefaultDBOptions
+	recoverOpts.DirPath = targetDir
+	recovered, err := Open(recoverOpts)
+	assert.Nil(t, err)
+	defer destroyDB(recovered)
+	assertTierData(t, recovered, 1200, 500)
+}
+
+// 旧格式的分层目录，merge的结果在冷目录中
+func TestDB_ColdDirPathUpgrade(t *testing.T) {
+	opts := DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-tier-upgrade")
+	coldDir, _ := os.MkdirTemp("", "bitcask-go-tier-upgrade-cold")
+	opts.DirPath = dir
+	opts.ColdDirPath = coldDir
+	opts.DataFileMergeRatio = 0
+	makeLegacyDir(t, dir)
+	for _, name := range []string{filepath.Base(data.GetDataFileName(dir, 0)), data.HintFileName, data.MergeFinishedName} {
+		assert.Nil(t, os.Rename(filepath.Join(dir, name), filepath.Join(coldDir, name)))
+	}
+
+	assert.Nil(t, UpgradeWithOptions(opts))
+	for _, name := range []string{
+		data.GetDataFileName(coldDir, 0),
+		data.GetDataFileName(dir, 1),
+		filepath.Join(coldDir, data.HintFileName),
+		filepath.Join(coldDir, data.MergeFinishedName),
+	} {
+		legacy, err := data.IsLegacyFile(fio.OSFS{}, name)
+		assert.Nil(t, err)
+		assert.False(t, legacy, name)
+	}
+	_, err := os.Stat(data.GetDataFileName(dir, 0))
+	assert.True(t, os.IsNotExist(err))
+
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+	checkLegacyDirData(t, db, 199)
+}
@@ -0,0 +1,193 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/fio"
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// 离线把dir中没有文件头的旧格式文件升级到最新格式
+// 数据文件加上文件头之后记录整体后移，hint文件中的位置一起修改，B+树索引文件删除后重建
+// 升级后的文件先以merge临时文件的方式写好，通过MANIFEST提交，中途崩溃下次打开时会继续完成或者丢弃
+func Upgrade(dir string) error {
+	return UpgradeWithFS(fio.OSFS{}, dir)
+}
+
+// 离线升级fs中的数据目录dir
+func UpgradeWithFS(fs fio.FS, dir string) error {
+	options := DefaultDBOptions
+	options.DirPath = dir
+	options.FS = fs
+	return UpgradeWithOptions(options)
+}
+
+// 离线升级options中的数据目录，只使用DirPath、ColdDirPath和FS，配置了冷数据目录时其中的文件一起升级
+func UpgradeWithOptions(options Options) error {
+	fs := options.FS
+	if fs == nil {
+		fs = fio.OSFS{}
+	}
+	dir := options.DirPath
+	if _, err := fs.Stat(dir); err != nil {
+		return err
+	}
+	//离线操作，不能和打开的数据库同时进行
+	filelock := fs.NewLocker(filepath.Join(dir, fileLockName))
+	hold, err := filelock.TryLock()
+	if err != nil {
+		return err
+	}
+	if !hold {
+		return ErrDatabaseIsUsing
+	}
+	defer func() {
+		_ = filelock.Unlock()
+	}()
+
+	//先完成上一次没有安装完的merge，重写的MANIFEST已经是最新格式
+	opts := DefaultDBOptions
+	opts.DirPath = dir
+	opts.ColdDirPath = options.ColdDirPath
+	opts.FS = fs
+	db := &DB{options: opts, fs: fs}
+	if err := db.loadManifest(); err != nil {
+		return err
+	}
+	defer func() {
+		_ = db.manifest.Close()
+	}()
+	if err := db.loadMergeFile(); err != nil {
+		return err
+	}
+	if err := db.collectGarbageFiles(); err != nil {
+		return err
+	}
+
+	edit := &manifestEdit{mergeState: manifestMergePending}
+	upgraded := make(map[uint32]bool)
+	for _, fid := range db.manifestState.fileIds() {
+		fileName := data.GetDataFileName(db.dataFileDir(fid), fid)
+		legacy, err := data.IsLegacyFile(fs, fileName)
+		if err != nil {
+			return err
+		}
+		if !legacy {
+			continue
+		}
+		if err := data.UpgradeFile(fs, fileName, fileName+mergeTempSuffix, data.FileTypeData); err != nil {
+			return err
+		}
+		upgraded[fid] = true
+		if size := db.manifestState.files[fid]; size != manifestActiveSize {
+			edit.sealed = append(edit.sealed, manifestSealed{fid: fid, size: size + data.FileHeaderSize})
+		}
+	}
+
+	changed := len(upgraded) > 0
+	hintChanged, err := upgradeHintFile(fs, db.mergeFileDir(data.HintFileName), upgraded)
+	if err != nil {
+		return err
+	}
+	changed = changed || hintChanged
+	for name, fileType := range map[string]data.FileType{
+		data.MergeFinishedName: data.FileTypeMergeFinished,
+		data.SeqNoFileName:     data.FileTypeSeqNo,
+		data.BloomFilterName:   data.FileTypeBloomFilter,
+	} {
+		//完成标识可能在冷目录中，序列号和布隆过滤器文件在数据目录中
+		fileName := filepath.Join(db.mergeFileDir(name), name)
+		if _, err := fs.Stat(fileName); err != nil {
+			continue
+		}
+		legacy, err := data.IsLegacyFile(fs, fileName)
+		if err != nil {
+			return err
+		}
+		if !legacy {
+			continue
+		}
+		if err := data.UpgradeFile(fs, fileName, fileName+mergeTempSuffix, fileType); err != nil {
+			return err
+		}
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+
+	//B+树索引中记录的位置失效了，删掉之后打开时从数据文件重建
+	if len(upgraded) > 0 {
+		if err := fs.RemoveAll(filepath.Join(dir, bptreeIndexName)); err != nil {
+			return err
+		}
+	}
+	for _, dataDir := range db.dataDirs() {
+		if err := fs.SyncDir(dataDir); err != nil {
+			return err
+		}
+	}
+	if err := db.appendManifestEdit(edit); err != nil {
+		return err
+	}
+	return db.finishMergeInstall()
+}
+
+// 重写hint文件，指向升级过的数据文件的位置加上文件头的长度
+// hint文件是旧格式或者有位置需要修改时返回true
+func upgradeHintFile(fs fio.FS, dir string, upgraded map[uint32]bool) (bool, error) {
+	fileName := filepath.Join(dir, data.HintFileName)
+	if _, err := fs.Stat(fileName); err != nil {
+		return false, nil
+	}
+	legacy, err := data.IsLegacyFile(fs, fileName)
+	if err != nil {
+		return false, err
+	}
+	if !legacy && len(upgraded) == 0 {
+		return false, nil
+	}
+
+	hintFile, err := data.OpenHintFile(fs, dir)
+	if err != nil {
+		return false, err
+	}
+	defer hintFile.Close()
+	tempFile, err := fs.OpenFile(fileName+mergeTempSuffix, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, fio.DatafilePerm)
+	if err != nil {
+		return false, err
+	}
+	defer tempFile.Close()
+
+	writer := bufio.NewWriter(tempFile)
+	header := &data.FileHeader{Version: data.FileFormatVersion, Type: data.FileTypeHint, CreatedAt: time.Now().UnixNano()}
+	if _, err := writer.Write(data.EncodeFileHeader(header)); err != nil {
+		return false, err
+	}
+	offset := hintFile.RecordStart()
+	for {
+		logRecord, size, err := hintFile.ReadLogRecord(offset)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return false, err
+		}
+		offset += size
+		pos := data.DecodeLogRecordPos(logRecord.Value)
+		if upgraded[pos.Fid] {
+			pos.Offset += data.FileHeaderSize
+		}
+		record, _ := data.EncodeLogRecord(&data.LogRecord{Key: logRecord.Key, Value: data.EncodeLogRecordPos(pos)})
+		if _, err := writer.Write(record); err != nil {
+			return false, err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return false, err
+	}
+	return true, tempFile.Sync()
+}
@@ -0,0 +1,151 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/fio"
+	"bitcask-go/utils"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 写一个没有文件头的旧格式文件，返回每条记录的位置
+func writeLegacyFile(t *testing.T, fileName string, records []*data.LogRecord) []int64 {
+	file, err := os.OpenFile(fileName, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, fio.DatafilePerm)
+	assert.Nil(t, err)
+	defer file.Close()
+	var offsets []int64
+	var offset int64
+	for _, record := range records {
+		buf, size := data.EncodeLogRecord(record)
+		_, err := file.Write(buf)
+		assert.Nil(t, err)
+		offsets = append(offsets, offset)
+		offset += size
+	}
+	return offsets
+}
+
+// 构造旧版本的数据目录：文件0是merge的结果，有hint文件和merge完成标识，文件1是merge之后的写入
+func makeLegacyDir(t *testing.T, dir string) {
+	var merged []*data.LogRecord
+	for i := 0; i < 100; i++ {
+		merged = append(merged, &data.LogRecord{
+			Key:   logRecordKeyAddSeq(utils.GetTestKey(i), nonTransactionSeqNo),
+			Value: utils.GetTestKey(i),
+		})
+	}
+	offsets := writeLegacyFile(t, data.GetDataFileName(dir, 0), merged)
+	var hints []*data.LogRecord
+	for i, offset := range offsets {
+		hints = append(hints, &data.LogRecord{
+			Key:   utils.GetTestKey(i),
+			Value: data.EncodeLogRecordPos(&data.LogRecordPos{Fid: 0, Offset: offset}),
+		})
+	}
+	writeLegacyFile(t, filepath.Join(dir, data.HintFileName), hints)
+	writeLegacyFile(t, filepath.Join(dir, data.MergeFinishedName), []*data.LogRecord{
+		{Key: []byte("mergeFinishedKey"), Value: []byte(strconv.Itoa(1))},
+	})
+
+	var writes []*data.LogRecord
+	for i := 100; i < 200; i++ {
+		writes = append(writes, &data.LogRecord{
+			Key:   logRecordKeyAddSeq(utils.GetTestKey(i), nonTransactionSeqNo),
+			Value: utils.GetTestKey(i),
+		})
+	}
+	writes = append(writes, &data.LogRecord{
+		Key:  logRecordKeyAddSeq(utils.GetTestKey(0), nonTransactionSeqNo),
+		Type: data.LogRecordDelete,
+	})
+	writeLegacyFile(t, data.GetDataFileName(dir, 1), writes)
+}
+
+func checkLegacyDirData(t *testing.T, db *DB, keyNum int) {
+	assert.Equal(t, keyNum, len(db.ListKeys()))
+	_, err := db.Get(utils.GetTestKey(0))
+	assert.Equal(t, ErrKeyNotFound, err)
+	for i := 1; i < 200; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, utils.GetTestKey(i), val)
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	for _, indexType := range []IndexerType{Btree, BPTree} {
+		opts := DefaultDBOptions
+		dir, _ := os.MkdirTemp("", "bitcask-go-upgrade")
+		opts.DirPath = dir
+		opts.IndexType = indexType
+		opts.DataFileMergeRatio = 0
+		makeLegacyDir(t, dir)
+
+		//旧格式的目录可以直接打开
+		db, err := Open(opts)
+		assert.Nil(t, err)
+		checkLegacyDirData(t, db, 199)
+		assert.Nil(t, db.Put([]byte("before-upgrade"), []byte("v")))
+		assert.Nil(t, db.Close())
+
+		assert.Nil(t, Upgrade(dir))
+		for _, name := range []string{
+			data.GetDataFileName(dir, 0),
+			data.GetDataFileName(dir, 1),
+			filepath.Join(dir, data.HintFileName),
+			filepath.Join(dir, data.MergeFinishedName),
+			filepath.Join(dir, data.ManifestFileName),
+		} {
+			legacy, err := data.IsLegacyFile(fio.OSFS{}, name)
+			assert.Nil(t, err)
+			assert.False(t, legacy, name)
+		}
+		tempIds, err := listMergeTempFileIds(fio.OSFS{}, dir)
+		assert.Nil(t, err)
+		assert.Equal(t, 0, len(tempIds))
+		//已经是最新格式，再次升级什么都不做
+		assert.Nil(t, Upgrade(dir))
+
+		db, err = Open(opts)
+		assert.Nil(t, err)
+		checkLegacyDirData(t, db, 200)
+		val, err := db.Get([]byte("before-upgrade"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("v"), val)
+		assert.Nil(t, db.Put([]byte("after-upgrade"), []byte("v")))
+		assert.Nil(t, db.Merge())
+		assert.Nil(t, db.Close())
+
+		db, err = Open(opts)
+		assert.Nil(t, err)
+		checkLegacyDirData(t, db, 201)
+		_, err = db.Get([]byte("after-upgrade"))
+		assert.Nil(t, err)
+		destroyDB(db)
+	}
+}
+
+// 升级的文件写好之后，提交之前崩溃，旧文件保持不变
+func TestUpgradeCrashBeforeCommit(t *testing.T) {
+	opts := DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-upgrade")
+	opts.DirPath = dir
+	makeLegacyDir(t, dir)
+	name := data.GetDataFileName(dir, 1)
+	assert.Nil(t, data.UpgradeFile(fio.OSFS{}, name, name+mergeTempSuffix, data.FileTypeData))
+
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+	tempIds, err := listMergeTempFileIds(fio.OSFS{}, dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(tempIds))
+	legacy, err := data.IsLegacyFile(fio.OSFS{}, name)
+	assert.Nil(t, err)
+	assert.True(t, legacy)
+	checkLegacyDirData(t, db, 199)
+}
@@ -0,0 +1,122 @@
+package utils
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"math"
+	"sync/atomic"
+)
+
+var ErrInvalidBloomFilter = errors.New("invalid bloom filter data")
+
+// 布隆过滤器，用于快速判断一个key一定不存在
+// 只能添加不能删除，所以删除的key依然可能返回存在
+type BloomFilter struct {
+	bits   []uint64 //位数组
+	m      uint64   //位数
+	k      uint64   //哈希函数个数
+	count  uint64   //已经添加的key数量
+	expect uint64   //预期容纳的key数量
+}
+
+// 根据预期的key数量和误判率创建布隆过滤器
+func NewBloomFilter(expect uint64, fpRate float64) *BloomFilter {
+	if expect == 0 {
+		expect = 1
+	}
+	//m = -n*ln(p)/(ln2)^2, k = m/n*ln2
+	m := uint64(math.Ceil(-float64(expect) * math.Log(fpRate) / (math.Ln2 * math.Ln2)))
+	k := uint64(math.Ceil(float64(m) / float64(expect) * math.Ln2))
+	if k == 0 {
+		k = 1
+	}
+	words := (m + 63) / 64
+	return &BloomFilter{
+		bits:   make([]uint64, words),
+		m:      words * 64,
+		k:      k,
+		expect: expect,
+	}
+}
+
+// 计算两个基础哈希值，通过 h1 + i*h2 模拟k个哈希函数
+func bloomHash(key []byte) (uint64, uint64) {
+	h := fnv.New64a()
+	_, _ = h.Write(key)
+	h1 := h.Sum64()
+	h2 := (h1 >> 33) | (h1 << 31)
+	return h1, h2 | 1
+}
+
+// 添加key，可以并发调用
+func (bf *BloomFilter) Add(key []byte) {
+	h1, h2 := bloomHash(key)
+	for i := uint64(0); i < bf.k; i++ {
+		bit := (h1 + i*h2) % bf.m
+		word, mask := &bf.bits[bit/64], uint64(1)<<(bit%64)
+		for {
+			old := atomic.LoadUint64(word)
+			if old&mask != 0 || atomic.CompareAndSwapUint64(word, old, old|mask) {
+				break
+			}
+		}
+	}
+	atomic.AddUint64(&bf.count, 1)
+}
+
+// 判断key是否可能存在，返回false表示一定不存在
+func (bf *BloomFilter) MayContain(key []byte) bool {
+	h1, h2 := bloomHash(key)
+	for i := uint64(0); i < bf.k; i++ {
+		bit := (h1 + i*h2) % bf.m
+		if atomic.LoadUint64(&bf.bits[bit/64])&(uint64(1)<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// 添加的key是否已经超过预期数量，超过后误判率会上升，需要重建
+func (bf *BloomFilter) Overloaded() bool {
+	return atomic.LoadUint64(&bf.count) > bf.expect
+}
+
+// 编码布隆过滤器 m k count expect bits
+func (bf *BloomFilter) Encode() []byte {
+	buf := make([]byte, binary.MaxVarintLen64*4+len(bf.bits)*8)
+	var index = 0
+	index += binary.PutUvarint(buf[index:], bf.m)
+	index += binary.PutUvarint(buf[index:], bf.k)
+	index += binary.PutUvarint(buf[index:], atomic.LoadUint64(&bf.count))
+	index += binary.PutUvarint(buf[index:], bf.expect)
+	for i := range bf.bits {
+		binary.LittleEndian.PutUint64(buf[index:], atomic.LoadUint64(&bf.bits[i]))
+		index += 8
+	}
+	return buf[:index]
+}
+
+// 解码布隆过滤器
+func DecodeBloomFilter(buf []byte) (*BloomFilter, error) {
+	var fields [4]uint64
+	var index = 0
+	for i := range fields {
+		v, n := binary.Uvarint(buf[index:])
+		if n <= 0 {
+			return nil, ErrInvalidBloomFilter
+		}
+		fields[i] = v
+		index += n
+	}
+	m, k, count, expect := fields[0], fields[1], fields[2], fields[3]
+	if m == 0 || m%64 != 0 || k == 0 || uint64(len(buf)-index) != m/8 {
+		return nil, ErrInvalidBloomFilter
+	}
+	bits := make([]uint64, m/64)
+	for i := range bits {
+		bits[i] = binary.LittleEndian.Uint64(buf[index:])
+		index += 8
+	}
+	return &BloomFilter{bits: bits, m: m, k: k, count: count, expect: expect}, nil
+}
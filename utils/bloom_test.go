@@ -0,0 +1,49 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBloomFilter(t *testing.T) {
+	bf := NewBloomFilter(1000, 0.01)
+	for i := 0; i < 1000; i++ {
+		bf.Add(GetTestKey(i))
+	}
+	//添加过的key一定存在
+	for i := 0; i < 1000; i++ {
+		assert.True(t, bf.MayContain(GetTestKey(i)))
+	}
+	assert.False(t, bf.Overloaded())
+
+	//没添加过的key误判率应该接近配置的误判率
+	var falsePositive int
+	for i := 1000; i < 11000; i++ {
+		if bf.MayContain(GetTestKey(i)) {
+			falsePositive++
+		}
+	}
+	assert.Less(t, falsePositive, 300)
+
+	bf.Add([]byte("overload"))
+	assert.True(t, bf.Overloaded())
+}
+
+func TestBloomFilter_Encode(t *testing.T) {
+	bf := NewBloomFilter(100, 0.01)
+	for i := 0; i < 100; i++ {
+		bf.Add(GetTestKey(i))
+	}
+	bf2, err := DecodeBloomFilter(bf.Encode())
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.True(t, bf2.MayContain(GetTestKey(i)))
+	}
+	assert.Equal(t, bf.Overloaded(), bf2.Overloaded())
+
+	_, err = DecodeBloomFilter([]byte{1, 2})
+	assert.Equal(t, ErrInvalidBloomFilter, err)
+	_, err = DecodeBloomFilter(nil)
+	assert.Equal(t, ErrInvalidBloomFilter, err)
+}
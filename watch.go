@@ -0,0 +1,232 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// 变更事件
+type Event struct {
+	Key   []byte
+	Value []byte //删除事件为空
+	Type  EventType
+	SeqNo uint64 //提交的序列号，写入时持有db锁分配，同一个WriteBatch的事件序列号相同；重新打开后继续递增，崩溃之后会跳过一段
+}
+
+type EventType = byte
+
+const (
+	EventPut EventType = iota + 1
+	EventDelete
+)
+
+// 订阅者消费太慢，缓冲区放不下时的处理策略
+type SlowConsumerPolicy = int8
+
+const (
+	//丢弃放不下的事件，同一批次的事件要么全部丢弃要么全部投递
+	WatchDrop SlowConsumerPolicy = iota + 1
+	//阻塞写入直到订阅者消费，会拖慢所有写操作，取消订阅或者数据库关闭时不再阻塞
+	WatchBlock
+	//关闭订阅者的通道
+	WatchDisconnect
+)
+
+type WatchOptions struct {
+	//通道的缓冲大小
+	BufferSize int
+	//消费太慢时的处理策略
+	Policy SlowConsumerPolicy
+}
+
+var DefaultWatchOptions = WatchOptions{
+	BufferSize: 1024,
+	Policy:     WatchDrop,
+}
+
+// 变更订阅者
+type watcher struct {
+	ch      chan Event
+	match   func(key []byte) ([]byte, bool) //是否关心这个key，返回给订阅者的key
+	options WatchOptions
+	done    chan struct{} //取消订阅时关闭
+
+	mu     sync.Mutex //投递和关闭通道互斥，同一个订阅者的投递按顺序进行
+	closed bool       //通道已经关闭
+}
+
+// 管理所有订阅者并投递事件，序列号在写入时分配
+// 同一个key的事件按序列号顺序投递，不同key的事件可能不按序列号顺序到达
+type watchHub struct {
+	mu       sync.Mutex
+	watchers map[*watcher]struct{}
+	count    int32 //订阅者数量，没有订阅者时写入不需要构造事件
+	closed   bool
+}
+
+func newWatchHub() *watchHub {
+	return &watchHub{watchers: make(map[*watcher]struct{})}
+}
+
+// 订阅前缀为prefix的key的变更，ctx取消或者数据库关闭时通道会被关闭
+// 命名空间的key不会出现，需要通过Namespace.Watch订阅
+func (db *DB) Watch(ctx context.Context, prefix []byte, options WatchOptions) (<-chan Event, error) {
+	return db.watchHub.subscribe(ctx, options, func(key []byte) ([]byte, bool) {
+		return key, !isReservedKey(key) && bytes.HasPrefix(key, prefix)
+	})
+}
+
+// 订阅命名空间内前缀为prefix的key的变更，返回的key不带命名空间前缀
+func (ns *Namespace) Watch(ctx context.Context, prefix []byte, options WatchOptions) (<-chan Event, error) {
+	return ns.db.watchHub.subscribe(ctx, options, func(key []byte) ([]byte, bool) {
+		name, _, userKey, ok := parseNsDataKey(key)
+		return userKey, ok && name == ns.name && bytes.HasPrefix(userKey, prefix)
+	})
+}
+
+func (hub *watchHub) subscribe(ctx context.Context, options WatchOptions,
+	match func(key []byte) ([]byte, bool)) (<-chan Event, error) {
+	if options.BufferSize <= 0 {
+		return nil, errors.New("watch buffer size sould be > 0")
+	}
+	if options.Policy < WatchDrop || options.Policy > WatchDisconnect {
+		return nil, errors.New("invalid slow consumer policy")
+	}
+	w := &watcher{
+		ch:      make(chan Event, options.BufferSize),
+		match:   match,
+		options: options,
+		done:    make(chan struct{}),
+	}
+
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	if hub.closed {
+		return nil, ErrDatabaseIsClosed
+	}
+	hub.watchers[w] = struct{}{}
+	atomic.AddInt32(&hub.count, 1)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			hub.mu.Lock()
+			hub.remove(w)
+			hub.mu.Unlock()
+		case <-w.done:
+		}
+	}()
+	return w.ch, nil
+}
+
+// 移除订阅者并关闭通道，调用方必须持有hub锁
+// 先关闭done让阻塞的投递放弃，拿到订阅者的锁之后再关闭通道
+func (hub *watchHub) remove(w *watcher) {
+	if _, ok := hub.watchers[w]; !ok {
+		return
+	}
+	delete(hub.watchers, w)
+	atomic.AddInt32(&hub.count, -1)
+	close(w.done)
+	w.mu.Lock()
+	w.closed = true
+	close(w.ch)
+	w.mu.Unlock()
+}
+
+// 是否有订阅者
+func (hub *watchHub) active() bool {
+	return atomic.LoadInt32(&hub.count) > 0
+}
+
+// 投递一次提交产生的事件，seqNo是写入时分配的提交序列号
+// 调用方需要持有这些key的分段锁，保证同一个key的事件按提交顺序投递
+// 投递时不持有hub锁，阻塞的订阅者不会影响其他订阅者的取消和数据库关闭
+func (hub *watchHub) publish(seqNo uint64, records []*data.LogRecord) {
+	if !hub.active() {
+		return
+	}
+
+	//拷贝一份，调用方之后可能会修改传入的key和value
+	events := make([]Event, len(records))
+	for i, record := range records {
+		events[i] = Event{
+			Key:   append([]byte{}, record.Key...),
+			Value: append([]byte{}, record.Value...),
+			Type:  EventPut,
+			SeqNo: seqNo,
+		}
+		if record.Type == data.LogRecordDelete {
+			events[i].Type = EventDelete
+			events[i].Value = nil
+		}
+	}
+
+	hub.mu.Lock()
+	watchers := make([]*watcher, 0, len(hub.watchers))
+	for w := range hub.watchers {
+		watchers = append(watchers, w)
+	}
+	hub.mu.Unlock()
+
+	for _, w := range watchers {
+		var matched []Event
+		for _, event := range events {
+			if key, ok := w.match(event.Key); ok {
+				event.Key = key
+				matched = append(matched, event)
+			}
+		}
+		if len(matched) == 0 {
+			continue
+		}
+		if !w.deliver(matched) {
+			hub.mu.Lock()
+			hub.remove(w)
+			hub.mu.Unlock()
+		}
+	}
+}
+
+// 按订阅者的策略投递，同一批事件整体投递，需要断开订阅者时返回false
+// 只有持有订阅者锁的投递会往通道写，所以剩余容量只会变大
+func (w *watcher) deliver(events []Event) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return true
+	}
+	if w.options.Policy != WatchBlock {
+		if cap(w.ch)-len(w.ch) < len(events) {
+			return w.options.Policy != WatchDisconnect
+		}
+		for _, event := range events {
+			w.ch <- event
+		}
+		return true
+	}
+
+	//取消订阅和数据库关闭都会先关闭done，阻塞在这里的写入可以继续
+	for _, event := range events {
+		select {
+		case w.ch <- event:
+		case <-w.done:
+			return true
+		}
+	}
+	return true
+}
+
+// 数据库关闭时关闭所有订阅者的通道
+func (hub *watchHub) close() {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	for w := range hub.watchers {
+		hub.remove(w)
+	}
+	hub.closed = true
+}
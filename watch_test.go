@@ -0,0 +1,219 @@
+package bitcask_go
+
+import (
+	"bitcask-go/fio"
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_Watch(t *testing.T) {
+	opts := DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-watch")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := db.Watch(ctx, []byte("user-"), DefaultWatchOptions)
+	assert.Nil(t, err)
+
+	assert.Nil(t, db.Put([]byte("user-1"), []byte("v1")))
+	assert.Nil(t, db.Put([]byte("other"), []byte("v")))
+	assert.Nil(t, db.Namespace("users").Put([]byte("user-ns"), []byte("v")))
+	assert.Nil(t, db.Delete([]byte("user-1")))
+
+	event := <-events
+	assert.Equal(t, []byte("user-1"), event.Key)
+	assert.Equal(t, []byte("v1"), event.Value)
+	assert.Equal(t, EventPut, event.Type)
+	first := event.SeqNo
+
+	event = <-events
+	assert.Equal(t, []byte("user-1"), event.Key)
+	assert.Equal(t, EventDelete, event.Type)
+	assert.Nil(t, event.Value)
+	//序列号在写入时分配，没有订阅的写入也会占用序列号
+	assert.Equal(t, first+3, event.SeqNo)
+
+	//同一批次的事件一起投递，序列号相同
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, wb.Put([]byte("user-2"), []byte("v2")))
+	assert.Nil(t, wb.Put([]byte("user-3"), []byte("v3")))
+	assert.Nil(t, wb.Put([]byte("other-2"), []byte("v")))
+	assert.Nil(t, wb.Commit())
+	e1, e2 := <-events, <-events
+	assert.Equal(t, e1.SeqNo, e2.SeqNo)
+	assert.ElementsMatch(t, []string{"user-2", "user-3"}, []string{string(e1.Key), string(e2.Key)})
+	assert.Equal(t, 0, len(events))
+
+	//取消后通道关闭
+	cancel()
+	for range events {
+	}
+}
+
+func TestNamespace_Watch(t *testing.T) {
+	opts := DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-watch-ns")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	users := db.Namespace("users")
+	events, err := users.Watch(context.Background(), nil, DefaultWatchOptions)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put([]byte("a"), []byte("raw")))
+	assert.Nil(t, db.Namespace("sessions").Put([]byte("a"), []byte("session")))
+	assert.Nil(t, users.Put([]byte("a"), []byte("user")))
+
+	event := <-events
+	assert.Equal(t, []byte("a"), event.Key)
+	assert.Equal(t, []byte("user"), event.Value)
+
+	//数据库关闭后通道关闭
+	assert.Nil(t, db.Close())
+	_, ok := <-events
+	assert.False(t, ok)
+	_, err = db.Watch(context.Background(), nil, DefaultWatchOptions)
+	assert.Equal(t, ErrDatabaseIsClosed, err)
+}
+
+func TestDB_WatchSlowConsumer(t *testing.T) {
+	opts := DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-watch-slow")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	ctx := context.Background()
+	dropped, err := db.Watch(ctx, nil, WatchOptions{BufferSize: 2, Policy: WatchDrop})
+	assert.Nil(t, err)
+	disconnected, err := db.Watch(ctx, nil, WatchOptions{BufferSize: 2, Policy: WatchDisconnect})
+	assert.Nil(t, err)
+	blocked, err := db.Watch(ctx, nil, WatchOptions{BufferSize: 1, Policy: WatchBlock})
+	assert.Nil(t, err)
+	_, err = db.Watch(ctx, nil, WatchOptions{BufferSize: 0, Policy: WatchDrop})
+	assert.NotNil(t, err)
+
+	var received []Event
+	done := make(chan struct{})
+	go func() {
+		for event := range blocked {
+			received = append(received, event)
+			if len(received) == 4 {
+				close(done)
+				return
+			}
+		}
+	}()
+
+	assert.Nil(t, db.Put([]byte("k1"), []byte("v")))
+	//放不下整批的事件，整批丢弃或者断开
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, wb.Put([]byte("k2"), []byte("v")))
+	assert.Nil(t, wb.Put([]byte("k3"), []byte("v")))
+	assert.Nil(t, wb.Commit())
+	assert.Nil(t, db.Put([]byte("k4"), []byte("v")))
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("blocked watcher did not receive all events")
+	}
+	assert.Equal(t, []byte("k1"), received[0].Key)
+	assert.Equal(t, []byte("k4"), received[3].Key)
+
+	//丢弃了k2 k3这一批
+	assert.Equal(t, []byte("k1"), (<-dropped).Key)
+	assert.Equal(t, []byte("k4"), (<-dropped).Key)
+
+	//断开后通道里只剩断开前的事件
+	assert.Equal(t, []byte("k1"), (<-disconnected).Key)
+	_, ok := <-disconnected
+	assert.False(t, ok)
+}
+
+func TestDB_WatchBlockClose(t *testing.T) {
+	opts := DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-watch-block")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	blocked, err := db.Watch(context.Background(), nil, WatchOptions{BufferSize: 1, Policy: WatchBlock})
+	assert.Nil(t, err)
+	putDone := make(chan error)
+	go func() {
+		//第二次写入放不下，阻塞在投递上
+		if err := db.Put([]byte("k1"), []byte("v1")); err != nil {
+			putDone <- err
+			return
+		}
+		putDone <- db.Put([]byte("k2"), []byte("v2"))
+	}()
+	for len(blocked) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	//阻塞的投递不持有hub锁，其他订阅者可以正常订阅和取消
+	ctx, cancel := context.WithCancel(context.Background())
+	other, err := db.Watch(ctx, nil, DefaultWatchOptions)
+	assert.Nil(t, err)
+	cancel()
+	for range other {
+	}
+
+	//关闭数据库时阻塞的写入返回
+	closed := make(chan error)
+	go func() {
+		closed <- db.Close()
+	}()
+	select {
+	case err := <-putDone:
+		assert.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("blocked put did not return after close")
+	}
+	assert.Nil(t, <-closed)
+	assert.Equal(t, []byte("k1"), (<-blocked).Key)
+	_, ok := <-blocked
+	assert.False(t, ok)
+}
+
+func TestDB_WatchSeqNoAfterReopen(t *testing.T) {
+	ffs := fio.NewFaultFS(fio.NewMemFS())
+	opts := crashOptions(ffs)
+	putSeqNo := func(db *DB) uint64 {
+		events, err := db.Watch(context.Background(), nil, DefaultWatchOptions)
+		assert.Nil(t, err)
+		assert.Nil(t, db.Put([]byte("key"), []byte("value")))
+		return (<-events).SeqNo
+	}
+
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	first := putSeqNo(db)
+
+	//崩溃之后从MANIFEST中预留的上限继续，不会重复
+	assert.Nil(t, ffs.Crash())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	second := putSeqNo(db)
+	assert.Greater(t, second, first)
+
+	//正常关闭之后连续递增
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, second+1, putSeqNo(db))
+	assert.Nil(t, db.Close())
+}